@@ -0,0 +1,184 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hood-chat/core/store"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-msgio"
+	mh "github.com/multiformats/go-multihash"
+)
+
+const (
+	AttachmentID = "/chat/attachment/1.0.0"
+
+	AttachmentServiceName = "chat.attachment"
+
+	// MaxAttachmentSize bounds the text of a message sent as an attachment.
+	MaxAttachmentSize = 1 << 20
+
+	// cidSize bounds a requested CID, a sha2-256 one is well under it.
+	cidSize = 128
+)
+
+var (
+	// ErrAttachmentSize is returned when sending a text longer than
+	// MaxAttachmentSize.
+	ErrAttachmentSize = errors.New("message text too long")
+	// ErrAttachmentMismatch is returned when a peer serves data that
+	// doesn't hash to the CID asked for.
+	ErrAttachmentMismatch = errors.New("attachment does not match its CID")
+)
+
+// attachmentCID addresses data by its sha2-256 hash.
+func attachmentCID(data []byte) (cid.Cid, error) {
+	return cid.V1Builder{Codec: cid.Raw, MhType: mh.SHA2_256}.Sum(data)
+}
+
+// AttachmentStore keeps attachments by CID, Option.Attachments routes them
+// to the platform's own storage, e.g. the media store of a phone. Get
+// fails for a CID not held.
+type AttachmentStore interface {
+	Put(id string, data []byte) error
+	Get(id string) ([]byte, error)
+	Delete(id string) error
+}
+
+// storeAttachments keeps attachments in the datastore of the repo, the
+// default AttachmentStore.
+type storeAttachments struct {
+	store *store.Store
+}
+
+func (s storeAttachments) Put(id string, data []byte) error {
+	return s.store.UpsertAttachment(store.BHAttachment{ID: id, Data: data})
+}
+
+func (s storeAttachments) Get(id string) ([]byte, error) {
+	a, err := s.store.AttachmentByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return a.Data, nil
+}
+
+func (s storeAttachments) Delete(id string) error {
+	return s.store.DeleteAttachment(id)
+}
+
+// attachmentService keeps message texts too long for a frame and serves
+// them by CID. Knowing the CID is enough to fetch one, it travels only in
+// the frames of the message.
+type attachmentService struct {
+	host  host.Host
+	store AttachmentStore
+}
+
+func newAttachmentService(h host.Host, s AttachmentStore) *attachmentService {
+	as := &attachmentService{host: h, store: s}
+	h.SetStreamHandler(AttachmentID, as.Handler)
+	log.Debug("service attachment created")
+	return as
+}
+
+// put stores data and returns its CID.
+func (c *attachmentService) put(data []byte) (string, error) {
+	if len(data) > MaxAttachmentSize {
+		return "", ErrAttachmentSize
+	}
+	id, err := attachmentCID(data)
+	if err != nil {
+		return "", err
+	}
+	err = c.store.Put(id.String(), data)
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// fetch asks p for the attachment id and checks the data against it.
+func (c *attachmentService) fetch(ctx context.Context, p peer.ID, id string) ([]byte, error) {
+	want, err := cid.Decode(id)
+	if err != nil {
+		return nil, err
+	}
+	s, err := c.host.NewStream(ctx, p, AttachmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(StreamTimeout))
+
+	if err := msgio.NewVarintWriter(s).WriteMsg([]byte(id)); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	data, err := msgio.NewVarintReaderSize(s, MaxAttachmentSize).ReadMsg()
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
+	got, err := want.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !got.Equals(want) {
+		return nil, ErrAttachmentMismatch
+	}
+	return data, nil
+}
+
+// keep fetches the attachment id from p and stores it, unless it is held
+// already.
+func (c *attachmentService) keep(ctx context.Context, p peer.ID, id string) error {
+	if _, err := c.store.Get(id); err == nil {
+		return nil
+	}
+	data, err := c.fetch(ctx, p, id)
+	if err != nil {
+		return err
+	}
+	return c.store.Put(id, data)
+}
+
+// local returns the attachment id held by the node.
+func (c *attachmentService) local(id string) ([]byte, error) {
+	return c.store.Get(id)
+}
+
+func (c *attachmentService) Handler(str network.Stream) {
+	if err := str.Scope().SetService(AttachmentServiceName); err != nil {
+		log.Debugf("error attaching stream to attachment service: %s", err)
+		str.Reset()
+		return
+	}
+	defer str.Close()
+	str.SetDeadline(time.Now().Add(StreamTimeout))
+
+	id, err := msgio.NewVarintReaderSize(str, cidSize).ReadMsg()
+	if err != nil {
+		log.Debugf("error reading attachment request: %s", err)
+		str.Reset()
+		return
+	}
+	data, err := c.store.Get(string(id))
+	if err != nil {
+		log.Debugf("attachment %s not served: %s", id, err)
+		str.Reset()
+		return
+	}
+	if err := msgio.NewVarintWriter(str).WriteMsg(data); err != nil {
+		log.Errorf("error writing attachment: %s", err)
+		str.Reset()
+	}
+}
+
+func (c *attachmentService) Stop() {
+	c.host.RemoveStreamHandler(AttachmentID)
+}
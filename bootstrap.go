@@ -0,0 +1,229 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/routing"
+)
+
+const (
+	DefaultBootstrapMinPeers    = 1
+	DefaultBootstrapParallelism = 4
+	// BootstrapPeriod is how often the connection count is checked against
+	// the bootstrap threshold.
+	BootstrapPeriod = 30 * time.Second
+	// BootstrapDialTimeout bounds each round of bootstrap dials.
+	BootstrapDialTimeout = BootstrapPeriod / 3
+	// BootstrapRetryMin is the wait before the first retry while the node
+	// is short of the threshold, doubling up to BootstrapPeriod.
+	BootstrapRetryMin = time.Second
+)
+
+var ErrBootstrapMinPeers = errors.New("bootstrap threshold can't be negative")
+
+// BootstrapState tells whether the node has the connections it bootstraps
+// towards.
+type BootstrapState int
+
+const (
+	// BootstrapOff is reported by nodes without a DHT.
+	BootstrapOff BootstrapState = iota
+	// BootstrapConnecting nodes are short of the bootstrap threshold and
+	// keep dialing bootstrap peers.
+	BootstrapConnecting
+	// BootstrapReady nodes reached the threshold.
+	BootstrapReady
+)
+
+func (s BootstrapState) String() string {
+	switch s {
+	case BootstrapConnecting:
+		return "connecting"
+	case BootstrapReady:
+		return "ready"
+	default:
+		return "off"
+	}
+}
+
+// BootstrapConfig tunes how the DHT keeps the node connected.
+type BootstrapConfig struct {
+	// MinPeers is the number of connections below which bootstrap peers
+	// are dialed, DefaultBootstrapMinPeers when zero.
+	MinPeers int
+	// Parallelism bounds the bootstrap peers dialed at once,
+	// DefaultBootstrapParallelism when zero.
+	Parallelism int
+}
+
+// bootstrapLimits are shared by the bootstrappers of a host, so updates
+// outlive a DHT reset.
+type bootstrapLimits struct {
+	minPeers    int32
+	parallelism int
+}
+
+func newBootstrapLimits(conf BootstrapConfig) *bootstrapLimits {
+	if conf.MinPeers == 0 {
+		conf.MinPeers = DefaultBootstrapMinPeers
+	}
+	if conf.Parallelism == 0 {
+		conf.Parallelism = DefaultBootstrapParallelism
+	}
+	return &bootstrapLimits{minPeers: int32(conf.MinPeers), parallelism: conf.Parallelism}
+}
+
+func (l *bootstrapLimits) setMinPeers(n int) {
+	atomic.StoreInt32(&l.minPeers, int32(n))
+}
+
+func (l *bootstrapLimits) getMinPeers() int {
+	return int(atomic.LoadInt32(&l.minPeers))
+}
+
+// bootstrapper dials bootstrap peers whenever the host has fewer
+// connections than the threshold, and bootstraps the routing once.
+type bootstrapper struct {
+	h      host.Host
+	peers  []peer.AddrInfo
+	limits *bootstrapLimits
+	period time.Duration
+	// retryMin is the first wait between rounds while short of peers
+	retryMin time.Duration
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// startBootstrap runs a first round within ctx before returning, then more
+// in the background until closed: every period once the threshold is met,
+// backing off from BootstrapRetryMin while it is not. A first round left
+// short doesn't fail, only the end of ctx does, with its error.
+func startBootstrap(ctx context.Context, h host.Host, rt routing.Routing, peers []peer.AddrInfo, limits *bootstrapLimits, period time.Duration) (*bootstrapper, error) {
+	if len(peers) == 0 {
+		log.Warn("no bootstrap nodes configured")
+	}
+	b := &bootstrapper{
+		h:        h,
+		peers:    peers,
+		limits:   limits,
+		period:   period,
+		retryMin: BootstrapRetryMin,
+		done:     make(chan struct{}),
+	}
+	b.round(ctx)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if rt != nil {
+		// the DHT refreshes its routing table on its own later on
+		if err := rt.Bootstrap(ctx); err != nil {
+			log.Errorf("routing bootstrap failed %s", err.Error())
+		}
+	}
+	var bctx context.Context
+	bctx, b.cancel = context.WithCancel(context.Background())
+	go b.background(bctx)
+	return b, nil
+}
+
+func (b *bootstrapper) background(ctx context.Context) {
+	defer close(b.done)
+	retry := b.retryMin
+	timer := time.NewTimer(b.next(&retry))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			b.round(ctx)
+			timer.Reset(b.next(&retry))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// next is the wait before the next round, the period when ready, retry
+// otherwise, doubled for the round after.
+func (b *bootstrapper) next(retry *time.Duration) time.Duration {
+	if b.state() == BootstrapReady {
+		*retry = b.retryMin
+		return b.period
+	}
+	wait := *retry
+	if wait > b.period {
+		wait = b.period
+	}
+	*retry = 2 * wait
+	return wait
+}
+
+func (b *bootstrapper) state() BootstrapState {
+	if len(b.h.Network().Peers()) < b.limits.getMinPeers() {
+		return BootstrapConnecting
+	}
+	return BootstrapReady
+}
+
+// round dials bootstrap peers, parallelism at a time, until the host has
+// the threshold of connections or none are left to try.
+func (b *bootstrapper) round(ctx context.Context) {
+	missing := b.limits.getMinPeers() - len(b.h.Network().Peers())
+	if missing <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, BootstrapDialTimeout)
+	defer cancel()
+	// rounds are paced here, the swarm dial backoff would skip retries
+	ctx = network.WithForceDirectDial(ctx, "bootstrap")
+	var candidates []peer.AddrInfo
+	for _, p := range b.peers {
+		if p.ID != b.h.ID() && b.h.Network().Connectedness(p.ID) != network.Connected {
+			candidates = append(candidates, p)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	for missing > 0 && len(candidates) > 0 && ctx.Err() == nil {
+		n := missing
+		if n > b.limits.parallelism {
+			n = b.limits.parallelism
+		}
+		if n > len(candidates) {
+			n = len(candidates)
+		}
+		var wg sync.WaitGroup
+		var made int32
+		for _, p := range candidates[:n] {
+			wg.Add(1)
+			go func(p peer.AddrInfo) {
+				defer wg.Done()
+				b.h.Peerstore().AddAddrs(p.ID, p.Addrs, peerstore.PermanentAddrTTL)
+				if err := b.h.Connect(ctx, p); err != nil {
+					log.Debugf("failed to bootstrap with %s: %s", p.ID, err)
+					return
+				}
+				atomic.AddInt32(&made, 1)
+			}(p)
+		}
+		wg.Wait()
+		candidates = candidates[n:]
+		missing -= int(made)
+	}
+	if missing > 0 {
+		log.Debugf("bootstrap left %d connections short", missing)
+	}
+}
+
+func (b *bootstrapper) Close() error {
+	b.cancel()
+	<-b.done
+	return nil
+}
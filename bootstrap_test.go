@@ -0,0 +1,160 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hood-chat/core/entity"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrapMinPeers(t *testing.T) {
+	var peers []peer.AddrInfo
+	for i := 0; i < 5; i++ {
+		p := newTestHost(t)
+		peers = append(peers, peer.AddrInfo{ID: p.ID(), Addrs: p.Addrs()})
+	}
+	h := newTestHost(t)
+	limits := newBootstrapLimits(BootstrapConfig{MinPeers: 3, Parallelism: 2})
+	b, err := startBootstrap(context.Background(), h, nil, peers, limits, 100*time.Millisecond)
+	require.NoError(t, err)
+	defer b.Close()
+	// the first round is done on return and dials no more than needed
+	require.Len(t, h.Network().Peers(), 3)
+	require.Never(t, func() bool { return len(h.Network().Peers()) > 3 }, 300*time.Millisecond, 50*time.Millisecond)
+
+	limits.setMinPeers(5)
+	require.Eventually(t, func() bool { return len(h.Network().Peers()) == 5 }, 5*time.Second, 50*time.Millisecond)
+}
+
+// newStallingPeer is a bootstrap peer that accepts connections but never
+// answers, until the listener is closed.
+func newStallingPeer(t *testing.T) (peer.AddrInfo, net.Listener) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	pid, err := peer.IDFromPrivateKey(sk)
+	require.NoError(t, err)
+	addr, err := manet.FromNetAddr(l.Addr())
+	require.NoError(t, err)
+	return peer.AddrInfo{ID: pid, Addrs: []ma.Multiaddr{addr}}, l
+}
+
+func TestCreateContextCancel(t *testing.T) {
+	pi, _ := newStallingPeer(t)
+	opt := Option{
+		LpOpt:          []libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")},
+		BootstrapPeers: []peer.AddrInfo{pi},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	h, err := DefaultRoutedHost{}.CreateContext(ctx, opt)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Nil(t, h)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestStartContextRetry(t *testing.T) {
+	pi, l := newStallingPeer(t)
+	opt := Option{
+		LpOpt:          []libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")},
+		BootstrapPeers: []peer.AddrInfo{pi},
+	}
+	m, err := MessengerBuilder(t.TempDir()+"/h1", opt, DefaultRoutedHost{})
+	require.NoError(t, err)
+	id, err := entity.CreateIdentity("h1")
+	require.NoError(t, err)
+	*m.identity = id
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	require.ErrorIs(t, m.StartContext(ctx), context.Canceled)
+	require.Less(t, time.Since(start), 2*time.Second)
+	require.Nil(t, m.Host)
+
+	// the bootstrap peer now refuses, the retry comes up without it
+	require.NoError(t, l.Close())
+	require.NoError(t, m.StartContext(context.Background()))
+	defer m.Stop()
+	require.Equal(t, id.ID.String(), m.Host.ID().String())
+}
+
+func TestBootstrapRetry(t *testing.T) {
+	// a bootstrap peer that only starts listening once the node is up
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr, err := manet.FromNetAddr(l.Addr())
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	p, err := libp2p.New(libp2p.NoListenAddrs)
+	require.NoError(t, err)
+	defer p.Close()
+	peers := []peer.AddrInfo{{ID: p.ID(), Addrs: []ma.Multiaddr{addr}}}
+
+	// the host comes up while no bootstrap peer answers
+	opt := Option{
+		LpOpt:          []libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")},
+		BootstrapPeers: peers,
+	}
+	rh, err := DefaultRoutedHost{}.CreateContext(context.Background(), opt)
+	require.NoError(t, err)
+	require.Equal(t, BootstrapConnecting, rh.(bootstrapStater).BootstrapState())
+	require.NoError(t, rh.Close())
+
+	h := newTestHost(t)
+	limits := newBootstrapLimits(BootstrapConfig{})
+	b, err := startBootstrap(context.Background(), h, nil, peers, limits, time.Hour)
+	require.NoError(t, err)
+	defer b.Close()
+	require.Equal(t, BootstrapConnecting, b.state())
+	// retried well before the period once the peer listens
+	require.NoError(t, p.Network().Listen(addr))
+	require.Eventually(t, func() bool { return b.state() == BootstrapReady }, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, p.ID(), h.Network().Peers()[0])
+}
+
+func TestNewNode(t *testing.T) {
+	const proto = protocol.ID("/test/early/1.0.0")
+	p := newTestHost(t)
+	opt := Option{
+		LpOpt:          []libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")},
+		BootstrapPeers: []peer.AddrInfo{{ID: p.ID(), Addrs: p.Addrs()}},
+	}
+	h, err := DefaultRoutedHost{}.NewNode(context.Background(), opt)
+	require.NoError(t, err)
+	defer h.Close()
+	require.Never(t, func() bool { return len(h.Network().Peers()) > 0 }, 300*time.Millisecond, 50*time.Millisecond)
+
+	// the handler is in place before the first bootstrap peer connects
+	h.SetStreamHandler(proto, func(s network.Stream) { s.Close() })
+	require.NoError(t, h.(Bootstrapper).Bootstrap(context.Background()))
+	require.Equal(t, network.Connected, h.Network().Connectedness(p.ID()))
+	s, err := p.NewStream(context.Background(), h.ID(), proto)
+	require.NoError(t, err)
+	s.Close()
+	require.Equal(t, BootstrapReady, h.(bootstrapStater).BootstrapState())
+}
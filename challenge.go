@@ -0,0 +1,119 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-msgio"
+)
+
+const (
+	ChallengeID = "/chat/challenge/1.0.0"
+
+	ChallengeServiceName = "chat.challenge"
+
+	NonceSize = 32
+
+	// challengePrefix keeps challenge signatures from being reused elsewhere.
+	challengePrefix = "hood-chat challenge:"
+)
+
+var ErrChallengeFailed = errors.New("peer failed the identity challenge")
+
+type ChallengeService interface {
+	Challenge(ctx context.Context, p peer.ID) error
+	Handler(str network.Stream)
+	Stop()
+}
+
+// NewChallengeService creates a service answering challenges signed with key.
+func NewChallengeService(h host.Host, key crypto.PrivKey) ChallengeService {
+	return newChallengeService(h, key)
+}
+
+type challengeService struct {
+	host host.Host
+	key  crypto.PrivKey
+}
+
+func newChallengeService(h host.Host, key crypto.PrivKey) *challengeService {
+	cs := &challengeService{host: h, key: key}
+	h.SetStreamHandler(ChallengeID, cs.Handler)
+	log.Debug("service challenge created")
+	return cs
+}
+
+// Challenge sends p a random nonce and checks it comes back signed with
+// the key p's ID is derived from.
+func (c *challengeService) Challenge(ctx context.Context, p peer.ID) error {
+	pk, err := p.ExtractPublicKey()
+	if err != nil {
+		pk = c.host.Peerstore().PubKey(p)
+	}
+	if pk == nil {
+		return ErrChallengeFailed
+	}
+
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	s, err := c.host.NewStream(ctx, p, ChallengeID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(StreamTimeout))
+
+	if err := msgio.NewVarintWriter(s).WriteMsg(nonce); err != nil {
+		s.Reset()
+		return err
+	}
+	sig, err := msgio.NewVarintReaderSize(s, MaxMsgSize).ReadMsg()
+	if err != nil {
+		s.Reset()
+		return err
+	}
+	ok, err := pk.Verify(append([]byte(challengePrefix), nonce...), sig)
+	if err != nil || !ok {
+		return ErrChallengeFailed
+	}
+	return nil
+}
+
+func (c *challengeService) Handler(str network.Stream) {
+	if err := str.Scope().SetService(ChallengeServiceName); err != nil {
+		log.Debugf("error attaching stream to challenge service: %s", err)
+		str.Reset()
+		return
+	}
+	defer str.Close()
+	str.SetDeadline(time.Now().Add(StreamTimeout))
+
+	nonce, err := msgio.NewVarintReaderSize(str, NonceSize).ReadMsg()
+	if err != nil {
+		log.Errorf("error reading challenge: %s", err)
+		str.Reset()
+		return
+	}
+	sig, err := c.key.Sign(append([]byte(challengePrefix), nonce...))
+	if err != nil {
+		log.Errorf("error signing challenge: %s", err)
+		str.Reset()
+		return
+	}
+	if err := msgio.NewVarintWriter(str).WriteMsg(sig); err != nil {
+		log.Errorf("error writing challenge response: %s", err)
+		str.Reset()
+	}
+}
+
+func (c *challengeService) Stop() {
+	c.host.RemoveStreamHandler(ChallengeID)
+}
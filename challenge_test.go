@@ -0,0 +1,27 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChallengeMITM(t *testing.T) {
+	h1 := newTestHost(t)
+	h2 := newTestHost(t)
+	// h2 answers challenges without holding its identity key
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	cs1 := newChallengeService(h1, h1.Peerstore().PrivKey(h1.ID()))
+	cs2 := newChallengeService(h2, key)
+	defer cs1.Stop()
+	defer cs2.Stop()
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	require.ErrorIs(t, cs1.Challenge(context.Background(), h2.ID()), ErrChallengeFailed)
+	require.NoError(t, cs2.Challenge(context.Background(), h1.ID()))
+}
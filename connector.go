@@ -2,36 +2,66 @@ package core
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	bf "github.com/libp2p/go-libp2p/p2p/discovery/backoff"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
 type Connector interface {
 	Need(proc string, p peer.AddrInfo)
 	Done(proc string, p peer.ID)
+	// Stop ends the retries and stops watching the network.
+	Stop()
+}
+
+// RetryPolicy bounds how a connector retries unreachable peers.
+type RetryPolicy struct {
+	// MaxAttempts is the number of failed attempts after which a peer is
+	// deemed unreachable, zero retries forever.
+	MaxAttempts int
+	// Backoff paces the attempts, nil uses the default backoff.
+	Backoff bf.BackoffFactory
+	// Interval is how often due retries are checked, 5 seconds when zero.
+	Interval time.Duration
 }
 
 func NewConnector(h host.Host) Connector {
-	return newConnector(h)
+	return newConnector(h, RetryPolicy{}, nil)
+}
+
+// NewConnectorWithPolicy creates a connector retrying by policy, calling
+// onUnreachable when it gives up on a peer.
+func NewConnectorWithPolicy(h host.Host, policy RetryPolicy, onUnreachable func(peer.ID)) Connector {
+	return newConnector(h, policy, onUnreachable)
 }
 
 var _ Connector = (*connector)(nil)
 
 type connector struct {
-	h      host.Host
-	needed *PeerSet
+	h             host.Host
+	needed        *PeerSet
+	interval      time.Duration
+	onUnreachable func(peer.ID)
+
+	mux    sync.Mutex
 	bctx   context.Context
 	cancel context.CancelFunc
 }
 
-func newConnector(h host.Host) *connector {
+func newConnector(h host.Host, policy RetryPolicy, onUnreachable func(peer.ID)) *connector {
 	c := connector{}
 	c.h = h
-	c.needed = NewPeerSet()
+	c.needed = NewPeerSetWithPolicy(policy.Backoff, policy.MaxAttempts)
+	c.interval = policy.Interval
+	if c.interval == 0 {
+		c.interval = 5 * time.Second
+	}
+	c.onUnreachable = onUnreachable
 	c.h.Network().Notify((*connectorNotifiee)(&c))
 	c.bctx = nil
 	c.cancel = nil
@@ -40,7 +70,7 @@ func newConnector(h host.Host) *connector {
 }
 
 func (c *connector) background(ctx context.Context) {
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(c.interval)
 	for {
 		select {
 		case t := <-ticker.C:
@@ -58,6 +88,8 @@ func (c *connector) background(ctx context.Context) {
 }
 
 func (c *connector) mayStart() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 	if c.bctx == nil {
 		c.bctx, c.cancel = context.WithCancel(context.Background())
 		go c.background(c.bctx)
@@ -66,6 +98,8 @@ func (c *connector) mayStart() {
 }
 
 func (c *connector) mayStop() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
 	if c.needed.Empty() && c.bctx != nil {
 		c.cancel()
 		c.bctx = nil
@@ -76,9 +110,11 @@ func (c *connector) mayStop() {
 func (c *connector) connect(p peer.AddrInfo) {
 	if c.h.Network().Connectedness(p.ID) != network.Connected {
 		go func(pi peer.AddrInfo) {
-			err := c.h.Connect(context.Background(), pi)
+			err := connectWithFallback(context.Background(), c.h, pi)
 			if err != nil {
-				c.needed.Failed(pi.ID)
+				if c.needed.Failed(pi.ID) && c.onUnreachable != nil {
+					c.onUnreachable(pi.ID)
+				}
 				return
 			}
 		}(p)
@@ -98,6 +134,17 @@ func (c *connector) Done(proc string, p peer.ID) {
 	c.mayStop()
 }
 
+func (c *connector) Stop() {
+	c.h.Network().StopNotify((*connectorNotifiee)(c))
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.bctx != nil {
+		c.cancel()
+		c.bctx = nil
+		c.cancel = nil
+	}
+}
+
 type connectorNotifiee connector
 
 func (cn *connectorNotifiee) connector() *connector {
@@ -111,6 +158,6 @@ func (cn *connectorNotifiee) Connected(n network.Network, c network.Conn) {
 	cn.connector().needed.Done(c.RemotePeer())
 }
 func (cn *connectorNotifiee) Disconnected(n network.Network, c network.Conn) {
-	log.Debugf("node %v peer %v disconnected ", cn.h.ID(), c.RemotePeer())
-	cn.connector().needed.Failed(c.RemotePeer())
+	log.Debugf("node %v peer %v disconnected ", logID(cn.h.ID()), logID(c.RemotePeer()))
+	cn.connector().needed.Lost(c.RemotePeer())
 }
@@ -2,6 +2,8 @@ package core
 
 import (
 	"context"
+	"errors"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -10,6 +12,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	bf "github.com/libp2p/go-libp2p/p2p/discovery/backoff"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/blank"
 	swarmt "github.com/libp2p/go-libp2p/p2p/net/swarm/testing"
 	ma "github.com/multiformats/go-multiaddr"
@@ -161,3 +164,38 @@ func isConnected2(h host.Host, ps ...peer.ID) bool {
 	}
 	return f
 }
+
+// countingHost fails every dial, counting them.
+type countingHost struct {
+	host.Host
+	dials int32
+}
+
+func (c *countingHost) Connect(ctx context.Context, pi peer.AddrInfo) error {
+	atomic.AddInt32(&c.dials, 1)
+	return errors.New("unreachable")
+}
+
+func TestConnectorRetryPolicy(t *testing.T) {
+	h := &countingHost{Host: newTestHost(t)}
+	unreachable := make(chan peer.ID, 2)
+	policy := RetryPolicy{
+		MaxAttempts: 3,
+		Backoff:     bf.NewFixedBackoff(10 * time.Millisecond),
+		Interval:    20 * time.Millisecond,
+	}
+	c := NewConnectorWithPolicy(h, policy, func(p peer.ID) { unreachable <- p })
+	p := getPeers(1)[0]
+	c.Need("test", p)
+
+	select {
+	case id := <-unreachable:
+		require.Equal(t, p.ID, id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not deemed unreachable")
+	}
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, int32(3), atomic.LoadInt32(&h.dials))
+	require.Empty(t, unreachable)
+	c.Done("test", p.ID)
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	dutil "github.com/libp2p/go-libp2p/p2p/discovery/util"
+)
+
+const (
+	// DiscoveryNS is the rendezvous namespace chat nodes advertise under.
+	DiscoveryNS = "/chat/rendezvous/1.0.0"
+
+	DiscoveryInterval = time.Minute
+
+	// DiscoveryBufferSize bounds the peers waiting to be read from
+	// Discovery.Peers, those that don't fit are dropped and reported when
+	// found again.
+	DiscoveryBufferSize = 32
+
+	// MDNSServiceTag is the mDNS service nodes announce themselves under on
+	// the local network, when no other is set.
+	MDNSServiceTag = "hood-chat"
+
+	// MDNSConnectTimeout bounds connecting to a peer found over mDNS.
+	MDNSConnectTimeout = 10 * time.Second
+)
+
+var ErrNotRouted = errors.New("host does not route through a DHT")
+
+// Discovery surfaces peers learned through DHT walks and rendezvous, and
+// over mDNS when enabled.
+type Discovery interface {
+	Peers() <-chan peer.AddrInfo
+	// Republish announces the rendezvous namespace again, restoring
+	// provider records that expired while the node was offline.
+	Republish(ctx context.Context) error
+	Stop()
+}
+
+// NewDiscovery creates a discovery for h. Hosts that are not Routed never
+// discover anything.
+func NewDiscovery(h host.Host) Discovery {
+	return newDiscovery(h, DiscoveryInterval, "")
+}
+
+// NewDiscoveryWithMDNS also finds and connects peers on the local network
+// announcing serviceTag over mDNS, so they meet without the internet.
+func NewDiscoveryWithMDNS(h host.Host, serviceTag string) Discovery {
+	if serviceTag == "" {
+		serviceTag = MDNSServiceTag
+	}
+	return newDiscovery(h, DiscoveryInterval, serviceTag)
+}
+
+type discovery struct {
+	host     host.Host
+	routed   Routed
+	rd       *drouting.RoutingDiscovery
+	interval time.Duration
+	out      chan peer.AddrInfo
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mdns     mdns.Service
+
+	mux  sync.Mutex
+	seen map[peer.ID]struct{}
+	// dialing are the peers found over mDNS being connected
+	dialing map[peer.ID]struct{}
+}
+
+// newDiscovery walks the DHT every interval and, with a mdnsTag, listens
+// for peers on the local network.
+func newDiscovery(h host.Host, interval time.Duration, mdnsTag string) *discovery {
+	d := &discovery{
+		host:     h,
+		interval: interval,
+		out:      make(chan peer.AddrInfo, DiscoveryBufferSize),
+		seen:     make(map[peer.ID]struct{}),
+		dialing:  make(map[peer.ID]struct{}),
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	if mdnsTag != "" {
+		d.mdns = mdns.NewMdnsService(h, mdnsTag, (*mdnsNotifee)(d))
+		if err := d.mdns.Start(); err != nil {
+			log.Errorf("can not start mdns %s", err.Error())
+		}
+	}
+	r, ok := h.(Routed)
+	if !ok {
+		log.Debug("host is not routed, DHT discovery disabled")
+		return d
+	}
+	d.routed = r
+	d.rd = drouting.NewRoutingDiscovery(currentDHT{r})
+	go d.background(d.ctx)
+	return d
+}
+
+func (d *discovery) background(ctx context.Context) {
+	dutil.Advertise(ctx, d.rd, DiscoveryNS)
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		d.discover(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *discovery) discover(ctx context.Context) {
+	for _, p := range d.routed.DHT().RoutingTable().ListPeers() {
+		d.found(d.host.Peerstore().PeerInfo(p))
+	}
+	peers, err := d.rd.FindPeers(ctx, DiscoveryNS)
+	if err != nil {
+		log.Debugf("rendezvous lookup failed: %s", err)
+		return
+	}
+	for pi := range peers {
+		d.found(pi)
+	}
+}
+
+// found reports pi once, never waiting for the reader.
+func (d *discovery) found(pi peer.AddrInfo) {
+	// the node is among the providers of the namespace it advertises
+	if pi.ID == "" || pi.ID == d.host.ID() {
+		return
+	}
+	d.mux.Lock()
+	_, ok := d.seen[pi.ID]
+	d.seen[pi.ID] = struct{}{}
+	d.mux.Unlock()
+	if ok {
+		return
+	}
+	select {
+	case d.out <- pi:
+	default:
+		log.Warnf("discovered peer %s dropped, reader is too slow", logID(pi.ID))
+		d.mux.Lock()
+		delete(d.seen, pi.ID)
+		d.mux.Unlock()
+	}
+}
+
+func (d *discovery) Peers() <-chan peer.AddrInfo {
+	return d.out
+}
+
+func (d *discovery) Republish(ctx context.Context) error {
+	if d.rd == nil {
+		return ErrNotRouted
+	}
+	_, err := d.rd.Advertise(ctx, DiscoveryNS)
+	return err
+}
+
+func (d *discovery) Stop() {
+	d.cancel()
+	if d.mdns != nil {
+		d.mdns.Close()
+	}
+}
+
+type mdnsNotifee discovery
+
+// HandlePeerFound connects a peer found on the local network and reports
+// it like peers found through the DHT. A peer is connected once at a time
+// however often it is announced.
+func (mn *mdnsNotifee) HandlePeerFound(pi peer.AddrInfo) {
+	d := (*discovery)(mn)
+	if pi.ID == d.host.ID() {
+		return
+	}
+	if d.host.Network().Connectedness(pi.ID) == network.Connected {
+		d.found(pi)
+		return
+	}
+	d.mux.Lock()
+	_, ok := d.dialing[pi.ID]
+	d.dialing[pi.ID] = struct{}{}
+	d.mux.Unlock()
+	if ok {
+		return
+	}
+	go func() {
+		defer func() {
+			d.mux.Lock()
+			delete(d.dialing, pi.ID)
+			d.mux.Unlock()
+		}()
+		ctx, cancel := context.WithTimeout(d.ctx, MDNSConnectTimeout)
+		defer cancel()
+		if err := d.host.Connect(ctx, pi); err != nil {
+			log.Debugf("can not connect %s found over mdns: %s", logID(pi.ID), err)
+			return
+		}
+		d.found(pi)
+	}()
+}
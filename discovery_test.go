@@ -0,0 +1,371 @@
+package core
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hood-chat/core/entity"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	dsync "github.com/ipfs/go-datastore/sync"
+	libp2p "github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRoutedHost(t *testing.T, opts ...dht.Option) *routedHost {
+	opts = append([]dht.Option{dht.Mode(dht.ModeServer)}, opts...)
+	r, err := newRoutedHost(context.Background(), newTestHost(t), func(ctx context.Context, h host.Host) (*dht.IpfsDHT, io.Closer, error) {
+		kDht, err := dht.New(context.Background(), h, opts...)
+		return kDht, nil, err
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestDiscoveredPeers(t *testing.T) {
+	hub := newTestRoutedHost(t)
+	h1 := newTestRoutedHost(t)
+	h2 := newTestRoutedHost(t)
+	// h1 and h2 only know the hub
+	for _, h := range []*routedHost{h1, h2} {
+		require.NoError(t, h.Connect(context.Background(), peer.AddrInfo{ID: hub.ID(), Addrs: hub.Addrs()}))
+		require.Eventually(t, func() bool { return h.DHT().RoutingTable().Size() > 0 }, 5*time.Second, 50*time.Millisecond)
+	}
+
+	d2 := newDiscovery(h2, time.Hour, "")
+	defer d2.Stop()
+	d1 := newDiscovery(h1, 200*time.Millisecond, "")
+	defer d1.Stop()
+
+	found := map[peer.ID]int{}
+	timeout := time.After(10 * time.Second)
+	for found[h2.ID()] == 0 || found[hub.ID()] == 0 {
+		select {
+		case pi := <-d1.Peers():
+			found[pi.ID]++
+		case <-timeout:
+			t.Fatalf("peers not discovered, got %v", found)
+		}
+	}
+
+	// peers are reported once however often they are rediscovered
+	time.Sleep(time.Second)
+	for {
+		select {
+		case pi := <-d1.Peers():
+			found[pi.ID]++
+			continue
+		default:
+		}
+		break
+	}
+	require.Equal(t, 1, found[h2.ID()])
+	require.Equal(t, 1, found[hub.ID()])
+}
+
+func TestDiscoveryUnread(t *testing.T) {
+	d := newDiscovery(newTestHost(t), time.Hour, "")
+	defer d.Stop()
+	var pis []peer.AddrInfo
+	for i := 0; i < DiscoveryBufferSize+8; i++ {
+		pis = append(pis, peer.AddrInfo{ID: peer.ID(rune('A' + i))})
+	}
+	// nobody reads, the peers past the buffer are dropped without waiting
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, pi := range pis {
+			d.found(pi)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("found waits for the reader")
+	}
+	require.Len(t, d.Peers(), DiscoveryBufferSize)
+
+	// and reported once found again
+	for range pis[:DiscoveryBufferSize] {
+		<-d.Peers()
+	}
+	d.found(pis[len(pis)-1])
+	d.found(pis[0])
+	require.Len(t, d.Peers(), 1)
+	require.Equal(t, pis[len(pis)-1].ID, (<-d.Peers()).ID)
+}
+
+func TestMDNSPeerFound(t *testing.T) {
+	h := newTestHost(t)
+	d := newDiscovery(h, time.Hour, "")
+	defer d.Stop()
+	stalled, _ := newStallingPeer(t)
+	p := newTestHost(t)
+	found := peer.AddrInfo{ID: p.ID(), Addrs: p.Addrs()}
+
+	// announcements of a peer being connected don't pile up
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		(*mdnsNotifee)(d).HandlePeerFound(stalled)
+	}
+	require.Less(t, runtime.NumGoroutine()-before, 10)
+
+	// nor do those of a connected one, reported once and left unread
+	(*mdnsNotifee)(d).HandlePeerFound(found)
+	require.Eventually(t, func() bool { return len(d.Peers()) == 1 }, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, network.Connected, h.Network().Connectedness(p.ID()))
+	before = runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		(*mdnsNotifee)(d).HandlePeerFound(found)
+	}
+	require.Less(t, runtime.NumGoroutine()-before, 10)
+	require.Equal(t, p.ID(), (<-d.Peers()).ID)
+	require.Len(t, d.Peers(), 0)
+}
+
+func TestDiscoverySkipsSelf(t *testing.T) {
+	provs := &memProviders{recs: make(map[string][]peer.AddrInfo)}
+	hub := newTestRoutedHost(t, dht.ProviderStore(provs))
+	h1 := newTestRoutedHost(t)
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: hub.ID(), Addrs: hub.Addrs()}))
+	require.Eventually(t, func() bool { return h1.DHT().RoutingTable().Size() > 0 }, 5*time.Second, 50*time.Millisecond)
+
+	d1 := newDiscovery(h1, 100*time.Millisecond, "")
+	defer d1.Stop()
+	require.Eventually(t, func() bool { return provs.has(h1.ID()) }, 5*time.Second, 50*time.Millisecond)
+	// from here on the rendezvous lookups see h1 among the providers
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case pi := <-d1.Peers():
+			require.NotEqual(t, h1.ID(), pi.ID)
+			continue
+		case <-timeout:
+		}
+		break
+	}
+}
+
+// memProviders is a provider store whose records can be expired at will.
+type memProviders struct {
+	mux  sync.Mutex
+	recs map[string][]peer.AddrInfo
+}
+
+func (m *memProviders) AddProvider(_ context.Context, key []byte, prov peer.AddrInfo) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.recs[string(key)] = append(m.recs[string(key)], prov)
+	return nil
+}
+
+func (m *memProviders) GetProviders(_ context.Context, key []byte) ([]peer.AddrInfo, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.recs[string(key)], nil
+}
+
+func (m *memProviders) has(p peer.ID) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for _, provs := range m.recs {
+		for _, prov := range provs {
+			if prov.ID == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m *memProviders) expire() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.recs = make(map[string][]peer.AddrInfo)
+}
+
+func TestRepublish(t *testing.T) {
+	provs := &memProviders{recs: make(map[string][]peer.AddrInfo)}
+	hub := newTestRoutedHost(t, dht.ProviderStore(provs))
+	h1 := newTestRoutedHost(t)
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: hub.ID(), Addrs: hub.Addrs()}))
+	require.Eventually(t, func() bool { return h1.DHT().RoutingTable().Size() > 0 }, 5*time.Second, 50*time.Millisecond)
+
+	d1 := newDiscovery(h1, time.Hour, "")
+	defer d1.Stop()
+	require.Eventually(t, func() bool { return provs.has(h1.ID()) }, 5*time.Second, 50*time.Millisecond)
+
+	provs.expire()
+	require.NoError(t, d1.Republish(context.Background()))
+	// provider records are sent without waiting for a reply
+	require.Eventually(t, func() bool { return provs.has(h1.ID()) }, 5*time.Second, 50*time.Millisecond)
+
+	require.ErrorIs(t, newDiscovery(newTestHost(t), time.Hour, "").Republish(context.Background()), ErrNotRouted)
+}
+
+func TestResetDHT(t *testing.T) {
+	hub := newTestRoutedHost(t)
+	h1 := newTestRoutedHost(t)
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: hub.ID(), Addrs: hub.Addrs()}))
+	require.Eventually(t, func() bool { return h1.DHT().RoutingTable().Size() > 0 }, 5*time.Second, 50*time.Millisecond)
+
+	old := h1.DHT()
+	old.RoutingTable().RemovePeer(hub.ID())
+	require.NoError(t, h1.ResetDHT(context.Background()))
+	require.NotSame(t, old, h1.DHT())
+	require.Eventually(t, func() bool { return h1.DHT().RoutingTable().Size() > 0 }, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, network.Connected, h1.Network().Connectedness(hub.ID()))
+
+	// the routed host resolves peers through the new DHT
+	h2 := newTestRoutedHost(t)
+	require.NoError(t, h2.Connect(context.Background(), peer.AddrInfo{ID: hub.ID(), Addrs: hub.Addrs()}))
+	require.Eventually(t, func() bool { return h2.DHT().RoutingTable().Size() > 0 }, 5*time.Second, 50*time.Millisecond)
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID()}))
+}
+
+func TestRefreshPeerAddrs(t *testing.T) {
+	hub := newTestRoutedHost(t)
+	h2 := newTestRoutedHost(t, dht.Mode(dht.ModeClient))
+	m, err := MessengerBuilder(t.TempDir()+"/h1", Option{}, routedBuilder{})
+	require.NoError(t, err)
+	_, err = m.SignUp("h1")
+	require.NoError(t, err)
+	defer m.Stop()
+	r := m.Host.(Routed)
+	for _, h := range []host.Host{m.Host, h2} {
+		require.NoError(t, h.Connect(context.Background(), peer.AddrInfo{ID: hub.ID(), Addrs: hub.Addrs()}))
+	}
+	require.Eventually(t, func() bool { return r.DHT().RoutingTable().Size() > 0 }, 5*time.Second, 50*time.Millisecond)
+
+	stale, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1")
+	require.NoError(t, err)
+	m.Host.Peerstore().AddAddrs(h2.ID(), []ma.Multiaddr{stale}, time.Hour)
+	// h2 may have met h1 refreshing its routing table, make it a stranger
+	require.NoError(t, m.Host.Network().ClosePeer(h2.ID()))
+	require.NoError(t, m.RefreshPeerAddrs(context.Background(), h2.ID()))
+	addrs := m.Host.Peerstore().Addrs(h2.ID())
+	require.NotContains(t, addrs, stale)
+	require.Subset(t, addrs, h2.Addrs())
+
+	gone, err := entity.CreateIdentity("gone")
+	require.NoError(t, err)
+	pid, err := peer.Decode(gone.ID.String())
+	require.NoError(t, err)
+	m.Host.Peerstore().AddAddrs(pid, []ma.Multiaddr{stale}, time.Hour)
+	require.Error(t, m.RefreshPeerAddrs(context.Background(), pid))
+	require.Equal(t, []ma.Multiaddr{stale}, m.Host.Peerstore().Addrs(pid))
+}
+
+// routedBuilder makes messenger hosts on loopback with a test DHT.
+type routedBuilder struct{}
+
+func (b routedBuilder) Create(opt Option) (host.Host, error) {
+	h, err := libp2p.New(append(opt.LpOpt, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))...)
+	if err != nil {
+		return nil, err
+	}
+	return newRoutedHost(context.Background(), h, func(ctx context.Context, h host.Host) (*dht.IpfsDHT, io.Closer, error) {
+		kDht, err := dht.New(context.Background(), h, dht.Mode(dht.ModeServer))
+		return kDht, nil, err
+	})
+}
+
+func TestDHTDatastore(t *testing.T) {
+	key := []byte("record")
+	prov := getPeers(1)[0]
+	create := func(opt Option) *routedHost {
+		opt.LpOpt = []libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")}
+		h, err := DefaultRoutedHost{}.Create(opt)
+		require.NoError(t, err)
+		return h.(*routedHost)
+	}
+
+	// records outlive the host
+	opt := Option{DHTDatastorePath: t.TempDir() + "/dht"}
+	r := create(opt)
+	require.NoError(t, r.DHT().ProviderStore().AddProvider(context.Background(), key, prov))
+	require.NoError(t, r.Close())
+	r = create(opt)
+	provs, err := r.DHT().ProviderStore().GetProviders(context.Background(), key)
+	require.NoError(t, err)
+	require.Len(t, provs, 1)
+	require.Equal(t, prov.ID, provs[0].ID)
+	require.NoError(t, r.Close())
+
+	// an injected datastore gets them and stays open
+	mem := dsync.MutexWrap(ds.NewMapDatastore())
+	r = create(Option{DHTDatastore: mem})
+	require.NoError(t, r.DHT().ProviderStore().AddProvider(context.Background(), key, prov))
+	require.NoError(t, r.Close())
+	res, err := mem.Query(context.Background(), dsq.Query{KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+}
+
+func TestBootstrapPeers(t *testing.T) {
+	hub := newTestRoutedHost(t)
+	opt := Option{
+		LpOpt:          []libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")},
+		BootstrapPeers: []peer.AddrInfo{{ID: hub.ID(), Addrs: hub.Addrs()}},
+	}
+	h, err := DefaultRoutedHost{}.Create(opt)
+	require.NoError(t, err)
+	defer h.Close()
+	require.Eventually(t, func() bool {
+		return h.Network().Connectedness(hub.ID()) == network.Connected
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// the public nodes are left out entirely
+	defaults, err := DefaultBootstrapPeers()
+	require.NoError(t, err)
+	require.NotEmpty(t, defaults)
+	for _, pi := range defaults {
+		require.Empty(t, h.Peerstore().Addrs(pi.ID))
+	}
+}
+
+func TestNetworkChanged(t *testing.T) {
+	provs := &memProviders{recs: make(map[string][]peer.AddrInfo)}
+	hub := newTestRoutedHost(t, dht.ProviderStore(provs))
+	m, err := MessengerBuilder(t.TempDir()+"/h1", Option{}, routedBuilder{})
+	require.NoError(t, err)
+	_, err = m.SignUp("h1")
+	require.NoError(t, err)
+	defer m.Stop()
+
+	require.NoError(t, m.Host.Connect(context.Background(), peer.AddrInfo{ID: hub.ID(), Addrs: hub.Addrs()}))
+	r := m.Host.(Routed)
+	require.Eventually(t, func() bool { return r.DHT().RoutingTable().Size() > 0 }, 5*time.Second, 50*time.Millisecond)
+	require.NoError(t, m.RepublishProviderRecords(context.Background()))
+	require.Eventually(t, func() bool { return provs.has(m.Host.ID()) }, 5*time.Second, 50*time.Millisecond)
+	old := m.Host.Network().ConnsToPeer(hub.ID())[0]
+	var boots int32
+	m.Host.(*routedHost).bootstrap = func(context.Context, host.Host, *dht.IpfsDHT) (io.Closer, error) {
+		atomic.AddInt32(&boots, 1)
+		return nil, nil
+	}
+
+	provs.expire()
+	m.NetworkChanged()
+	require.Equal(t, int32(1), atomic.LoadInt32(&boots))
+	// the refresh dialed the hub again over a new connection
+	conns := m.Host.Network().ConnsToPeer(hub.ID())
+	require.NotEmpty(t, conns)
+	for _, c := range conns {
+		require.NotEqual(t, old, c)
+	}
+	require.Eventually(t, func() bool { return provs.has(m.Host.ID()) }, 5*time.Second, 50*time.Millisecond)
+}
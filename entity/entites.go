@@ -1,14 +1,21 @@
 package entity
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/libp2p/go-libp2p/core/crypto"
 	ic "github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
 	"github.com/hood-chat/core/pb"
+	"golang.org/x/crypto/scrypt"
 )
 
 type Status int
@@ -26,22 +33,205 @@ const (
 	Failed
 )
 
+// Presence is the availability a peer announces to its contacts.
+type Presence int
+
+const (
+	Offline Presence = iota
+	Online
+	Away
+)
+
+var presenceNames = []string{"offline", "online", "away"}
+
+func (p Presence) String() string {
+	if p < 0 || int(p) >= len(presenceNames) {
+		return "unknown"
+	}
+	return presenceNames[p]
+}
+
+// ParsePresence reads a presence written by String, false when unknown.
+func ParsePresence(s string) (Presence, bool) {
+	for i, name := range presenceNames {
+		if name == s {
+			return Presence(i), true
+		}
+	}
+	return Offline, false
+}
+
 type Identity struct {
 	ID      ID
 	Name    string
 	PrivKey string
+	// Nickname is a local-only label for the user, never shared with peers
+	Nickname string
 }
 
-// DecodePrivateKey is a helper to decode the users PrivateKey
+// ErrWrongPassphrase is returned when the identity key can't be decrypted
+// with the passphrase given.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// encryptedKeyPrefix marks private keys encrypted with a passphrase. Keys
+// without it are stored in the clear.
+const encryptedKeyPrefix = "enc:"
+
+const (
+	saltSize = 16
+	// scrypt parameters recommended for interactive logins
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// DecodePrivateKey is a helper to decode the users PrivateKey. Keys stored
+// in the clear load whatever the passphrase.
 func (i *Identity) DecodePrivateKey(passphrase string) (ic.PrivKey, error) {
+	enc := strings.HasPrefix(i.PrivKey, encryptedKeyPrefix)
+	pkb, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(i.PrivKey, encryptedKeyPrefix))
+	if err != nil {
+		return nil, err
+	}
+	if enc {
+		pkb, err = decryptKey(pkb, passphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ic.UnmarshalPrivateKey(pkb)
+}
+
+// EncryptPrivateKey encrypts the stored key with passphrase. An empty
+// passphrase leaves the key as it is.
+func (i *Identity) EncryptPrivateKey(passphrase string) error {
+	if passphrase == "" || strings.HasPrefix(i.PrivKey, encryptedKeyPrefix) {
+		return nil
+	}
 	pkb, err := base64.StdEncoding.DecodeString(i.PrivKey)
+	if err != nil {
+		return err
+	}
+	sealed, err := encryptKey(pkb, passphrase)
+	if err != nil {
+		return err
+	}
+	i.PrivKey = encryptedKeyPrefix + base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+
+func keyCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
 	if err != nil {
 		return nil, err
 	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
 
-	// currently storing key unencrypted. in the future we need to encrypt it.
-	// TODO(security)
-	return ic.UnmarshalPrivateKey(pkb)
+// encryptKey seals key as salt|nonce|ciphertext.
+func encryptKey(key []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := keyCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(salt, nonce...)
+	return aead.Seal(out, nonce, key, nil), nil
+}
+
+func decryptKey(sealed []byte, passphrase string) ([]byte, error) {
+	if len(sealed) < saltSize {
+		return nil, ErrWrongPassphrase
+	}
+	aead, err := keyCipher(passphrase, sealed[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[saltSize:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	key, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// SealWithPassphrase encrypts data with passphrase the way the identity
+// key is encrypted.
+func SealWithPassphrase(data []byte, passphrase string) ([]byte, error) {
+	return encryptKey(data, passphrase)
+}
+
+// OpenWithPassphrase decrypts data sealed by SealWithPassphrase, failing
+// with ErrWrongPassphrase when passphrase is not the one it was sealed with.
+func OpenWithPassphrase(sealed []byte, passphrase string) ([]byte, error) {
+	return decryptKey(sealed, passphrase)
+}
+
+// SharedKeySize is the size of a key shared with a contact, for AES-256.
+const SharedKeySize = 32
+
+var (
+	// ErrSharedKeySize is returned for shared keys not SharedKeySize long.
+	ErrSharedKeySize = errors.New("shared key must be 32 bytes")
+	// ErrSealedText is returned when a text can't be opened with the key.
+	ErrSealedText = errors.New("text can not be opened with the shared key")
+)
+
+// SealText encrypts text with a key shared with a contact, as base64 of
+// nonce|ciphertext.
+func SealText(key []byte, text string) (string, error) {
+	aead, err := sharedCipher(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(text), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// OpenText decrypts a text sealed by SealText.
+func OpenText(key []byte, sealed string) (string, error) {
+	aead, err := sharedCipher(key)
+	if err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(b) < aead.NonceSize() {
+		return "", ErrSealedText
+	}
+	text, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return "", ErrSealedText
+	}
+	return string(text), nil
+}
+
+func sharedCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != SharedKeySize {
+		return nil, ErrSharedKeySize
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
 }
 
 func (i *Identity) Me() *Contact {
@@ -51,14 +241,73 @@ func (i *Identity) Me() *Contact {
 	}
 }
 
+const (
+	KeyEd25519 = "ed25519"
+	KeyRSA     = "rsa"
+
+	// DefaultRSABits is the RSA key length when none is asked for, the
+	// one older IPFS nodes use.
+	DefaultRSABits = 2048
+
+	algorithmDefault = KeyEd25519
+)
+
+var (
+	// ErrKeyAlgorithm is returned for a key algorithm other than KeyEd25519
+	// and KeyRSA.
+	ErrKeyAlgorithm = errors.New("unsupported key algorithm")
+	// ErrKeyBits is returned when a bit size is given for a key whose
+	// length is fixed.
+	ErrKeyBits = errors.New("key bits only apply to rsa")
+)
+
+// KeyOption picks the type of the identity key made at sign up.
+type KeyOption struct {
+	// Algorithm is KeyEd25519 or KeyRSA, KeyEd25519 when empty.
+	Algorithm string
+	// Bits is the RSA key length, DefaultRSABits when zero. It must stay
+	// zero for other algorithms.
+	Bits int
+}
+
+func (o KeyOption) algorithm() string {
+	if o.Algorithm == "" {
+		return algorithmDefault
+	}
+	return strings.ToLower(o.Algorithm)
+}
+
+func (o KeyOption) generate() (crypto.PrivKey, crypto.PubKey, error) {
+	switch o.algorithm() {
+	case KeyEd25519:
+		if o.Bits != 0 {
+			return nil, nil, ErrKeyBits
+		}
+		return crypto.GenerateEd25519Key(rand.Reader)
+	case KeyRSA:
+		bits := o.Bits
+		if bits == 0 {
+			bits = DefaultRSABits
+		}
+		return crypto.GenerateRSAKeyPair(bits, rand.Reader)
+	default:
+		return nil, nil, fmt.Errorf("%w: %s", ErrKeyAlgorithm, o.Algorithm)
+	}
+}
+
 func CreateIdentity(name string) (Identity, error) {
+	return CreateIdentityWithKey(name, KeyOption{})
+}
+
+// CreateIdentityWithKey is CreateIdentity with the key type picked by key.
+func CreateIdentityWithKey(name string, key KeyOption) (Identity, error) {
 	ident := Identity{}
 
 	var sk crypto.PrivKey
 	var pk crypto.PubKey
 
-	fmt.Printf("generating ED25519 keypair...")
-	priv, pub, err := crypto.GenerateEd25519Key(rand.Reader)
+	fmt.Printf("generating %s keypair...", strings.ToUpper(key.algorithm()))
+	priv, pub, err := key.generate()
 	if err != nil {
 		return ident, err
 	}
@@ -68,8 +317,7 @@ func CreateIdentity(name string) (Identity, error) {
 
 	fmt.Print("done\n")
 
-	// currently storing key unencrypted. in the future we need to encrypt it.
-	// TODO(security)
+	// stored in the clear, EncryptPrivateKey seals it with a passphrase
 	skbytes, err := crypto.MarshalPrivateKey(sk)
 	if err != nil {
 		return ident, err
@@ -93,43 +341,122 @@ type Message struct {
 	Text      string
 	Status    Status
 	Author    Contact
+	// ForwardedFrom is the original author of a forwarded message
+	ForwardedFrom *Contact
+	// Attachment is the CID of the text when it is too long to travel in
+	// the frame, peers fetch it from the author
+	Attachment string
+	// Sealed is set when Text is encrypted with the key shared with the
+	// recipient
+	Sealed bool
 }
 
 type Contact struct {
 	ID   ID
 	Name string
+	// Verified is set once the contact proved it holds its identity key
+	Verified bool
+	// Addrs are the multiaddrs the contact was last known to listen on
+	Addrs []string
+	// SharedKey, when set, encrypts the texts exchanged with the contact
+	// instead of relying on the identity keys alone
+	SharedKey []byte
 }
 
+// AdderInfo is the contact's peer info with its known addresses, those
+// that don't parse are left out.
 func (c Contact) AdderInfo() (*peer.AddrInfo, error){
 	p, err := c.PeerID()
 	if err != nil {
 		return nil, err
 	}
-	return peer.AddrInfoFromString("/p2p/" + p.String())
+	pi, err := peer.AddrInfoFromString("/p2p/" + p.String())
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range c.Addrs {
+		addr, err := ma.NewMultiaddr(a)
+		if err == nil {
+			pi.Addrs = append(pi.Addrs, addr)
+		}
+	}
+	return pi, nil
+}
+
+// Proto converts the contact to its wire form, nil stays nil.
+func (c *Contact) Proto() *pb.Contact {
+	if c == nil {
+		return nil
+	}
+	return &pb.Contact{Id: c.ID.String(), Name: c.Name}
 }
 
 func (c Contact) PeerID() (peer.ID, error) {
 	return peer.Decode(string(c.ID))
 }
 
+// Frame types carried in pb.Message.Type
+const (
+	TextType = "text"
+	SeenType = "seen"
+	// DeliveredType frames tell the author a message was stored.
+	DeliveredType = "delivered"
+	// AckType frames are written back on the stream once a frame is
+	// received, they carry the id of the frame.
+	AckType = "ack"
+)
+
+// FileMeta describes a file sent to a peer.
+type FileMeta struct {
+	Name string
+	MIME string
+	// Size is the exact number of bytes sent
+	Size int64
+}
+
 type Envelop struct {
 	To Contact
 	Message Message
+	// Type of the frame, TextType when empty
+	Type string
+	// Protocol to send the frame over, the negotiated one when empty
+	Protocol protocol.ID
+}
+
+// Key identifies the envelope among those waiting for delivery, receipts
+// share the id of the message they refer to.
+func (n Envelop) Key() ID {
+	typ := n.Type
+	if typ == "" {
+		typ = TextType
+	}
+	return ID(typ + "/" + n.Message.ID.String())
 }
 
 func (n Envelop) Proto() *pb.Message {
 	msg := n.Message
+	typ := n.Type
+	if typ == "" {
+		typ = TextType
+	}
+	text := msg.Text
+	if msg.Attachment != "" {
+		text = ""
+	}
 	return &pb.Message{
-		Text:      msg.Text,
+		Text:      text,
 		Id:        msg.ID.String(),
 		ChatId:    msg.ChatID.String(),
 		CreatedAt: msg.CreatedAt,
-		Type:      "text",
+		Type:      typ,
 		Sig:       "",
 		Author: &pb.Contact{
 			Id:   msg.Author.ID.String(),
 			Name: msg.Author.Name,
 		},
+		ForwardedFrom: msg.ForwardedFrom.Proto(),
+		Attachment:    msg.Attachment,
+		Sealed:        msg.Sealed,
 	}
 }
 
@@ -138,4 +465,33 @@ type ChatInfo struct {
 	ID      ID
 	Name    string
 	Members []Contact
+	Unread  int
+	// LastActivity is the creation time of the newest message and
+	// LastMessageID its ID, zero for chats without messages.
+	LastActivity  int64
+	LastMessageID ID
+}
+
+// ConversationSummary is a chat as listed by the UI.
+type ConversationSummary struct {
+	Chat ChatInfo
+	// LastMessage is the newest message of the chat, nil when empty.
+	LastMessage *Message
+}
+
+// PendingRequest holds messages from a peer that is not a contact yet.
+type PendingRequest struct {
+	ID        ID
+	Name      string
+	Intro     string
+	CreatedAt int64
+	Messages  []Message
+}
+
+// StorageStats is an estimate of the bytes used by chat data.
+type StorageStats struct {
+	Outbox   int64
+	History  int64
+	Contacts int64
+	Disk     int64
 }
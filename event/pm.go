@@ -1,9 +1,154 @@
 package event
 
 import (
+	"time"
+
+	"github.com/hood-chat/core/entity"
 	"github.com/hood-chat/core/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
 )
 
 type EvtMessageReceived struct {
 	Msg *pb.Message
 }
+
+// Ack types carried by EvtMessageAcked
+const (
+	AckDelivered = "delivered"
+	AckRead      = "read"
+)
+
+// EvtMessageAcked is emitted when a peer acknowledges one of our messages,
+// AckDelivered once it stored it and AckRead once it was read.
+type EvtMessageAcked struct {
+	MsgID entity.ID
+	Type  string
+}
+
+// EvtContactOnline is emitted when a saved contact becomes reachable.
+type EvtContactOnline struct {
+	ID peer.ID
+}
+
+// EvtPresenceChanged is emitted when a contact announces a new presence,
+// or goes offline after missing its heartbeats.
+type EvtPresenceChanged struct {
+	ID       peer.ID
+	Presence entity.Presence
+}
+
+// Hole punch outcomes carried by EvtHolePunch
+const (
+	HolePunchStarted   = "started"
+	HolePunchSucceeded = "succeeded"
+	HolePunchFailed    = "failed"
+)
+
+// EvtHolePunch is emitted when a hole punch to a peer starts and when it
+// ends, HolePunchSucceeded meaning the relayed connection was upgraded to
+// a direct one.
+type EvtHolePunch struct {
+	ID      peer.ID
+	Outcome string
+	// Error tells why the hole punch failed
+	Error string
+}
+
+// EvtTyping is emitted when a contact starts or stops typing to us. Starts
+// repeat while it keeps typing, so one not followed by another within a few
+// seconds can be taken as a stop.
+type EvtTyping struct {
+	ID     peer.ID
+	Typing bool
+}
+
+// EvtFileReceived is emitted once an incoming file was fully written to
+// Path.
+type EvtFileReceived struct {
+	From peer.ID
+	File entity.FileMeta
+	Path string
+}
+
+// EvtFileSent is emitted once a queued file ID was stored by To, or
+// declined with Err.
+type EvtFileSent struct {
+	To   peer.ID
+	ID   string
+	File entity.FileMeta
+	Err  error
+}
+
+// EvtPeerConnected is sent to peer subscribers when the first connection
+// to a peer opens.
+type EvtPeerConnected struct {
+	ID peer.ID
+	At time.Time
+}
+
+// EvtPeerDisconnected is sent to peer subscribers when the last connection
+// to a peer closes.
+type EvtPeerDisconnected struct {
+	ID peer.ID
+	At time.Time
+}
+
+// EvtInfraPeerConnected is sent to infrastructure subscribers when the
+// first connection to a bootstrap or relay peer opens.
+type EvtInfraPeerConnected struct {
+	ID        peer.ID
+	Bootstrap bool
+	Relay     bool
+	At        time.Time
+}
+
+// EvtInfraPeerDisconnected is sent to infrastructure subscribers when the
+// last connection to a bootstrap or relay peer closes.
+type EvtInfraPeerDisconnected struct {
+	ID        peer.ID
+	Bootstrap bool
+	Relay     bool
+	At        time.Time
+}
+
+// EvtContactProfileChanged is emitted when a refreshed contact profile
+// differs from the saved one.
+type EvtContactProfileChanged struct {
+	Contact entity.Contact
+}
+
+// EvtFavoriteUnreachable is emitted when reconnecting a favorite peer
+// exhausted its retry policy.
+type EvtFavoriteUnreachable struct {
+	ID peer.ID
+}
+
+// EvtOutboxDepthChanged is emitted whenever the number of messages waiting
+// for delivery changes.
+type EvtOutboxDepthChanged struct {
+	Depth int
+}
+
+// EvtOutboxDrained is emitted when the last message waiting for delivery
+// was delivered or failed.
+type EvtOutboxDrained struct{}
+
+// EvtMessagesPurged is emitted when messages that failed long ago are
+// deleted from a chat by OutboxPolicy.PurgeFailed. The chat is read again
+// for its last activity and unread count.
+type EvtMessagesPurged struct {
+	ChatID entity.ID
+	IDs    []entity.ID
+}
+
+// Reasons a message is dropped
+const (
+	DropBackpressure = "backpressure"
+)
+
+// EvtMessageDropped is emitted when a message is dropped before delivery.
+type EvtMessageDropped struct {
+	MsgID  entity.ID
+	ChatID entity.ID
+	Reason string
+}
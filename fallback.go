@@ -0,0 +1,40 @@
+package core
+
+import (
+	"context"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// connectWithFallback connects to pi and, when that fails, e.g. because UDP
+// is blocked and QUIC can't get through, retries over the peer's direct TCP
+// addresses ignoring their dial backoff.
+func connectWithFallback(ctx context.Context, h host.Host, pi peer.AddrInfo) error {
+	err := h.Connect(ctx, pi)
+	if err == nil {
+		return nil
+	}
+	tcp := tcpAddrs(append(pi.Addrs, h.Peerstore().Addrs(pi.ID)...))
+	if len(tcp) == 0 {
+		return err
+	}
+	log.Debugf("dial to %s failed, falling back to tcp: %s", logID(pi.ID), err)
+	fctx := network.WithForceDirectDial(ctx, "tcp fallback")
+	return h.Connect(fctx, peer.AddrInfo{ID: pi.ID, Addrs: tcp})
+}
+
+func tcpAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	res := make([]ma.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		if _, err := a.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			continue
+		}
+		if _, err := a.ValueForProtocol(ma.P_TCP); err == nil {
+			res = append(res, a)
+		}
+	}
+	return res
+}
@@ -0,0 +1,707 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hood-chat/core/entity"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-msgio"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	FileID = "/chat/file/1.0.0"
+
+	FileServiceName = "chat.file"
+
+	// FileChunkSize is the most file bytes carried by one frame.
+	FileChunkSize = 64 * 1024
+
+	// DefaultPartExpiry is how long part files wait for their transfer to
+	// resume by default.
+	DefaultPartExpiry = 24 * time.Hour
+)
+
+var (
+	// ErrFileRejected is returned when the receiver declines a file, the
+	// error text carries its reason.
+	ErrFileRejected = errors.New("file rejected")
+	// ErrFileIncomplete is returned when a transfer ends before the size
+	// announced.
+	ErrFileIncomplete = errors.New("file transfer incomplete")
+	// ErrFileSize is returned when the data sent doesn't match the size
+	// announced.
+	ErrFileSize = errors.New("file size mismatch")
+	// ErrFileIdle is returned when a transfer makes no progress for
+	// FilePolicy.IdleTimeout.
+	ErrFileIdle = errors.New("file transfer idle")
+)
+
+// FilePolicy bounds file transfers.
+type FilePolicy struct {
+	// IdleTimeout aborts a transfer that made no progress for that long,
+	// on both sides, discarding what was received unless it is queued to
+	// resume. StreamTimeout when zero.
+	IdleTimeout time.Duration
+	// MaxSize rejects incoming files larger than it, zero takes any size.
+	MaxSize int64
+	// AllowedTypes are the MIME types of the incoming files accepted, such
+	// as "image/png" or "image/*" for any image. Empty accepts all types.
+	AllowedTypes []string
+	// MaxConcurrentTransfers bounds the files sent and received at once,
+	// the others wait for a transfer to end. Zero doesn't bound them.
+	MaxConcurrentTransfers int
+	// PartExpiry deletes the part files of received transfers that did
+	// not resume for that long. Queued transfers live in the memory of the
+	// sender, those it lost when it closed never resume.
+	// DefaultPartExpiry when zero.
+	PartExpiry time.Duration
+}
+
+// check tells why an incoming file breaks the policy, nil when it doesn't.
+func (p FilePolicy) check(meta entity.FileMeta) error {
+	if p.MaxSize > 0 && meta.Size > p.MaxSize {
+		return fmt.Errorf("file too large, %d bytes at most", p.MaxSize)
+	}
+	if len(p.AllowedTypes) == 0 {
+		return nil
+	}
+	for _, typ := range p.AllowedTypes {
+		if typ == meta.MIME || (strings.HasSuffix(typ, "/*") && strings.HasPrefix(meta.MIME, strings.TrimSuffix(typ, "*"))) {
+			return nil
+		}
+	}
+	return fmt.Errorf("file type %q not allowed", meta.MIME)
+}
+
+// FileProgress reports how many bytes of a file were sent.
+type FileProgress struct {
+	Done  int64
+	Total int64
+}
+
+// FileHandler decides on a file offered by from. It returns the path to
+// write the file to, or an error to reject it with.
+type FileHandler func(from peer.ID, meta entity.FileMeta) (string, error)
+
+// fileHeader opens a transfer. One with an ID can resume, the receiver
+// then follows its verdict with the offset it holds the file up to.
+type fileHeader struct {
+	entity.FileMeta
+	ID string `json:",omitempty"`
+}
+
+// fileTransfer is a file queued for a peer until the peer stores it.
+type fileTransfer struct {
+	header fileHeader
+	r      io.ReaderAt
+	// running while sent, again when the peer reconnected meanwhile
+	running bool
+	again   bool
+}
+
+// fileService streams files over FileID. Each transfer is a header frame
+// with the metadata, a verdict frame from the receiver, chunk frames ended
+// by an empty one, then a final frame once the receiver stored the file.
+// Verdict and final frames are empty on success and hold the error text
+// otherwise.
+type fileService struct {
+	host     host.Host
+	policy   FilePolicy
+	idle     time.Duration
+	received func(from peer.ID, meta entity.FileMeta, path string)
+	sent     func(to peer.ID, id string, meta entity.FileMeta, err error)
+	slots    chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mux     sync.RWMutex
+	handler FileHandler
+	queued  map[peer.ID][]*fileTransfer
+	// dirs are where part files were received, swept of the expired ones
+	dirs map[string]struct{}
+}
+
+func newFileService(h host.Host, policy FilePolicy, received func(peer.ID, entity.FileMeta, string), sent func(peer.ID, string, entity.FileMeta, error)) *fileService {
+	fs := &fileService{
+		host:     h,
+		policy:   policy,
+		idle:     policy.IdleTimeout,
+		received: received,
+		sent:     sent,
+		queued:   make(map[peer.ID][]*fileTransfer),
+		dirs:     make(map[string]struct{}),
+	}
+	if fs.idle <= 0 {
+		fs.idle = StreamTimeout
+	}
+	if fs.policy.PartExpiry <= 0 {
+		fs.policy.PartExpiry = DefaultPartExpiry
+	}
+	if policy.MaxConcurrentTransfers > 0 {
+		fs.slots = make(chan struct{}, policy.MaxConcurrentTransfers)
+	}
+	fs.ctx, fs.cancel = context.WithCancel(context.Background())
+	go fs.sweep(fs.ctx)
+	h.SetStreamHandler(FileID, fs.Handler)
+	h.Network().Notify((*fileNotifiee)(fs))
+	log.Debug("service file created")
+	return fs
+}
+
+// acquire waits for a free transfer slot, the returned func gives it back.
+func (c *fileService) acquire(ctx context.Context) (func(), error) {
+	if c.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.slots <- struct{}{}:
+		return func() { <-c.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.ctx.Done():
+		return nil, c.ctx.Err()
+	}
+}
+
+// handle accepts incoming files through fn, nil rejects them.
+func (c *fileService) handle(fn FileHandler) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.handler = fn
+}
+
+// send streams the file to p, read from where p holds it up to, and
+// returns once p stored it.
+func (c *fileService) send(ctx context.Context, p peer.ID, hdr fileHeader, from func(offset int64) io.Reader, progress chan<- FileProgress) error {
+	header, err := json.Marshal(hdr)
+	if err != nil {
+		return err
+	}
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	s, err := c.host.NewStream(ctx, p, FileID)
+	if err != nil {
+		return err
+	}
+	// a cancelled ctx or no progress for too long breaks the transfer off,
+	// once r returns when it is the one stalled
+	done := make(chan struct{})
+	active := make(chan struct{}, 1)
+	idled := make(chan struct{})
+	defer close(done)
+	go func() {
+		timer := time.NewTimer(c.idle)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				s.Reset()
+				return
+			case <-timer.C:
+				close(idled)
+				s.Reset()
+				return
+			case <-active:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(c.idle)
+			case <-done:
+				return
+			}
+		}
+	}()
+	err = c.write(s, from, header, hdr, progress, active)
+	if err != nil {
+		s.Reset()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		select {
+		case <-idled:
+			return ErrFileIdle
+		default:
+		}
+		return err
+	}
+	return s.Close()
+}
+
+// write sends the transfer over s, ticking active on each chunk.
+func (c *fileService) write(s network.Stream, from func(offset int64) io.Reader, header []byte, hdr fileHeader, progress chan<- FileProgress, active chan<- struct{}) error {
+	wr := msgio.NewVarintWriter(s)
+	rd := msgio.NewVarintReaderSize(s, MaxMsgSize)
+	s.SetDeadline(time.Now().Add(StreamTimeout))
+	if err := wr.WriteMsg(header); err != nil {
+		return err
+	}
+	if err := readVerdict(rd, ErrFileRejected); err != nil {
+		return err
+	}
+	size := hdr.Size
+	var done int64
+	if hdr.ID != "" {
+		msg, err := rd.ReadMsg()
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrFileIncomplete, err)
+		}
+		done, err = strconv.ParseInt(string(msg), 10, 64)
+		if err != nil || done < 0 || done > size {
+			return fmt.Errorf("%w: bad offset %q", ErrFileIncomplete, msg)
+		}
+	}
+	select {
+	case active <- struct{}{}:
+	default:
+	}
+	r := from(done)
+	buf := make([]byte, FileChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			done += int64(n)
+			if done > size {
+				return ErrFileSize
+			}
+			s.SetDeadline(time.Now().Add(c.idle))
+			if werr := wr.WriteMsg(buf[:n]); werr != nil {
+				return fmt.Errorf("%w: %s", ErrFileIncomplete, werr)
+			}
+			select {
+			case active <- struct{}{}:
+			default:
+			}
+			select {
+			case progress <- FileProgress{Done: done, Total: size}:
+			default:
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if done != size {
+		return ErrFileSize
+	}
+	if err := wr.WriteMsg(nil); err != nil {
+		return err
+	}
+	s.SetDeadline(time.Now().Add(StreamTimeout))
+	return readVerdict(rd, ErrFileIncomplete)
+}
+
+// readVerdict reads a verdict frame, wrapping a refusal in base and a
+// broken stream in ErrFileIncomplete.
+func readVerdict(rd msgio.Reader, base error) error {
+	msg, err := rd.ReadMsg()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrFileIncomplete, err)
+	}
+	if len(msg) > 0 {
+		return fmt.Errorf("%w: %s", base, msg)
+	}
+	return nil
+}
+
+func (c *fileService) Handler(str network.Stream) {
+	if err := str.Scope().SetService(FileServiceName); err != nil {
+		log.Debugf("error attaching stream to file service: %s", err)
+		str.Reset()
+		return
+	}
+	str.SetDeadline(time.Now().Add(StreamTimeout))
+	rd := msgio.NewVarintReaderSize(str, FileChunkSize)
+	wr := msgio.NewVarintWriter(str)
+	from := str.Conn().RemotePeer()
+
+	header, err := rd.ReadMsg()
+	if err != nil {
+		log.Debugf("error reading file header: %s", err)
+		str.Reset()
+		return
+	}
+	var hdr fileHeader
+	if err := json.Unmarshal(header, &hdr); err != nil || hdr.Size < 0 || !validTransferID(hdr.ID) {
+		wr.WriteMsg([]byte("bad file header"))
+		str.Close()
+		return
+	}
+	meta := hdr.FileMeta
+	if err := c.policy.check(meta); err != nil {
+		wr.WriteMsg([]byte(err.Error()))
+		str.Close()
+		return
+	}
+	release, err := c.acquire(context.Background())
+	if err != nil {
+		str.Reset()
+		return
+	}
+	defer release()
+	str.SetDeadline(time.Now().Add(StreamTimeout))
+	c.mux.RLock()
+	handler := c.handler
+	c.mux.RUnlock()
+	if handler == nil {
+		wr.WriteMsg([]byte("files not accepted"))
+		str.Close()
+		return
+	}
+	path, err := handler(from, meta)
+	if err != nil {
+		wr.WriteMsg([]byte(err.Error()))
+		str.Close()
+		return
+	}
+	// a transfer that can resume is told where to go on from
+	var part *os.File
+	var offset int64
+	if hdr.ID != "" {
+		c.sweepDir(filepath.Dir(path), time.Now())
+		part, offset, err = openPart(path, hdr.ID, meta.Size)
+		if err != nil {
+			wr.WriteMsg([]byte(err.Error()))
+			str.Close()
+			return
+		}
+	}
+	err = wr.WriteMsg(nil)
+	if err == nil && part != nil {
+		err = wr.WriteMsg([]byte(strconv.FormatInt(offset, 10)))
+	}
+	switch {
+	case err != nil:
+		if part != nil {
+			part.Close()
+		}
+	case part != nil:
+		err = receivePart(str, rd, part, path, offset, meta.Size, c.idle)
+	default:
+		err = receiveFile(str, rd, path, meta.Size, c.idle)
+	}
+	if err != nil {
+		log.Errorf("file from %s failed: %s", from, err)
+		wr.WriteMsg([]byte(err.Error()))
+		str.Reset()
+		return
+	}
+	if err := wr.WriteMsg(nil); err != nil {
+		log.Debugf("can not confirm file: %s", err)
+	}
+	str.Close()
+	c.received(from, meta, path)
+}
+
+// receiveFile writes the chunks to a temporary file next to path, renamed
+// to path once all size bytes arrived. A broken transfer, or one idle for
+// longer than idle, leaves nothing.
+func receiveFile(str network.Stream, rd msgio.Reader, path string, size int64, idle time.Duration) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err := receiveChunks(str, rd, tmp, 0, size, idle); err != nil {
+		return err
+	}
+	return storeFile(tmp, path)
+}
+
+// validTransferID tells whether id can name a part file, transfers that
+// can't resume have none.
+func validTransferID(id string) bool {
+	if id == "" {
+		return true
+	}
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+// openPart opens the part file of transfer id next to path, with the
+// number of bytes it already holds.
+func openPart(path string, id string, size int64) (*os.File, int64, error) {
+	part, err := os.OpenFile(path+"."+id+".part", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+	st, err := part.Stat()
+	if err != nil {
+		part.Close()
+		return nil, 0, err
+	}
+	offset := st.Size()
+	if offset > size {
+		offset = 0
+	}
+	if err := part.Truncate(offset); err != nil {
+		part.Close()
+		return nil, 0, err
+	}
+	if _, err := part.Seek(offset, io.SeekStart); err != nil {
+		part.Close()
+		return nil, 0, err
+	}
+	return part, offset, nil
+}
+
+// sweep deletes the expired part files of the directories received in
+// every so often, until ctx is done.
+func (c *fileService) sweep(ctx context.Context) {
+	interval := c.policy.PartExpiry
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.mux.RLock()
+			dirs := make([]string, 0, len(c.dirs))
+			for dir := range c.dirs {
+				dirs = append(dirs, dir)
+			}
+			c.mux.RUnlock()
+			for _, dir := range dirs {
+				c.sweepDir(dir, now)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sweepDir deletes the part files in dir not written to for longer than
+// PartExpiry and keeps dir for the next sweeps. Only the files named after
+// a transfer ID are ours.
+func (c *fileService) sweepDir(dir string, now time.Time) {
+	c.mux.Lock()
+	c.dirs[dir] = struct{}{}
+	c.mux.Unlock()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Debugf("can not sweep part files in %s: %s", dir, err)
+		return
+	}
+	for _, e := range entries {
+		name := strings.TrimSuffix(e.Name(), ".part")
+		if name == e.Name() || e.IsDir() {
+			continue
+		}
+		if _, err := uuid.Parse(strings.TrimPrefix(filepath.Ext(name), ".")); err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || now.Sub(info.ModTime()) < c.policy.PartExpiry {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			log.Debugf("can not delete expired part file: %s", err)
+		}
+	}
+}
+
+// receivePart appends the chunks to part, which holds offset bytes
+// already, and moves it to path once all size bytes arrived. A broken
+// transfer keeps part for the sender to resume.
+func receivePart(str network.Stream, rd msgio.Reader, part *os.File, path string, offset int64, size int64, idle time.Duration) error {
+	err := receiveChunks(str, rd, part, offset, size, idle)
+	if errors.Is(err, ErrFileSize) {
+		// more than announced, what it holds can't be trusted
+		part.Close()
+		os.Remove(part.Name())
+		return err
+	}
+	if err != nil {
+		part.Sync()
+		part.Close()
+		return err
+	}
+	return storeFile(part, path)
+}
+
+// receiveChunks writes chunks to f until the empty frame, done of the size
+// bytes being there already.
+func receiveChunks(str network.Stream, rd msgio.Reader, f *os.File, done int64, size int64, idle time.Duration) error {
+	for {
+		str.SetDeadline(time.Now().Add(idle))
+		chunk, err := rd.ReadMsg()
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrFileIncomplete, err)
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		done += int64(len(chunk))
+		if done > size {
+			return ErrFileSize
+		}
+		if _, err := f.Write(chunk); err != nil {
+			return err
+		}
+		rd.ReleaseMsg(chunk)
+	}
+	if done != size {
+		return ErrFileIncomplete
+	}
+	return nil
+}
+
+// storeFile syncs f and moves it to path.
+func storeFile(f *os.File, path string) error {
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// queue sends the file r holds to p in the background until p stored it
+// or declined it, and returns the ID the outcome is reported under.
+func (c *fileService) queue(p peer.ID, r io.ReaderAt, meta entity.FileMeta) string {
+	t := &fileTransfer{header: fileHeader{FileMeta: meta, ID: uuid.New().String()}, r: r}
+	c.mux.Lock()
+	c.queued[p] = append(c.queued[p], t)
+	c.mux.Unlock()
+	go c.resume(p)
+	return t.header.ID
+}
+
+// resume sends the transfers queued for p that are not under way, each
+// from where p holds it up to. Those that break stay queued until p
+// connects again.
+func (c *fileService) resume(p peer.ID) {
+	c.mux.Lock()
+	var todo []*fileTransfer
+	for _, t := range c.queued[p] {
+		if t.running {
+			t.again = true
+			continue
+		}
+		t.running = true
+		todo = append(todo, t)
+	}
+	c.mux.Unlock()
+	for _, t := range todo {
+		c.run(p, t)
+	}
+}
+
+func (c *fileService) run(p peer.ID, t *fileTransfer) {
+	from := func(offset int64) io.Reader {
+		return io.NewSectionReader(t.r, offset, t.header.Size-offset)
+	}
+	for {
+		err := c.send(c.ctx, p, t.header, from, nil)
+		// a declined file or one not matching its size won't do better
+		done := err == nil || errors.Is(err, ErrFileRejected) || errors.Is(err, ErrFileSize)
+		c.mux.Lock()
+		again := t.again && !done && c.ctx.Err() == nil
+		t.again = false
+		t.running = again
+		if done {
+			c.dequeue(p, t)
+		}
+		c.mux.Unlock()
+		if done {
+			c.sent(p, t.header.ID, t.header.FileMeta, err)
+			return
+		}
+		log.Debugf("file %s to %s interrupted: %s", t.header.ID, p, err)
+		if !again {
+			return
+		}
+	}
+}
+
+// dequeue forgets t, c.mux must be held.
+func (c *fileService) dequeue(p peer.ID, t *fileTransfer) {
+	ts := c.queued[p]
+	for i := range ts {
+		if ts[i] == t {
+			ts = append(ts[:i], ts[i+1:]...)
+			break
+		}
+	}
+	if len(ts) == 0 {
+		delete(c.queued, p)
+	} else {
+		c.queued[p] = ts
+	}
+}
+
+func (c *fileService) Stop() {
+	c.cancel()
+	c.host.Network().StopNotify((*fileNotifiee)(c))
+	c.host.RemoveStreamHandler(FileID)
+}
+
+// fileNotifiee resumes the transfers queued for peers that connect.
+type fileNotifiee fileService
+
+func (fn *fileNotifiee) Listen(network.Network, ma.Multiaddr)       {}
+func (fn *fileNotifiee) ListenClose(network.Network, ma.Multiaddr)  {}
+func (fn *fileNotifiee) Disconnected(network.Network, network.Conn) {}
+func (fn *fileNotifiee) Connected(n network.Network, conn network.Conn) {
+	c := (*fileService)(fn)
+	p := conn.RemotePeer()
+	c.mux.RLock()
+	_, ok := c.queued[p]
+	c.mux.RUnlock()
+	if ok {
+		go c.resume(p)
+	}
+}
+
+// SendFile streams r to p, announced with meta whose Size must match the
+// bytes r yields. Progress is reported on progress when given, updates a
+// slow reader misses are skipped. It returns once p stored the file, with
+// an ErrFileRejected error when p declined it, or ErrFileIdle when it made
+// no progress for FilePolicy.IdleTimeout.
+func (m *Messenger) SendFile(ctx context.Context, p peer.ID, r io.Reader, meta entity.FileMeta, progress chan<- FileProgress) error {
+	from := func(int64) io.Reader { return r }
+	return m.files.send(ctx, p, fileHeader{FileMeta: meta}, from, progress)
+}
+
+// QueueFile sends the file r holds to p in the background, like a message
+// waiting in the outbox. A transfer that breaks resumes where p left it
+// once p connects again. The outcome is announced with event.EvtFileSent
+// under the ID returned, r must stay readable until then.
+func (m *Messenger) QueueFile(p peer.ID, r io.ReaderAt, meta entity.FileMeta) string {
+	return m.files.queue(p, r, meta)
+}
+
+// HandleFiles accepts files offered by peers through fn, which picks where
+// to store them. Stored files are announced with event.EvtFileReceived.
+// Files are rejected while fn is nil.
+func (m *Messenger) HandleFiles(fn FileHandler) {
+	m.files.handle(fn)
+}
@@ -0,0 +1,513 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// GroupBuffer is the channel capacity of a joined group. Messages that
+// don't fit are dropped rather than holding up the topic.
+const GroupBuffer = 64
+
+// ErrNotJoined is returned for groups that were not joined.
+var ErrNotJoined = errors.New("group not joined")
+
+// ErrMaxRooms is returned when joining a group past Option.MaxRooms.
+var ErrMaxRooms = errors.New("too many groups joined, leave one first")
+
+// ErrNotRoomCreator is returned when setting the metadata of a group
+// another peer created.
+var ErrNotRoomCreator = errors.New("only the group creator sets its metadata")
+
+// GroupMessage is a message published on a group topic.
+type GroupMessage struct {
+	Topic string
+	// From is the peer that published the message
+	From peer.ID
+	Text string
+	At   time.Time
+	// Clock is the Lamport timestamp of the message, a message sent after
+	// another was received has a greater one
+	Clock uint64
+}
+
+// Before tells if m is ordered before o in the room. Messages with the
+// same clock are concurrent and ordered by sender.
+func (m GroupMessage) Before(o GroupMessage) bool {
+	if m.Clock != o.Clock {
+		return m.Clock < o.Clock
+	}
+	return m.From < o.From
+}
+
+// RoomMetadata describes a group. Its creator, the first peer to set it,
+// is the only one who can change it.
+type RoomMetadata struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Avatar is the CID of the group picture.
+	Avatar string `json:"avatar,omitempty"`
+}
+
+// roomMetaUpdate is RoomMetadata signed by the creator of the group, newer
+// versions replace older ones.
+type roomMetaUpdate struct {
+	Topic   string       `json:"topic"`
+	Meta    RoomMetadata `json:"meta"`
+	Version uint64       `json:"version"`
+	Creator peer.ID      `json:"creator"`
+	Sig     []byte       `json:"sig,omitempty"`
+}
+
+// signedData is what the creator signs, the topic included so an update
+// can't be replayed in another group.
+func (u roomMetaUpdate) signedData() ([]byte, error) {
+	u.Sig = nil
+	return json.Marshal(u)
+}
+
+func (u *roomMetaUpdate) sign(key crypto.PrivKey) error {
+	data, err := u.signedData()
+	if err != nil {
+		return err
+	}
+	u.Sig, err = key.Sign(data)
+	return err
+}
+
+func (u roomMetaUpdate) verify(pub crypto.PubKey) bool {
+	data, err := u.signedData()
+	if err != nil {
+		return false
+	}
+	ok, err := pub.Verify(data, u.Sig)
+	return err == nil && ok
+}
+
+// groupFrame is what is published on a group topic. Older clients publish
+// the bare text.
+type groupFrame struct {
+	Text  string          `json:"text,omitempty"`
+	Clock uint64          `json:"clock,omitempty"`
+	Meta  *roomMetaUpdate `json:"meta,omitempty"`
+}
+
+func decodeGroupFrame(data []byte) groupFrame {
+	var f groupFrame
+	if err := json.Unmarshal(data, &f); err != nil {
+		return groupFrame{Text: string(data)}
+	}
+	return f
+}
+
+// RoomSummary is a joined group as listed by the UI.
+type RoomSummary struct {
+	Topic    string
+	Metadata RoomMetadata
+	// Unread counts the messages of others received since the group was
+	// last marked read.
+	Unread int
+	// LastActivity is when the last message of others arrived, zero until
+	// one did.
+	LastActivity time.Time
+}
+
+// GroupPolicy tunes the gossipsub router carrying group messages, e.g. a
+// smaller mesh and slower heartbeats for large rooms on mobile. Zero fields
+// keep the gossipsub defaults.
+type GroupPolicy struct {
+	// HeartbeatInterval paces the mesh upkeep and gossip.
+	HeartbeatInterval time.Duration
+	// MeshDegree is how many peers of a topic messages are pushed to, the
+	// bounds the mesh is kept within follow it.
+	MeshDegree int
+	// HistoryLength is how many heartbeats messages are remembered for,
+	// to answer peers that missed them.
+	HistoryLength int
+}
+
+func (p GroupPolicy) params() pubsub.GossipSubParams {
+	params := pubsub.DefaultGossipSubParams()
+	if p.HeartbeatInterval > 0 {
+		params.HeartbeatInterval = p.HeartbeatInterval
+	}
+	if d := p.MeshDegree; d > 0 {
+		params.D = d
+		params.Dlo = d * pubsub.GossipSubDlo / pubsub.GossipSubD
+		if params.Dlo < 1 {
+			params.Dlo = 1
+		}
+		params.Dhi = d * pubsub.GossipSubDhi / pubsub.GossipSubD
+		params.Dscore = d * pubsub.GossipSubDscore / pubsub.GossipSubD
+		// outbound peers must leave room in the mesh for inbound ones
+		params.Dout = d / 2
+		if params.Dout >= params.Dlo {
+			params.Dout = params.Dlo - 1
+		}
+	}
+	if h := p.HistoryLength; h > 0 {
+		params.HistoryLength = h
+		// gossip can only tell about messages still remembered
+		if params.HistoryGossip > h {
+			params.HistoryGossip = h
+		}
+	}
+	return params
+}
+
+// group is a joined topic and the subscription feeding its channel.
+type group struct {
+	topic *pubsub.Topic
+	sub   *pubsub.Subscription
+	out   chan GroupMessage
+	done  chan struct{}
+	// events tell when peers join the topic, to announce the metadata to
+	// them, until cancel
+	events *pubsub.TopicEventHandler
+	cancel context.CancelFunc
+	// guarded by the groups mux
+	unread int
+	last   time.Time
+	// clock is the Lamport clock of the group
+	clock uint64
+	// meta is the latest metadata update, nil until one was seen
+	meta *roomMetaUpdate
+}
+
+// groups tracks the topics joined over gossipsub.
+type groups struct {
+	mux    sync.Mutex
+	ps     *pubsub.PubSub
+	host   host.Host
+	self   peer.ID
+	ctx    context.Context
+	cancel context.CancelFunc
+	joined map[string]*group
+	// max bounds the groups joined, zero doesn't bound them
+	max int
+	// heartbeat is how often the gossipsub mesh is maintained
+	heartbeat time.Duration
+}
+
+func newGroups(h host.Host, policy GroupPolicy, max int) (*groups, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	params := policy.params()
+	ps, err := pubsub.NewGossipSub(ctx, h, pubsub.WithGossipSubParams(params))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &groups{
+		ps:        ps,
+		host:      h,
+		self:      h.ID(),
+		ctx:       ctx,
+		cancel:    cancel,
+		joined:    make(map[string]*group),
+		max:       max,
+		heartbeat: params.HeartbeatInterval,
+	}, nil
+}
+
+// join subscribes to topic, joining it again yields the same channel.
+func (g *groups) join(topic string) (<-chan GroupMessage, error) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if gr, ok := g.joined[topic]; ok {
+		return gr.out, nil
+	}
+	if g.max > 0 && len(g.joined) >= g.max {
+		return nil, ErrMaxRooms
+	}
+	t, err := g.ps.Join(topic)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := t.Subscribe()
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	events, err := t.EventHandler()
+	if err != nil {
+		sub.Cancel()
+		t.Close()
+		return nil, err
+	}
+	gr := &group{
+		topic:  t,
+		sub:    sub,
+		out:    make(chan GroupMessage, GroupBuffer),
+		done:   make(chan struct{}),
+		events: events,
+	}
+	var ctx context.Context
+	ctx, gr.cancel = context.WithCancel(g.ctx)
+	g.joined[topic] = gr
+	go g.read(topic, gr)
+	go g.announce(ctx, gr)
+	return gr.out, nil
+}
+
+// announce publishes the metadata of a group created by the node again to
+// every peer joining it, so they learn it without waiting for a change.
+func (g *groups) announce(ctx context.Context, gr *group) {
+	for {
+		evt, err := gr.events.NextPeerEvent(ctx)
+		if err != nil {
+			return
+		}
+		if evt.Type != pubsub.PeerJoin {
+			continue
+		}
+		// messages only go to the mesh, which takes the peer in on a
+		// heartbeat
+		select {
+		case <-time.After(2 * g.heartbeat):
+		case <-ctx.Done():
+			return
+		}
+		g.mux.Lock()
+		meta := gr.meta
+		g.mux.Unlock()
+		if meta == nil || meta.Creator != g.self {
+			continue
+		}
+		if err := publishFrame(ctx, gr.topic, groupFrame{Meta: meta}); err != nil {
+			log.Debugf("can not announce group metadata: %s", err)
+		}
+	}
+}
+
+func publishFrame(ctx context.Context, t *pubsub.Topic, f groupFrame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return t.Publish(ctx, data)
+}
+
+// read forwards the messages of others until the subscription ends.
+func (g *groups) read(topic string, gr *group) {
+	defer close(gr.done)
+	defer close(gr.out)
+	for {
+		msg, err := gr.sub.Next(g.ctx)
+		if err != nil {
+			return
+		}
+		if msg.GetFrom() == g.self {
+			continue
+		}
+		f := decodeGroupFrame(msg.GetData())
+		if f.Meta != nil {
+			g.updateMeta(topic, gr, *f.Meta)
+			continue
+		}
+		at := time.Now()
+		g.mux.Lock()
+		gr.unread++
+		gr.last = at
+		if f.Clock > gr.clock {
+			gr.clock = f.Clock
+		}
+		g.mux.Unlock()
+		select {
+		case gr.out <- GroupMessage{Topic: topic, From: msg.GetFrom(), Text: f.Text, At: at, Clock: f.Clock}:
+		default:
+			log.Warnf("group message dropped, subscriber is too slow")
+		}
+	}
+}
+
+// leave cancels the subscription to topic and closes its channel.
+func (g *groups) leave(topic string) error {
+	g.mux.Lock()
+	gr, ok := g.joined[topic]
+	delete(g.joined, topic)
+	g.mux.Unlock()
+	if !ok {
+		return ErrNotJoined
+	}
+	gr.cancel()
+	gr.events.Cancel()
+	gr.sub.Cancel()
+	<-gr.done
+	return gr.topic.Close()
+}
+
+// updateMeta keeps u when the group creator signed it and it is newer than
+// the metadata known. The first signer seen is the creator.
+func (g *groups) updateMeta(topic string, gr *group, u roomMetaUpdate) {
+	if u.Topic != topic {
+		return
+	}
+	pub := g.host.Peerstore().PubKey(u.Creator)
+	if pub == nil || !u.verify(pub) {
+		log.Debugf("group metadata with a bad signature from %s dropped", logID(u.Creator))
+		return
+	}
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if gr.meta != nil && (gr.meta.Creator != u.Creator || gr.meta.Version >= u.Version) {
+		return
+	}
+	gr.meta = &u
+}
+
+// setMeta signs meta as the creator of topic and publishes it.
+func (g *groups) setMeta(ctx context.Context, topic string, meta RoomMetadata) error {
+	g.mux.Lock()
+	gr, ok := g.joined[topic]
+	if !ok {
+		g.mux.Unlock()
+		return ErrNotJoined
+	}
+	u := &roomMetaUpdate{Topic: topic, Meta: meta, Creator: g.self, Version: uint64(time.Now().UnixNano())}
+	if gr.meta != nil {
+		if gr.meta.Creator != g.self {
+			g.mux.Unlock()
+			return ErrNotRoomCreator
+		}
+		if u.Version <= gr.meta.Version {
+			u.Version = gr.meta.Version + 1
+		}
+	}
+	if err := u.sign(g.host.Peerstore().PrivKey(g.self)); err != nil {
+		g.mux.Unlock()
+		return err
+	}
+	gr.meta = u
+	g.mux.Unlock()
+	return publishFrame(ctx, gr.topic, groupFrame{Meta: u})
+}
+
+// meta is the metadata of the joined topic, zero until its creator set it.
+func (g *groups) meta(topic string) (RoomMetadata, error) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	gr, ok := g.joined[topic]
+	if !ok {
+		return RoomMetadata{}, ErrNotJoined
+	}
+	if gr.meta == nil {
+		return RoomMetadata{}, nil
+	}
+	return gr.meta.Meta, nil
+}
+
+// rooms summarizes the joined groups, most recently active first.
+func (g *groups) rooms() []RoomSummary {
+	g.mux.Lock()
+	res := make([]RoomSummary, 0, len(g.joined))
+	for topic, gr := range g.joined {
+		sum := RoomSummary{Topic: topic, Unread: gr.unread, LastActivity: gr.last}
+		if gr.meta != nil {
+			sum.Metadata = gr.meta.Meta
+		}
+		res = append(res, sum)
+	}
+	g.mux.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].LastActivity.Equal(res[j].LastActivity) {
+			return res[i].LastActivity.After(res[j].LastActivity)
+		}
+		return res[i].Topic < res[j].Topic
+	})
+	return res
+}
+
+// markRead resets the unread count of topic.
+func (g *groups) markRead(topic string) error {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	gr, ok := g.joined[topic]
+	if !ok {
+		return ErrNotJoined
+	}
+	gr.unread = 0
+	return nil
+}
+
+func (g *groups) publish(ctx context.Context, topic string, text string) error {
+	g.mux.Lock()
+	gr, ok := g.joined[topic]
+	if !ok {
+		g.mux.Unlock()
+		return ErrNotJoined
+	}
+	gr.clock++
+	clock := gr.clock
+	g.mux.Unlock()
+	return publishFrame(ctx, gr.topic, groupFrame{Text: text, Clock: clock})
+}
+
+// stop leaves every group and shuts gossipsub down.
+func (g *groups) stop() {
+	g.mux.Lock()
+	topics := make([]string, 0, len(g.joined))
+	for topic := range g.joined {
+		topics = append(topics, topic)
+	}
+	g.mux.Unlock()
+	for _, topic := range topics {
+		if err := g.leave(topic); err != nil {
+			log.Debugf("can not leave group %s: %s", topic, err)
+		}
+	}
+	g.cancel()
+}
+
+// JoinGroup subscribes to the group room topic. Messages published there by
+// others arrive on the returned channel, joining again returns the same one.
+// Past Option.MaxRooms it fails with ErrMaxRooms.
+func (m *Messenger) JoinGroup(topic string) (<-chan GroupMessage, error) {
+	return m.groups.join(topic)
+}
+
+// LeaveGroup unsubscribes from topic and closes its channel.
+func (m *Messenger) LeaveGroup(topic string) error {
+	return m.groups.leave(topic)
+}
+
+// Rooms lists the joined groups with their unread counts, most recently
+// active first.
+func (m *Messenger) Rooms() []RoomSummary {
+	return m.groups.rooms()
+}
+
+// MarkRoomRead resets the unread count of the joined group topic.
+func (m *Messenger) MarkRoomRead(topic string) error {
+	return m.groups.markRead(topic)
+}
+
+// SetRoomMetadata signs meta and shares it with the members of the joined
+// group topic. The first peer to set it is taken as the group creator by
+// everyone, the others get ErrNotRoomCreator.
+func (m *Messenger) SetRoomMetadata(topic string, meta RoomMetadata) error {
+	ctx, cancel := context.WithTimeout(context.Background(), StreamTimeout)
+	defer cancel()
+	return m.groups.setMeta(ctx, topic, meta)
+}
+
+// RoomMetadata is the metadata of the joined group topic, zero until its
+// creator set it.
+func (m *Messenger) RoomMetadata(topic string) (RoomMetadata, error) {
+	return m.groups.meta(topic)
+}
+
+// Publish sends text to the members of the joined group topic.
+func (m *Messenger) Publish(topic string, text string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), StreamTimeout)
+	defer cancel()
+	return m.groups.publish(ctx, topic, text)
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/hood-chat/core/event"
+	"github.com/libp2p/go-libp2p/core/peer"
+	bf "github.com/libp2p/go-libp2p/p2p/discovery/backoff"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// HolePunchPolicy paces hole punching to peers it keeps failing for.
+type HolePunchPolicy struct {
+	// Backoff paces hole punches after a failed one, nil uses the default
+	// backoff.
+	Backoff bf.BackoffFactory
+	// RelayOnlyAfter is the number of failed hole punches in a row after
+	// which a peer is only reached through relays, zero keeps trying.
+	RelayOnlyAfter int
+}
+
+var _ holepunch.EventTracer = (*punchBackoff)(nil)
+var _ holepunch.AddrFilter = (*punchBackoff)(nil)
+
+type punchState struct {
+	failures int
+	nextTry  time.Time
+	strat    bf.BackoffStrategy
+}
+
+// punchBackoff traces hole punch outcomes and, as address filter, holds
+// off hole punches to a peer while it backs off. With no addresses to
+// exchange the hole punch is aborted and the relayed connection stays.
+type punchBackoff struct {
+	mux            sync.Mutex
+	bfk            bf.BackoffFactory
+	relayOnlyAfter int
+	peers          map[peer.ID]*punchState
+	now            func() time.Time
+	// report is told when hole punches start and end, may be nil
+	report func(event.EvtHolePunch)
+}
+
+func newPunchBackoff(policy HolePunchPolicy, report func(event.EvtHolePunch)) *punchBackoff {
+	b := &punchBackoff{
+		bfk:            policy.Backoff,
+		relayOnlyAfter: policy.RelayOnlyAfter,
+		peers:          make(map[peer.ID]*punchState),
+		now:            time.Now,
+		report:         report,
+	}
+	if b.bfk == nil {
+		b.bfk = bf.NewExponentialBackoff(time.Minute, time.Hour, bf.NoJitter, time.Minute, 2, 0, rand.NewSource(0))
+	}
+	return b
+}
+
+func (b *punchBackoff) Trace(evt *holepunch.Event) {
+	switch evt.Type {
+	case holepunch.StartHolePunchEvtT:
+		b.reportOutcome(event.EvtHolePunch{ID: evt.Remote, Outcome: event.HolePunchStarted})
+	case holepunch.EndHolePunchEvtT:
+		end, ok := evt.Evt.(*holepunch.EndHolePunchEvt)
+		if !ok {
+			return
+		}
+		if end.Success {
+			b.succeeded(evt.Remote)
+			b.reportOutcome(event.EvtHolePunch{ID: evt.Remote, Outcome: event.HolePunchSucceeded})
+			return
+		}
+		b.failed(evt.Remote)
+		b.reportOutcome(event.EvtHolePunch{ID: evt.Remote, Outcome: event.HolePunchFailed, Error: end.Error})
+	}
+}
+
+func (b *punchBackoff) reportOutcome(e event.EvtHolePunch) {
+	if b.report != nil {
+		b.report(e)
+	}
+}
+
+func (b *punchBackoff) succeeded(p peer.ID) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	delete(b.peers, p)
+}
+
+func (b *punchBackoff) failed(p peer.ID) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	st, ok := b.peers[p]
+	if !ok {
+		st = &punchState{strat: b.bfk()}
+		b.peers[p] = st
+	}
+	st.failures++
+	st.nextTry = b.now().Add(st.strat.Delay())
+	if b.relayOnly(st) {
+		log.Infof("hole punching %s failed %d times, using relays only", logID(p), st.failures)
+	}
+}
+
+func (b *punchBackoff) relayOnly(st *punchState) bool {
+	return b.relayOnlyAfter > 0 && st.failures >= b.relayOnlyAfter
+}
+
+// RelayOnly reports whether hole punching p was given up on.
+func (b *punchBackoff) RelayOnly(p peer.ID) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	st, ok := b.peers[p]
+	return ok && b.relayOnly(st)
+}
+
+// allowed reports whether p may be hole punched now.
+func (b *punchBackoff) allowed(p peer.ID) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	st, ok := b.peers[p]
+	if !ok {
+		return true
+	}
+	return !b.relayOnly(st) && !b.now().Before(st.nextTry)
+}
+
+func (b *punchBackoff) FilterLocal(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+	if !b.allowed(p) {
+		return nil
+	}
+	return addrs
+}
+
+func (b *punchBackoff) FilterRemote(p peer.ID, addrs []ma.Multiaddr) []ma.Multiaddr {
+	return b.FilterLocal(p, addrs)
+}
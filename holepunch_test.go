@@ -0,0 +1,81 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hood-chat/core/event"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHolePunchBackoff(t *testing.T) {
+	now := time.Now()
+	b := newPunchBackoff(HolePunchPolicy{RelayOnlyAfter: 3}, nil)
+	b.now = func() time.Time { return now }
+	p := getPeers(1)[0].ID
+	addrs := []ma.Multiaddr{ma.StringCast("/ip4/1.2.3.4/udp/4001/quic-v1")}
+	end := func(err error) {
+		evt := &holepunch.EndHolePunchEvt{Success: err == nil}
+		b.Trace(&holepunch.Event{Remote: p, Type: holepunch.EndHolePunchEvtT, Evt: evt})
+	}
+	// how long after now the peer is held off
+	heldOff := func() time.Duration {
+		start := now
+		for !b.allowed(p) {
+			now = now.Add(time.Second)
+		}
+		d := now.Sub(start)
+		require.Equal(t, addrs, b.FilterLocal(p, addrs))
+		return d
+	}
+
+	require.Equal(t, addrs, b.FilterRemote(p, addrs))
+	end(errors.New("punch failed"))
+	require.Empty(t, b.FilterLocal(p, addrs))
+	require.Empty(t, b.FilterRemote(p, addrs))
+	first := heldOff()
+	end(errors.New("punch failed"))
+	require.Greater(t, heldOff(), first)
+
+	end(errors.New("punch failed"))
+	require.True(t, b.RelayOnly(p))
+	now = now.Add(24 * time.Hour)
+	require.Empty(t, b.FilterLocal(p, addrs))
+
+	// a successful punch from the other side starts over
+	end(nil)
+	require.False(t, b.RelayOnly(p))
+	require.Equal(t, addrs, b.FilterLocal(p, addrs))
+}
+
+func TestHolePunchEvents(t *testing.T) {
+	m, err := MessengerBuilder(t.TempDir()+"/h1", Option{HolePunching: true}, routedBuilder{})
+	require.NoError(t, err)
+	_, err = m.SignUp("h1")
+	require.NoError(t, err)
+	defer m.Stop()
+	sub, err := m.EventBus().Subscribe(new(event.EvtHolePunch))
+	require.NoError(t, err)
+	defer sub.Close()
+	next := func() event.EvtHolePunch {
+		select {
+		case e := <-sub.Out():
+			return e.(event.EvtHolePunch)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no hole punch event")
+		}
+		return event.EvtHolePunch{}
+	}
+
+	p := getPeers(1)[0].ID
+	m.punch.Trace(&holepunch.Event{Remote: p, Type: holepunch.StartHolePunchEvtT, Evt: &holepunch.StartHolePunchEvt{}})
+	require.Equal(t, event.EvtHolePunch{ID: p, Outcome: event.HolePunchStarted}, next())
+	m.punch.Trace(&holepunch.Event{Remote: p, Type: holepunch.EndHolePunchEvtT, Evt: &holepunch.EndHolePunchEvt{Success: true}})
+	require.Equal(t, event.EvtHolePunch{ID: p, Outcome: event.HolePunchSucceeded}, next())
+	evt := &holepunch.EndHolePunchEvt{Error: "punch failed"}
+	m.punch.Trace(&holepunch.Event{Remote: p, Type: holepunch.EndHolePunchEvtT, Evt: evt})
+	require.Equal(t, event.EvtHolePunch{ID: p, Outcome: event.HolePunchFailed, Error: "punch failed"}, next())
+}
@@ -2,20 +2,34 @@ package core
 
 import (
 	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
 
 	"github.com/hood-chat/core/entity"
+	"github.com/hood-chat/core/store"
+	"github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
 	dsync "github.com/ipfs/go-datastore/sync"
 	libp2p "github.com/libp2p/go-libp2p"
+	ic "github.com/libp2p/go-libp2p/core/crypto"
 	host "github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
 
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/p2p/host/autorelay"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 	rh "github.com/libp2p/go-libp2p/p2p/host/routed"
+	noise "github.com/libp2p/go-libp2p/p2p/security/noise"
+	tls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-libp2p/p2p/transport/websocket"
 
-	"github.com/ipfs/kubo/core/bootstrap"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
@@ -35,10 +49,128 @@ type HostBuilder interface {
 type Option struct {
 	LpOpt []libp2p.Option
 	ID    peer.ID
+	// RequestFirst holds messages from unknown peers as pending requests
+	// instead of adding the sender as a contact right away.
+	RequestFirst bool
+	// Protocols are the message protocols to offer, most preferred first.
+	// DefaultProtocols is used when empty.
+	Protocols []protocol.ID
+	// ProtocolLimits caps streams and memory per protocol, so a flood on
+	// one protocol can't starve the others. Applied on top of the libp2p
+	// default limits.
+	ProtocolLimits map[protocol.ID]rcmgr.BaseLimit
+	// OnUnknownProtocol handles streams for chat protocols this node does
+	// not speak. Nil answers with a pb.Unsupported frame and closes.
+	OnUnknownProtocol network.StreamHandler
+	// Outbox bounds how long and how often undelivered messages are
+	// retried.
+	Outbox OutboxPolicy
+	// Inbound caps the size of incoming messages and how often a peer may
+	// send them. The zero value uses the defaults, which never block.
+	Inbound InboundPolicy
+	// FrameMagic opens the streams of the ID and JSONID protocols. Nil uses
+	// DefaultFrameMagic, an empty one skips the check. Peers only talk
+	// when theirs match.
+	FrameMagic []byte
+	// Files bounds file transfers.
+	Files FilePolicy
+	// FavoriteRetry bounds reconnection attempts to favorite peers.
+	FavoriteRetry RetryPolicy
+	// DisableDHT skips the DHT and bootstrap, peers are then only reached
+	// through explicit addresses and relays.
+	DisableDHT bool
+	// DHTDatastore keeps the DHT records, it stays open when the host
+	// closes. Nil opens one at DHTDatastorePath, or keeps the records in
+	// memory when that is empty too.
+	DHTDatastore ds.Batching
+	// DHTDatastorePath is where the DHT records persist across restarts.
+	// MessengerBuilder defaults it to the dht directory of the repo.
+	DHTDatastorePath string
+	// BootstrapPeers are dialed to join the DHT instead of BootstrapNodes,
+	// append them to DefaultBootstrapPeers to keep those too. Empty uses
+	// BootstrapNodes.
+	BootstrapPeers []peer.AddrInfo
+	// MDNS finds and connects peers on the local network, announcing under
+	// MDNSServiceTag, so they meet without the internet. DefaultOption
+	// enables it.
+	MDNS bool
+	// MDNSServiceTag keeps deployments apart on a shared network. Empty
+	// uses the package MDNSServiceTag.
+	MDNSServiceTag string
+	// DHTMode runs the DHT as client, server or switching between them as
+	// reachability changes. The zero value is dht.ModeAuto.
+	DHTMode dht.ModeOpt
+	// ProfileRefresh is how often profiles of connected contacts are
+	// fetched again to pick up name changes. Zero disables refreshing.
+	ProfileRefresh time.Duration
+	// AttachmentThreshold is the text length, in bytes, above which a
+	// message is sent as an attachment fetched by CID, keeping frames
+	// small. Zero sends every text inline.
+	AttachmentThreshold int
+	// Attachments keeps the attachments sent and received. Nil keeps them
+	// in the datastore of the repo.
+	Attachments AttachmentStore
+	// ProfilePush accepts profile updates contacts push when they change,
+	// so names update without waiting for a refresh.
+	ProfilePush bool
+	// TypingInterval is how often a contact is told again that we are
+	// still typing. Zero uses TypingInterval.
+	TypingInterval time.Duration
+	// Presence announces the node's presence to connected contacts and
+	// tracks theirs, paced by PresencePolicy. DefaultOption enables it.
+	Presence       bool
+	PresencePolicy PresencePolicy
+	// Group tunes gossipsub for group chats, the zero value keeps its
+	// defaults.
+	Group GroupPolicy
+	// MaxRooms bounds the groups joined at once, zero doesn't bound them.
+	MaxRooms int
+	// ListenAddrs are the multiaddrs to listen on. Empty uses the ones
+	// saved by the last start, or the libp2p defaults on the first one.
+	ListenAddrs []string
+	// QUICOnly drops the TCP and websocket transports. Without ListenAddrs
+	// the node then listens on QUICListenAddrs.
+	QUICOnly bool
+	// Security are the security transports offered on TCP and websocket
+	// connections, SecurityNoise or SecurityTLS, most preferred first.
+	// Empty offers both. QUIC always secures with TLS 1.3, so it is only
+	// enabled when SecurityTLS is offered.
+	Security []string
+	// HolePunching upgrades relayed connections to direct ones, paced by
+	// HolePunchPolicy. DefaultOption enables it.
+	HolePunching    bool
+	HolePunchPolicy HolePunchPolicy
+	// Relays are the static relays to reserve slots with while the node
+	// is not reachable. DefaultOption uses the bootstrap nodes.
+	Relays []peer.AddrInfo
+	// TrustedPeers, when not empty, are the only peers relay slots are
+	// reserved with and bootstrap dials, e.g. the user's own relays.
+	// Relays and bootstrap nodes outside it are never used.
+	TrustedPeers []peer.ID
+	// Bootstrap sets how many connections the DHT keeps up and how many
+	// bootstrap peers it dials at once to get there.
+	Bootstrap BootstrapConfig
+	// Passphrase encrypts the identity key at sign up and decrypts it on
+	// start. Empty keeps the key unencrypted, as repos made before it.
+	Passphrase string
+	// IdentityKey picks the algorithm and size of the key made at sign
+	// up, Ed25519 when zero. Identities already made keep their key.
+	IdentityKey entity.KeyOption
+	// CacheIdentityKey keeps the decoded identity key in memory until the
+	// node closes, so restarts skip decoding it again. DefaultOption
+	// enables it.
+	CacheIdentityKey bool
+	keys             *keyCache
 }
 
 func (opt *Option) SetIdentity(identity *entity.Identity) error {
-	sk, err := identity.DecodePrivateKey("passphrase todo!")
+	var sk ic.PrivKey
+	var err error
+	if opt.keys != nil {
+		sk, err = opt.keys.get(identity, opt.Passphrase)
+	} else {
+		sk, err = identity.DecodePrivateKey(opt.Passphrase)
+	}
 	if err != nil {
 		return err
 	}
@@ -47,35 +179,446 @@ func (opt *Option) SetIdentity(identity *entity.Identity) error {
 	return nil
 }
 
-func DefaultOption() Option {
+// keyCache holds the identity key once decoded, for the identity and
+// passphrase it was decoded with.
+type keyCache struct {
+	mux        sync.Mutex
+	id         entity.ID
+	passphrase string
+	sk         ic.PrivKey
+}
+
+func (c *keyCache) get(identity *entity.Identity, passphrase string) (ic.PrivKey, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.sk != nil && c.id == identity.ID && c.passphrase == passphrase {
+		return c.sk, nil
+	}
+	sk, err := identity.DecodePrivateKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	c.id, c.passphrase, c.sk = identity.ID, passphrase, sk
+	return sk, nil
+}
+
+func (c *keyCache) clear() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.id, c.passphrase, c.sk = "", "", nil
+}
+
+// dhtDatastore is the DHT datastore to use, with the closer of the one
+// opened at DHTDatastorePath.
+func (opt *Option) dhtDatastore() (ds.Batching, io.Closer, error) {
+	if opt.DHTDatastore != nil {
+		return opt.DHTDatastore, nil, nil
+	}
+	if opt.DHTDatastorePath != "" {
+		d, err := store.NewDatastore(opt.DHTDatastorePath)
+		if err != nil {
+			return nil, nil, err
+		}
+		return d, d, nil
+	}
+	return dsync.MutexWrap(ds.NewMapDatastore()), nil, nil
+}
+
+// QUICListenAddrs are listened on in QUICOnly mode when no ListenAddrs are
+// given.
+var QUICListenAddrs = []string{
+	"/ip4/0.0.0.0/udp/0/quic",
+	"/ip4/0.0.0.0/udp/0/quic-v1",
+	"/ip6/::/udp/0/quic",
+	"/ip6/::/udp/0/quic-v1",
+}
+
+// listenOptions sets the transports and listen addresses. With neither
+// set, libp2p falls back to its default transports and addresses.
+func (opt *Option) listenOptions() []libp2p.Option {
+	var lpOpt []libp2p.Option
+	addrs := opt.ListenAddrs
+	if opt.QUICOnly {
+		lpOpt = append(lpOpt, libp2p.Transport(quic.NewTransport))
+		if len(addrs) == 0 {
+			addrs = QUICListenAddrs
+		}
+	}
+	if len(addrs) > 0 {
+		lpOpt = append(lpOpt, libp2p.ListenAddrStrings(addrs...))
+	}
+	return lpOpt
+}
+
+// Security transports for Option.Security.
+const (
+	SecurityNoise = "noise"
+	SecurityTLS   = "tls"
+)
+
+var (
+	// ErrSecurity is returned when Option.Security names an unknown
+	// transport.
+	ErrSecurity = errors.New("unknown security transport")
+	// ErrSecurityQUIC is returned when QUICOnly is set but Option.Security
+	// doesn't offer TLS, which QUIC can't do without.
+	ErrSecurityQUIC = errors.New("QUIC needs the tls security transport")
+)
+
+// securityOptions offers the Security transports, nil leaves libp2p to
+// offer its defaults. Without TLS it also drops QUIC, which would secure
+// connections with TLS anyway.
+func (opt *Option) securityOptions() ([]libp2p.Option, error) {
+	var lpOpt []libp2p.Option
+	withTLS := len(opt.Security) == 0
+	for _, name := range opt.Security {
+		switch name {
+		case SecurityNoise:
+			lpOpt = append(lpOpt, libp2p.Security(noise.ID, noise.New))
+		case SecurityTLS:
+			lpOpt = append(lpOpt, libp2p.Security(tls.ID, tls.New))
+			withTLS = true
+		default:
+			return nil, ErrSecurity
+		}
+	}
+	if !withTLS {
+		if opt.QUICOnly {
+			return nil, ErrSecurityQUIC
+		}
+		lpOpt = append(lpOpt,
+			libp2p.Transport(tcp.NewTCPTransport),
+			libp2p.Transport(websocket.New))
+	}
+	return lpOpt, nil
+}
+
+// relayOptions reserves slots with the trusted Relays, relaying stays off
+// when none are left.
+func (opt *Option) relayOptions() []libp2p.Option {
+	relays := opt.trustedOnly(opt.Relays)
+	if len(relays) == 0 {
+		return nil
+	}
+	return []libp2p.Option{libp2p.EnableAutoRelay(autorelay.WithStaticRelays(relays))}
+}
+
+// bootstrapPeers are the trusted BootstrapPeers, or DefaultBootstrapPeers.
+func (opt *Option) bootstrapPeers() ([]peer.AddrInfo, error) {
+	bts := opt.BootstrapPeers
+	if len(bts) == 0 {
+		var err error
+		bts, err = DefaultBootstrapPeers()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return opt.trustedOnly(bts), nil
+}
+
+// trustedOnly keeps the peers in TrustedPeers, all of them when no peers
+// are trusted.
+func (opt *Option) trustedOnly(pis []peer.AddrInfo) []peer.AddrInfo {
+	if len(opt.TrustedPeers) == 0 {
+		return pis
+	}
+	var res []peer.AddrInfo
+	for _, pi := range pis {
+		for _, id := range opt.TrustedPeers {
+			if pi.ID == id {
+				res = append(res, pi)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// resourceManager builds a resource manager enforcing ProtocolLimits.
+func (opt *Option) resourceManager() (network.ResourceManager, error) {
+	limits := rcmgr.DefaultLimits
+	libp2p.SetDefaultServiceLimits(&limits)
+	for proto, l := range opt.ProtocolLimits {
+		limits.AddProtocolLimit(proto, l, rcmgr.BaseLimitIncrease{})
+	}
+	return rcmgr.NewResourceManager(rcmgr.NewFixedLimiter(limits.AutoScale()))
+}
+
+// ErrConnLimits is returned when the connection manager low watermark is
+// above the high one.
+var ErrConnLimits = errors.New("connection low watermark above high watermark")
+
+// ConnLimits are the connection manager watermarks. Once more than High
+// connections are open, the oldest are trimmed down to Low; connections
+// younger than Grace are left alone.
+type ConnLimits struct {
+	Low   int
+	High  int
+	Grace time.Duration
+}
+
+var DefaultConnLimits = ConnLimits{Low: 10, High: 100, Grace: time.Minute}
+
+func DefaultOption() (Option, error) {
+	return OptionWithLimits(DefaultConnLimits)
+}
+
+// OptionWithLimits is DefaultOption with its own connection manager
+// watermarks.
+func OptionWithLimits(limits ConnLimits) (Option, error) {
+	if limits.Low > limits.High {
+		return Option{}, ErrConnLimits
+	}
 	bts, err := ParseBootstrapPeers(BootstrapNodes)
 	if err != nil {
-		panic(err)
+		return Option{}, err
 	}
-	con, err := connmgr.NewConnManager(10, 100)
+	con, err := connmgr.NewConnManager(limits.Low, limits.High, connmgr.WithGracePeriod(limits.Grace))
 	if err != nil {
-		panic(err)
+		return Option{}, err
 	}
 
+	// transports and listen addresses are left to Option.ListenAddrs and
+	// Option.QUICOnly, libp2p defaults them when unset
+	// so are security transports, see Option.Security
 	opt := []libp2p.Option{
-		libp2p.DefaultTransports,
-		libp2p.DefaultSecurity,
-		libp2p.DefaultListenAddrs,
 		libp2p.ConnectionManager(con),
-		libp2p.EnableAutoRelay(autorelay.WithStaticRelays(bts)),
 		libp2p.EnableNATService(),
-		libp2p.EnableHolePunching(),
 	}
 	return Option{
-		LpOpt: opt,
-		ID:    "",
+		LpOpt:            opt,
+		ID:               "",
+		Relays:           bts,
+		HolePunching:     true,
+		MDNS:             true,
+		Presence:         true,
+		CacheIdentityKey: true,
+	}, nil
+}
+
+// Routed is implemented by hosts that route through a DHT.
+type Routed interface {
+	DHT() *dht.IpfsDHT
+	// ResetDHT throws the DHT and its routing table away and rejoins the
+	// network with a fresh one, keeping the host, its connections and the
+	// stored records.
+	ResetDHT(ctx context.Context) error
+}
+
+// bootstrapTuner is implemented by hosts whose bootstrap threshold can
+// change while running.
+type bootstrapTuner interface {
+	SetBootstrapMinPeers(n int)
+}
+
+// bootstrapStater is implemented by hosts that bootstrap, to tell how far
+// along they are.
+type bootstrapStater interface {
+	BootstrapState() BootstrapState
+}
+
+// addrSignaler is implemented by hosts that can be told the network
+// interfaces changed.
+type addrSignaler interface {
+	SignalAddressChange()
+}
+
+// dhtBuilder makes a DHT for a host within ctx, along with whatever keeps
+// it bootstrapped.
+type dhtBuilder func(ctx context.Context, h host.Host) (*dht.IpfsDHT, io.Closer, error)
+
+// dhtBootstrap joins a DHT to the network within ctx and keeps it joined
+// until closed.
+type dhtBootstrap func(ctx context.Context, h host.Host, kDht *dht.IpfsDHT) (io.Closer, error)
+
+// Bootstrapper is implemented by hosts that join the network through
+// bootstrap peers. Hosts from DefaultRoutedHost.NewNode join only once
+// Bootstrap is called, so protocol handlers can be set before any peer
+// connects.
+type Bootstrapper interface {
+	Bootstrap(ctx context.Context) error
+}
+
+type routedHost struct {
+	*rh.RoutedHost
+	basic host.Host
+	build dhtBuilder
+	// bootstrap joins the DHTs built, nil without bootstrap
+	bootstrap dhtBootstrap
+
+	mux  sync.RWMutex
+	dht  *dht.IpfsDHT
+	boot io.Closer
+	// dstore closes the DHT datastore the host opened, nil otherwise
+	dstore io.Closer
+	// limits tune the bootstrap of every DHT built, nil without bootstrap
+	limits *bootstrapLimits
+}
+
+func newRoutedHost(ctx context.Context, h host.Host, build dhtBuilder) (*routedHost, error) {
+	r := &routedHost{basic: h, build: build}
+	var err error
+	r.dht, r.boot, err = build(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	r.RoutedHost = rh.Wrap(h, currentDHT{r})
+	return r, nil
+}
+
+func (r *routedHost) DHT() *dht.IpfsDHT {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.dht
+}
+
+// Bootstrap joins the DHT to the network within ctx and keeps it joined
+// until the host closes. Calling it again restarts the bootstrap.
+func (r *routedHost) Bootstrap(ctx context.Context) error {
+	if r.bootstrap == nil {
+		return nil
+	}
+	// the DHT stays usable while the first round dials
+	kDht := r.DHT()
+	boot, err := r.bootstrap(ctx, r.basic, kDht)
+	if err != nil {
+		return err
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.boot != nil {
+		r.boot.Close()
+	}
+	r.boot = boot
+	return nil
+}
+
+func (r *routedHost) ResetDHT(ctx context.Context) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	// a host not bootstrapped yet leaves it to Bootstrap
+	booted := r.boot != nil
+	if r.boot != nil {
+		r.boot.Close()
+		r.boot = nil
+	}
+	// closing first releases the DHT protocol handlers for the new one
+	if err := r.dht.Close(); err != nil {
+		log.Errorf("closing dht failed: %s", err)
+	}
+	kDht, boot, err := r.build(ctx, r.basic)
+	if err != nil {
+		return err
+	}
+	r.dht, r.boot = kDht, boot
+	if booted && r.bootstrap != nil {
+		if r.boot, err = r.bootstrap(ctx, r.basic, kDht); err != nil {
+			return err
+		}
+	}
+	return kDht.Bootstrap(ctx)
+}
+
+// SetBootstrapMinPeers changes the bootstrap threshold from the next round.
+func (r *routedHost) SetBootstrapMinPeers(n int) {
+	if r.limits != nil {
+		r.limits.setMinPeers(n)
 	}
 }
 
+// BootstrapState tells whether the host has the connections it bootstraps
+// towards.
+func (r *routedHost) BootstrapState() BootstrapState {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	if b, ok := r.boot.(*bootstrapper); ok {
+		return b.state()
+	}
+	return BootstrapOff
+}
+
+// SignalAddressChange makes the underlying host recheck its addresses and
+// tell connected peers about any change.
+func (r *routedHost) SignalAddressChange() {
+	if s, ok := r.basic.(addrSignaler); ok {
+		s.SignalAddressChange()
+	}
+}
+
+func (r *routedHost) Close() error {
+	r.mux.Lock()
+	if r.boot != nil {
+		r.boot.Close()
+	}
+	r.dht.Close()
+	if r.dstore != nil {
+		if err := r.dstore.Close(); err != nil {
+			log.Errorf("closing dht datastore failed: %s", err)
+		}
+	}
+	r.mux.Unlock()
+	return r.RoutedHost.Close()
+}
+
+// currentDHT routes through whichever DHT r holds at call time.
+type currentDHT struct {
+	r Routed
+}
+
+func (c currentDHT) FindPeer(ctx context.Context, p peer.ID) (peer.AddrInfo, error) {
+	return c.r.DHT().FindPeer(ctx, p)
+}
+
+func (c currentDHT) Provide(ctx context.Context, key cid.Cid, announce bool) error {
+	return c.r.DHT().Provide(ctx, key, announce)
+}
+
+func (c currentDHT) FindProvidersAsync(ctx context.Context, key cid.Cid, count int) <-chan peer.AddrInfo {
+	return c.r.DHT().FindProvidersAsync(ctx, key, count)
+}
+
 type DefaultRoutedHost struct {
 }
 
+// contextHostBuilder is implemented by host builders that can give up
+// when a context ends.
+type contextHostBuilder interface {
+	CreateContext(ctx context.Context, opt Option) (host.Host, error)
+}
+
+// nodeBuilder is implemented by host builders that can build a host
+// without joining the network yet, see Bootstrapper.
+type nodeBuilder interface {
+	NewNode(ctx context.Context, opt Option) (host.Host, error)
+}
+
 func (b DefaultRoutedHost) Create(opt Option) (host.Host, error) {
+	return b.CreateContext(context.Background(), opt)
+}
+
+// CreateContext builds the host with NewNode and bootstraps it within ctx.
+// When ctx ends first, e.g. while the network is down, the host is closed
+// and the ctx error returned.
+func (b DefaultRoutedHost) CreateContext(ctx context.Context, opt Option) (host.Host, error) {
+	h, err := b.NewNode(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	if bh, ok := h.(Bootstrapper); ok {
+		if err := bh.Bootstrap(ctx); err != nil {
+			log.Error("bootstrap failed. ", err)
+			h.Close()
+			return nil, err
+		}
+	}
+	log.Infof("core ready on:", h.Addrs())
+	return h, nil
+}
+
+// NewNode builds the host, and unless opt.DisableDHT its DHT and
+// datastore, without dialing the bootstrap peers. The host joins the
+// network once its Bootstrapper Bootstrap is called.
+func (b DefaultRoutedHost) NewNode(ctx context.Context, opt Option) (host.Host, error) {
 	basicHost, err := libp2p.New(opt.LpOpt...)
 	if err != nil {
 		return nil, err
@@ -86,30 +629,57 @@ func (b DefaultRoutedHost) Create(opt Option) (host.Host, error) {
 	// }
 
 	basicHost.Network()
-	// Construct a datastore (needed by the DHT). This is just a simple, in-memory thread-safe datastore.
-	dstore := dsync.MutexWrap(ds.NewMapDatastore())
-
-	// Make the DHT
-	kDht := dht.NewDHT(context.Background(), basicHost, dstore)
-
-	bts, err := ParseBootstrapPeers(BootstrapNodes)
+	if opt.DisableDHT {
+		log.Info("core built without DHT")
+		return basicHost, nil
+	}
+	bts, err := opt.bootstrapPeers()
 	if err != nil {
+		basicHost.Close()
 		return nil, err
 	}
-	btconf := bootstrap.BootstrapConfigWithPeers(bts)
-	btconf.MinPeerThreshold = 1
+	limits := newBootstrapLimits(opt.Bootstrap)
 
-	// connect to the chosen ipfs nodes
-	_, err = bootstrap.Bootstrap(ID, basicHost, kDht, btconf)
+	// the datastore outlives DHT resets
+	dstore, closer, err := opt.dhtDatastore()
 	if err != nil {
-		log.Error("bootstrap failed. ", err)
+		basicHost.Close()
 		return nil, err
 	}
+
 	// Make the routed host
-	routedHost := rh.Wrap(basicHost, kDht)
+	rHost, err := newRoutedHost(ctx, basicHost, func(ctx context.Context, h host.Host) (*dht.IpfsDHT, io.Closer, error) {
+		// Make the DHT, it outlives ctx
+		kDht, err := dht.New(context.Background(), h, dht.Datastore(dstore), dht.Mode(opt.DHTMode))
+		if err != nil {
+			return nil, nil, err
+		}
+		return kDht, nil, nil
+	})
+	if err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		basicHost.Close()
+		return nil, err
+	}
+	rHost.dstore = closer
+	rHost.limits = limits
+	// connect to the chosen ipfs nodes
+	rHost.bootstrap = func(ctx context.Context, h host.Host, kDht *dht.IpfsDHT) (io.Closer, error) {
+		boot, err := startBootstrap(ctx, h, kDht, bts, limits, BootstrapPeriod)
+		if err != nil {
+			return nil, err
+		}
+		return boot, nil
+	}
+	return rHost, nil
+}
 
-	log.Infof("core bootstrapped and ready on:", routedHost.Addrs())
-	return routedHost, nil
+// DefaultBootstrapPeers are the BootstrapNodes the DHT joins through
+// unless Option.BootstrapPeers is set.
+func DefaultBootstrapPeers() ([]peer.AddrInfo, error) {
+	return ParseBootstrapPeers(BootstrapNodes)
 }
 
 func ParseBootstrapPeers(addrs []string) ([]peer.AddrInfo, error) {
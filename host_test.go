@@ -0,0 +1,64 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hood-chat/core/entity"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheIdentityKey(t *testing.T) {
+	pi, l := newStallingPeer(t)
+	opt := Option{
+		LpOpt:            []libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")},
+		BootstrapPeers:   []peer.AddrInfo{pi},
+		Passphrase:       "pass",
+		CacheIdentityKey: true,
+	}
+	m, err := MessengerBuilder(t.TempDir()+"/h1", opt, DefaultRoutedHost{})
+	require.NoError(t, err)
+	id, err := entity.CreateIdentity("h1")
+	require.NoError(t, err)
+	require.NoError(t, id.EncryptPrivateKey("pass"))
+	*m.identity = id
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, m.StartContext(ctx), context.DeadlineExceeded)
+
+	// the second start reuses the key, it would fail to decode this one
+	m.identity.PrivKey = "not a key"
+	require.NoError(t, l.Close())
+	require.NoError(t, m.StartContext(context.Background()))
+	defer m.Stop()
+	require.Equal(t, id.ID.String(), m.Host.ID().String())
+}
+
+func TestKeyCacheMiss(t *testing.T) {
+	id, err := entity.CreateIdentity("h1")
+	require.NoError(t, err)
+	require.NoError(t, id.EncryptPrivateKey("pass"))
+	other, err := entity.CreateIdentity("h2")
+	require.NoError(t, err)
+	c := &keyCache{}
+	sk, err := c.get(&id, "pass")
+	require.NoError(t, err)
+
+	// another identity or passphrase decodes again
+	osk, err := c.get(&other, "")
+	require.NoError(t, err)
+	require.False(t, sk.Equals(osk))
+	_, err = c.get(&id, "wrong")
+	require.Error(t, err)
+	got, err := c.get(&id, "pass")
+	require.NoError(t, err)
+	require.True(t, sk.Equals(got))
+
+	c.clear()
+	id.PrivKey = "not a key"
+	_, err = c.get(&id, "pass")
+	require.Error(t, err)
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// DefaultInboundMessages is how many message streams a peer may open
+	// per DefaultInboundInterval, room for a busy chat and its receipts.
+	DefaultInboundMessages = 60
+	DefaultInboundInterval = 10 * time.Second
+	// DefaultInboundStrikes is how many streams a peer may have reset for
+	// breaking the limits within an interval before it is blocked.
+	DefaultInboundStrikes = 10
+)
+
+// InboundPolicy guards the message handler against peers flooding it or
+// sending frames too big for a phone to hold.
+type InboundPolicy struct {
+	// MaxMessageSize bounds an incoming frame, streams sending a bigger
+	// one are reset. MaxMsgSize when zero.
+	MaxMessageSize int
+	// Messages is how many streams a peer may open per Interval, the ones
+	// past it are reset. DefaultInboundMessages and DefaultInboundInterval
+	// when zero.
+	Messages int
+	Interval time.Duration
+	// Strikes is how many streams a peer may have reset for breaking the
+	// limits within an interval before it is blocked, DefaultInboundStrikes
+	// when zero.
+	Strikes int
+	// BlockFor is how long a peer out of strikes is disconnected and its
+	// connections refused. Zero never blocks.
+	BlockFor time.Duration
+}
+
+// inboundWindow counts the streams of a peer since start.
+type inboundWindow struct {
+	start   time.Time
+	count   int
+	strikes int
+}
+
+// inboundLimiter counts the message streams of each peer over fixed
+// windows of the policy interval.
+type inboundLimiter struct {
+	policy InboundPolicy
+	// block disconnects a peer out of strikes for a while
+	block func(peer.ID, time.Duration)
+
+	mux     sync.Mutex
+	windows map[peer.ID]*inboundWindow
+	swept   time.Time
+}
+
+func newInboundLimiter(policy InboundPolicy, block func(peer.ID, time.Duration)) *inboundLimiter {
+	if policy.MaxMessageSize == 0 {
+		policy.MaxMessageSize = MaxMsgSize
+	}
+	if policy.Messages == 0 {
+		policy.Messages = DefaultInboundMessages
+	}
+	if policy.Interval == 0 {
+		policy.Interval = DefaultInboundInterval
+	}
+	if policy.Strikes == 0 {
+		policy.Strikes = DefaultInboundStrikes
+	}
+	return &inboundLimiter{
+		policy:  policy,
+		block:   block,
+		windows: make(map[peer.ID]*inboundWindow),
+	}
+}
+
+// allow counts a stream from p, false once p went over its rate.
+func (l *inboundLimiter) allow(p peer.ID, now time.Time) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	w := l.window(p, now)
+	w.count++
+	return w.count <= l.policy.Messages
+}
+
+// strike counts a stream of p reset for breaking the limits, and blocks p
+// when it runs out of strikes.
+func (l *inboundLimiter) strike(p peer.ID, now time.Time) {
+	l.mux.Lock()
+	w := l.window(p, now)
+	w.strikes++
+	out := w.strikes == l.policy.Strikes
+	l.mux.Unlock()
+	if out && l.policy.BlockFor > 0 && l.block != nil {
+		log.Warnf("blocking %s for %s, it keeps flooding messages", logID(p), l.policy.BlockFor)
+		l.block(p, l.policy.BlockFor)
+	}
+}
+
+// window is the current window of p, dropping the ended ones of every peer
+// once an interval.
+func (l *inboundLimiter) window(p peer.ID, now time.Time) *inboundWindow {
+	if now.Sub(l.swept) > l.policy.Interval {
+		for pid, w := range l.windows {
+			if now.Sub(w.start) > l.policy.Interval {
+				delete(l.windows, pid)
+			}
+		}
+		l.swept = now
+	}
+	w, ok := l.windows[p]
+	if !ok || now.Sub(w.start) > l.policy.Interval {
+		w = &inboundWindow{start: now}
+		l.windows[p] = w
+	}
+	return w
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"github.com/hood-chat/core/entity"
+)
+
+type IssueKind int
+
+const (
+	// OrphanMessage is a message whose chat no longer exists.
+	OrphanMessage IssueKind = iota
+	// UnreadMismatch is a chat whose unread counter is negative or above
+	// the number of messages received in it.
+	UnreadMismatch
+)
+
+// Issue is an inconsistency found in the repo. ID names the message or
+// chat at fault.
+type Issue struct {
+	Kind IssueKind
+	ID   entity.ID
+}
+
+// VerifyRepo scans the repo for entries left inconsistent, e.g. by a crash
+// between two writes.
+func (m *Messenger) VerifyRepo() ([]Issue, error) {
+	return m.checkRepo(false)
+}
+
+// RepairRepo fixes what VerifyRepo reports: orphan messages are removed
+// and unread counters brought back in range. It returns the issues fixed.
+func (m *Messenger) RepairRepo() ([]Issue, error) {
+	return m.checkRepo(true)
+}
+
+func (m *Messenger) checkRepo(repair bool) ([]Issue, error) {
+	issues := make([]Issue, 0)
+	orphans, err := m.store.OrphanMessages()
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range orphans {
+		if repair {
+			if err := m.store.DeleteMessage(msg.ID); err != nil {
+				return issues, err
+			}
+		}
+		issues = append(issues, Issue{Kind: OrphanMessage, ID: entity.ID(msg.ID)})
+	}
+
+	const page = 100
+	for skip := 0; ; skip += page {
+		chats, err := m.store.ChatList(skip, page)
+		if err != nil {
+			return issues, err
+		}
+		for _, chat := range chats {
+			n, err := m.store.CountReceived(chat.ID, m.identity.ID.String())
+			if err != nil {
+				return issues, err
+			}
+			if chat.Unread >= 0 && uint64(chat.Unread) <= n {
+				continue
+			}
+			if repair {
+				if chat.Unread < 0 {
+					chat.Unread = 0
+				} else {
+					chat.Unread = int(n)
+				}
+				// written as stored, the chat repo would drop members
+				// that are not contacts
+				if err := m.store.UpdateChat(chat); err != nil {
+					return issues, err
+				}
+			}
+			issues = append(issues, Issue{Kind: UnreadMismatch, ID: entity.ID(chat.ID)})
+		}
+		if len(chats) < page {
+			return issues, nil
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencySamples is the number of recent deliveries send latency stats
+// are computed over.
+const LatencySamples = 1024
+
+// LatencyStats summarizes the time from queueing a message to writing it
+// to the recipient.
+type LatencyStats struct {
+	// Count is the number of deliveries the percentiles cover.
+	Count int
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+}
+
+// latencyRecorder times messages from queueing to delivery, keeping the
+// last LatencySamples results.
+type latencyRecorder struct {
+	mux     sync.Mutex
+	queued  map[string]time.Time
+	samples []time.Duration
+	next    int
+}
+
+func newLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{queued: make(map[string]time.Time)}
+}
+
+func (l *latencyRecorder) start(id string, at time.Time) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.queued[id] = at
+}
+
+// stop records the latency of id if it was started.
+func (l *latencyRecorder) stop(id string, at time.Time) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	start, ok := l.queued[id]
+	if !ok {
+		return
+	}
+	delete(l.queued, id)
+	l.add(at.Sub(start))
+}
+
+func (l *latencyRecorder) forget(id string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	delete(l.queued, id)
+}
+
+// add must be called with mux held.
+func (l *latencyRecorder) add(d time.Duration) {
+	if len(l.samples) < LatencySamples {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % LatencySamples
+}
+
+func (l *latencyRecorder) stats() LatencyStats {
+	l.mux.Lock()
+	sorted := append([]time.Duration(nil), l.samples...)
+	l.mux.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return LatencyStats{
+		Count: len(sorted),
+		P50:   percentile(sorted, 50),
+		P95:   percentile(sorted, 95),
+		P99:   percentile(sorted, 99),
+	}
+}
+
+// percentile picks the nearest-rank p-th percentile of sorted.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
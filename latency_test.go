@@ -0,0 +1,39 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyStats(t *testing.T) {
+	l := newLatencyRecorder()
+	require.Equal(t, LatencyStats{}, l.stats())
+
+	start := time.Now()
+	// delivered out of order, 1ms to 100ms after queueing
+	for i := 100; i >= 1; i-- {
+		id := string(rune(i))
+		l.start(id, start)
+		l.stop(id, start.Add(time.Duration(i)*time.Millisecond))
+	}
+	l.start("failed", start)
+	l.forget("failed")
+	l.stop("failed", start.Add(time.Hour))
+	l.stop("unknown", start.Add(time.Hour))
+
+	require.Equal(t, LatencyStats{
+		Count: 100,
+		P50:   50 * time.Millisecond,
+		P95:   95 * time.Millisecond,
+		P99:   99 * time.Millisecond,
+	}, l.stats())
+
+	// only the most recent samples count
+	for i := 0; i < LatencySamples; i++ {
+		l.start("x", start)
+		l.stop("x", start.Add(time.Second))
+	}
+	require.Equal(t, LatencyStats{Count: LatencySamples, P50: time.Second, P95: time.Second, P99: time.Second}, l.stats())
+}
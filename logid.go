@@ -0,0 +1,42 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/zap/zapcore"
+)
+
+// PeerIDDisplay is how peer IDs appear in logs unless debug logging is on.
+type PeerIDDisplay int
+
+const (
+	// PeerIDTruncate keeps the last few characters of the ID.
+	PeerIDTruncate PeerIDDisplay = iota
+	// PeerIDHash replaces the ID with a short hash of it.
+	PeerIDHash
+	// PeerIDFull logs the whole ID.
+	PeerIDFull
+)
+
+// LogPeerIDs sets how peer IDs are logged. Debug logging always shows full IDs.
+var LogPeerIDs = PeerIDTruncate
+
+const logIDLen = 6
+
+// logID formats p for a log line.
+func logID(p peer.ID) string {
+	s := p.String()
+	if LogPeerIDs == PeerIDFull || log.Desugar().Core().Enabled(zapcore.DebugLevel) {
+		return s
+	}
+	if LogPeerIDs == PeerIDHash {
+		sum := sha256.Sum256([]byte(p))
+		return "#" + hex.EncodeToString(sum[:])[:logIDLen*2]
+	}
+	if len(s) <= logIDLen {
+		return s
+	}
+	return "*" + s[len(s)-logIDLen:]
+}
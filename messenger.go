@@ -1,8 +1,15 @@
 package core
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,51 +19,137 @@ import (
 	"github.com/hood-chat/core/repo"
 	"github.com/hood-chat/core/store"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/crypto"
 	lpevt "github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	"github.com/libp2p/go-libp2p/p2p/protocol/holepunch"
+	ma "github.com/multiformats/go-multiaddr"
+	"google.golang.org/protobuf/proto"
 )
 
 var log = logging.Logger("msgr-core")
 
+var ErrNotInChat = errors.New("message is not part of the conversation")
+
+// ErrRepoExists is returned when restoring into a repo that already holds
+// an identity.
+var ErrRepoExists = errors.New("repo already holds an identity")
+
+// ErrExportPassphrase is returned when exporting an identity without a
+// passphrase to encrypt its key with.
+var ErrExportPassphrase = errors.New("identity export needs a passphrase")
+
+// ErrSnapshotPassphrase is returned when snapshotting a repo without a
+// passphrase to encrypt the bundle with.
+var ErrSnapshotPassphrase = errors.New("snapshot needs a passphrase")
+
+// ErrIdentityMismatch is returned when importing an identity whose key
+// doesn't belong to its id.
+var ErrIdentityMismatch = errors.New("identity key does not match its id")
+
+// ErrNotRelayed is returned when a connection through a relay ends up
+// direct.
+var ErrNotRelayed = errors.New("connection is not relayed")
+
+// ErrNoPeerAddrs is returned when a lookup finds no address for a peer.
+var ErrNoPeerAddrs = errors.New("no addresses found for peer")
+
+// StopTimeout bounds how long Stop waits for the messenger to wind down.
+const StopTimeout = 10 * time.Second
+
+// ExportPageSize is the number of messages read at a time while exporting.
+const ExportPageSize = 100
+
+// SearchPageSize is the number of messages scanned between checks for
+// cancellation while searching.
+const SearchPageSize = 100
+
+// FavoriteProc tags connections kept alive for favorite peers.
+const FavoriteProc = "favorite"
+
 type Messenger struct {
 	Host     host.Host
 	store    *store.Store
-	identity entity.Identity
+	identity *entity.Identity
 	pms      PMService
+	profile  ProfileService
+	chal     ChallengeService
+	unknown  *unsupportedHandler
+	groups   *groups
+	nat      *natWatcher
+	presence *presenceService
+	typing   *typingService
+	files    *fileService
+	attach   *attachmentService
+	favorite Connector
+	punch    *punchBackoff
+	disc     Discovery
 	hb       HostBuilder
 	opt      Option
 	bus      lpevt.Bus
+	gater    *pauseGater
+	mw       *middlewares
+	refresh  context.CancelFunc
+	subs     []lpevt.Subscription
+	running  *sync.WaitGroup
+	bw       *metrics.BandwidthCounter
+	started  time.Time
 }
 
-func MessengerBuilder(path string, opt Option, hb HostBuilder) Messenger {
+// MessengerBuilder opens the messenger stored at path, starting it when an
+// identity was already created there.
+func MessengerBuilder(path string, opt Option, hb HostBuilder) (Messenger, error) {
 	if hb == nil {
 		hb = DefaultRoutedHost{}
 	}
+	if opt.DHTDatastore == nil && opt.DHTDatastorePath == "" {
+		opt.DHTDatastorePath = path + "/dht"
+	}
+	// the services started here read the identity the caller's copy changes
 	msgr := Messenger{
-		bus: eventbus.NewBus(),
-		hb:  hb,
-		opt: opt,
+		identity: &entity.Identity{},
+		bus:      eventbus.NewBus(),
+		hb:       hb,
+		opt:      opt,
+		gater:    &pauseGater{},
+		mw:       &middlewares{},
+		running:  &sync.WaitGroup{},
+		bw:       metrics.NewBandwidthCounter(),
+	}
+	if opt.CacheIdentityKey {
+		msgr.opt.keys = &keyCache{}
 	}
 
 	err := checkWritable(path)
 	if err != nil {
-		panic("path is not writable ")
+		return msgr, err
 	}
 	s, err := store.NewStore(path + "/store")
 	if err != nil {
-		panic(err)
+		return msgr, err
 	}
 	msgr.store = s
 	rIdentity := repo.NewIdentityRepo(s)
 	id, err := rIdentity.Get()
 	if err != nil {
-		return msgr
+		return msgr, nil
 	}
-	msgr.identity = id
+	*msgr.identity = id
 
-	msgr.Start()
-	return msgr
+	if err := msgr.Start(); err != nil {
+		s.Close()
+		return msgr, err
+	}
+	return msgr, nil
 }
 
 func (m Messenger) getContactRepo() repo.IRepo[entity.Contact] {
@@ -75,21 +168,157 @@ func (m Messenger) getMessageRepo() repo.IRepo[entity.Message] {
 	return repo.NewMessageRepo(m.store)
 }
 
-func (m *Messenger) Start() {
-	m.opt.SetIdentity(&m.identity)
-	h, err := m.hb.Create(m.opt)
+func (m Messenger) getFavoriteRepo() repo.IRepo[entity.ID] {
+	return repo.NewFavoriteRepo(m.store)
+}
+
+func (m Messenger) getBlockedRepo() repo.IRepo[entity.ID] {
+	return repo.NewBlockedRepo(m.store)
+}
+
+func (m Messenger) getOutboxRepo() repo.IRepo[entity.Envelop] {
+	return repo.NewOutboxRepo(m.store)
+}
+
+func (m Messenger) getPendingRequestRepo() repo.IRepo[entity.PendingRequest] {
+	return repo.NewPendingRequestRepo(m.store)
+}
+
+// Start brings up the host and services for the current identity.
+func (m *Messenger) Start() error {
+	return m.StartContext(context.Background())
+}
+
+// StartContext is Start giving up with the ctx error when ctx ends while
+// the host is built, with builders that support it such as
+// DefaultRoutedHost. A host built with NewNode bootstraps once the
+// services handle their protocols. A start that failed can be retried.
+func (m *Messenger) StartContext(ctx context.Context) error {
+	m.loadNetConfig()
+	if err := m.loadBlocked(); err != nil {
+		return err
+	}
+	// the libp2p options of a start are built on a copy of the caller's,
+	// libp2p refuses a second identity, gater or resource manager
+	opt := m.opt
+	opt.LpOpt = append([]libp2p.Option(nil), m.opt.LpOpt...)
+	err := opt.SetIdentity(m.identity)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	m.opt.ID = opt.ID
+	opt.LpOpt = append(opt.LpOpt, opt.listenOptions()...)
+	security, err := opt.securityOptions()
+	if err != nil {
+		return err
+	}
+	opt.LpOpt = append(opt.LpOpt, security...)
+	opt.LpOpt = append(opt.LpOpt, opt.relayOptions()...)
+	opt.LpOpt = append(opt.LpOpt, libp2p.ConnectionGater(m.gater), libp2p.BandwidthReporter(m.bw))
+	if opt.HolePunching {
+		m.punch = newPunchBackoff(opt.HolePunchPolicy, m.holePunched)
+		opt.LpOpt = append(opt.LpOpt, libp2p.EnableHolePunching(holepunch.WithTracer(m.punch), holepunch.WithAddrFilter(m.punch)))
+	}
+	if len(opt.ProtocolLimits) > 0 {
+		rm, err := opt.resourceManager()
+		if err != nil {
+			return err
+		}
+		opt.LpOpt = append(opt.LpOpt, libp2p.ResourceManager(rm))
 	}
-	m.Host = h
-	m.pms = NewPMService(h, m.bus)
-
 	sub, err := m.bus.Subscribe(new(event.EvtMessageReceived))
 	if err != nil {
-		panic(err)
+		return err
+	}
+	subStaus, err := m.bus.Subscribe(new(event.EvtObject))
+	if err != nil {
+		sub.Close()
+		return err
+	}
+	var h host.Host
+	nb, lazy := m.hb.(nodeBuilder)
+	if lazy {
+		h, err = nb.NewNode(ctx, opt)
+	} else if cb, ok := m.hb.(contextHostBuilder); ok {
+		h, err = cb.CreateContext(ctx, opt)
+	} else {
+		h, err = m.hb.Create(opt)
+	}
+	if err != nil {
+		sub.Close()
+		subStaus.Close()
+		return err
+	}
+	m.Host = h
+	m.started = time.Now()
+	attachments := m.opt.Attachments
+	if attachments == nil {
+		attachments = storeAttachments{m.store}
+	}
+	m.attach = newAttachmentService(h, attachments)
+	m.pms, err = NewPMServiceWithInbound(h, m.bus, m.opt.Protocols, m.getOutboxRepo(), m.opt.Outbox, m.opt.Inbound, m.blockPeer, m.opt.FrameMagic)
+	if err == nil {
+		m.pms.(*pmService).keepAttachments(m.attach.keep)
+	}
+	if err == nil {
+		m.unknown, err = newUnsupportedHandler(h, m.opt.OnUnknownProtocol)
+	}
+	if err == nil {
+		m.groups, err = newGroups(h, m.opt.Group, m.opt.MaxRooms)
+	}
+	if err == nil {
+		m.nat, err = newNATWatcher(h.EventBus())
+	}
+	if err != nil {
+		sub.Close()
+		subStaus.Close()
+		h.Close()
+		m.Host = nil
+		return err
+	}
+	m.profile = NewProfileService(h, func() entity.Contact { return *m.identity.Me() })
+	m.chal = NewChallengeService(h, h.Peerstore().PrivKey(h.ID()))
+	m.files = newFileService(h, m.opt.Files, m.fileReceived, m.fileSent)
+	m.typing = newTypingService(h, m.opt.TypingInterval, m.isContact, m.typingChanged)
+	m.eachContact(m.preloadAddrs)
+	h.Network().Notify((*msgrNotifiee)(m))
+	m.favorite = NewConnectorWithPolicy(h, m.opt.FavoriteRetry, m.favoriteUnreachable)
+	if m.opt.MDNS {
+		m.disc = NewDiscoveryWithMDNS(h, m.opt.MDNSServiceTag)
+	} else {
+		m.disc = NewDiscovery(h)
+	}
+	if m.opt.ProfilePush {
+		m.profile.OnPush(m.profilePushed)
+	}
+	if m.opt.Presence {
+		m.presence = newPresenceService(h, m.opt.PresencePolicy, m.connectedContactIDs, m.isContact, m.presenceChanged)
+	}
+	favs, err := m.Favorites()
+	if err != nil {
+		log.Errorf("can not load favorites %s", err.Error())
+	}
+	for _, id := range favs {
+		m.needFavorite(id)
 	}
+	var rctx context.Context
+	rctx, m.refresh = context.WithCancel(context.Background())
+	if m.opt.ProfileRefresh > 0 {
+		go m.refreshProfiles(rctx, m.opt.ProfileRefresh)
+	}
+	if m.opt.Outbox.PurgeFailed > 0 {
+		// tracked so the store outlives a purge under way
+		m.running.Add(1)
+		go func() {
+			defer m.running.Done()
+			m.purgeFailed(rctx, m.opt.Outbox.PurgeFailed)
+		}()
+	}
+
+	m.subs = []lpevt.Subscription{sub, subStaus}
+	m.running.Add(2)
 	go func() {
-		defer sub.Close()
+		defer m.running.Done()
 		for e := range sub.Out() {
 			log.Debug("EvtMessageReceived received")
 			msg := e.(event.EvtMessageReceived).Msg
@@ -97,12 +326,8 @@ func (m *Messenger) Start() {
 			m.MessageHandler(msg)
 		}
 	}()
-	subStaus, err := m.bus.Subscribe(new(event.EvtObject))
-	if err != nil {
-		panic(err)
-	}
 	go func() {
-		defer subStaus.Close()
+		defer m.running.Done()
 		for e := range subStaus.Out() {
 			log.Debug("EvtObject received")
 			evt := e.(event.EvtObject)
@@ -117,6 +342,16 @@ func (m *Messenger) Start() {
 
 		}
 	}()
+	if bh, ok := h.(Bootstrapper); ok && lazy {
+		// joined only now, so the first peers find the handlers above
+		if err := bh.Bootstrap(ctx); err != nil {
+			log.Error("bootstrap failed. ", err)
+			m.shutdown(context.Background())
+			m.Host = nil
+			return err
+		}
+	}
+	return nil
 }
 
 func (m *Messenger) IsLogin() bool {
@@ -125,23 +360,86 @@ func (m *Messenger) IsLogin() bool {
 	return err == nil
 }
 
+// loadNetConfig falls back to the listen settings saved by the last start
+// when none are given, and saves the ones given otherwise.
+func (m *Messenger) loadNetConfig() {
+	if len(m.opt.ListenAddrs) == 0 && !m.opt.QUICOnly {
+		conf, err := m.store.GetNetConfig()
+		if err == nil {
+			m.opt.ListenAddrs = conf.ListenAddrs
+			m.opt.QUICOnly = conf.QUICOnly
+		}
+		return
+	}
+	err := m.store.SetNetConfig(store.BHNetConfig{ListenAddrs: m.opt.ListenAddrs, QUICOnly: m.opt.QUICOnly})
+	if err != nil {
+		log.Errorf("can not save listen addresses %s", err.Error())
+	}
+}
+
+// ResetNetConfig forgets the saved listen settings, so the next start
+// without ListenAddrs or QUICOnly is back on the libp2p defaults.
+func (m *Messenger) ResetNetConfig() error {
+	m.opt.ListenAddrs = nil
+	m.opt.QUICOnly = false
+	return m.store.DeleteNetConfig()
+}
+
 func (m *Messenger) SignUp(name string) (*entity.Identity, error) {
 	rIdentity := m.getIdentityRepo()
-	iden, err := entity.CreateIdentity(name)
+	iden, err := entity.CreateIdentityWithKey(name, m.opt.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	err = iden.EncryptPrivateKey(m.opt.Passphrase)
 	if err != nil {
 		return nil, err
 	}
 	err = rIdentity.Set(iden)
-	m.identity = iden
+	*m.identity = iden
+	if err != nil {
+		return nil, err
+	}
+	err = m.Start()
 	if err != nil {
 		return nil, err
 	}
-	m.Start()
 	return &iden, nil
 }
 
 func (m *Messenger) GetIdentity() (entity.Identity, error) {
-	return m.identity, nil
+	return *m.identity, nil
+}
+
+// SetSelfNickname sets the local-only label for the user. Peers only ever
+// see the identity name.
+func (m *Messenger) SetSelfNickname(nickname string) error {
+	iden := *m.identity
+	iden.Nickname = nickname
+	err := m.getIdentityRepo().Set(iden)
+	if err != nil {
+		return err
+	}
+	*m.identity = iden
+	return nil
+}
+
+func (m *Messenger) SelfNickname() string {
+	return m.identity.Nickname
+}
+
+// SetName changes the profile name contacts see. Connected contacts
+// accepting profile pushes are told right away.
+func (m *Messenger) SetName(name string) error {
+	iden := *m.identity
+	iden.Name = name
+	err := m.getIdentityRepo().Set(iden)
+	if err != nil {
+		return err
+	}
+	*m.identity = iden
+	go m.pushProfile()
+	return nil
 }
 
 func (m *Messenger) GetContacts(skip int, limit int) ([]entity.Contact, error) {
@@ -155,177 +453,1743 @@ func (m *Messenger) GetContact(id entity.ID) (entity.Contact, error) {
 	return rContact.GetByID(id)
 }
 
+// AddContact saves c, its addresses are dialed first when reaching it.
 func (m *Messenger) AddContact(c entity.Contact) error {
 	rContact := m.getContactRepo()
-	return rContact.Add(c)
-}
-
-func (m *Messenger) GetChat(id entity.ID) (entity.ChatInfo, error) {
-	rChat := m.getChatRepo()
-	ci := entity.ChatInfo{}
-	c, err := rChat.GetByID(id)
+	err := rContact.Add(c)
 	if err != nil {
-		return ci, err
+		return err
 	}
-	return c, nil
+	if m.Host != nil {
+		m.preloadAddrs(c)
+	}
+	return nil
 }
 
-func (m *Messenger) GetChats(skip int, limit int) ([]entity.ChatInfo, error) {
-	rChat := repo.NewChatRepo(m.store)
-	opt := repo.NewOption(skip, limit)
-	return rChat.GetAll(opt)
+// RemoveContact deletes contact id, its chats and messages are kept.
+func (m *Messenger) RemoveContact(id entity.ID) error {
+	return m.getContactRepo().Delete(id)
 }
 
-func (m *Messenger) CreatePMChat(contactID entity.ID) (entity.ChatInfo, error) {
-	c, err := m.GetContact(contactID)
-	chatID := m.generatePMChatID(c)
+// SetSharedKey encrypts the texts exchanged with contact id with key, on
+// top of the identity keys securing the connection. Both sides must set the
+// same key. A nil key stops it. Texts long enough to go as attachments are
+// served sealed under their own CID.
+func (m *Messenger) SetSharedKey(id entity.ID, key []byte) error {
+	if key != nil && len(key) != entity.SharedKeySize {
+		return entity.ErrSharedKeySize
+	}
+	rContact := m.getContactRepo()
+	con, err := rContact.GetByID(id)
 	if err != nil {
-		return entity.ChatInfo{}, err
+		return err
 	}
-	chat := m.CreateChat(chatID, []entity.Contact{*m.identity.Me(), c}, c.Name)
-	err = m.getChatRepo().Add(chat)
-	return chat, err
+	con.SharedKey = key
+	return rContact.Set(con)
 }
 
-func (m *Messenger) GetPMChat(contactID entity.ID) (entity.ChatInfo, error) {
-	c, err := m.GetContact(contactID)
-	chatID := m.generatePMChatID(c)
-	if err != nil {
-		return entity.ChatInfo{}, err
+// preloadAddrs adds the saved addresses of con to the peerstore, so
+// reaching it doesn't wait on the DHT.
+func (m *Messenger) preloadAddrs(con entity.Contact) {
+	pi, err := con.AdderInfo()
+	if err != nil || len(pi.Addrs) == 0 {
+		return
 	}
-	chat, err := m.getChatRepo().GetByID(chatID)
-	return chat, err
+	m.Host.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.AddressTTL)
 }
 
-func (m *Messenger) CreateChat(id entity.ID, members []entity.Contact, name string) entity.ChatInfo {
-	return entity.ChatInfo{
-		ID:      entity.ID(id),
-		Name:    name,
-		Members: members,
+func (m *Messenger) refreshProfiles(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.refreshContacts(ctx)
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func (m *Messenger) MessageHandler(msg *pb.Message) {
-	mAuthorID := entity.ID(msg.Author.Id)
-	msgID := entity.ID(msg.GetId())
-	chatID := entity.ID(msg.ChatId)
-	rCon := m.getContactRepo()
-	con, err := rCon.GetByID(mAuthorID)
+// purgeFailed deletes the messages that failed longer than retention ago,
+// checking at most hourly.
+func (m *Messenger) purgeFailed(ctx context.Context, retention time.Duration) {
+	interval := retention
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var keep func(store.BHTextMessage) bool
+	if exempt := m.opt.Outbox.KeepFailed; exempt != nil {
+		keep = func(tm store.BHTextMessage) bool { return exempt(entity.ID(tm.ID)) }
+	}
+	em, err := m.bus.Emitter(new(event.EvtMessagesPurged))
 	if err != nil {
-		log.Errorf("fail to get contact %s", err.Error())
-		con = entity.Contact{
-			ID:   mAuthorID,
-			Name: msg.Author.Name,
-		}
-		err := rCon.Add(con)
+		log.Errorf("can not create emitter. reason: %s", err)
+		return
+	}
+	defer em.Close()
+	for {
+		before := time.Now().Add(-retention).UTC().Unix()
+		deleted, err := m.store.DeleteFailedBefore(before, keep)
 		if err != nil {
-			log.Errorf("fail to add contact %s", err.Error())
+			log.Errorf("can not purge failed messages %s", err.Error())
+		}
+		chats := make(map[string][]entity.ID)
+		for _, tm := range deleted {
+			chats[tm.ChatID] = append(chats[tm.ChatID], entity.ID(tm.ID))
+		}
+		for chatID, ids := range chats {
+			em.Emit(event.EvtMessagesPurged{ChatID: entity.ID(chatID), IDs: ids})
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
 			return
 		}
 	}
+}
 
-	rchat := m.getChatRepo()
-	chat, err := rchat.GetByID(entity.ID(msg.GetChatId()))
+// refreshContacts fetches the profile of every connected contact, offline
+// ones are left for a later round.
+func (m *Messenger) refreshContacts(ctx context.Context) {
+	m.connectedContacts(func(pid peer.ID, con entity.Contact) {
+		m.refreshContact(ctx, pid, con)
+	})
+}
 
-	if err != nil {
-		log.Errorf("can not find chat %s", err.Error())
-		chat = m.CreateChat(chatID, []entity.Contact{*m.identity.Me(), con}, msg.Author.Name)
-		err := rchat.Add(chat)
-		if err != nil {
-			log.Errorf("fail to handle new message %s", err.Error())
-			return
+// connectedContacts calls fn for each contact currently connected.
+func (m *Messenger) connectedContacts(fn func(peer.ID, entity.Contact)) {
+	m.eachContact(func(con entity.Contact) {
+		pid, err := con.PeerID()
+		if err == nil && m.Host.Network().Connectedness(pid) == network.Connected {
+			fn(pid, con)
 		}
-	}
-	newMsg := entity.Message{
-		ID:        msgID,
-		ChatID:    chat.ID,
-		CreatedAt: msg.GetCreatedAt(),
-		Text:      msg.GetText(),
-		Status:    entity.Received,
-		Author:    con,
-	}
-	rmsg := m.getMessageRepo()
-	err = rmsg.Add(newMsg)
-	log.Debugf("new message %s ", newMsg)
+	})
+}
+
+func (m *Messenger) connectedContactIDs() []peer.ID {
+	var pids []peer.ID
+	m.connectedContacts(func(pid peer.ID, _ entity.Contact) {
+		pids = append(pids, pid)
+	})
+	return pids
+}
+
+func (m *Messenger) isContact(pid peer.ID) bool {
+	_, err := m.GetContact(entity.ID(pid.String()))
+	return err == nil
+}
+
+func (m *Messenger) presenceChanged(pid peer.ID, p entity.Presence) {
+	em, err := m.bus.Emitter(new(event.EvtPresenceChanged))
 	if err != nil {
-		log.Errorf("Can not add message %s , %d", err.Error(), newMsg)
+		log.Errorf("can not create emitter. reason: %s", err)
 		return
 	}
-
-	em, _ := m.bus.Emitter(new(event.EvtObject))
 	defer em.Close()
-	evgrp := event.NewMessagingEventGroup()
-	ev, _ := evgrp.Make("ChangeMessageStatus", entity.Received, msgID)
-	em.Emit(*ev)
+	em.Emit(event.EvtPresenceChanged{ID: pid, Presence: p})
 }
 
-func (m *Messenger) SendPM(chatID entity.ID, content string) (*entity.Message, error) {
-	msg := entity.Message{
-		ID:        entity.ID(uuid.New().String()),
-		ChatID:    chatID,
-		CreatedAt: time.Now().UTC().Unix(),
-		Text:      content,
-		Status:    entity.Pending,
-		Author:    *m.identity.Me(),
+func (m *Messenger) holePunched(e event.EvtHolePunch) {
+	em, err := m.bus.Emitter(new(event.EvtHolePunch))
+	if err != nil {
+		log.Errorf("can not create emitter. reason: %s", err)
+		return
 	}
-	rmsg := m.getMessageRepo()
-	err := rmsg.Add(msg)
+	defer em.Close()
+	em.Emit(e)
+}
+
+func (m *Messenger) typingChanged(pid peer.ID, typing bool) {
+	em, err := m.bus.Emitter(new(event.EvtTyping))
 	if err != nil {
-		log.Errorf("Can not add message %s", err.Error())
-		return nil, err
+		log.Errorf("can not create emitter. reason: %s", err)
+		return
 	}
-	rchat := m.getChatRepo()
-	chat, err := rchat.GetByID(chatID)
+	defer em.Close()
+	em.Emit(event.EvtTyping{ID: pid, Typing: typing})
+}
+
+func (m *Messenger) fileReceived(from peer.ID, meta entity.FileMeta, path string) {
+	em, err := m.bus.Emitter(new(event.EvtFileReceived))
 	if err != nil {
-		log.Errorf("Can not get chat %s", err.Error())
-		return nil, err
+		log.Errorf("can not create emitter. reason: %s", err)
+		return
 	}
-	for _, to := range chat.Members {
-		if to.ID != msg.Author.ID {
-			log.Debugf("outbox message")
-			m.pms.Send(entity.Envelop{To: to, Message: msg})
-			log.Debugf("outboxed message")
-		}
+	defer em.Close()
+	em.Emit(event.EvtFileReceived{From: from, File: meta, Path: path})
+}
+
+func (m *Messenger) fileSent(to peer.ID, id string, meta entity.FileMeta, failed error) {
+	em, err := m.bus.Emitter(new(event.EvtFileSent))
+	if err != nil {
+		log.Errorf("can not create emitter. reason: %s", err)
+		return
 	}
-	return &msg, nil
+	defer em.Close()
+	em.Emit(event.EvtFileSent{To: to, ID: id, File: meta, Err: failed})
 }
 
-func (m *Messenger) GetMessages(chatID entity.ID, skip int, limit int) ([]entity.Message, error) {
-	opt := repo.NewOption(skip, limit)
-	opt.AddFilter("chatID", string(chatID))
-	return m.getMessageRepo().GetAll(opt)
+// SetPresence changes the presence announced to contacts, they are told
+// right away.
+func (m *Messenger) SetPresence(p entity.Presence) {
+	if m.presence != nil {
+		m.presence.set(p)
+	}
 }
 
-func (m *Messenger) GetMessage(ID entity.ID) (entity.Message, error) {
-	return m.getMessageRepo().GetByID(ID)
+// GetPresence is the presence contact pid last announced, entity.Offline
+// when it went silent or presence is disabled. Changes are emitted as
+// event.EvtPresenceChanged.
+func (m *Messenger) GetPresence(pid peer.ID) entity.Presence {
+	if m.presence == nil {
+		return entity.Offline
+	}
+	return m.presence.get(pid)
 }
 
-func (m *Messenger) generatePMChatID(con entity.Contact) entity.ID {
-	cons := []string{con.ID.String(), m.identity.Me().ID.String()}
-	sort.Strings(cons)
-	return entity.ID(strings.Join(cons, ""))
+// SendTyping tells pid whether we are typing. It can be called on every
+// keystroke, starts are sent at most once per Option.TypingInterval.
+// Nothing is sent when pid is not connected, and nothing is stored.
+func (m *Messenger) SendTyping(pid peer.ID, typing bool) {
+	m.typing.send(pid, typing, time.Now())
 }
 
-func (m *Messenger) updateMessageStatus(msgID entity.ID, status entity.Status) error {
-	rmsg := m.getMessageRepo()
-	msg, err := rmsg.GetByID(msgID)
-	if err != nil {
-		return err
-	}
-	msg.Status = status
-	err = rmsg.Set(msg)
+// TypingEvents yields the typing indicators contacts send us. Events are
+// dropped while the reader lags behind.
+func (m *Messenger) TypingEvents() <-chan event.EvtTyping {
+	out := make(chan event.EvtTyping, 16)
+	sub, err := m.bus.Subscribe(new(event.EvtTyping))
 	if err != nil {
-		return err
+		log.Errorf("can not subscribe to typing %s", err.Error())
+		close(out)
+		return out
 	}
-	return nil
-}
-
-func (m *Messenger) EventBus() lpevt.Bus {
-	return m.bus
+	go func() {
+		defer close(out)
+		defer sub.Close()
+		for e := range sub.Out() {
+			select {
+			case out <- e.(event.EvtTyping):
+			default:
+			}
+		}
+	}()
+	return out
 }
 
-func (m *Messenger) Stop() {
-	m.store.Close()
+// eachContact calls fn for every saved contact.
+func (m *Messenger) eachContact(fn func(entity.Contact)) {
+	const page = 100
+	rContact := m.getContactRepo()
+	for skip := 0; ; skip += page {
+		cons, err := rContact.GetAll(repo.NewOption(skip, page))
+		if err != nil {
+			log.Errorf("can not list contacts %s", err.Error())
+			return
+		}
+		for _, con := range cons {
+			fn(con)
+		}
+		if len(cons) < page {
+			return
+		}
+	}
+}
+
+func (m *Messenger) refreshContact(ctx context.Context, pid peer.ID, con entity.Contact) {
+	fctx, cancel := context.WithTimeout(ctx, StreamTimeout)
+	defer cancel()
+	fresh, err := m.profile.Fetch(fctx, pid)
+	if err != nil {
+		log.Debugf("profile refresh of %s failed: %s", logID(pid), err)
+		return
+	}
+	m.updateProfile(con, fresh)
+}
+
+// updateProfile saves fresh as the profile of contact con if it changed.
+func (m *Messenger) updateProfile(con entity.Contact, fresh entity.Contact) {
+	if fresh.Name == con.Name {
+		return
+	}
+	con.Name = fresh.Name
+	if err := m.getContactRepo().Set(con); err != nil {
+		log.Errorf("can not update contact %s", err.Error())
+		return
+	}
+	em, err := m.bus.Emitter(new(event.EvtContactProfileChanged))
+	if err != nil {
+		log.Errorf("can not create emitter. reason: %s", err)
+		return
+	}
+	defer em.Close()
+	em.Emit(event.EvtContactProfileChanged{Contact: con})
+}
+
+// profilePushed takes a profile pushed by a peer, ignored unless the peer
+// is a contact.
+func (m *Messenger) profilePushed(fresh entity.Contact) {
+	con, err := m.getContactRepo().GetByID(fresh.ID)
+	if err != nil {
+		log.Debugf("profile pushed by unknown peer: %s", err)
+		return
+	}
+	m.updateProfile(con, fresh)
+}
+
+// pushProfile sends the local profile to every connected contact accepting
+// pushes.
+func (m *Messenger) pushProfile() {
+	m.connectedContacts(func(pid peer.ID, _ entity.Contact) {
+		ctx, cancel := context.WithTimeout(context.Background(), StreamTimeout)
+		defer cancel()
+		// peers not accepting pushes don't speak the protocol
+		if err := m.profile.Push(ctx, pid); err != nil {
+			log.Debugf("profile push to %s failed: %s", logID(pid), err)
+		}
+	})
+}
+
+// ChallengePeer asks contact pid to sign a random nonce with its identity
+// key and marks the contact verified when the signature holds.
+func (m *Messenger) ChallengePeer(ctx context.Context, pid peer.ID) error {
+	rContact := m.getContactRepo()
+	con, err := rContact.GetByID(entity.ID(pid.String()))
+	if err != nil {
+		return err
+	}
+	err = m.chal.Challenge(ctx, pid)
+	if err != nil {
+		return err
+	}
+	con.Verified = true
+	return rContact.Set(con)
+}
+
+// PublicKeyBytes exports the node's identity public key, for users who
+// compare keys out of band. PeerIDFromPublicKey turns it back into an ID.
+func (m *Messenger) PublicKeyBytes() ([]byte, error) {
+	return crypto.MarshalPublicKey(m.Host.Peerstore().PubKey(m.Host.ID()))
+}
+
+// PeerIDFromPublicKey derives the peer ID of a key exported with
+// PublicKeyBytes.
+func PeerIDFromPublicKey(b []byte) (peer.ID, error) {
+	pk, err := crypto.UnmarshalPublicKey(b)
+	if err != nil {
+		return "", err
+	}
+	return peer.IDFromPublicKey(pk)
+}
+
+// AddContactFromInvite connects to the peer in invite, a p2p multiaddr,
+// and saves it as a contact under its self-reported profile name along
+// with the invite address.
+func (m *Messenger) AddContactFromInvite(ctx context.Context, invite string) (entity.Contact, error) {
+	pi, err := peer.AddrInfoFromString(invite)
+	if err != nil {
+		return entity.Contact{}, err
+	}
+	err = m.Host.Connect(ctx, *pi)
+	if err != nil {
+		return entity.Contact{}, err
+	}
+	con, err := m.profile.Fetch(ctx, pi.ID)
+	if err != nil {
+		return entity.Contact{}, err
+	}
+	for _, a := range pi.Addrs {
+		con.Addrs = append(con.Addrs, a.String())
+	}
+	err = m.AddContact(con)
+	if err != nil {
+		return entity.Contact{}, err
+	}
+	return con, nil
+}
+
+// ConnectViaRelay dials target through a circuit on the given relay. The
+// connections already open to target are closed first, dialing would reuse
+// them otherwise.
+func (m *Messenger) ConnectViaRelay(ctx context.Context, target peer.ID, relay peer.AddrInfo) error {
+	err := m.Host.Connect(ctx, relay)
+	if err != nil {
+		return err
+	}
+	circuit, err := ma.NewMultiaddr("/p2p/" + relay.ID.String() + "/p2p-circuit")
+	if err != nil {
+		return err
+	}
+	if err := m.Host.Network().ClosePeer(target); err != nil {
+		return err
+	}
+	// the direct addresses would be dialed along with the circuit
+	ps := m.Host.Peerstore()
+	old := ps.Addrs(target)
+	ps.ClearAddrs(target)
+	err = m.Host.Connect(ctx, peer.AddrInfo{ID: target, Addrs: []ma.Multiaddr{circuit}})
+	ps.AddAddrs(target, old, peerstore.AddressTTL)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.RelayForPeer(target); !ok {
+		return ErrNotRelayed
+	}
+	return nil
+}
+
+// Warmup connects to pid ahead of a send so the first message does not wait
+// on peer resolution and dialing. It is a no-op when pid is connected.
+func (m *Messenger) Warmup(ctx context.Context, pid peer.ID) error {
+	if m.Host.Network().Connectedness(pid) == network.Connected {
+		return nil
+	}
+	return connectWithFallback(ctx, m.Host, m.Host.Peerstore().PeerInfo(pid))
+}
+
+// TestDial checks that info can be dialed, for feedback on a pasted
+// address. The connection is closed right away and the peer is not added
+// as a contact. A peer already connected is left connected.
+func (m *Messenger) TestDial(ctx context.Context, info peer.AddrInfo) error {
+	if m.Host.Network().Connectedness(info.ID) == network.Connected {
+		return nil
+	}
+	err := m.Host.Connect(ctx, info)
+	if err != nil {
+		return err
+	}
+	return m.Host.Network().ClosePeer(info.ID)
+}
+
+// Reachability tells how a peer can be reached.
+type Reachability int
+
+const (
+	PeerUnreachable Reachability = iota
+	// PeerDirect peers accept direct connections.
+	PeerDirect
+	// PeerRelayOnly peers are only reachable through a relay, which is
+	// slower.
+	PeerRelayOnly
+)
+
+// PeerReachability probes whether pid can be connected to directly or only
+// through a relay. An unreachable peer comes with the dial error.
+func (m *Messenger) PeerReachability(ctx context.Context, pid peer.ID) (Reachability, error) {
+	if len(m.Host.Peerstore().Addrs(pid)) == 0 {
+		if r, ok := m.Host.(Routed); ok {
+			if pi, err := r.DHT().FindPeer(ctx, pid); err == nil {
+				m.Host.Peerstore().AddAddrs(pid, pi.Addrs, peerstore.TempAddrTTL)
+			}
+		}
+	}
+	// a forced direct dial skips relay addresses and relayed connections
+	dctx := network.WithForceDirectDial(ctx, "reachability probe")
+	_, err := m.Host.Network().DialPeer(dctx, pid)
+	if err == nil {
+		return PeerDirect, nil
+	}
+	if m.Host.Network().Connectedness(pid) == network.Connected {
+		return PeerRelayOnly, nil
+	}
+	if err := m.Host.Connect(ctx, peer.AddrInfo{ID: pid}); err != nil {
+		return PeerUnreachable, err
+	}
+	return PeerRelayOnly, nil
+}
+
+// RefreshPeerAddrs looks pid up in the DHT and replaces the addresses the
+// peerstore holds for it, for a peer rarely contacted whose cached ones may
+// be stale. The cached addresses are kept when the lookup fails, and a
+// connected peer keeps the ones it told us over identify.
+func (m *Messenger) RefreshPeerAddrs(ctx context.Context, pid peer.ID) error {
+	r, ok := m.Host.(Routed)
+	if !ok {
+		return ErrNotRouted
+	}
+	ps := m.Host.Peerstore()
+	old := ps.Addrs(pid)
+	// the DHT answers from the peerstore, stale addresses would stay
+	if m.Host.Network().Connectedness(pid) != network.Connected {
+		ps.ClearAddrs(pid)
+	}
+	pi, err := r.DHT().FindPeer(ctx, pid)
+	if err == nil && len(pi.Addrs) == 0 {
+		err = ErrNoPeerAddrs
+	}
+	if err != nil {
+		ps.AddAddrs(pid, old, peerstore.AddressTTL)
+		return err
+	}
+	ps.AddAddrs(pid, pi.Addrs, peerstore.AddressTTL)
+	return nil
+}
+
+// RelayForPeer returns the relay carrying the connection to pid, false
+// when pid is not connected or reachable directly.
+func (m *Messenger) RelayForPeer(pid peer.ID) (peer.ID, bool) {
+	var relay peer.ID
+	for _, c := range m.Host.Network().ConnsToPeer(pid) {
+		before, circuit := ma.SplitFunc(c.RemoteMultiaddr(), func(c ma.Component) bool {
+			return c.Protocol().Code == ma.P_CIRCUIT
+		})
+		// a direct connection wins over any relayed one
+		if circuit == nil {
+			return "", false
+		}
+		if before == nil {
+			continue
+		}
+		id, err := before.ValueForProtocol(ma.P_P2P)
+		if err != nil {
+			continue
+		}
+		relay, err = peer.Decode(id)
+		if err != nil {
+			continue
+		}
+	}
+	return relay, relay != ""
+}
+
+// AddFavorite keeps the contact connected, redialing it whenever it drops.
+func (m *Messenger) AddFavorite(id entity.ID) error {
+	err := m.getFavoriteRepo().Add(id)
+	if err != nil {
+		return err
+	}
+	m.needFavorite(id)
+	return nil
+}
+
+func (m *Messenger) RemoveFavorite(id entity.ID) error {
+	err := m.getFavoriteRepo().Delete(id)
+	if err != nil {
+		return err
+	}
+	pid, err := peer.Decode(id.String())
+	if err != nil {
+		return err
+	}
+	m.favorite.Done(FavoriteProc, pid)
+	return nil
+}
+
+func (m *Messenger) Favorites() ([]entity.ID, error) {
+	return m.getFavoriteRepo().GetAll(repo.NewOption(0, 0))
+}
+
+func (m *Messenger) needFavorite(id entity.ID) {
+	pi, err := entity.Contact{ID: id}.AdderInfo()
+	if err != nil {
+		log.Errorf("invalid favorite %s", err.Error())
+		return
+	}
+	m.favorite.Need(FavoriteProc, *pi)
+}
+
+func (m *Messenger) favoriteUnreachable(pid peer.ID) {
+	log.Infof("favorite %s unreachable, giving up", logID(pid))
+	em, err := m.bus.Emitter(new(event.EvtFavoriteUnreachable))
+	if err != nil {
+		log.Errorf("can not create emitter. reason: %s", err)
+		return
+	}
+	defer em.Close()
+	em.Emit(event.EvtFavoriteUnreachable{ID: pid})
+}
+
+// PurgePeer deletes every trace of pid: the contact with its profile, the
+// conversation with its unread count and attachments, a pending request,
+// the favorite mark and the messages still queued for it. The stored ones
+// go in one transaction.
+func (m *Messenger) PurgePeer(pid peer.ID) error {
+	id := entity.ID(pid.String())
+	chatID := m.generatePMChatID(entity.Contact{ID: id})
+	orphans, err := m.store.PurgePeer(id.String(), chatID.String())
+	if err != nil {
+		return err
+	}
+	// the default store lost them in the transaction already
+	if m.opt.Attachments != nil {
+		for _, a := range orphans {
+			if err := m.opt.Attachments.Delete(a); err != nil {
+				log.Errorf("can not delete attachment %s: %s", a, err)
+			}
+		}
+	}
+	m.favorite.Done(FavoriteProc, pid)
+	m.pms.Discard(pid)
+	return nil
+}
+
+func (m *Messenger) GetChat(id entity.ID) (entity.ChatInfo, error) {
+	rChat := m.getChatRepo()
+	ci := entity.ChatInfo{}
+	c, err := rChat.GetByID(id)
+	if err != nil {
+		return ci, err
+	}
+	return c, nil
+}
+
+func (m *Messenger) GetChats(skip int, limit int) ([]entity.ChatInfo, error) {
+	rChat := repo.NewChatRepo(m.store)
+	opt := repo.NewOption(skip, limit)
+	return rChat.GetAll(opt)
+}
+
+// ConversationsPage lists up to limit conversations, most recently active
+// first, along with their newest message. An empty cursor starts from the
+// most recent one, the cursor returned continues after the page and is
+// empty once the list is exhausted.
+func (m *Messenger) ConversationsPage(cursor string, limit int) ([]entity.ConversationSummary, string, error) {
+	opt := repo.NewOption(0, limit)
+	opt.AddFilter("before", cursor)
+	chats, err := m.getChatRepo().GetAll(opt)
+	if err != nil {
+		return nil, "", err
+	}
+	page := make([]entity.ConversationSummary, 0, len(chats))
+	for _, chat := range chats {
+		sum := entity.ConversationSummary{Chat: chat}
+		if chat.LastMessageID != "" {
+			last, err := m.GetMessage(chat.LastMessageID)
+			if err != nil {
+				return nil, "", err
+			}
+			sum.LastMessage = &last
+		}
+		page = append(page, sum)
+	}
+	next := ""
+	if limit > 0 && len(chats) == limit {
+		next = repo.ChatCursor(chats[len(chats)-1])
+	}
+	return page, next, nil
+}
+
+func (m *Messenger) CreatePMChat(contactID entity.ID) (entity.ChatInfo, error) {
+	c, err := m.GetContact(contactID)
+	chatID := m.generatePMChatID(c)
+	if err != nil {
+		return entity.ChatInfo{}, err
+	}
+	chat := m.CreateChat(chatID, []entity.Contact{*m.identity.Me(), c}, c.Name)
+	err = m.getChatRepo().Add(chat)
+	return chat, err
+}
+
+func (m *Messenger) GetPMChat(contactID entity.ID) (entity.ChatInfo, error) {
+	c, err := m.GetContact(contactID)
+	chatID := m.generatePMChatID(c)
+	if err != nil {
+		return entity.ChatInfo{}, err
+	}
+	chat, err := m.getChatRepo().GetByID(chatID)
+	return chat, err
+}
+
+func (m *Messenger) CreateChat(id entity.ID, members []entity.Contact, name string) entity.ChatInfo {
+	return entity.ChatInfo{
+		ID:      entity.ID(id),
+		Name:    name,
+		Members: members,
+	}
+}
+
+func (m *Messenger) MessageHandler(msg *pb.Message) {
+	switch msg.GetType() {
+	case entity.SeenType:
+		m.seenHandler(msg)
+		return
+	case entity.DeliveredType:
+		m.deliveredHandler(msg)
+		return
+	}
+	if msg.GetAttachment() != "" {
+		var err error
+		msg, err = m.attachedText(msg)
+		if err != nil {
+			log.Errorf("can not fetch text of %s %s", msg.GetId(), err.Error())
+			return
+		}
+	}
+	mAuthorID := entity.ID(msg.Author.Id)
+	rCon := m.getContactRepo()
+	con, err := rCon.GetByID(mAuthorID)
+	if msg.GetSealed() {
+		// only contacts share a key
+		msg, err = openText(msg, con.SharedKey)
+		if err != nil {
+			log.Errorf("can not open text of %s %s", msg.GetId(), err.Error())
+			return
+		}
+	}
+	if err != nil && m.opt.RequestFirst {
+		m.queueRequest(msg)
+		return
+	}
+	if err != nil {
+		log.Errorf("fail to get contact %s", err.Error())
+		con = entity.Contact{
+			ID:   mAuthorID,
+			Name: msg.Author.Name,
+		}
+		err := rCon.Add(con)
+		if err != nil {
+			log.Errorf("fail to add contact %s", err.Error())
+			return
+		}
+	}
+
+	newMsg := entity.Message{
+		ID:            entity.ID(msg.GetId()),
+		ChatID:        entity.ID(msg.GetChatId()),
+		CreatedAt:     msg.GetCreatedAt(),
+		Text:          msg.GetText(),
+		Status:        entity.Received,
+		Author:        con,
+		ForwardedFrom: forwardedFrom(msg),
+		Attachment:    msg.GetAttachment(),
+	}
+	if m.receive(newMsg) {
+		m.ack(newMsg, entity.DeliveredType)
+	}
+}
+
+// openText returns a copy of msg with its text decrypted with key.
+func openText(msg *pb.Message, key []byte) (*pb.Message, error) {
+	text, err := entity.OpenText(key, msg.GetText())
+	if err != nil {
+		return msg, err
+	}
+	msg = proto.Clone(msg).(*pb.Message)
+	msg.Text = text
+	msg.Sealed = false
+	return msg, nil
+}
+
+// attachedText returns a copy of msg holding the text sent as an
+// attachment, fetched before the message was acknowledged.
+func (m *Messenger) attachedText(msg *pb.Message) (*pb.Message, error) {
+	text, err := m.attach.local(msg.GetAttachment())
+	if err != nil {
+		return msg, err
+	}
+	msg = proto.Clone(msg).(*pb.Message)
+	msg.Text = string(text)
+	return msg, nil
+}
+
+func forwardedFrom(msg *pb.Message) *entity.Contact {
+	from := msg.GetForwardedFrom()
+	if from == nil {
+		return nil
+	}
+	return &entity.Contact{ID: entity.ID(from.GetId()), Name: from.GetName()}
+}
+
+// receive stores a message from a known contact, creating its chat if
+// needed, and reports whether it was stored. The author is not told.
+func (m *Messenger) receive(newMsg entity.Message) bool {
+	err := m.mw.applyReceive(&newMsg)
+	if err != nil {
+		log.Infof("message %s dropped by middleware: %s", newMsg.ID, err)
+		return false
+	}
+	rchat := m.getChatRepo()
+	chat, err := rchat.GetByID(newMsg.ChatID)
+	if err != nil {
+		log.Errorf("can not find chat %s", err.Error())
+		chat = m.CreateChat(newMsg.ChatID, []entity.Contact{*m.identity.Me(), newMsg.Author}, newMsg.Author.Name)
+		err := rchat.Add(chat)
+		if err != nil {
+			log.Errorf("fail to handle new message %s", err.Error())
+			return false
+		}
+	}
+	rmsg := m.getMessageRepo()
+	err = rmsg.Add(newMsg)
+	log.Debugf("new message %s ", newMsg)
+	if err != nil {
+		log.Errorf("Can not add message %s , %d", err.Error(), newMsg)
+		return false
+	}
+	chat.Unread++
+	err = rchat.Set(chat)
+	if err != nil {
+		log.Errorf("Can not update unread count %s", err.Error())
+	}
+
+	em, _ := m.bus.Emitter(new(event.EvtObject))
+	defer em.Close()
+	evgrp := event.NewMessagingEventGroup()
+	ev, _ := evgrp.Make("ChangeMessageStatus", entity.Received, newMsg.ID)
+	em.Emit(*ev)
+	return true
+}
+
+// queueRequest holds a message from a stranger until the request is accepted.
+func (m *Messenger) queueRequest(msg *pb.Message) {
+	rpr := m.getPendingRequestRepo()
+	author := entity.Contact{ID: entity.ID(msg.Author.Id), Name: msg.Author.Name}
+	pr, err := rpr.GetByID(author.ID)
+	if err != nil {
+		pr = entity.PendingRequest{
+			ID:        author.ID,
+			Name:      author.Name,
+			Intro:     msg.GetText(),
+			CreatedAt: time.Now().UTC().Unix(),
+		}
+	}
+	pr.Messages = append(pr.Messages, entity.Message{
+		ID:            entity.ID(msg.GetId()),
+		ChatID:        entity.ID(msg.GetChatId()),
+		CreatedAt:     msg.GetCreatedAt(),
+		Text:          msg.GetText(),
+		Status:        entity.Received,
+		Author:        author,
+		ForwardedFrom: forwardedFrom(msg),
+		Attachment:    msg.GetAttachment(),
+	})
+	err = rpr.Set(pr)
+	if err != nil {
+		log.Errorf("fail to queue request %s", err.Error())
+		return
+	}
+	m.ack(pr.Messages[len(pr.Messages)-1], entity.DeliveredType)
+}
+
+// ack answers the author of msg with a frame of typ. The receipt waits in
+// the outbox like a message while the author is offline.
+func (m *Messenger) ack(msg entity.Message, typ string) {
+	receipt := entity.Message{
+		ID:        msg.ID,
+		ChatID:    msg.ChatID,
+		CreatedAt: time.Now().UTC().Unix(),
+		Author:    *m.identity.Me(),
+	}
+	m.pms.Send(entity.Envelop{To: msg.Author, Message: receipt, Type: typ})
+}
+
+// seenHandler marks our own message as seen when its recipient reads it.
+func (m *Messenger) seenHandler(msg *pb.Message) {
+	sent, ok := m.ackedMessage(msg)
+	if !ok {
+		return
+	}
+	err := m.updateMessageStatus(sent.ID, entity.Seen)
+	if err != nil {
+		log.Errorf("Can not update message status %s", err.Error())
+		return
+	}
+	em, _ := m.bus.Emitter(new(event.EvtObject))
+	defer em.Close()
+	evgrp := event.NewMessagingEventGroup()
+	ev, _ := evgrp.Make("ChangeMessageStatus", entity.Seen, sent.ID)
+	em.Emit(*ev)
+	m.emitAck(sent.ID, event.AckRead)
+}
+
+// deliveredHandler announces that the recipient stored our message.
+func (m *Messenger) deliveredHandler(msg *pb.Message) {
+	sent, ok := m.ackedMessage(msg)
+	if !ok {
+		return
+	}
+	m.emitAck(sent.ID, event.AckDelivered)
+}
+
+// ackedMessage finds our message a receipt refers to. Receipts for
+// messages that are unknown or not ours, or sent by a peer outside the
+// chat of the message, are ignored.
+func (m *Messenger) ackedMessage(msg *pb.Message) (entity.Message, bool) {
+	sent, err := m.getMessageRepo().GetByID(entity.ID(msg.GetId()))
+	if err != nil || sent.Author.ID != m.identity.ID {
+		log.Debugf("ignore receipt for unknown message %s", msg.GetId())
+		return entity.Message{}, false
+	}
+	chat, err := m.getChatRepo().GetByID(sent.ChatID)
+	if err != nil {
+		log.Debugf("ignore receipt for message %s without chat", msg.GetId())
+		return entity.Message{}, false
+	}
+	from := entity.ID(msg.GetAuthor().GetId())
+	for _, member := range chat.Members {
+		if member.ID == from && from != m.identity.ID {
+			return sent, true
+		}
+	}
+	log.Debugf("ignore receipt for %s from %s outside its chat", msg.GetId(), from)
+	return entity.Message{}, false
+}
+
+func (m *Messenger) emitAck(id entity.ID, typ string) {
+	em, err := m.bus.Emitter(new(event.EvtMessageAcked))
+	if err != nil {
+		log.Errorf("can not create emitter. reason: %s", err)
+		return
+	}
+	defer em.Close()
+	em.Emit(event.EvtMessageAcked{MsgID: id, Type: typ})
+}
+
+// ClearUnread resets the unread counter of a chat without sending read receipts.
+func (m *Messenger) ClearUnread(chatID entity.ID) error {
+	rchat := m.getChatRepo()
+	chat, err := rchat.GetByID(chatID)
+	if err != nil {
+		return err
+	}
+	chat.Unread = 0
+	return rchat.Set(chat)
+}
+
+// MarkConversationRead marks received messages of a chat as seen, resets its
+// unread counter and lets the authors know with a read receipt.
+func (m *Messenger) MarkConversationRead(chatID entity.ID) error {
+	err := m.ClearUnread(chatID)
+	if err != nil {
+		return err
+	}
+	msgs, err := m.GetMessages(chatID, 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if msg.Status != entity.Received {
+			continue
+		}
+		err = m.updateMessageStatus(msg.ID, entity.Seen)
+		if err != nil {
+			return err
+		}
+		m.ack(msg, entity.SeenType)
+	}
+	return nil
+}
+
+// PendingRequests lists peers waiting to be accepted as contacts.
+func (m *Messenger) PendingRequests(skip int, limit int) ([]entity.PendingRequest, error) {
+	opt := repo.NewOption(skip, limit)
+	return m.getPendingRequestRepo().GetAll(opt)
+}
+
+// AcceptRequest adds the requesting peer as a contact and delivers its
+// queued messages, their author was told they arrived when they were queued.
+func (m *Messenger) AcceptRequest(id entity.ID) error {
+	rpr := m.getPendingRequestRepo()
+	pr, err := rpr.GetByID(id)
+	if err != nil {
+		return err
+	}
+	err = m.AddContact(entity.Contact{ID: pr.ID, Name: pr.Name})
+	if err != nil {
+		return err
+	}
+	for _, msg := range pr.Messages {
+		m.receive(msg)
+	}
+	return rpr.Delete(id)
+}
+
+// RejectRequest drops the request and all of its queued messages.
+func (m *Messenger) RejectRequest(id entity.ID) error {
+	return m.getPendingRequestRepo().Delete(id)
+}
+
+func (m *Messenger) SendPM(chatID entity.ID, content string) (*entity.Message, error) {
+	return m.SendPMOver(chatID, content, "")
+}
+
+// SendPMOver sends a message over proto instead of the negotiated message
+// protocol, proto must have a codec registered with RegisterCodec.
+func (m *Messenger) SendPMOver(chatID entity.ID, content string, proto protocol.ID) (*entity.Message, error) {
+	if _, ok := codecFor(proto); proto != "" && !ok {
+		return nil, ErrUnknownProtocol
+	}
+	msg := entity.Message{
+		ID:        entity.ID(uuid.New().String()),
+		ChatID:    chatID,
+		CreatedAt: time.Now().UTC().Unix(),
+		Text:      content,
+		Status:    entity.Pending,
+		Author:    *m.identity.Me(),
+	}
+	return m.send(msg, proto)
+}
+
+// Forward sends a copy of a message to a contact, crediting its original author.
+func (m *Messenger) Forward(msgID entity.ID, to entity.ID) (*entity.Message, error) {
+	orig, err := m.GetMessage(msgID)
+	if err != nil {
+		return nil, err
+	}
+	chat, err := m.GetPMChat(to)
+	if err != nil {
+		chat, err = m.CreatePMChat(to)
+		if err != nil {
+			return nil, err
+		}
+	}
+	from := orig.ForwardedFrom
+	if from == nil {
+		from = &orig.Author
+	}
+	msg := entity.Message{
+		ID:            entity.ID(uuid.New().String()),
+		ChatID:        chat.ID,
+		CreatedAt:     time.Now().UTC().Unix(),
+		Text:          orig.Text,
+		Status:        entity.Pending,
+		Author:        *m.identity.Me(),
+		ForwardedFrom: from,
+	}
+	return m.send(msg, "")
+}
+
+func (m *Messenger) send(msg entity.Message, proto protocol.ID) (*entity.Message, error) {
+	err := m.mw.applySend(&msg)
+	if err != nil {
+		return nil, err
+	}
+	if t := m.opt.AttachmentThreshold; t > 0 && len(msg.Text) > t {
+		msg.Attachment, err = m.attach.put([]byte(msg.Text))
+		if err != nil {
+			return nil, err
+		}
+	}
+	rmsg := m.getMessageRepo()
+	err = rmsg.Add(msg)
+	if err != nil {
+		log.Errorf("Can not add message %s", err.Error())
+		return nil, err
+	}
+	rchat := m.getChatRepo()
+	chat, err := rchat.GetByID(msg.ChatID)
+	if err != nil {
+		log.Errorf("Can not get chat %s", err.Error())
+		return nil, err
+	}
+	for _, to := range chat.Members {
+		if to.ID != msg.Author.ID {
+			sealed, err := m.sealFor(to.ID, msg)
+			if err != nil {
+				log.Errorf("can not seal message for %s %s", to.ID, err.Error())
+				continue
+			}
+			log.Debugf("outbox message")
+			m.pms.Send(entity.Envelop{To: to, Message: sealed, Protocol: proto})
+			log.Debugf("outboxed message")
+		}
+	}
+	return &msg, nil
+}
+
+// sealFor encrypts the text of msg when contact to shares a key, so only
+// ciphertext leaves the history. A text sent as an attachment is stored
+// sealed as one of its own.
+func (m *Messenger) sealFor(to entity.ID, msg entity.Message) (entity.Message, error) {
+	con, err := m.getContactRepo().GetByID(to)
+	if err != nil || len(con.SharedKey) == 0 {
+		return msg, nil
+	}
+	text, err := entity.SealText(con.SharedKey, msg.Text)
+	if err != nil {
+		return msg, err
+	}
+	if msg.Attachment != "" {
+		msg.Attachment, err = m.attach.put([]byte(text))
+		if err != nil {
+			return msg, err
+		}
+	}
+	msg.Text = text
+	msg.Sealed = true
+	return msg, nil
+}
+
+func (m *Messenger) GetMessages(chatID entity.ID, skip int, limit int) ([]entity.Message, error) {
+	opt := repo.NewOption(skip, limit)
+	opt.AddFilter("chatID", string(chatID))
+	return m.getMessageRepo().GetAll(opt)
+}
+
+func (m *Messenger) GetMessage(ID entity.ID) (entity.Message, error) {
+	return m.getMessageRepo().GetByID(ID)
+}
+
+// MessageStatuses reads the status of many messages at once. Unknown IDs
+// are left out of the result.
+func (m *Messenger) MessageStatuses(ids []entity.ID) (map[entity.ID]entity.Status, error) {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+	msgs, err := m.store.MsgsByIDs(strs)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[entity.ID]entity.Status, len(msgs))
+	for _, msg := range msgs {
+		res[entity.ID(msg.ID)] = entity.Status(msg.Status)
+	}
+	return res, nil
+}
+
+// MessagesAround returns up to before messages preceding anchor in the
+// conversation with pid, the anchor itself and up to after messages
+// following it, oldest first.
+func (m *Messenger) MessagesAround(pid peer.ID, anchor entity.ID, before, after int) ([]entity.Message, error) {
+	chatID := m.generatePMChatID(entity.Contact{ID: entity.ID(pid.String())})
+	msg, err := m.GetMessage(anchor)
+	if err != nil {
+		return nil, err
+	}
+	if msg.ChatID != chatID {
+		return nil, ErrNotInChat
+	}
+	rmsg := m.getMessageRepo()
+	opt := repo.NewOption(0, before)
+	opt.AddFilter("chatID", string(chatID))
+	opt.AddFilter("before", string(anchor))
+	older, err := rmsg.GetAll(opt)
+	if err != nil {
+		return nil, err
+	}
+	opt = repo.NewOption(0, after)
+	opt.AddFilter("chatID", string(chatID))
+	opt.AddFilter("after", string(anchor))
+	newer, err := rmsg.GetAll(opt)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]entity.Message, 0, len(older)+1+len(newer))
+	for i := len(older) - 1; i >= 0; i-- {
+		msgs = append(msgs, older[i])
+	}
+	msgs = append(msgs, msg)
+	return append(msgs, newer...), nil
+}
+
+// ExportConversation writes the conversation with pid to w as a JSON array
+// of messages, oldest first.
+func (m *Messenger) ExportConversation(pid peer.ID, w io.Writer) error {
+	chatID := m.generatePMChatID(entity.Contact{ID: entity.ID(pid.String())})
+	_, err := m.GetChat(chatID)
+	if err != nil {
+		return err
+	}
+	msgs := make([]entity.Message, 0)
+	for skip := 0; ; skip += ExportPageSize {
+		page, err := m.GetMessages(chatID, skip, ExportPageSize)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, page...)
+		if len(page) < ExportPageSize {
+			break
+		}
+	}
+	// messages are listed newest first
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(msgs)
+}
+
+// Snapshot writes the identity, contacts, chats with their history,
+// pending requests, favorites and the outbox as one bundle, encrypted with
+// the repo passphrase. A repo without one can't be snapshotted.
+func (m *Messenger) Snapshot(w io.Writer) error {
+	if m.opt.Passphrase == "" {
+		return ErrSnapshotPassphrase
+	}
+	b, err := m.store.Export()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	sealed, err := entity.SealWithPassphrase(data, m.opt.Passphrase)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// Restore decrypts a bundle made by Snapshot with passphrase and writes it
+// into the repo at path, which must not hold an identity yet. Open it with
+// MessengerBuilder afterwards, using the same passphrase.
+func Restore(r io.Reader, passphrase string, path string) error {
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	data, err := entity.OpenWithPassphrase(sealed, passphrase)
+	if err != nil {
+		return err
+	}
+	var b store.BHBundle
+	err = json.Unmarshal(data, &b)
+	if err != nil {
+		return err
+	}
+	err = checkWritable(path)
+	if err != nil {
+		return err
+	}
+	s, err := store.NewStore(path + "/store")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if _, err := s.GetIdentity(); err == nil {
+		return ErrRepoExists
+	}
+	return s.Import(b)
+}
+
+// identityExport is the blob written by ExportIdentity.
+type identityExport struct {
+	ID       entity.ID
+	Name     string
+	Nickname string
+	// Key is the identity key encrypted with the export passphrase
+	Key       string
+	NetConfig *store.BHNetConfig `json:",omitempty"`
+}
+
+// ExportIdentity writes the identity and the listen settings of the node
+// as a blob to move them to another device with ImportIdentity. The key is
+// encrypted with passphrase, whatever the repo passphrase is.
+func (m *Messenger) ExportIdentity(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, ErrExportPassphrase
+	}
+	sk, err := m.identity.DecodePrivateKey(m.opt.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	skbytes, err := crypto.MarshalPrivateKey(sk)
+	if err != nil {
+		return nil, err
+	}
+	iden := *m.identity
+	iden.PrivKey = base64.StdEncoding.EncodeToString(skbytes)
+	if err := iden.EncryptPrivateKey(passphrase); err != nil {
+		return nil, err
+	}
+	exp := identityExport{ID: iden.ID, Name: iden.Name, Nickname: iden.Nickname, Key: iden.PrivKey}
+	conf, err := m.store.GetNetConfig()
+	if err == nil {
+		exp.NetConfig = &conf
+	}
+	return json.Marshal(exp)
+}
+
+// ImportIdentity writes a fresh repo at configRoot holding the identity
+// exported in blob, with its key still encrypted with passphrase. Open it
+// with MessengerBuilder using that passphrase. A repo already holding an
+// identity is only replaced, history included, when overwrite is set, and
+// must not be open.
+func ImportIdentity(blob []byte, passphrase string, configRoot string, overwrite bool) error {
+	var exp identityExport
+	if err := json.Unmarshal(blob, &exp); err != nil {
+		return err
+	}
+	iden := entity.Identity{ID: exp.ID, Name: exp.Name, Nickname: exp.Nickname, PrivKey: exp.Key}
+	sk, err := iden.DecodePrivateKey(passphrase)
+	if err != nil {
+		return err
+	}
+	id, err := peer.IDFromPrivateKey(sk)
+	if err != nil {
+		return err
+	}
+	if entity.ID(id.String()) != iden.ID {
+		return ErrIdentityMismatch
+	}
+	if err := checkWritable(configRoot); err != nil {
+		return err
+	}
+	s, err := store.NewStore(configRoot + "/store")
+	if err != nil {
+		return err
+	}
+	_, err = s.GetIdentity()
+	s.Close()
+	if err == nil {
+		if !overwrite {
+			return ErrRepoExists
+		}
+		if err := os.RemoveAll(configRoot + "/store"); err != nil {
+			return err
+		}
+	}
+	s, err = store.NewStore(configRoot + "/store")
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if exp.NetConfig != nil {
+		if err := s.SetNetConfig(*exp.NetConfig); err != nil {
+			return err
+		}
+	}
+	return repo.NewIdentityRepo(s).Set(iden)
+}
+
+// SearchMessages lists the messages of chatID containing text, ignoring
+// case, newest first. When ctx ends before the whole history is scanned the
+// matches found so far are returned with truncated set.
+func (m *Messenger) SearchMessages(ctx context.Context, chatID entity.ID, text string) (res []entity.Message, truncated bool, err error) {
+	text = strings.ToLower(text)
+	for skip := 0; ; skip += SearchPageSize {
+		if ctx.Err() != nil {
+			return res, true, nil
+		}
+		page, err := m.GetMessages(chatID, skip, SearchPageSize)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, msg := range page {
+			if strings.Contains(strings.ToLower(msg.Text), text) {
+				res = append(res, msg)
+			}
+		}
+		if len(page) < SearchPageSize {
+			return res, false, nil
+		}
+	}
+}
+
+func (m *Messenger) generatePMChatID(con entity.Contact) entity.ID {
+	cons := []string{con.ID.String(), m.identity.Me().ID.String()}
+	sort.Strings(cons)
+	return entity.ID(strings.Join(cons, ""))
+}
+
+func (m *Messenger) updateMessageStatus(msgID entity.ID, status entity.Status) error {
+	rmsg := m.getMessageRepo()
+	msg, err := rmsg.GetByID(msgID)
+	if err != nil {
+		return err
+	}
+	msg.Status = status
+	err = rmsg.Set(msg)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// OnContactOnline calls fn every time a saved contact becomes reachable.
+func (m *Messenger) OnContactOnline(fn func(peer.ID)) error {
+	sub, err := m.bus.Subscribe(new(event.EvtContactOnline))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer sub.Close()
+		for e := range sub.Out() {
+			fn(e.(event.EvtContactOnline).ID)
+		}
+	}()
+	return nil
+}
+
+// StorageUsage estimates how much space chat data takes.
+func (m *Messenger) StorageUsage() (entity.StorageStats, error) {
+	history, err := m.store.Usage(store.BHTextMessage{}, store.BHChat{})
+	if err != nil {
+		return entity.StorageStats{}, err
+	}
+	contacts, err := m.store.Usage(store.BHContact{}, store.BHPendingRequest{}, store.BHFavorite{})
+	if err != nil {
+		return entity.StorageStats{}, err
+	}
+	return entity.StorageStats{
+		Outbox:   m.pms.OutboxSize(),
+		History:  history,
+		Contacts: contacts,
+		Disk:     m.store.DiskUsage(),
+	}, nil
+}
+
+// SendLatencyStats reports percentiles of the time recent messages took
+// from SendPM to reaching the recipient.
+func (m *Messenger) SendLatencyStats() LatencyStats {
+	return m.pms.SendLatency()
+}
+
+// StreamInfo describes an open stream.
+type StreamInfo struct {
+	Peer      peer.ID
+	Protocol  protocol.ID
+	Direction network.Direction
+	Age       time.Duration
+}
+
+// ActiveStreams lists the streams open on all connections, to spot
+// leaked or stuck ones.
+func (m *Messenger) ActiveStreams() []StreamInfo {
+	now := time.Now()
+	var infos []StreamInfo
+	for _, c := range m.Host.Network().Conns() {
+		for _, s := range c.GetStreams() {
+			st := s.Stat()
+			infos = append(infos, StreamInfo{
+				Peer:      c.RemotePeer(),
+				Protocol:  s.Protocol(),
+				Direction: st.Direction,
+				Age:       now.Sub(st.Opened),
+			})
+		}
+	}
+	return infos
+}
+
+// HolePunchRelayOnly reports whether hole punching pid failed often enough
+// that it's only reached through relays. Each hole punch is emitted as
+// event.EvtHolePunch as it starts and ends.
+func (m *Messenger) HolePunchRelayOnly(pid peer.ID) bool {
+	return m.punch != nil && m.punch.RelayOnly(pid)
+}
+
+// SetBootstrapMinPeers changes the number of connections below which
+// bootstrap peers are dialed. It takes effect on the next bootstrap round.
+func (m *Messenger) SetBootstrapMinPeers(n int) error {
+	if n < 0 {
+		return ErrBootstrapMinPeers
+	}
+	b, ok := m.Host.(bootstrapTuner)
+	if !ok {
+		return ErrNotRouted
+	}
+	b.SetBootstrapMinPeers(n)
+	return nil
+}
+
+// DHTMode is the mode the DHT currently runs in, dht.ModeClient or
+// dht.ModeServer. In auto mode it changes with reachability.
+func (m *Messenger) DHTMode() (dht.ModeOpt, error) {
+	if _, ok := m.Host.(Routed); !ok {
+		return 0, ErrNotRouted
+	}
+	// only servers answer DHT queries
+	for _, p := range m.Host.Mux().Protocols() {
+		if protocol.ID(p) == dht.ProtocolDHT {
+			return dht.ModeServer, nil
+		}
+	}
+	return dht.ModeClient, nil
+}
+
+// ConnManager is the connection manager of the host, nil when the host
+// was built with one other than the libp2p basic manager.
+func (m *Messenger) ConnManager() *connmgr.BasicConnMgr {
+	cm, _ := m.Host.ConnManager().(*connmgr.BasicConnMgr)
+	return cm
+}
+
+// OutboxDepth is the number of messages waiting for delivery.
+func (m *Messenger) OutboxDepth() int {
+	return m.pms.Pending()
+}
+
+// OutboxDepthChanged yields the outbox depth, starting with the current
+// one, each time it changes.
+func (m *Messenger) OutboxDepthChanged() <-chan int {
+	out := make(chan int, 16)
+	sub, err := m.bus.Subscribe(new(event.EvtOutboxDepthChanged))
+	if err != nil {
+		log.Errorf("can not subscribe to outbox depth %s", err.Error())
+		close(out)
+		return out
+	}
+	go func() {
+		defer close(out)
+		defer sub.Close()
+		for e := range sub.Out() {
+			depth := e.(event.EvtOutboxDepthChanged).Depth
+			// never block the bus on a slow reader, the latest depth wins
+			select {
+			case out <- depth:
+			default:
+				select {
+				case <-out:
+				default:
+				}
+				out <- depth
+			}
+		}
+	}()
+	return out
+}
+
+// DroppedMessages is the number of outgoing messages dropped due to backpressure.
+func (m *Messenger) DroppedMessages() uint64 {
+	return m.pms.Dropped()
+}
+
+// Pause takes the node offline: existing connections are closed and no
+// connection is dialed or accepted until Resume. Messages sent meanwhile
+// wait in the outbox.
+func (m *Messenger) Pause() {
+	m.gater.pause()
+	for _, p := range m.Host.Network().Peers() {
+		m.Host.Network().ClosePeer(p)
+	}
+}
+
+// Resume brings a paused node back online and delivers queued messages.
+func (m *Messenger) Resume() {
+	m.gater.resume()
+	m.pms.Flush()
+}
+
+// blockPeer drops the connections of pid and refuses new ones for d.
+func (m *Messenger) blockPeer(pid peer.ID, d time.Duration) {
+	m.gater.block(pid, time.Now().Add(d))
+	m.Host.Network().ClosePeer(pid)
+}
+
+// Block drops the connections of pid and refuses its dials and streams
+// until Unblock, across restarts.
+func (m *Messenger) Block(pid peer.ID) error {
+	err := m.getBlockedRepo().Add(entity.ID(pid.String()))
+	if err != nil {
+		return err
+	}
+	m.gater.block(pid, time.Time{})
+	if m.Host != nil {
+		m.Host.Network().ClosePeer(pid)
+	}
+	return nil
+}
+
+func (m *Messenger) Unblock(pid peer.ID) error {
+	err := m.getBlockedRepo().Delete(entity.ID(pid.String()))
+	if err != nil {
+		return err
+	}
+	m.gater.unblock(pid)
+	return nil
+}
+
+// BlockedPeers lists the peers blocked with Block.
+func (m *Messenger) BlockedPeers() ([]peer.ID, error) {
+	ids, err := m.getBlockedRepo().GetAll(repo.NewOption(0, 0))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]peer.ID, 0, len(ids))
+	for _, id := range ids {
+		pid, err := peer.Decode(id.String())
+		if err != nil {
+			log.Errorf("invalid blocked peer %s", err.Error())
+			continue
+		}
+		res = append(res, pid)
+	}
+	return res, nil
+}
+
+// loadBlocked hands the persisted blocklist to the gater before the host
+// accepts any connection.
+func (m *Messenger) loadBlocked() error {
+	pids, err := m.BlockedPeers()
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		m.gater.block(pid, time.Time{})
+	}
+	return nil
+}
+
+// Paused reports whether networking is paused.
+func (m *Messenger) Paused() bool {
+	return m.gater.Paused()
+}
+
+// RepublishProviderRecords re-announces the node on the DHT, e.g. after a
+// long offline period let its provider records expire.
+func (m *Messenger) RepublishProviderRecords(ctx context.Context) error {
+	return m.disc.Republish(ctx)
+}
+
+// NetworkChanged refreshes the node after the OS reports a network change.
+// Connections over the old network are dropped, the new addresses announced,
+// the DHT bootstrapped again and the outbox flushed over fresh connections.
+// Favorites reconnect on their own once dropped.
+func (m *Messenger) NetworkChanged() {
+	for _, c := range m.Host.Network().Conns() {
+		c.Close()
+	}
+	if s, ok := m.Host.(addrSignaler); ok {
+		s.SignalAddressChange()
+	}
+	if r, ok := m.Host.(Routed); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), ConnectTimeout)
+		defer cancel()
+		// the bootstrap peers were dropped along with the rest
+		if bh, ok := m.Host.(Bootstrapper); ok {
+			if err := bh.Bootstrap(ctx); err != nil {
+				log.Errorf("bootstrap failed: %s", err)
+			}
+		}
+		select {
+		case err := <-r.DHT().ForceRefresh():
+			if err != nil {
+				log.Errorf("dht refresh failed: %s", err)
+			}
+		case <-ctx.Done():
+		}
+		if err := m.disc.Republish(ctx); err != nil {
+			log.Errorf("republish failed: %s", err)
+		}
+	}
+	m.pms.Flush()
+}
+
+// AddSendMiddleware appends fn to the chain run on outgoing messages before
+// they are stored and sent. An error drops the message and is returned to
+// the sender.
+func (m *Messenger) AddSendMiddleware(fn Middleware) {
+	m.mw.addSend(fn)
+}
+
+// AddReceiveMiddleware appends fn to the chain run on incoming messages
+// before they are stored. An error drops the message.
+func (m *Messenger) AddReceiveMiddleware(fn Middleware) {
+	m.mw.addReceive(fn)
+}
+
+// ResetDHT rebuilds the DHT from the bootstrap peers, for recovery from a
+// corrupted routing state, without restarting the host.
+func (m *Messenger) ResetDHT(ctx context.Context) error {
+	r, ok := m.Host.(Routed)
+	if !ok {
+		return ErrNotRouted
+	}
+	return r.ResetDHT(ctx)
+}
+
+// DiscoveredPeers yields each reachable peer the node learns about once.
+func (m *Messenger) DiscoveredPeers() <-chan peer.AddrInfo {
+	return m.disc.Peers()
+}
+
+func (m *Messenger) EventBus() lpevt.Bus {
+	return m.bus
+}
+
+// Close tears the messenger down: services stop first, then the host
+// closes its connections, DHT and listeners, and the store is closed last
+// once nothing can write to it. It waits for event handling to finish
+// until ctx ends, so a new messenger can take over the same path and ports.
+// A messenger never started only closes its store.
+func (m *Messenger) Close(ctx context.Context) error {
+	if m.Host == nil {
+		if m.store != nil {
+			m.store.Close()
+		}
+		return nil
+	}
+	herr := m.shutdown(ctx)
+	m.store.Close()
+	if m.opt.keys != nil {
+		m.opt.keys.clear()
+	}
+	if herr != nil {
+		return herr
+	}
+	return ctx.Err()
+}
+
+// shutdown stops the services and closes the host, waiting for the event
+// handlers until ctx ends. The store stays open.
+func (m *Messenger) shutdown(ctx context.Context) error {
+	if m.presence != nil {
+		m.presence.Stop(ctx)
+	}
+	m.refresh()
+	m.disc.Stop()
+	m.chal.Stop()
+	m.files.Stop()
+	m.attach.Stop()
+	m.typing.Stop()
+	m.unknown.Stop()
+	m.profile.Stop()
 	m.pms.Stop()
-	m.Host.Close()
+	m.favorite.Stop()
+	m.groups.stop()
+	m.nat.stop()
+	for _, sub := range m.subs {
+		sub.Close()
+	}
+	herr := m.Host.Close()
+
+	done := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Errorf("event handlers still running at close")
+	}
+	return herr
+}
+
+// Stop is Close with StopTimeout, errors are logged.
+func (m *Messenger) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), StopTimeout)
+	defer cancel()
+	if err := m.Close(ctx); err != nil {
+		log.Errorf("close failed %s", err.Error())
+	}
+}
+
+type msgrNotifiee Messenger
+
+func (mn *msgrNotifiee) messenger() *Messenger {
+	return (*Messenger)(mn)
+}
+
+func (mn *msgrNotifiee) Listen(network.Network, ma.Multiaddr)       {}
+func (mn *msgrNotifiee) ListenClose(network.Network, ma.Multiaddr)  {}
+func (mn *msgrNotifiee) Disconnected(network.Network, network.Conn) {}
+func (mn *msgrNotifiee) Connected(n network.Network, c network.Conn) {
+	pid := c.RemotePeer()
+	// only the first connection to a peer means it came online
+	if len(n.ConnsToPeer(pid)) > 1 {
+		return
+	}
+	_, err := mn.messenger().GetContact(entity.ID(pid.String()))
+	if err != nil {
+		return
+	}
+	if mn.presence != nil {
+		go mn.presence.announceTo(pid)
+	}
+	em, err := mn.bus.Emitter(new(event.EvtContactOnline))
+	if err != nil {
+		log.Errorf("can not create emitter. reason: %s", err)
+		return
+	}
+	defer em.Close()
+	em.Emit(event.EvtContactOnline{ID: pid})
 }
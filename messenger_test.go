@@ -1,29 +1,101 @@
 package core_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/hood-chat/core"
 	"github.com/hood-chat/core/entity"
+	"github.com/hood-chat/core/event"
+	"github.com/hood-chat/core/pb"
+	"github.com/hood-chat/core/repo"
+	"github.com/hood-chat/core/store"
+	"github.com/hood-chat/core/utils"
 	logging "github.com/ipfs/go-log"
+	logv2 "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	lpevent "github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/discovery/backoff"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
+	"github.com/libp2p/go-libp2p/p2p/net/swarm"
+	"github.com/libp2p/go-libp2p/p2p/protocol/circuitv2/client"
+	tls "github.com/libp2p/go-libp2p/p2p/security/tls"
+	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	"github.com/libp2p/go-msgio"
+	ma "github.com/multiformats/go-multiaddr"
 	"github.com/stretchr/testify/require"
+	"github.com/timshannon/badgerhold/v4"
+	"google.golang.org/protobuf/proto"
 )
 
+// localHost builds a plain host listening on loopback, no bootstrap needed.
+type localHost struct{}
+
+func (localHost) Create(opt core.Option) (host.Host, error) {
+	lpOpt := append(opt.LpOpt, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	return libp2p.New(lpOpt...)
+}
+
+func newTestMessenger(t *testing.T, name string) *core.Messenger {
+	return newTestMessengerWithOption(t, name, core.Option{})
+}
+
+func newTestMessengerWithOption(t *testing.T, name string, opt core.Option) *core.Messenger {
+	mr, err := core.MessengerBuilder(t.TempDir()+"/"+name, opt, localHost{})
+	require.NoError(t, err)
+	_, err = mr.SignUp(name)
+	require.NoError(t, err)
+	t.Cleanup(mr.Stop)
+	return &mr
+}
+
+func connect(t *testing.T, a, b *core.Messenger) {
+	pi := peer.AddrInfo{ID: b.Host.ID(), Addrs: b.Host.Addrs()}
+	require.NoError(t, a.Host.Connect(context.Background(), pi))
+}
+
 func TestMessenger(t *testing.T) {
 	t.Log("start test")
 	err := logging.SetLogLevel("msgr-core", "DEBUG")
 	require.NoError(t, err)
-	opt1 := core.DefaultOption()
-	opt2 := core.DefaultOption()
-	mr1 := core.MessengerBuilder(t.TempDir()+"/h1", opt1, core.DefaultRoutedHost{})
+	opt1, err := core.DefaultOption()
+	require.NoError(t, err)
+	opt2, err := core.DefaultOption()
+	require.NoError(t, err)
+	mr1, err := core.MessengerBuilder(t.TempDir()+"/h1", opt1, core.DefaultRoutedHost{})
+	require.NoError(t, err)
 	t.Log("somthing wrong")
 	_, err = mr1.SignUp("h1")
 	require.NoError(t, err)
 	t.Log("messenger 1 created")
 	_, err = mr1.GetIdentity()
 	require.NoError(t, err)
-	mr2 := core.MessengerBuilder(t.TempDir()+"/h2", opt2, core.DefaultRoutedHost{})
+	mr2, err := core.MessengerBuilder(t.TempDir()+"/h2", opt2, core.DefaultRoutedHost{})
+	require.NoError(t, err)
 	_, err = mr2.SignUp("h2")
 	require.NoError(t, err)
 	user2, err := mr2.GetIdentity()
@@ -66,3 +138,3157 @@ func TestMessenger(t *testing.T) {
 	mr2.Stop()
 
 }
+
+func TestOnContactOnline(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	mr3 := newTestMessenger(t, "h3")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+
+	online := make(chan peer.ID, 10)
+	require.NoError(t, mr1.OnContactOnline(func(p peer.ID) { online <- p }))
+
+	// strangers should not trigger the callback
+	connect(t, mr1, mr3)
+	connect(t, mr1, mr2)
+	select {
+	case p := <-online:
+		require.Equal(t, mr2.Host.ID(), p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback not fired")
+	}
+	require.Never(t, func() bool { return len(online) > 0 }, time.Second, 100*time.Millisecond)
+}
+
+func TestAddContactFromInvite(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+
+	invite := mr2.Host.Addrs()[0].String() + "/p2p/" + mr2.Host.ID().String()
+	con, err := mr1.AddContactFromInvite(context.Background(), invite)
+	require.NoError(t, err)
+	require.Equal(t, "h2", con.Name)
+	require.Equal(t, mr2.Host.ID().String(), con.ID.String())
+
+	saved, err := mr1.GetContact(con.ID)
+	require.NoError(t, err)
+	require.Equal(t, con, saved)
+}
+
+func TestChallengePeer(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	connect(t, mr1, mr2)
+
+	id := entity.ID(mr2.Host.ID().String())
+	require.NoError(t, mr1.AddContact(entity.Contact{ID: id, Name: "h2"}))
+	require.NoError(t, mr1.ChallengePeer(context.Background(), mr2.Host.ID()))
+
+	con, err := mr1.GetContact(id)
+	require.NoError(t, err)
+	require.True(t, con.Verified)
+}
+
+func TestPendingRequests(t *testing.T) {
+	path := t.TempDir() + "/h1"
+	opt := core.Option{RequestFirst: true}
+	mr1, err := core.MessengerBuilder(path, opt, localHost{})
+	require.NoError(t, err)
+	user1, err := mr1.SignUp("h1")
+	require.NoError(t, err)
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+
+	require.NoError(t, mr2.AddContact(*user1.Me()))
+	chat, err := mr2.CreatePMChat(user1.ID)
+	require.NoError(t, err)
+	connect(t, mr2, &mr1)
+	acks, err := mr2.EventBus().Subscribe(new(event.EvtMessageAcked))
+	require.NoError(t, err)
+	defer acks.Close()
+	_, err = mr2.SendPM(chat.ID, "hi, it's h2")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		prs, err := mr1.PendingRequests(0, 10)
+		return err == nil && len(prs) == 1
+	}, 5*time.Second, 100*time.Millisecond)
+	select {
+	case e := <-acks.Out():
+		require.Equal(t, event.AckDelivered, e.(event.EvtMessageAcked).Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued request not acked")
+	}
+	_, err = mr1.GetContact(user2.ID)
+	require.Error(t, err)
+
+	// restart and make sure the queue survived
+	mr1.Stop()
+	mr1, err = core.MessengerBuilder(path, opt, localHost{})
+	require.NoError(t, err)
+	t.Cleanup(mr1.Stop)
+	prs, err := mr1.PendingRequests(0, 10)
+	require.NoError(t, err)
+	require.Len(t, prs, 1)
+	require.Equal(t, user2.ID, prs[0].ID)
+	require.Equal(t, "h2", prs[0].Name)
+	require.Equal(t, "hi, it's h2", prs[0].Intro)
+
+	require.NoError(t, mr1.AcceptRequest(user2.ID))
+	con, err := mr1.GetContact(user2.ID)
+	require.NoError(t, err)
+	require.Equal(t, "h2", con.Name)
+	msgs, err := mr1.GetMessages(chat.ID, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	prs, err = mr1.PendingRequests(0, 10)
+	require.NoError(t, err)
+	require.Empty(t, prs)
+	// accepting doesn't ack the queued messages again
+	connect(t, mr2, &mr1)
+	select {
+	case e := <-acks.Out():
+		t.Fatalf("unexpected ack %v", e)
+	case <-time.After(time.Second):
+	}
+}
+
+func TestClearUnread(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	connect(t, mr1, mr2)
+
+	unread := func(n int) func() bool {
+		return func() bool {
+			c, err := mr2.GetChat(chat.ID)
+			return err == nil && c.Unread == n
+		}
+	}
+	statuses := func(s entity.Status) func() bool {
+		return func() bool {
+			msgs, err := mr1.GetMessages(chat.ID, 0, 10)
+			if err != nil {
+				return false
+			}
+			for _, msg := range msgs {
+				if msg.Status != s {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	_, err = mr1.SendPM(chat.ID, "one")
+	require.NoError(t, err)
+	_, err = mr1.SendPM(chat.ID, "two")
+	require.NoError(t, err)
+	require.Eventually(t, unread(2), 5*time.Second, 100*time.Millisecond)
+	require.Eventually(t, statuses(entity.Sent), 5*time.Second, 100*time.Millisecond)
+
+	// clearing the badge must not tell the sender
+	require.NoError(t, mr2.ClearUnread(chat.ID))
+	require.True(t, unread(0)())
+	require.Never(t, statuses(entity.Seen), 2*time.Second, 100*time.Millisecond)
+
+	_, err = mr1.SendPM(chat.ID, "three")
+	require.NoError(t, err)
+	require.Eventually(t, unread(1), 5*time.Second, 100*time.Millisecond)
+	require.NoError(t, mr2.MarkConversationRead(chat.ID))
+	require.True(t, unread(0)())
+	require.Eventually(t, statuses(entity.Seen), 5*time.Second, 100*time.Millisecond)
+}
+
+func newRelay(t *testing.T, opts ...libp2p.Option) host.Host {
+	relay, err := libp2p.New(append([]libp2p.Option{
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+		libp2p.EnableRelayService(),
+		libp2p.ForceReachabilityPublic(),
+	}, opts...)...)
+	require.NoError(t, err)
+	t.Cleanup(func() { relay.Close() })
+	return relay
+}
+
+func TestConnectViaRelay(t *testing.T) {
+	relay := newRelay(t)
+	relayInfo := peer.AddrInfo{ID: relay.ID(), Addrs: relay.Addrs()}
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+
+	require.NoError(t, mr2.Host.Connect(context.Background(), relayInfo))
+	_, err := client.Reserve(context.Background(), mr2.Host, relayInfo)
+	require.NoError(t, err)
+	// a direct connection is replaced by the relayed one
+	connect(t, mr1, mr2)
+
+	err = mr1.ConnectViaRelay(context.Background(), mr2.Host.ID(), relayInfo)
+	require.NoError(t, err)
+	require.Equal(t, network.Connected, mr1.Host.Network().Connectedness(mr2.Host.ID()))
+	conns := mr1.Host.Network().ConnsToPeer(mr2.Host.ID())
+	require.NotEmpty(t, conns)
+	for _, c := range conns {
+		_, err = c.RemoteMultiaddr().ValueForProtocol(ma.P_CIRCUIT)
+		require.NoError(t, err)
+	}
+	// the direct addresses are kept for later dials
+	require.NotEmpty(t, mr1.Host.Peerstore().Addrs(mr2.Host.ID()))
+}
+
+func TestFavoriteReconnect(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	connect(t, mr1, mr2)
+
+	require.NoError(t, mr1.AddFavorite(user2.ID))
+	favs, err := mr1.Favorites()
+	require.NoError(t, err)
+	require.Equal(t, []entity.ID{user2.ID}, favs)
+	require.True(t, mr1.Host.ConnManager().IsProtected(mr2.Host.ID(), core.FavoriteProc))
+
+	require.NoError(t, mr1.Host.Network().ClosePeer(mr2.Host.ID()))
+	require.Eventually(t, func() bool {
+		return mr1.Host.Network().Connectedness(mr2.Host.ID()) == network.Connected
+	}, 20*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, mr1.RemoveFavorite(user2.ID))
+	require.False(t, mr1.Host.ConnManager().IsProtected(mr2.Host.ID(), core.FavoriteProc))
+}
+
+func TestForward(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	mr3 := newTestMessenger(t, "h3")
+	user1, err := mr1.GetIdentity()
+	require.NoError(t, err)
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	user3, err := mr3.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	require.NoError(t, mr2.AddContact(*user3.Me()))
+	connect(t, mr1, mr2)
+	connect(t, mr2, mr3)
+
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	orig, err := mr1.SendPM(chat.ID, "pass it on")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := mr2.GetMessage(orig.ID)
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+
+	fwd, err := mr2.Forward(orig.ID, user3.ID)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := mr3.GetMessage(fwd.ID)
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	got, err := mr3.GetMessage(fwd.ID)
+	require.NoError(t, err)
+	require.Equal(t, "pass it on", got.Text)
+	require.Equal(t, user2.ID, got.Author.ID)
+	require.NotNil(t, got.ForwardedFrom)
+	require.Equal(t, *user1.Me(), *got.ForwardedFrom)
+}
+
+func TestPauseResume(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	connect(t, mr1, mr2)
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+
+	mr1.Pause()
+	require.True(t, mr1.Paused())
+	require.Empty(t, mr1.Host.Network().Peers())
+	msg, err := mr1.SendPM(chat.ID, "while offline")
+	require.NoError(t, err)
+	require.Never(t, func() bool { return len(mr1.Host.Network().Peers()) > 0 }, time.Second, 100*time.Millisecond)
+	usage, err := mr1.StorageUsage()
+	require.NoError(t, err)
+	require.Greater(t, usage.Outbox, int64(0))
+
+	mr1.Resume()
+	require.False(t, mr1.Paused())
+	require.Eventually(t, func() bool {
+		_, err := mr2.GetMessage(msg.ID)
+		return err == nil
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestInboundBlock(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessengerWithOption(t, "h2", core.Option{Inbound: core.InboundPolicy{
+		Messages: 1, Interval: time.Hour, Strikes: 1, BlockFor: time.Hour,
+	}})
+	connect(t, mr1, mr2)
+
+	// the second stream is over the rate and the first strike blocks
+	for i := 0; i < 2; i++ {
+		s, err := mr1.Host.NewStream(context.Background(), mr2.Host.ID(), core.ID)
+		require.NoError(t, err)
+		_, err = s.Write([]byte(core.DefaultFrameMagic))
+		require.NoError(t, err)
+		defer s.Reset()
+	}
+	require.Eventually(t, func() bool {
+		return mr2.Host.Network().Connectedness(mr1.Host.ID()) != network.Connected
+	}, 5*time.Second, 50*time.Millisecond)
+
+	pi := peer.AddrInfo{ID: mr2.Host.ID(), Addrs: mr2.Host.Addrs()}
+	mr1.Host.Connect(context.Background(), pi)
+	require.Never(t, func() bool {
+		return mr2.Host.Network().Connectedness(mr1.Host.ID()) == network.Connected
+	}, time.Second, 100*time.Millisecond)
+}
+
+func TestBlock(t *testing.T) {
+	path := t.TempDir() + "/h1"
+	mr1, err := core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	_, err = mr1.SignUp("h1")
+	require.NoError(t, err)
+	mr2 := newTestMessenger(t, "h2")
+	connect(t, &mr1, mr2)
+
+	require.NoError(t, mr1.Block(mr2.Host.ID()))
+	require.Eventually(t, func() bool {
+		return mr1.Host.Network().Connectedness(mr2.Host.ID()) != network.Connected
+	}, 5*time.Second, 50*time.Millisecond)
+	refused := func() {
+		pi := peer.AddrInfo{ID: mr1.Host.ID(), Addrs: mr1.Host.Addrs()}
+		mr2.Host.Connect(context.Background(), pi)
+		require.Never(t, func() bool {
+			return mr1.Host.Network().Connectedness(mr2.Host.ID()) == network.Connected
+		}, time.Second, 100*time.Millisecond)
+	}
+	refused()
+
+	// the blocklist survives a restart
+	mr1.Stop()
+	mr1, err = core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	defer mr1.Stop()
+	blocked, err := mr1.BlockedPeers()
+	require.NoError(t, err)
+	require.Equal(t, []peer.ID{mr2.Host.ID()}, blocked)
+	refused()
+
+	require.NoError(t, mr1.Unblock(mr2.Host.ID()))
+	blocked, err = mr1.BlockedPeers()
+	require.NoError(t, err)
+	require.Empty(t, blocked)
+	connect(t, mr2, &mr1)
+}
+
+func TestProtocolLimits(t *testing.T) {
+	const flood = protocol.ID("/test/flood/1.0.0")
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessengerWithOption(t, "h2", core.Option{
+		ProtocolLimits: map[protocol.ID]rcmgr.BaseLimit{
+			flood: {Streams: 1, StreamsInbound: 1, StreamsOutbound: 1, Memory: 1 << 20},
+		},
+	})
+	hold := make(chan struct{})
+	defer close(hold)
+	mr2.Host.SetStreamHandler(flood, func(s network.Stream) {
+		s.Write([]byte{1})
+		<-hold
+		s.Reset()
+	})
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	connect(t, mr1, mr2)
+
+	open := func() error {
+		s, err := mr1.Host.NewStream(context.Background(), mr2.Host.ID(), flood)
+		if err != nil {
+			return err
+		}
+		_, err = s.Read(make([]byte, 1))
+		return err
+	}
+	require.NoError(t, open())
+	require.Error(t, open())
+
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	msg, err := mr1.SendPM(chat.ID, "still flowing")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := mr2.GetMessage(msg.ID)
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestUnknownProtocol(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	connect(t, mr1, mr2)
+
+	s, err := mr1.Host.NewStream(context.Background(), mr2.Host.ID(), "/chat/nope/1.0.0")
+	require.NoError(t, err)
+	defer s.Close()
+	var msg pb.Unsupported
+	require.NoError(t, utils.NewDelimitedReader(s, core.MaxMsgSize).ReadMsg(&msg))
+	require.Equal(t, "/chat/nope/1.0.0", msg.GetProtocol())
+	require.Contains(t, msg.GetSupported(), core.ID)
+	require.NotContains(t, msg.GetSupported(), core.UnsupportedID)
+
+	// other namespaces are left to libp2p
+	_, err = mr1.Host.NewStream(context.Background(), mr2.Host.ID(), "/other/1.0.0")
+	require.Error(t, err)
+}
+
+func TestUnknownProtocolOption(t *testing.T) {
+	called := make(chan protocol.ID, 1)
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessengerWithOption(t, "h2", core.Option{
+		OnUnknownProtocol: func(s network.Stream) {
+			called <- s.Protocol()
+			s.Close()
+		},
+	})
+	connect(t, mr1, mr2)
+
+	s, err := mr1.Host.NewStream(context.Background(), mr2.Host.ID(), "/chat/nope/1.0.0")
+	require.NoError(t, err)
+	defer s.Close()
+	select {
+	case p := <-called:
+		require.Equal(t, protocol.ID("/chat/nope/1.0.0"), p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called")
+	}
+}
+
+func TestExportConversation(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	mr3 := newTestMessenger(t, "h3")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	user3, err := mr3.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	require.NoError(t, mr1.AddContact(*user3.Me()))
+
+	chat2, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	chat3, err := mr1.CreatePMChat(user3.ID)
+	require.NoError(t, err)
+	for _, text := range []string{"one", "two", "three"} {
+		_, err = mr1.SendPM(chat2.ID, text)
+		require.NoError(t, err)
+		_, err = mr1.SendPM(chat3.ID, "not "+text)
+		require.NoError(t, err)
+		time.Sleep(time.Second)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, mr1.ExportConversation(mr2.Host.ID(), &buf))
+	var msgs []entity.Message
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &msgs))
+	require.Len(t, msgs, 3)
+	for i, text := range []string{"one", "two", "three"} {
+		require.Equal(t, chat2.ID, msgs[i].ChatID)
+		require.Equal(t, text, msgs[i].Text)
+	}
+
+	require.Error(t, mr2.ExportConversation(mr3.Host.ID(), &buf))
+}
+
+func TestFavoriteUnreachable(t *testing.T) {
+	mr1 := newTestMessengerWithOption(t, "h1", core.Option{
+		FavoriteRetry: core.RetryPolicy{
+			MaxAttempts: 2,
+			Backoff:     backoff.NewFixedBackoff(10 * time.Millisecond),
+			Interval:    20 * time.Millisecond,
+		},
+	})
+	gone, err := entity.CreateIdentity("gone")
+	require.NoError(t, err)
+	sub, err := mr1.EventBus().Subscribe(new(event.EvtFavoriteUnreachable))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, mr1.AddFavorite(gone.ID))
+	select {
+	case e := <-sub.Out():
+		require.Equal(t, gone.ID.String(), e.(event.EvtFavoriteUnreachable).ID.String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("unreachable event not emitted")
+	}
+}
+
+func TestPurgeFailed(t *testing.T) {
+	var starred atomic.Value
+	starred.Store(entity.ID(""))
+	mr1 := newTestMessengerWithOption(t, "h1", core.Option{Outbox: core.OutboxPolicy{
+		Deadline:    time.Second,
+		PurgeFailed: 2 * time.Second,
+		KeepFailed:  func(id entity.ID) bool { return id == starred.Load().(entity.ID) },
+	}})
+	sub, err := mr1.EventBus().Subscribe(new(event.EvtMessagesPurged))
+	require.NoError(t, err)
+	defer sub.Close()
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	connect(t, mr1, mr2)
+	gone, err := entity.CreateIdentity("gone")
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*gone.Me()))
+
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	sent, err := mr1.SendPM(chat.ID, "delivered")
+	require.NoError(t, err)
+	chat, err = mr1.CreatePMChat(gone.ID)
+	require.NoError(t, err)
+	kept, err := mr1.SendPM(chat.ID, "never delivered, starred")
+	require.NoError(t, err)
+	starred.Store(kept.ID)
+	lost, err := mr1.SendPM(chat.ID, "never delivered")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		msg, err := mr1.GetMessage(lost.ID)
+		return err == nil && msg.Status == entity.Failed
+	}, 5*time.Second, 100*time.Millisecond)
+	select {
+	case e := <-sub.Out():
+		require.Equal(t, event.EvtMessagesPurged{ChatID: chat.ID, IDs: []entity.ID{lost.ID}}, e)
+	case <-time.After(5 * time.Second):
+		t.Fatal("purge not emitted")
+	}
+	_, err = mr1.GetMessage(lost.ID)
+	require.Error(t, err)
+	msg, err := mr1.GetMessage(kept.ID)
+	require.NoError(t, err)
+	require.Equal(t, entity.Failed, msg.Status)
+	chat, err = mr1.GetChat(chat.ID)
+	require.NoError(t, err)
+	require.Equal(t, kept.ID, chat.LastMessageID)
+	msg, err = mr1.GetMessage(sent.ID)
+	require.NoError(t, err)
+	require.Equal(t, entity.Sent, msg.Status)
+}
+
+func TestRelayForPeer(t *testing.T) {
+	relay := newRelay(t)
+	relayInfo := peer.AddrInfo{ID: relay.ID(), Addrs: relay.Addrs()}
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	mr3 := newTestMessenger(t, "h3")
+
+	_, ok := mr1.RelayForPeer(mr2.Host.ID())
+	require.False(t, ok)
+
+	require.NoError(t, mr2.Host.Connect(context.Background(), relayInfo))
+	_, err := client.Reserve(context.Background(), mr2.Host, relayInfo)
+	require.NoError(t, err)
+	require.NoError(t, mr1.ConnectViaRelay(context.Background(), mr2.Host.ID(), relayInfo))
+	via, ok := mr1.RelayForPeer(mr2.Host.ID())
+	require.True(t, ok)
+	require.Equal(t, relay.ID(), via)
+
+	connect(t, mr1, mr3)
+	_, ok = mr1.RelayForPeer(mr3.Host.ID())
+	require.False(t, ok)
+}
+
+func TestMiddleware(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	user1, err := mr1.GetIdentity()
+	require.NoError(t, err)
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	require.NoError(t, mr2.AddContact(*user1.Me()))
+	connect(t, mr1, mr2)
+
+	errTooLong := errors.New("too long")
+	mr1.AddSendMiddleware(func(msg *entity.Message) error {
+		if len(msg.Text) > 20 {
+			return errTooLong
+		}
+		return nil
+	})
+	mr1.AddSendMiddleware(func(msg *entity.Message) error {
+		msg.Text = strings.TrimSpace(msg.Text)
+		return nil
+	})
+	mr2.AddReceiveMiddleware(func(msg *entity.Message) error {
+		if strings.Contains(msg.Text, "spam") {
+			return errors.New("spam")
+		}
+		return nil
+	})
+
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	_, err = mr1.SendPM(chat.ID, "a message far too long to send")
+	require.ErrorIs(t, err, errTooLong)
+	spam, err := mr1.SendPM(chat.ID, "cheap spam")
+	require.NoError(t, err)
+	ham, err := mr1.SendPM(chat.ID, "  hello  ")
+	require.NoError(t, err)
+	require.Equal(t, "hello", ham.Text)
+
+	require.Eventually(t, func() bool {
+		_, err := mr2.GetMessage(ham.ID)
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+	_, err = mr2.GetMessage(spam.ID)
+	require.Error(t, err)
+}
+
+func TestSelfNickname(t *testing.T) {
+	mr1 := newTestMessenger(t, "display")
+	mr2 := newTestMessenger(t, "h2")
+	require.NoError(t, mr1.SetSelfNickname("just me"))
+	require.Equal(t, "just me", mr1.SelfNickname())
+	iden, err := mr1.GetIdentity()
+	require.NoError(t, err)
+	require.Equal(t, "display", iden.Name)
+	require.Equal(t, "display", iden.Me().Name)
+
+	invite := mr1.Host.Addrs()[0].String() + "/p2p/" + mr1.Host.ID().String()
+	con, err := mr2.AddContactFromInvite(context.Background(), invite)
+	require.NoError(t, err)
+	require.Equal(t, "display", con.Name)
+}
+
+func TestReopenedSetName(t *testing.T) {
+	path := t.TempDir() + "/h1"
+	mr1, err := core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	_, err = mr1.SignUp("h1")
+	require.NoError(t, err)
+	mr1.Stop()
+	// started by the builder this time
+	mr1, err = core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	t.Cleanup(mr1.Stop)
+	require.NoError(t, mr1.SetName("h1 renamed"))
+
+	mr2 := newTestMessenger(t, "h2")
+	invite := mr1.Host.Addrs()[0].String() + "/p2p/" + mr1.Host.ID().String()
+	con, err := mr2.AddContactFromInvite(context.Background(), invite)
+	require.NoError(t, err)
+	require.Equal(t, "h1 renamed", con.Name)
+}
+
+func TestMessagesAround(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	user2, err := entity.CreateIdentity("h2")
+	require.NoError(t, err)
+	user3, err := entity.CreateIdentity("h3")
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	require.NoError(t, mr1.AddContact(*user3.Me()))
+	chat2, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	chat3, err := mr1.CreatePMChat(user3.ID)
+	require.NoError(t, err)
+
+	var sent []entity.Message
+	for i := 0; i < 7; i++ {
+		msg, err := mr1.SendPM(chat2.ID, fmt.Sprint(i))
+		require.NoError(t, err)
+		sent = append(sent, *msg)
+		_, err = mr1.SendPM(chat3.ID, fmt.Sprint(i))
+		require.NoError(t, err)
+	}
+	// history is ordered by time, then ID
+	sort.Slice(sent, func(i, j int) bool {
+		if sent[i].CreatedAt != sent[j].CreatedAt {
+			return sent[i].CreatedAt < sent[j].CreatedAt
+		}
+		return sent[i].ID < sent[j].ID
+	})
+	ids := func(msgs []entity.Message) []entity.ID {
+		res := make([]entity.ID, 0, len(msgs))
+		for _, m := range msgs {
+			res = append(res, m.ID)
+		}
+		return res
+	}
+	pid, err := user2.Me().PeerID()
+	require.NoError(t, err)
+
+	got, err := mr1.MessagesAround(pid, sent[3].ID, 2, 2)
+	require.NoError(t, err)
+	require.Equal(t, ids(sent[1:6]), ids(got))
+
+	got, err = mr1.MessagesAround(pid, sent[0].ID, 2, 1)
+	require.NoError(t, err)
+	require.Equal(t, ids(sent[0:2]), ids(got))
+
+	got, err = mr1.MessagesAround(pid, sent[6].ID, 3, 5)
+	require.NoError(t, err)
+	require.Equal(t, ids(sent[3:7]), ids(got))
+
+	got, err = mr1.MessagesAround(pid, sent[2].ID, 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, ids(sent[2:3]), ids(got))
+
+	other, err := mr1.GetMessages(chat3.ID, 0, 1)
+	require.NoError(t, err)
+	_, err = mr1.MessagesAround(pid, other[0].ID, 1, 1)
+	require.ErrorIs(t, err, core.ErrNotInChat)
+}
+
+func TestDisableDHT(t *testing.T) {
+	newMessenger := func(name string) *core.Messenger {
+		opt := core.Option{
+			LpOpt:      []libp2p.Option{libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0")},
+			DisableDHT: true,
+		}
+		mr, err := core.MessengerBuilder(t.TempDir()+"/"+name, opt, core.DefaultRoutedHost{})
+		require.NoError(t, err)
+		_, err = mr.SignUp(name)
+		require.NoError(t, err)
+		t.Cleanup(mr.Stop)
+		return &mr
+	}
+	mr1 := newMessenger("h1")
+	mr2 := newMessenger("h2")
+	_, routed := mr1.Host.(core.Routed)
+	require.False(t, routed)
+	require.ErrorIs(t, mr1.ResetDHT(context.Background()), core.ErrNotRouted)
+
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	connect(t, mr1, mr2)
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	msg, err := mr1.SendPM(chat.ID, "direct only")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := mr2.GetMessage(msg.ID)
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestOutboxDepth(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	depths := mr1.OutboxDepthChanged()
+	next := func() int {
+		select {
+		case d := <-depths:
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatal("no depth change")
+			return -1
+		}
+	}
+
+	// h2 is unreachable until connected, messages wait
+	_, err = mr1.SendPM(chat.ID, "one")
+	require.NoError(t, err)
+	require.Equal(t, 1, next())
+	_, err = mr1.SendPM(chat.ID, "two")
+	require.NoError(t, err)
+	require.Equal(t, 2, next())
+	require.Equal(t, 2, mr1.OutboxDepth())
+
+	connect(t, mr1, mr2)
+	require.Equal(t, 1, next())
+	require.Equal(t, 0, next())
+	require.Equal(t, 0, mr1.OutboxDepth())
+}
+
+func TestOutboxDrained(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	sub, err := mr1.EventBus().Subscribe(new(event.EvtOutboxDrained))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	// h2 is unreachable until connected, messages wait
+	for _, text := range []string{"one", "two", "three"} {
+		_, err = mr1.SendPM(chat.ID, text)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return mr1.OutboxDepth() == 3 }, 5*time.Second, 50*time.Millisecond)
+	require.Empty(t, sub.Out())
+
+	connect(t, mr1, mr2)
+	select {
+	case <-sub.Out():
+	case <-time.After(5 * time.Second):
+		t.Fatal("outbox did not drain")
+	}
+	require.Equal(t, 0, mr1.OutboxDepth())
+	select {
+	case <-sub.Out():
+		t.Fatal("drained twice")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestPurgePeer(t *testing.T) {
+	mr1 := newTestMessengerWithOption(t, "h1", core.Option{RequestFirst: true})
+	mr2 := newTestMessenger(t, "h2")
+	user1, err := mr1.GetIdentity()
+	require.NoError(t, err)
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr2.AddContact(*user1.Me()))
+	chat2, err := mr2.CreatePMChat(user1.ID)
+	require.NoError(t, err)
+	connect(t, mr2, mr1)
+
+	// a request first, then a message once h2 is a contact
+	_, err = mr2.SendPM(chat2.ID, "hi")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		prs, err := mr1.PendingRequests(0, 10)
+		return err == nil && len(prs) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	msg, err := mr2.SendPM(chat2.ID, "again")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := mr1.GetMessage(msg.ID)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	chat1, err := mr1.GetPMChat(user2.ID)
+	require.NoError(t, err)
+	require.Equal(t, 1, chat1.Unread)
+	require.NoError(t, mr1.AddFavorite(user2.ID))
+	// h2 is gone, the reply waits in the outbox
+	mr1.Pause()
+	_, err = mr1.SendPM(chat1.ID, "reply")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return mr1.OutboxDepth() == 1 }, 5*time.Second, 50*time.Millisecond)
+
+	pid, err := peer.Decode(user2.ID.String())
+	require.NoError(t, err)
+	require.NoError(t, mr1.PurgePeer(pid))
+	_, err = mr1.GetContact(user2.ID)
+	require.Error(t, err)
+	_, err = mr1.GetChat(chat1.ID)
+	require.Error(t, err)
+	msgs, err := mr1.GetMessages(chat1.ID, 0, 10)
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+	prs, err := mr1.PendingRequests(0, 10)
+	require.NoError(t, err)
+	require.Empty(t, prs)
+	favs, err := mr1.Favorites()
+	require.NoError(t, err)
+	require.Empty(t, favs)
+	require.Zero(t, mr1.OutboxDepth())
+}
+
+func TestSendPMOver(t *testing.T) {
+	const bridge = protocol.ID("/bridge/chat/1.0.0")
+	core.RegisterCodec(bridge, utils.ProtoCodec{})
+	mr1 := newTestMessenger(t, "h1")
+	other, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	defer other.Close()
+	got := make(chan *pb.Message, 1)
+	other.SetStreamHandler(bridge, func(s network.Stream) {
+		defer s.Close()
+		var msg pb.Message
+		if err := utils.NewDelimitedReader(s, core.MaxMsgSize).ReadMsg(&msg); err == nil {
+			got <- &msg
+		}
+	})
+
+	con := entity.Contact{ID: entity.ID(other.ID().String()), Name: "bridge"}
+	require.NoError(t, mr1.AddContact(con))
+	require.NoError(t, mr1.Host.Connect(context.Background(), peer.AddrInfo{ID: other.ID(), Addrs: other.Addrs()}))
+	chat, err := mr1.CreatePMChat(con.ID)
+	require.NoError(t, err)
+
+	_, err = mr1.SendPMOver(chat.ID, "lost", "/unknown/1.0.0")
+	require.ErrorIs(t, err, core.ErrUnknownProtocol)
+	msg, err := mr1.SendPMOver(chat.ID, "across the bridge", bridge)
+	require.NoError(t, err)
+	select {
+	case m := <-got:
+		require.Equal(t, msg.ID.String(), m.GetId())
+		require.Equal(t, "across the bridge", m.GetText())
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received over the bridge protocol")
+	}
+}
+
+func TestSendFallsBackToTCP(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+
+	// the regular dial finds nothing usable, as when QUIC is blocked and
+	// the TCP address is still backing off from an earlier failure
+	sw, ok := mr1.Host.Network().(*swarm.Swarm)
+	require.True(t, ok)
+	for _, a := range mr2.Host.Addrs() {
+		sw.Backoff().AddBackoff(mr2.Host.ID(), a)
+	}
+	mr1.Host.Peerstore().AddAddrs(mr2.Host.ID(), mr2.Host.Addrs(), time.Hour)
+	require.Error(t, mr1.Host.Connect(context.Background(), peer.AddrInfo{ID: mr2.Host.ID()}))
+
+	msg, err := mr1.SendPM(chat.ID, "over tcp")
+	require.NoError(t, err)
+	// well before the dial backoff or a connector retry would allow it
+	require.Eventually(t, func() bool {
+		_, err := mr2.GetMessage(msg.ID)
+		return err == nil
+	}, 2*time.Second, 50*time.Millisecond)
+	conns := mr1.Host.Network().ConnsToPeer(mr2.Host.ID())
+	require.NotEmpty(t, conns)
+	_, err = conns[0].RemoteMultiaddr().ValueForProtocol(ma.P_TCP)
+	require.NoError(t, err)
+}
+
+func TestLogPeerIDTruncated(t *testing.T) {
+	require.NoError(t, logging.SetLogLevel("msgr-core", "INFO"))
+	defer logging.SetLogLevel("msgr-core", "DEBUG")
+	pr := logv2.NewPipeReader(logv2.PipeFormat(logv2.PlaintextOutput))
+	defer pr.Close()
+	lines := make(chan string, 64)
+	go func() {
+		sc := bufio.NewScanner(pr)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+	}()
+
+	mr1 := newTestMessengerWithOption(t, "h1", core.Option{
+		FavoriteRetry: core.RetryPolicy{
+			MaxAttempts: 1,
+			Backoff:     backoff.NewFixedBackoff(10 * time.Millisecond),
+			Interval:    20 * time.Millisecond,
+		},
+	})
+	gone, err := entity.CreateIdentity("gone")
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddFavorite(gone.ID))
+
+	id := gone.ID.String()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case l := <-lines:
+			if !strings.Contains(l, "unreachable") {
+				continue
+			}
+			require.NotContains(t, l, id)
+			require.Contains(t, l, "*"+id[len(id)-6:])
+			return
+		case <-timeout:
+			t.Fatal("unreachable favorite not logged")
+		}
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	mr1.Host.Peerstore().AddAddrs(mr2.Host.ID(), mr2.Host.Addrs(), time.Hour)
+
+	require.NoError(t, mr1.Warmup(context.Background(), mr2.Host.ID()))
+	require.Equal(t, network.Connected, mr1.Host.Network().Connectedness(mr2.Host.ID()))
+
+	var dials int32
+	mr1.Host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(network.Network, network.Conn) { atomic.AddInt32(&dials, 1) },
+	})
+	require.NoError(t, mr1.Warmup(context.Background(), mr2.Host.ID()))
+	msg, err := mr1.SendPM(chat.ID, "warm")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := mr2.GetMessage(msg.ID)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Zero(t, atomic.LoadInt32(&dials))
+}
+
+func TestPublicKeyBytes(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	b, err := mr1.PublicKeyBytes()
+	require.NoError(t, err)
+	pid, err := core.PeerIDFromPublicKey(b)
+	require.NoError(t, err)
+	require.Equal(t, mr1.Host.ID(), pid)
+
+	_, err = core.PeerIDFromPublicKey([]byte("not a key"))
+	require.Error(t, err)
+}
+
+func TestProfileRefresh(t *testing.T) {
+	mr1 := newTestMessengerWithOption(t, "h1", core.Option{ProfileRefresh: 50 * time.Millisecond})
+	mr2 := newTestMessenger(t, "h2")
+	mr3 := newTestMessenger(t, "h3")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	user3, err := mr3.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	require.NoError(t, mr1.AddContact(*user3.Me()))
+	connect(t, mr1, mr2)
+	sub, err := mr1.EventBus().Subscribe(new(event.EvtContactProfileChanged))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	require.NoError(t, mr2.SetName("h2 renamed"))
+	// mr3 is not connected, its rename is not picked up
+	require.NoError(t, mr3.SetName("h3 renamed"))
+	select {
+	case e := <-sub.Out():
+		con := e.(event.EvtContactProfileChanged).Contact
+		require.Equal(t, user2.ID, con.ID)
+		require.Equal(t, "h2 renamed", con.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("profile change not emitted")
+	}
+	con, err := mr1.GetContact(user2.ID)
+	require.NoError(t, err)
+	require.Equal(t, "h2 renamed", con.Name)
+	con, err = mr1.GetContact(user3.ID)
+	require.NoError(t, err)
+	require.Equal(t, "h3", con.Name)
+}
+
+// expiringCtx reports itself cancelled once Err was asked n times.
+type expiringCtx struct {
+	context.Context
+	n int32
+}
+
+func (c *expiringCtx) Err() error {
+	if atomic.AddInt32(&c.n, -1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestSearchMessagesCancel(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	total := 2*core.SearchPageSize + 50
+	for i := 0; i < total; i++ {
+		text := fmt.Sprintf("note %d", i)
+		if i%2 == 0 {
+			text = fmt.Sprintf("NOTE %d", i)
+		}
+		_, err = mr1.SendPM(chat.ID, text)
+		require.NoError(t, err)
+	}
+
+	res, truncated, err := mr1.SearchMessages(context.Background(), chat.ID, "note")
+	require.NoError(t, err)
+	require.False(t, truncated)
+	require.Len(t, res, total)
+
+	// cancelled after the first two pages were scanned
+	ctx := &expiringCtx{Context: context.Background(), n: 2}
+	res, truncated, err = mr1.SearchMessages(ctx, chat.ID, "note")
+	require.NoError(t, err)
+	require.True(t, truncated)
+	require.Len(t, res, 2*core.SearchPageSize)
+
+	ctx2, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, truncated, err = mr1.SearchMessages(ctx2, chat.ID, "note")
+	require.NoError(t, err)
+	require.True(t, truncated)
+	require.Empty(t, res)
+}
+
+func TestRepairRepo(t *testing.T) {
+	path := t.TempDir() + "/h1"
+	mr, err := core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	me, err := mr.SignUp("h1")
+	require.NoError(t, err)
+	mr.Stop()
+
+	// state left behind by a crash between writes
+	s, err := store.NewStore(path + "/store")
+	require.NoError(t, err)
+	peer2 := store.BHContact{ID: "peer2", Name: "h2"}
+	require.NoError(t, s.InsertChat(store.BHChat{ID: "ok", Members: []string{peer2.ID}, Unread: 1}))
+	require.NoError(t, s.InsertChat(store.BHChat{ID: "bad", Members: []string{peer2.ID}, Unread: 5}))
+	for i, chatID := range []string{"ok", "bad", "gone"} {
+		require.NoError(t, s.InsertTextMessage(store.BHTextMessage{
+			ID: fmt.Sprintf("in%d", i), ChatID: chatID, Text: "hi", Author: peer2,
+		}))
+	}
+	require.NoError(t, s.InsertTextMessage(store.BHTextMessage{
+		ID: "out", ChatID: "bad", Text: "hey", Author: store.BHContact{ID: me.ID.String()},
+	}))
+	s.Close()
+
+	mr, err = core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	defer mr.Stop()
+	want := []core.Issue{
+		{Kind: core.OrphanMessage, ID: "in2"},
+		{Kind: core.UnreadMismatch, ID: "bad"},
+	}
+	issues, err := mr.VerifyRepo()
+	require.NoError(t, err)
+	require.ElementsMatch(t, want, issues)
+	// verifying changes nothing
+	issues, err = mr.VerifyRepo()
+	require.NoError(t, err)
+	require.ElementsMatch(t, want, issues)
+
+	issues, err = mr.RepairRepo()
+	require.NoError(t, err)
+	require.ElementsMatch(t, want, issues)
+	issues, err = mr.VerifyRepo()
+	require.NoError(t, err)
+	require.Empty(t, issues)
+	_, err = mr.GetMessage("in2")
+	require.Error(t, err)
+	chat, err := mr.GetChat("bad")
+	require.NoError(t, err)
+	require.Equal(t, 1, chat.Unread)
+	chat, err = mr.GetChat("ok")
+	require.NoError(t, err)
+	require.Equal(t, 1, chat.Unread)
+}
+
+func TestMessageStatuses(t *testing.T) {
+	path := t.TempDir() + "/h1"
+	mr, err := core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	_, err = mr.SignUp("h1")
+	require.NoError(t, err)
+	mr.Stop()
+
+	s, err := store.NewStore(path + "/store")
+	require.NoError(t, err)
+	want := map[entity.ID]entity.Status{}
+	ids := []entity.ID{"unknown"}
+	statuses := []entity.Status{entity.Pending, entity.Sent, entity.Seen, entity.Received, entity.Failed}
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("msg%d", i)
+		st := statuses[i%len(statuses)]
+		require.NoError(t, s.InsertTextMessage(store.BHTextMessage{ID: id, ChatID: "chat", Status: store.Status(st)}))
+		want[entity.ID(id)] = st
+		ids = append(ids, entity.ID(id))
+	}
+	s.Close()
+
+	mr, err = core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	defer mr.Stop()
+	got, err := mr.MessageStatuses(ids)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func TestConversationsPage(t *testing.T) {
+	path := t.TempDir() + "/h1"
+	mr, err := core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	_, err = mr.SignUp("h1")
+	require.NoError(t, err)
+	mr.Stop()
+
+	s, err := store.NewStore(path + "/store")
+	require.NoError(t, err)
+	const chats = 53
+	var want []string
+	for i := 0; i < chats; i++ {
+		id := fmt.Sprintf("chat%02d", i)
+		require.NoError(t, s.InsertChat(store.BHChat{ID: id, Name: id}))
+		// every third chat has no messages, pairs of chats share a time
+		if i%3 == 0 {
+			continue
+		}
+		at := int64(1000 + (i*7)%chats/2)
+		for j, created := range []int64{at - 100, at, at - 50} {
+			require.NoError(t, s.InsertTextMessage(store.BHTextMessage{
+				ID: fmt.Sprintf("%s-%d", id, j), ChatID: id, CreatedAt: created, Text: id,
+			}))
+		}
+	}
+	s.Close()
+
+	mr, err = core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	defer mr.Stop()
+	all, err := mr.GetChats(0, chats)
+	require.NoError(t, err)
+	require.Len(t, all, chats)
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].LastActivity != all[j].LastActivity {
+			return all[i].LastActivity > all[j].LastActivity
+		}
+		return all[i].ID > all[j].ID
+	})
+	for _, chat := range all {
+		want = append(want, chat.ID.String())
+	}
+
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, chats)
+		page, next, err := mr.ConversationsPage(cursor, 10)
+		require.NoError(t, err)
+		for _, sum := range page {
+			got = append(got, sum.Chat.ID.String())
+			if sum.Chat.LastActivity == 0 {
+				require.Nil(t, sum.LastMessage)
+				continue
+			}
+			require.NotNil(t, sum.LastMessage)
+			require.Equal(t, sum.Chat.ID.String()+"-1", sum.LastMessage.ID.String())
+			require.Equal(t, sum.Chat.LastActivity, sum.LastMessage.CreatedAt)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	require.Equal(t, want, got)
+
+	_, _, err = mr.ConversationsPage("garbage", 10)
+	require.ErrorIs(t, err, repo.ErrBadCursor)
+}
+
+func TestSendLatencyStats(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	connect(t, mr1, mr2)
+
+	for i := 0; i < 3; i++ {
+		_, err := mr1.SendPM(chat.ID, fmt.Sprintf("msg %d", i))
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return mr1.SendLatencyStats().Count == 3 }, 5*time.Second, 50*time.Millisecond)
+	stats := mr1.SendLatencyStats()
+	require.Positive(t, stats.P50)
+	require.LessOrEqual(t, stats.P50, stats.P95)
+	require.LessOrEqual(t, stats.P95, stats.P99)
+}
+
+func TestProfilePush(t *testing.T) {
+	mr1 := newTestMessengerWithOption(t, "h1", core.Option{ProfilePush: true})
+	mr2 := newTestMessenger(t, "h2")
+	mr3 := newTestMessenger(t, "h3")
+	user1, err := mr1.GetIdentity()
+	require.NoError(t, err)
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	user3, err := mr3.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	require.NoError(t, mr2.AddContact(*user1.Me()))
+	require.NoError(t, mr2.AddContact(*user3.Me()))
+	require.NoError(t, mr3.AddContact(*user2.Me()))
+	connect(t, mr1, mr2)
+	connect(t, mr3, mr2)
+	sub, err := mr1.EventBus().Subscribe(new(event.EvtContactProfileChanged))
+	require.NoError(t, err)
+	defer sub.Close()
+	sub3, err := mr3.EventBus().Subscribe(new(event.EvtContactProfileChanged))
+	require.NoError(t, err)
+	defer sub3.Close()
+
+	require.NoError(t, mr2.SetName("h2 renamed"))
+	select {
+	case e := <-sub.Out():
+		con := e.(event.EvtContactProfileChanged).Contact
+		require.Equal(t, user2.ID, con.ID)
+		require.Equal(t, "h2 renamed", con.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("pushed profile not received")
+	}
+	con, err := mr1.GetContact(user2.ID)
+	require.NoError(t, err)
+	require.Equal(t, "h2 renamed", con.Name)
+
+	// mr3 is a connected contact too but did not opt in
+	select {
+	case <-sub3.Out():
+		t.Fatal("profile pushed to a peer not accepting pushes")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+type failingHost struct{}
+
+func (failingHost) Create(core.Option) (host.Host, error) {
+	return nil, errors.New("no network")
+}
+
+func TestBuilderErrors(t *testing.T) {
+	// a regular file where the repo directory should go, unwritable even
+	// for root
+	file := t.TempDir() + "/file"
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+	require.NotPanics(t, func() {
+		_, err := core.MessengerBuilder(file+"/h1", core.Option{}, localHost{})
+		require.Error(t, err)
+	})
+
+	path := t.TempDir() + "/h1"
+	mr, err := core.MessengerBuilder(path, core.Option{}, failingHost{})
+	require.NoError(t, err)
+	require.NotPanics(t, func() {
+		_, err = mr.SignUp("h1")
+		require.EqualError(t, err, "no network")
+	})
+}
+
+func TestPassphrase(t *testing.T) {
+	path := t.TempDir() + "/h1"
+	opt := core.Option{Passphrase: "correct horse"}
+	mr, err := core.MessengerBuilder(path, opt, localHost{})
+	require.NoError(t, err)
+	user, err := mr.SignUp("h1")
+	require.NoError(t, err)
+	_, err = user.DecodePrivateKey("")
+	require.ErrorIs(t, err, entity.ErrWrongPassphrase)
+	mr.Stop()
+
+	_, err = core.MessengerBuilder(path, core.Option{Passphrase: "wrong"}, localHost{})
+	require.ErrorIs(t, err, entity.ErrWrongPassphrase)
+	_, err = core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.ErrorIs(t, err, entity.ErrWrongPassphrase)
+
+	mr, err = core.MessengerBuilder(path, opt, localHost{})
+	require.NoError(t, err)
+	require.Equal(t, user.ID.String(), mr.Host.ID().String())
+	mr.Stop()
+
+	// repos made without a passphrase keep loading
+	path = t.TempDir() + "/h2"
+	mr, err = core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	user, err = mr.SignUp("h2")
+	require.NoError(t, err)
+	mr.Stop()
+	mr, err = core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	require.Equal(t, user.ID.String(), mr.Host.ID().String())
+	mr.Stop()
+}
+
+func TestIdentityKey(t *testing.T) {
+	path := t.TempDir() + "/h1"
+	opt := core.Option{IdentityKey: entity.KeyOption{Algorithm: entity.KeyRSA, Bits: 2048}}
+	mr, err := core.MessengerBuilder(path, opt, localHost{})
+	require.NoError(t, err)
+	user, err := mr.SignUp("h1")
+	require.NoError(t, err)
+	sk, err := user.DecodePrivateKey("")
+	require.NoError(t, err)
+	require.Equal(t, crypto.RSA, int(sk.Type()))
+	mr.Stop()
+
+	// the key option only applies at sign up
+	mr, err = core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	require.Equal(t, user.ID.String(), mr.Host.ID().String())
+	mr.Stop()
+
+	mr, err = core.MessengerBuilder(t.TempDir()+"/h2", core.Option{}, localHost{})
+	require.NoError(t, err)
+	user, err = mr.SignUp("h2")
+	require.NoError(t, err)
+	sk, err = user.DecodePrivateKey("")
+	require.NoError(t, err)
+	require.Equal(t, crypto.Ed25519, int(sk.Type()))
+	mr.Stop()
+
+	opt = core.Option{IdentityKey: entity.KeyOption{Algorithm: entity.KeyEd25519, Bits: 2048}}
+	mr, err = core.MessengerBuilder(t.TempDir()+"/h3", opt, localHost{})
+	require.NoError(t, err)
+	_, err = mr.SignUp("h3")
+	require.ErrorIs(t, err, entity.ErrKeyBits)
+	require.False(t, mr.IsLogin())
+	_, err = entity.CreateIdentityWithKey("h3", entity.KeyOption{Bits: 2048})
+	require.ErrorIs(t, err, entity.ErrKeyBits)
+	_, err = entity.CreateIdentityWithKey("h3", entity.KeyOption{Algorithm: "dsa"})
+	require.ErrorIs(t, err, entity.ErrKeyAlgorithm)
+}
+
+// bootRecorder records the protocols handled when it bootstraps.
+type bootRecorder struct {
+	host.Host
+	protos chan []string
+}
+
+func (r bootRecorder) Bootstrap(ctx context.Context) error {
+	r.protos <- r.Mux().Protocols()
+	if bh, ok := r.Host.(core.Bootstrapper); ok {
+		return bh.Bootstrap(ctx)
+	}
+	return nil
+}
+
+type lazyHost struct {
+	protos chan []string
+}
+
+func (lazyHost) Create(opt core.Option) (host.Host, error) {
+	return nil, errors.New("built with NewNode")
+}
+
+func (b lazyHost) NewNode(ctx context.Context, opt core.Option) (host.Host, error) {
+	h, err := libp2p.New(append(opt.LpOpt, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))...)
+	if err != nil {
+		return nil, err
+	}
+	return bootRecorder{Host: h, protos: b.protos}, nil
+}
+
+func TestStartBootstrapsLast(t *testing.T) {
+	b := lazyHost{protos: make(chan []string, 1)}
+	mr, err := core.MessengerBuilder(t.TempDir()+"/h1", core.Option{}, b)
+	require.NoError(t, err)
+	_, err = mr.SignUp("h1")
+	require.NoError(t, err)
+	defer mr.Stop()
+	protos := <-b.protos
+	for _, p := range []protocol.ID{core.ID, core.ProfileID, core.FileID, core.TypingID} {
+		require.Contains(t, protos, string(p))
+	}
+}
+
+// tcpHost builds a TCP-only host on addr.
+type tcpHost struct {
+	addr string
+}
+
+func (b tcpHost) Create(opt core.Option) (host.Host, error) {
+	lpOpt := append(opt.LpOpt,
+		libp2p.NoTransports,
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.ListenAddrStrings(b.addr),
+	)
+	return libp2p.New(lpOpt...)
+}
+
+func openFDs(t *testing.T) int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("can not count open files")
+	}
+	return len(fds)
+}
+
+func TestCloseReleases(t *testing.T) {
+	path := t.TempDir() + "/h1"
+	mr, err := core.MessengerBuilder(path, core.Option{}, tcpHost{"/ip4/127.0.0.1/tcp/0"})
+	require.NoError(t, err)
+	_, err = mr.SignUp("h1")
+	require.NoError(t, err)
+	// a favorite that is never reachable keeps its connector retrying
+	fav, err := entity.CreateIdentity("fav")
+	require.NoError(t, err)
+	require.NoError(t, mr.AddFavorite(fav.ID))
+	// reopening must find the same port free again
+	addr := mr.Host.Addrs()[0].String()
+	require.NoError(t, mr.Close(context.Background()))
+
+	goroutines, fds := runtime.NumGoroutine(), openFDs(t)
+	for i := 0; i < 5; i++ {
+		mr, err = core.MessengerBuilder(path, core.Option{}, tcpHost{addr})
+		require.NoError(t, err)
+		require.NoError(t, mr.Close(context.Background()))
+	}
+	require.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= goroutines && openFDs(t) <= fds
+	}, 5*time.Second, 100*time.Millisecond, "goroutines %d->%d, fds %d->%d",
+		goroutines, runtime.NumGoroutine(), fds, openFDs(t))
+
+	// a messenger without identity was never started
+	mr, err = core.MessengerBuilder(t.TempDir()+"/h2", core.Option{}, tcpHost{"/ip4/127.0.0.1/tcp/0"})
+	require.NoError(t, err)
+	require.NoError(t, mr.Close(context.Background()))
+}
+
+// relayOnlyHost builds a host only accepting relayed connections.
+type relayOnlyHost struct{}
+
+func (relayOnlyHost) Create(opt core.Option) (host.Host, error) {
+	return libp2p.New(append(opt.LpOpt, libp2p.ListenAddrStrings("/p2p-circuit"))...)
+}
+
+func TestPeerReachability(t *testing.T) {
+	relay := newRelay(t)
+	relayInfo := peer.AddrInfo{ID: relay.ID(), Addrs: relay.Addrs()}
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	mr3, err := core.MessengerBuilder(t.TempDir()+"/h3", core.Option{}, relayOnlyHost{})
+	require.NoError(t, err)
+	_, err = mr3.SignUp("h3")
+	require.NoError(t, err)
+	defer mr3.Stop()
+
+	mr1.Host.Peerstore().AddAddrs(mr2.Host.ID(), mr2.Host.Addrs(), time.Hour)
+	r, err := mr1.PeerReachability(context.Background(), mr2.Host.ID())
+	require.NoError(t, err)
+	require.Equal(t, core.PeerDirect, r)
+
+	require.NoError(t, mr3.Host.Connect(context.Background(), relayInfo))
+	_, err = client.Reserve(context.Background(), mr3.Host, relayInfo)
+	require.NoError(t, err)
+	circuit, err := ma.NewMultiaddr("/p2p/" + relay.ID().String() + "/p2p-circuit")
+	require.NoError(t, err)
+	require.NoError(t, mr1.Host.Connect(context.Background(), relayInfo))
+	mr1.Host.Peerstore().AddAddrs(mr3.Host.ID(), []ma.Multiaddr{circuit}, time.Hour)
+	r, err = mr1.PeerReachability(context.Background(), mr3.Host.ID())
+	require.NoError(t, err)
+	require.Equal(t, core.PeerRelayOnly, r)
+
+	gone, err := entity.CreateIdentity("gone")
+	require.NoError(t, err)
+	pid, err := peer.Decode(gone.ID.String())
+	require.NoError(t, err)
+	r, err = mr1.PeerReachability(context.Background(), pid)
+	require.Error(t, err)
+	require.Equal(t, core.PeerUnreachable, r)
+}
+
+func TestConnLimits(t *testing.T) {
+	_, err := core.OptionWithLimits(core.ConnLimits{Low: 5, High: 2})
+	require.ErrorIs(t, err, core.ErrConnLimits)
+
+	opt, err := core.OptionWithLimits(core.ConnLimits{Low: 2, High: 3, Grace: time.Second})
+	require.NoError(t, err)
+	mr1 := newTestMessengerWithOption(t, "h1", opt)
+	mr2 := newTestMessenger(t, "h2")
+	connect(t, mr1, mr2)
+
+	info := mr1.ConnManager().GetInfo()
+	require.Equal(t, 2, info.LowWater)
+	require.Equal(t, 3, info.HighWater)
+	require.Equal(t, time.Second, info.GracePeriod)
+	// the relays may be connected too
+	require.GreaterOrEqual(t, info.ConnCount, 1)
+}
+
+func TestActiveStreams(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	connect(t, mr1, mr2)
+
+	const proto = protocol.ID("/test/stuck/1.0.0")
+	release := make(chan struct{})
+	defer close(release)
+	mr2.Host.SetStreamHandler(proto, func(s network.Stream) {
+		<-release
+		s.Reset()
+	})
+	s, err := mr1.Host.NewStream(context.Background(), mr2.Host.ID(), proto)
+	require.NoError(t, err)
+	defer s.Reset()
+
+	find := func(m *core.Messenger) *core.StreamInfo {
+		for _, info := range m.ActiveStreams() {
+			if info.Protocol == proto {
+				return &info
+			}
+		}
+		return nil
+	}
+	out := find(mr1)
+	require.NotNil(t, out)
+	require.Equal(t, mr2.Host.ID(), out.Peer)
+	require.Equal(t, network.DirOutbound, out.Direction)
+	require.Eventually(t, func() bool { return find(mr2) != nil }, 5*time.Second, 50*time.Millisecond)
+	in := find(mr2)
+	require.Equal(t, mr1.Host.ID(), in.Peer)
+	require.Equal(t, network.DirInbound, in.Direction)
+}
+
+func TestSecurity(t *testing.T) {
+	tlsOnly := core.Option{Security: []string{core.SecurityTLS}}
+	mr1 := newTestMessengerWithOption(t, "h1", tlsOnly)
+	mr2 := newTestMessengerWithOption(t, "h2", tlsOnly)
+	mr3 := newTestMessengerWithOption(t, "h3", core.Option{Security: []string{core.SecurityNoise}})
+
+	connect(t, mr1, mr2)
+	conns := mr1.Host.Network().ConnsToPeer(mr2.Host.ID())
+	require.NotEmpty(t, conns)
+	require.Equal(t, tls.ID, string(conns[0].ConnState().Security))
+
+	pi := peer.AddrInfo{ID: mr3.Host.ID(), Addrs: mr3.Host.Addrs()}
+	require.Error(t, mr1.Host.Connect(context.Background(), pi))
+
+	mr, err := core.MessengerBuilder(t.TempDir()+"/h4", core.Option{Security: []string{"ssl"}}, localHost{})
+	require.NoError(t, err)
+	_, err = mr.SignUp("h4")
+	require.ErrorIs(t, err, core.ErrSecurity)
+
+	// QUIC secures with TLS, a noise-only node doesn't listen on it
+	noiseOnly := core.Option{
+		DisableDHT:  true,
+		Security:    []string{core.SecurityNoise},
+		ListenAddrs: []string{"/ip4/127.0.0.1/tcp/0", "/ip4/127.0.0.1/udp/0/quic-v1"},
+	}
+	mr, err = core.MessengerBuilder(t.TempDir()+"/h5", noiseOnly, core.DefaultRoutedHost{})
+	require.NoError(t, err)
+	_, err = mr.SignUp("h5")
+	require.NoError(t, err)
+	defer mr.Stop()
+	require.NotEmpty(t, mr.Host.Addrs())
+	for _, a := range mr.Host.Addrs() {
+		_, err := a.ValueForProtocol(ma.P_QUIC_V1)
+		require.Error(t, err, a.String())
+	}
+	h, err := libp2p.New(libp2p.Transport(quic.NewTransport), libp2p.NoListenAddrs)
+	require.NoError(t, err)
+	defer h.Close()
+	pi = peer.AddrInfo{ID: mr.Host.ID(), Addrs: mr.Host.Addrs()}
+	require.Error(t, h.Connect(context.Background(), pi))
+
+	noiseOnly.QUICOnly = true
+	mr, err = core.MessengerBuilder(t.TempDir()+"/h6", noiseOnly, core.DefaultRoutedHost{})
+	require.NoError(t, err)
+	_, err = mr.SignUp("h6")
+	require.ErrorIs(t, err, core.ErrSecurityQUIC)
+}
+
+func TestQUICOnly(t *testing.T) {
+	path := t.TempDir() + "/h1"
+	opt := core.Option{
+		DisableDHT:  true,
+		QUICOnly:    true,
+		ListenAddrs: []string{"/ip4/127.0.0.1/udp/0/quic-v1"},
+	}
+	mr, err := core.MessengerBuilder(path, opt, core.DefaultRoutedHost{})
+	require.NoError(t, err)
+	_, err = mr.SignUp("h1")
+	require.NoError(t, err)
+	quicOnly := func(h host.Host) {
+		require.NotEmpty(t, h.Addrs())
+		for _, a := range h.Addrs() {
+			require.True(t, strings.HasPrefix(a.String(), "/ip4/127.0.0.1/udp/"), a.String())
+			_, err := a.ValueForProtocol(ma.P_QUIC_V1)
+			require.NoError(t, err)
+		}
+	}
+	quicOnly(mr.Host)
+	mr.Stop()
+
+	// the listen addresses are kept for the next start
+	mr, err = core.MessengerBuilder(path, core.Option{DisableDHT: true}, core.DefaultRoutedHost{})
+	require.NoError(t, err)
+	defer mr.Stop()
+	quicOnly(mr.Host)
+	h2 := newTestMessenger(t, "h2")
+	connect(t, h2, &mr)
+
+	// until they are reset
+	require.NoError(t, mr.ResetNetConfig())
+	mr.Stop()
+	mr, err = core.MessengerBuilder(path, core.Option{DisableDHT: true}, core.DefaultRoutedHost{})
+	require.NoError(t, err)
+	onTCP := false
+	for _, a := range mr.Host.Addrs() {
+		if _, err := a.ValueForProtocol(ma.P_TCP); err == nil {
+			onTCP = true
+		}
+	}
+	require.True(t, onTCP, mr.Host.Addrs())
+}
+
+func TestSubscribePeers(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	events, cancel := mr1.SubscribePeers()
+
+	connect(t, mr1, mr2)
+	next := func() interface{} {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no peer event")
+			return nil
+		}
+	}
+	on, ok := next().(event.EvtPeerConnected)
+	require.True(t, ok)
+	require.Equal(t, mr2.Host.ID(), on.ID)
+	require.WithinDuration(t, time.Now(), on.At, 5*time.Second)
+
+	require.NoError(t, mr1.Host.Network().ClosePeer(mr2.Host.ID()))
+	off, ok := next().(event.EvtPeerDisconnected)
+	require.True(t, ok)
+	require.Equal(t, mr2.Host.ID(), off.ID)
+
+	cancel()
+	cancel()
+	_, open := <-events
+	require.False(t, open)
+	// no longer notified once unsubscribed
+	connect(t, mr1, mr2)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	opt := core.Option{Passphrase: "correct horse"}
+	mr1 := newTestMessengerWithOption(t, "h1", opt)
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	require.NoError(t, mr1.AddFavorite(user2.ID))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	for _, text := range []string{"one", "two"} {
+		_, err = mr1.SendPM(chat.ID, text)
+		require.NoError(t, err)
+	}
+
+	var buf bytes.Buffer
+	require.ErrorIs(t, mr2.Snapshot(&buf), core.ErrSnapshotPassphrase)
+	require.NoError(t, mr1.Snapshot(&buf))
+	snap := buf.Bytes()
+	require.NotContains(t, string(snap), "correct horse")
+	require.NotContains(t, string(snap), "two")
+	require.NotContains(t, string(snap), user2.Name)
+	path := t.TempDir() + "/restored"
+	require.ErrorIs(t, core.Restore(bytes.NewReader(snap), "wrong", path), entity.ErrWrongPassphrase)
+	require.NoError(t, core.Restore(bytes.NewReader(snap), opt.Passphrase, path))
+	require.ErrorIs(t, core.Restore(bytes.NewReader(snap), opt.Passphrase, path), core.ErrRepoExists)
+
+	mr, err := core.MessengerBuilder(path, opt, localHost{})
+	require.NoError(t, err)
+	defer mr.Stop()
+	require.Equal(t, mr1.Host.ID(), mr.Host.ID())
+	con, err := mr.GetContact(user2.ID)
+	require.NoError(t, err)
+	require.Equal(t, user2.Name, con.Name)
+	favs, err := mr.Favorites()
+	require.NoError(t, err)
+	require.Equal(t, []entity.ID{user2.ID}, favs)
+	want, err := mr1.GetMessages(chat.ID, 0, 10)
+	require.NoError(t, err)
+	msgs, err := mr.GetMessages(chat.ID, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, want, msgs)
+	require.Len(t, msgs, 2)
+}
+
+func TestDHTMode(t *testing.T) {
+	for _, mode := range []dht.ModeOpt{dht.ModeClient, dht.ModeServer} {
+		mr, err := core.MessengerBuilder(t.TempDir()+"/h1", core.Option{DHTMode: mode}, core.DefaultRoutedHost{})
+		require.NoError(t, err)
+		_, err = mr.SignUp("h1")
+		require.NoError(t, err)
+		got, err := mr.DHTMode()
+		require.NoError(t, err)
+		require.Equal(t, mode, got)
+		mr.Stop()
+	}
+	// auto mode acts as a client until the node is found publicly reachable
+	mr, err := core.MessengerBuilder(t.TempDir()+"/h1", core.Option{}, core.DefaultRoutedHost{})
+	require.NoError(t, err)
+	_, err = mr.SignUp("h1")
+	require.NoError(t, err)
+	defer mr.Stop()
+	got, err := mr.DHTMode()
+	require.NoError(t, err)
+	require.Equal(t, dht.ModeClient, got)
+
+	_, err = newTestMessenger(t, "h2").DHTMode()
+	require.ErrorIs(t, err, core.ErrNotRouted)
+}
+
+func TestMDNS(t *testing.T) {
+	tag := "hood-chat-test-" + uuid.NewString()
+	opt := core.Option{MDNS: true, MDNSServiceTag: tag}
+	mr1 := newTestMessengerWithOption(t, "h1", opt)
+	mr2 := newTestMessengerWithOption(t, "h2", opt)
+	// other deployments on the network are not met
+	mr3 := newTestMessengerWithOption(t, "h3", core.Option{MDNS: true, MDNSServiceTag: tag + "-other"})
+
+	require.Eventually(t, func() bool {
+		return mr1.Host.Network().Connectedness(mr2.Host.ID()) == network.Connected
+	}, 20*time.Second, 100*time.Millisecond)
+	select {
+	case pi := <-mr1.DiscoveredPeers():
+		require.Equal(t, mr2.Host.ID(), pi.ID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer found over mdns was not reported")
+	}
+	require.NotEqual(t, network.Connected, mr1.Host.Network().Connectedness(mr3.Host.ID()))
+}
+
+func TestTestDial(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, mr1.TestDial(ctx, peer.AddrInfo{ID: mr2.Host.ID(), Addrs: mr2.Host.Addrs()}))
+	require.NotEqual(t, network.Connected, mr1.Host.Network().Connectedness(mr2.Host.ID()))
+	_, err := mr1.GetContact(entity.ID(mr2.Host.ID().String()))
+	require.Error(t, err)
+
+	gone, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	info := peer.AddrInfo{ID: gone.ID(), Addrs: gone.Addrs()}
+	require.NoError(t, gone.Close())
+	require.Error(t, mr1.TestDial(ctx, info))
+}
+
+func TestOutboxReplay(t *testing.T) {
+	path1 := t.TempDir() + "/h1"
+	path2 := t.TempDir() + "/h2"
+	mr2, err := core.MessengerBuilder(path2, core.Option{}, localHost{})
+	require.NoError(t, err)
+	user2, err := mr2.SignUp("h2")
+	require.NoError(t, err)
+	mr2.Stop()
+
+	mr1, err := core.MessengerBuilder(path1, core.Option{}, localHost{})
+	require.NoError(t, err)
+	_, err = mr1.SignUp("h1")
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	msg, err := mr1.SendPM(chat.ID, "after restart")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		usage, err := mr1.StorageUsage()
+		return err == nil && usage.Outbox > 0
+	}, 5*time.Second, 50*time.Millisecond)
+	mr1.Stop()
+
+	// the undelivered message is picked up again on start
+	mr1, err = core.MessengerBuilder(path1, core.Option{}, localHost{})
+	require.NoError(t, err)
+	require.Equal(t, 1, mr1.OutboxDepth())
+	mr2, err = core.MessengerBuilder(path2, core.Option{}, localHost{})
+	require.NoError(t, err)
+	defer mr2.Stop()
+	connect(t, &mr1, &mr2)
+	require.Eventually(t, func() bool {
+		_, err := mr2.GetMessage(msg.ID)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool { return mr1.OutboxDepth() == 0 }, 5*time.Second, 50*time.Millisecond)
+	mr1.Stop()
+
+	// and forgotten once acknowledged
+	mr1, err = core.MessengerBuilder(path1, core.Option{}, localHost{})
+	require.NoError(t, err)
+	defer mr1.Stop()
+	require.Zero(t, mr1.OutboxDepth())
+}
+
+func TestOutboxUpgrade(t *testing.T) {
+	// BHOutboxEntry as stored before its format was versioned
+	type BHOutboxEntry struct {
+		ID       string `badgerhold:"unique"`
+		To       store.BHContact
+		Type     string
+		Protocol string
+		Message  store.BHTextMessage
+	}
+	path1 := t.TempDir() + "/h1"
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+
+	mr1, err := core.MessengerBuilder(path1, core.Option{}, localHost{})
+	require.NoError(t, err)
+	_, err = mr1.SignUp("h1")
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	msg, err := mr1.SendPM(chat.ID, "from an old release")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return mr1.OutboxDepth() == 1 }, 5*time.Second, 50*time.Millisecond)
+	mr1.Stop()
+
+	// rewrite the entry the way an old release kept it
+	s, err := store.NewStore(path1 + "/store")
+	require.NoError(t, err)
+	entries, err := s.OutboxEntries(0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, store.OutboxVersion, entries[0].Version)
+	s.Close()
+	opt := badgerhold.DefaultOptions
+	opt.Dir = path1 + "/store"
+	opt.ValueDir = opt.Dir
+	bh, err := badgerhold.Open(opt)
+	require.NoError(t, err)
+	e := entries[0]
+	e.To.SharedKey = []byte("leaked")
+	require.NoError(t, bh.Upsert(e.ID, BHOutboxEntry{ID: e.ID, To: e.To, Type: e.Type, Protocol: e.Protocol, Message: e.Message}))
+	require.NoError(t, bh.Close())
+
+	mr1, err = core.MessengerBuilder(path1, core.Option{}, localHost{})
+	require.NoError(t, err)
+	defer mr1.Stop()
+	require.Equal(t, 1, mr1.OutboxDepth())
+	connect(t, &mr1, mr2)
+	require.Eventually(t, func() bool {
+		got, err := mr2.GetMessage(msg.ID)
+		return err == nil && got.Text == "from an old release"
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool { return mr1.OutboxDepth() == 0 }, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestMessageAcks(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	connect(t, mr1, mr2)
+	sub, err := mr1.EventBus().Subscribe(new(event.EvtMessageAcked))
+	require.NoError(t, err)
+	defer sub.Close()
+	next := func() event.EvtMessageAcked {
+		select {
+		case e := <-sub.Out():
+			return e.(event.EvtMessageAcked)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no ack received")
+		}
+		return event.EvtMessageAcked{}
+	}
+
+	msg, err := mr1.SendPM(chat.ID, "hello")
+	require.NoError(t, err)
+	require.Equal(t, event.EvtMessageAcked{MsgID: msg.ID, Type: event.AckDelivered}, next())
+	require.NoError(t, mr2.MarkConversationRead(chat.ID))
+	require.Equal(t, event.EvtMessageAcked{MsgID: msg.ID, Type: event.AckRead}, next())
+
+	// acks for messages we never sent are dropped without breaking the stream
+	s, err := mr2.Host.NewStream(context.Background(), mr1.Host.ID(), core.ID)
+	require.NoError(t, err)
+	codec := core.Codecs[core.ID]
+	me := user2.Me()
+	_, err = s.Write([]byte(core.DefaultFrameMagic))
+	require.NoError(t, err)
+	require.NoError(t, utils.NewCodecWriter(s, codec).WriteMsg(&pb.Message{
+		Id:     "unknown",
+		Type:   entity.DeliveredType,
+		Author: &pb.Contact{Id: me.ID.String(), Name: me.Name},
+	}))
+	var ack pb.Message
+	require.NoError(t, utils.NewCodecReader(s, core.MaxMsgSize, codec).ReadMsg(&ack))
+	require.Equal(t, entity.AckType, ack.GetType())
+
+	// a peer outside the chat can't ack our message, nor speak for h2
+	mr3 := newTestMessenger(t, "h3")
+	user3, err := mr3.GetIdentity()
+	require.NoError(t, err)
+	connect(t, mr3, mr1)
+	for _, author := range []*entity.Contact{user3.Me(), me} {
+		s, err := mr3.Host.NewStream(context.Background(), mr1.Host.ID(), core.ID)
+		require.NoError(t, err)
+		_, err = s.Write([]byte(core.DefaultFrameMagic))
+		require.NoError(t, err)
+		require.NoError(t, utils.NewCodecWriter(s, codec).WriteMsg(&pb.Message{
+			Id:     msg.ID.String(),
+			ChatId: chat.ID.String(),
+			Type:   entity.DeliveredType,
+			Author: &pb.Contact{Id: author.ID.String(), Name: author.Name},
+		}))
+		// the stream is reset for the impostor
+		utils.NewCodecReader(s, core.MaxMsgSize, codec).ReadMsg(&ack)
+	}
+	select {
+	case e := <-sub.Out():
+		t.Fatalf("unexpected ack %v", e)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestContactBook(t *testing.T) {
+	path := t.TempDir() + "/h1"
+	mr1, err := core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	_, err = mr1.SignUp("h1")
+	require.NoError(t, err)
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	other, err := entity.CreateIdentity("amy")
+	require.NoError(t, err)
+
+	zed := entity.Contact{ID: user2.ID, Name: "zed"}
+	for _, a := range mr2.Host.Addrs() {
+		zed.Addrs = append(zed.Addrs, a.String())
+	}
+	require.NoError(t, mr1.AddContact(zed))
+	require.NoError(t, mr1.AddContact(*other.Me()))
+	mr1.Stop()
+
+	// the book survives a restart and its addresses are dialable right away
+	mr1, err = core.MessengerBuilder(path, core.Option{}, localHost{})
+	require.NoError(t, err)
+	defer mr1.Stop()
+	cons, err := mr1.GetContacts(0, 10)
+	require.NoError(t, err)
+	require.Equal(t, []entity.Contact{*other.Me(), zed}, cons)
+	pid, err := zed.PeerID()
+	require.NoError(t, err)
+	require.ElementsMatch(t, mr2.Host.Addrs(), mr1.Host.Peerstore().Addrs(pid))
+	chat, err := mr1.CreatePMChat(zed.ID)
+	require.NoError(t, err)
+	msg, err := mr1.SendPM(chat.ID, "no lookup needed")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := mr2.GetMessage(msg.ID)
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+
+	require.NoError(t, mr1.RemoveContact(other.ID))
+	cons, err = mr1.GetContacts(0, 10)
+	require.NoError(t, err)
+	require.Equal(t, []entity.Contact{zed}, cons)
+}
+
+func TestGroups(t *testing.T) {
+	mrs := []*core.Messenger{newTestMessenger(t, "h1"), newTestMessenger(t, "h2"), newTestMessenger(t, "h3")}
+	connect(t, mrs[0], mrs[1])
+	connect(t, mrs[0], mrs[2])
+	connect(t, mrs[1], mrs[2])
+	rooms := make([]<-chan core.GroupMessage, len(mrs))
+	for i, mr := range mrs {
+		room, err := mr.JoinGroup("room")
+		require.NoError(t, err)
+		rooms[i] = room
+	}
+	again, err := mrs[0].JoinGroup("room")
+	require.NoError(t, err)
+	require.Equal(t, rooms[0], again)
+
+	// peers learn about subscriptions asynchronously, publish until heard
+	got := make([]core.GroupMessage, len(mrs))
+	require.Eventually(t, func() bool {
+		require.NoError(t, mrs[0].Publish("room", "hello"))
+		for i := 1; i < len(mrs); i++ {
+			select {
+			case msg := <-rooms[i]:
+				got[i] = msg
+			default:
+			}
+		}
+		return got[1].Text != "" && got[2].Text != ""
+	}, 10*time.Second, 200*time.Millisecond)
+	for _, msg := range got[1:] {
+		require.Equal(t, "room", msg.Topic)
+		require.Equal(t, mrs[0].Host.ID(), msg.From)
+		require.Equal(t, "hello", msg.Text)
+	}
+	// the publisher doesn't hear itself
+	require.Empty(t, rooms[0])
+
+	require.NoError(t, mrs[1].LeaveGroup("room"))
+	for range rooms[1] {
+	}
+	require.ErrorIs(t, mrs[1].LeaveGroup("room"), core.ErrNotJoined)
+	require.ErrorIs(t, mrs[1].Publish("room", "gone"), core.ErrNotJoined)
+}
+
+func TestRooms(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	connect(t, mr1, mr2)
+	rooms := map[string]<-chan core.GroupMessage{}
+	for _, topic := range []string{"room1", "room2"} {
+		_, err := mr1.JoinGroup(topic)
+		require.NoError(t, err)
+		rooms[topic], err = mr2.JoinGroup(topic)
+		require.NoError(t, err)
+	}
+	// peers learn about subscriptions asynchronously, publish until heard
+	for topic, room := range rooms {
+		require.Eventually(t, func() bool {
+			require.NoError(t, mr1.Publish(topic, "ping"))
+			select {
+			case <-room:
+				return true
+			case <-time.After(100 * time.Millisecond):
+				return false
+			}
+		}, 10*time.Second, 100*time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	for topic, room := range rooms {
+		for len(room) > 0 {
+			<-room
+		}
+		require.NoError(t, mr2.MarkRoomRead(topic))
+	}
+
+	send := func(topic string, n int) {
+		for i := 0; i < n; i++ {
+			require.NoError(t, mr1.Publish(topic, fmt.Sprint("hello ", i)))
+			select {
+			case <-rooms[topic]:
+			case <-time.After(5 * time.Second):
+				t.Fatal("group message not received")
+			}
+		}
+	}
+	send("room1", 2)
+	send("room2", 3)
+	got := mr2.Rooms()
+	require.Len(t, got, 2)
+	require.Equal(t, "room2", got[0].Topic)
+	require.Equal(t, 3, got[0].Unread)
+	require.Equal(t, "room1", got[1].Topic)
+	require.Equal(t, 2, got[1].Unread)
+	require.True(t, got[0].LastActivity.After(got[1].LastActivity))
+	// the publisher has nothing unread
+	for _, r := range mr1.Rooms() {
+		require.Zero(t, r.Unread)
+	}
+
+	require.NoError(t, mr2.MarkRoomRead("room2"))
+	require.Zero(t, mr2.Rooms()[0].Unread)
+	require.ErrorIs(t, mr2.MarkRoomRead("room3"), core.ErrNotJoined)
+}
+
+func TestRoomMetadata(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	_, err := mr1.JoinGroup("room")
+	require.NoError(t, err)
+	meta := core.RoomMetadata{Name: "hood", Description: "the neighbours", Avatar: "bafyavatar"}
+	require.NoError(t, mr1.SetRoomMetadata("room", meta))
+	_, err = mr1.RoomMetadata("other")
+	require.ErrorIs(t, err, core.ErrNotJoined)
+
+	// a member joining later learns the metadata from the creator
+	connect(t, mr1, mr2)
+	room, err := mr2.JoinGroup("room")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		got, err := mr2.RoomMetadata("room")
+		return err == nil && got == meta
+	}, 10*time.Second, 100*time.Millisecond)
+	require.Equal(t, meta, mr2.Rooms()[0].Metadata)
+
+	meta.Name = "hood 2"
+	require.NoError(t, mr1.SetRoomMetadata("room", meta))
+	require.Eventually(t, func() bool {
+		got, _ := mr2.RoomMetadata("room")
+		return got == meta
+	}, 10*time.Second, 100*time.Millisecond)
+	require.ErrorIs(t, mr2.SetRoomMetadata("room", core.RoomMetadata{Name: "mine"}), core.ErrNotRoomCreator)
+
+	// updates not signed by the creator are dropped
+	rogue, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	defer rogue.Close()
+	ps, err := pubsub.NewGossipSub(context.Background(), rogue)
+	require.NoError(t, err)
+	topic, err := ps.Join("room")
+	require.NoError(t, err)
+	sub, err := topic.Subscribe()
+	require.NoError(t, err)
+	defer sub.Cancel()
+	require.NoError(t, rogue.Connect(context.Background(), peer.AddrInfo{ID: mr2.Host.ID(), Addrs: mr2.Host.Addrs()}))
+	type update struct {
+		Topic   string            `json:"topic"`
+		Meta    core.RoomMetadata `json:"meta"`
+		Version uint64            `json:"version"`
+		Creator peer.ID           `json:"creator"`
+		Sig     []byte            `json:"sig,omitempty"`
+	}
+	forge := func(creator peer.ID) []byte {
+		u := update{Topic: "room", Meta: core.RoomMetadata{Name: "pwned"}, Version: math.MaxUint64, Creator: creator}
+		data, err := json.Marshal(u)
+		require.NoError(t, err)
+		u.Sig, err = rogue.Peerstore().PrivKey(rogue.ID()).Sign(data)
+		require.NoError(t, err)
+		frame, err := json.Marshal(map[string]update{"meta": u})
+		require.NoError(t, err)
+		return frame
+	}
+	require.Eventually(t, func() bool {
+		return len(topic.ListPeers()) > 0
+	}, 10*time.Second, 100*time.Millisecond)
+	require.NoError(t, topic.Publish(context.Background(), forge(mr1.Host.ID())))
+	require.NoError(t, topic.Publish(context.Background(), forge(rogue.ID())))
+	// the text sent after the forgeries tells they were handled
+	require.NoError(t, topic.Publish(context.Background(), []byte(`{"text":"done"}`)))
+	for msg := range room {
+		if msg.From == rogue.ID() {
+			require.Equal(t, "done", msg.Text)
+			break
+		}
+	}
+	got, err := mr2.RoomMetadata("room")
+	require.NoError(t, err)
+	require.Equal(t, meta, got)
+}
+
+func TestGroupCausalOrder(t *testing.T) {
+	mrs := []*core.Messenger{newTestMessenger(t, "h1"), newTestMessenger(t, "h2"), newTestMessenger(t, "h3")}
+	connect(t, mrs[0], mrs[1])
+	connect(t, mrs[1], mrs[2])
+	connect(t, mrs[0], mrs[2])
+	rooms := make([]<-chan core.GroupMessage, len(mrs))
+	for i, mr := range mrs {
+		var err error
+		rooms[i], err = mr.JoinGroup("room")
+		require.NoError(t, err)
+	}
+	next := func(i int) core.GroupMessage {
+		select {
+		case msg := <-rooms[i]:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("group message not received")
+		}
+		return core.GroupMessage{}
+	}
+	// wait for everyone to be in the mesh of everyone
+	for i, mr := range mrs {
+		for j := range mrs {
+			if i == j {
+				continue
+			}
+			require.Eventually(t, func() bool {
+				require.NoError(t, mr.Publish("room", "ping"))
+				select {
+				case <-rooms[j]:
+					return true
+				case <-time.After(100 * time.Millisecond):
+					return false
+				}
+			}, 10*time.Second, 100*time.Millisecond)
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	for _, room := range rooms {
+		for len(room) > 0 {
+			<-room
+		}
+	}
+
+	// the first two members take turns, each answering what the other sent
+	texts := []string{"question", "answer", "thanks"}
+	for i, text := range texts {
+		require.NoError(t, mrs[i%2].Publish("room", text))
+		if i < len(texts)-1 {
+			require.Equal(t, text, next((i+1)%2).Text)
+		}
+	}
+	// the third member restores the conversation whatever order the
+	// network delivered it in
+	got := make([]core.GroupMessage, 0, len(texts))
+	for range texts {
+		got = append([]core.GroupMessage{next(2)}, got...)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Before(got[j]) })
+	for i, text := range texts {
+		require.Equal(t, text, got[i].Text)
+		if i > 0 {
+			require.Greater(t, got[i].Clock, got[i-1].Clock)
+		}
+	}
+}
+
+func TestMaxRooms(t *testing.T) {
+	mr := newTestMessengerWithOption(t, "h1", core.Option{MaxRooms: 2})
+	_, err := mr.JoinGroup("room1")
+	require.NoError(t, err)
+	_, err = mr.JoinGroup("room2")
+	require.NoError(t, err)
+	// joining again takes no room
+	_, err = mr.JoinGroup("room2")
+	require.NoError(t, err)
+	_, err = mr.JoinGroup("room3")
+	require.ErrorIs(t, err, core.ErrMaxRooms)
+
+	require.NoError(t, mr.LeaveGroup("room1"))
+	_, err = mr.JoinGroup("room3")
+	require.NoError(t, err)
+}
+
+func TestGroupPolicy(t *testing.T) {
+	opt := core.Option{Group: core.GroupPolicy{
+		HeartbeatInterval: 100 * time.Millisecond,
+		MeshDegree:        1,
+		HistoryLength:     2,
+	}}
+	mrs := []*core.Messenger{
+		newTestMessengerWithOption(t, "h1", opt),
+		newTestMessengerWithOption(t, "h2", opt),
+		newTestMessengerWithOption(t, "h3", opt),
+	}
+	connect(t, mrs[0], mrs[1])
+	connect(t, mrs[0], mrs[2])
+	connect(t, mrs[1], mrs[2])
+	rooms := make([]<-chan core.GroupMessage, len(mrs))
+	for i, mr := range mrs {
+		room, err := mr.JoinGroup("room")
+		require.NoError(t, err)
+		rooms[i] = room
+	}
+
+	// a mesh of one still reaches every member
+	heard := make([]bool, len(mrs))
+	require.Eventually(t, func() bool {
+		require.NoError(t, mrs[0].Publish("room", "hello"))
+		for i := 1; i < len(mrs); i++ {
+			select {
+			case msg := <-rooms[i]:
+				heard[i] = heard[i] || msg.Text == "hello"
+			default:
+			}
+		}
+		return heard[1] && heard[2]
+	}, 10*time.Second, 200*time.Millisecond)
+}
+
+func TestPresence(t *testing.T) {
+	pair := func(policy core.PresencePolicy) (*core.Messenger, *core.Messenger, lpevent.Subscription) {
+		opt := core.Option{Presence: true, PresencePolicy: policy}
+		mr1 := newTestMessengerWithOption(t, "h1", opt)
+		// the test stops h2 itself
+		mr2, err := core.MessengerBuilder(t.TempDir()+"/h2", opt, localHost{})
+		require.NoError(t, err)
+		_, err = mr2.SignUp("h2")
+		require.NoError(t, err)
+		user1, err := mr1.GetIdentity()
+		require.NoError(t, err)
+		user2, err := mr2.GetIdentity()
+		require.NoError(t, err)
+		require.NoError(t, mr1.AddContact(*user2.Me()))
+		require.NoError(t, mr2.AddContact(*user1.Me()))
+		sub, err := mr1.EventBus().Subscribe(new(event.EvtPresenceChanged))
+		require.NoError(t, err)
+		t.Cleanup(func() { sub.Close() })
+		connect(t, mr1, &mr2)
+		return mr1, &mr2, sub
+	}
+	next := func(sub lpevent.Subscription, within time.Duration) event.EvtPresenceChanged {
+		select {
+		case e := <-sub.Out():
+			return e.(event.EvtPresenceChanged)
+		case <-time.After(within):
+			t.Fatal("no presence change")
+		}
+		return event.EvtPresenceChanged{}
+	}
+
+	// a closing node says goodbye instead of waiting for the timeout
+	mr1, mr2, sub := pair(core.PresencePolicy{Interval: 100 * time.Millisecond, Timeout: time.Minute})
+	require.Equal(t, event.EvtPresenceChanged{ID: mr2.Host.ID(), Presence: entity.Online}, next(sub, 5*time.Second))
+	require.Equal(t, entity.Online, mr1.GetPresence(mr2.Host.ID()))
+	mr2.SetPresence(entity.Away)
+	require.Equal(t, event.EvtPresenceChanged{ID: mr2.Host.ID(), Presence: entity.Away}, next(sub, 5*time.Second))
+	mr2.Stop()
+	require.Equal(t, event.EvtPresenceChanged{ID: mr2.Host.ID(), Presence: entity.Offline}, next(sub, 2*time.Second))
+	require.Equal(t, entity.Offline, mr1.GetPresence(mr2.Host.ID()))
+
+	// a silent contact goes offline after the timeout
+	mr1, mr2, sub = pair(core.PresencePolicy{Interval: 100 * time.Millisecond, Timeout: 500 * time.Millisecond})
+	require.Equal(t, entity.Online, next(sub, 5*time.Second).Presence)
+	defer mr2.Stop()
+	mr2.Pause()
+	require.Equal(t, event.EvtPresenceChanged{ID: mr2.Host.ID(), Presence: entity.Offline}, next(sub, 5*time.Second))
+}
+
+func TestTyping(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	mr3 := newTestMessenger(t, "h3")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	connect(t, mr1, mr2)
+	typing := mr1.TypingEvents()
+	next := func() event.EvtTyping {
+		select {
+		case e := <-typing:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no typing event")
+		}
+		return event.EvtTyping{}
+	}
+	quiet := func() {
+		select {
+		case e := <-typing:
+			t.Fatalf("unexpected typing event %v", e)
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+
+	// keystrokes within the interval send a single start
+	for i := 0; i < 10; i++ {
+		mr2.SendTyping(mr1.Host.ID(), true)
+	}
+	require.Equal(t, event.EvtTyping{ID: mr2.Host.ID(), Typing: true}, next())
+	quiet()
+	mr2.SendTyping(mr1.Host.ID(), false)
+	mr2.SendTyping(mr1.Host.ID(), false)
+	require.Equal(t, event.EvtTyping{ID: mr2.Host.ID(), Typing: false}, next())
+	quiet()
+	require.Zero(t, mr2.OutboxDepth())
+
+	// nothing is queued nor dialed for a peer not connected
+	mr2.SendTyping(mr3.Host.ID(), true)
+	require.Never(t, func() bool {
+		return mr2.Host.Network().Connectedness(mr3.Host.ID()) == network.Connected
+	}, 300*time.Millisecond, 50*time.Millisecond)
+	require.Zero(t, mr2.OutboxDepth())
+}
+
+func TestTypingInterval(t *testing.T) {
+	const interval = 200 * time.Millisecond
+	opt, err := core.DefaultOption()
+	require.NoError(t, err)
+	opt.TypingInterval = interval
+	mr := newTestMessengerWithOption(t, "h1", opt)
+	other, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	defer other.Close()
+	frames := make(chan []byte, 100)
+	other.SetStreamHandler(core.TypingID, func(s network.Stream) {
+		defer s.Close()
+		msg, err := msgio.NewVarintReaderSize(s, 1).ReadMsg()
+		if err == nil {
+			frames <- msg
+		}
+	})
+	require.NoError(t, mr.Host.Connect(context.Background(), peer.AddrInfo{ID: other.ID(), Addrs: other.Addrs()}))
+
+	// a keystroke every 10ms for five intervals
+	start := time.Now()
+	for time.Since(start) < 5*interval {
+		mr.SendTyping(other.ID(), true)
+		time.Sleep(10 * time.Millisecond)
+	}
+	mr.SendTyping(other.ID(), false)
+	var starts, stops int
+	for stops == 0 {
+		select {
+		case f := <-frames:
+			if f[0] == 1 {
+				starts++
+			} else {
+				stops++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("typing stop not received")
+		}
+	}
+	require.GreaterOrEqual(t, starts, 4)
+	require.LessOrEqual(t, starts, 6)
+	require.Len(t, frames, 0)
+}
+
+// stallReader yields data then blocks until done is closed.
+type stallReader struct {
+	data []byte
+	done chan struct{}
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		<-r.done
+		return 0, errors.New("stalled")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestSendFile(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	connect(t, mr1, mr2)
+	dir := t.TempDir()
+	ctx := context.Background()
+	data := make([]byte, 5*core.FileChunkSize/2)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	meta := entity.FileMeta{Name: "photo.jpg", MIME: "image/jpeg", Size: int64(len(data))}
+	left := func() []os.DirEntry {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		return entries
+	}
+
+	err := mr1.SendFile(ctx, mr2.Host.ID(), bytes.NewReader(data), meta, nil)
+	require.ErrorIs(t, err, core.ErrFileRejected)
+
+	mr2.HandleFiles(func(from peer.ID, meta entity.FileMeta) (string, error) {
+		if meta.MIME != "image/jpeg" {
+			return "", errors.New("photos only")
+		}
+		return dir + "/" + meta.Name, nil
+	})
+	sub, err := mr2.EventBus().Subscribe(new(event.EvtFileReceived))
+	require.NoError(t, err)
+	defer sub.Close()
+	progress := make(chan core.FileProgress, 16)
+	require.NoError(t, mr1.SendFile(ctx, mr2.Host.ID(), bytes.NewReader(data), meta, progress))
+	var last core.FileProgress
+	for len(progress) > 0 {
+		last = <-progress
+	}
+	require.Equal(t, core.FileProgress{Done: meta.Size, Total: meta.Size}, last)
+	select {
+	case e := <-sub.Out():
+		require.Equal(t, event.EvtFileReceived{From: mr1.Host.ID(), File: meta, Path: dir + "/photo.jpg"}, e)
+	case <-time.After(5 * time.Second):
+		t.Fatal("file not announced")
+	}
+	got, err := os.ReadFile(dir + "/photo.jpg")
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+	require.NoError(t, os.Remove(dir+"/photo.jpg"))
+
+	other := entity.FileMeta{Name: "tool.exe", Size: 1}
+	err = mr1.SendFile(ctx, mr2.Host.ID(), bytes.NewReader([]byte{1}), other, nil)
+	require.ErrorIs(t, err, core.ErrFileRejected)
+	require.Contains(t, err.Error(), "photos only")
+
+	// fewer bytes than announced
+	err = mr1.SendFile(ctx, mr2.Host.ID(), bytes.NewReader(data[:10]), meta, nil)
+	require.ErrorIs(t, err, core.ErrFileSize)
+	require.Eventually(t, func() bool { return len(left()) == 0 }, 5*time.Second, 50*time.Millisecond)
+
+	// a transfer broken off midway leaves no partial file
+	stall := &stallReader{data: data[:core.FileChunkSize], done: make(chan struct{})}
+	cctx, cancel := context.WithCancel(ctx)
+	go func() {
+		// the reader can't be interrupted, it gives up once cancelled
+		defer close(stall.done)
+		defer cancel()
+		for i := 0; i < 500 && len(left()) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	err = mr1.SendFile(cctx, mr2.Host.ID(), stall, meta, nil)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Eventually(t, func() bool { return len(left()) == 0 }, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestFileIdleTimeout(t *testing.T) {
+	opt := core.Option{Files: core.FilePolicy{IdleTimeout: 300 * time.Millisecond}}
+	mr1 := newTestMessengerWithOption(t, "h1", opt)
+	mr2 := newTestMessengerWithOption(t, "h2", opt)
+	connect(t, mr1, mr2)
+	dir := t.TempDir()
+	mr2.HandleFiles(func(from peer.ID, meta entity.FileMeta) (string, error) {
+		return dir + "/" + meta.Name, nil
+	})
+	data := make([]byte, 2*core.FileChunkSize)
+	meta := entity.FileMeta{Name: "photo.jpg", Size: int64(len(data))}
+
+	left := func() int {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		return len(entries)
+	}
+
+	// the first chunk goes, then the reader stalls
+	stall := &stallReader{data: data[:core.FileChunkSize], done: make(chan struct{})}
+	go func() {
+		// the receiver gives up on its own and discards the partial file
+		defer close(stall.done)
+		for i := 0; i < 500 && left() == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		for i := 0; i < 500 && left() > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	err := mr1.SendFile(context.Background(), mr2.Host.ID(), stall, meta, nil)
+	require.ErrorIs(t, err, core.ErrFileIdle)
+	require.Less(t, time.Since(start), core.StreamTimeout)
+	require.Zero(t, left())
+}
+
+func TestFilePolicy(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessengerWithOption(t, "h2", core.Option{Files: core.FilePolicy{
+		MaxSize:      1024,
+		AllowedTypes: []string{"image/*", "text/plain"},
+	}})
+	connect(t, mr1, mr2)
+	dir := t.TempDir()
+	mr2.HandleFiles(func(from peer.ID, meta entity.FileMeta) (string, error) {
+		return dir + "/" + meta.Name, nil
+	})
+	send := func(meta entity.FileMeta) error {
+		return mr1.SendFile(context.Background(), mr2.Host.ID(), bytes.NewReader(make([]byte, meta.Size)), meta, nil)
+	}
+
+	err := send(entity.FileMeta{Name: "big.png", MIME: "image/png", Size: 1025})
+	require.ErrorIs(t, err, core.ErrFileRejected)
+	require.Contains(t, err.Error(), "too large")
+	err = send(entity.FileMeta{Name: "tool.exe", MIME: "application/x-msdownload", Size: 10})
+	require.ErrorIs(t, err, core.ErrFileRejected)
+	require.Contains(t, err.Error(), "not allowed")
+	require.NoError(t, send(entity.FileMeta{Name: "small.png", MIME: "image/png", Size: 1024}))
+	require.NoError(t, send(entity.FileMeta{Name: "notes.txt", MIME: "text/plain", Size: 10}))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func TestMaxConcurrentTransfers(t *testing.T) {
+	limited := core.Option{Files: core.FilePolicy{MaxConcurrentTransfers: 1}}
+	for name, opts := range map[string][2]core.Option{
+		"send":    {limited, {}},
+		"receive": {{}, limited},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mr1 := newTestMessengerWithOption(t, "h1", opts[0])
+			mr2 := newTestMessengerWithOption(t, "h2", opts[1])
+			connect(t, mr1, mr2)
+			dir := t.TempDir()
+			started := make(chan string, 2)
+			mr2.HandleFiles(func(from peer.ID, meta entity.FileMeta) (string, error) {
+				started <- meta.Name
+				return dir + "/" + meta.Name, nil
+			})
+			data := make([]byte, core.FileChunkSize)
+			send := func(name string, r io.Reader) chan error {
+				done := make(chan error, 1)
+				go func() {
+					meta := entity.FileMeta{Name: name, Size: int64(len(data))}
+					done <- mr1.SendFile(context.Background(), mr2.Host.ID(), r, meta, nil)
+				}()
+				return done
+			}
+
+			pr, pw := io.Pipe()
+			first := send("first", pr)
+			require.Equal(t, "first", <-started)
+			second := send("second", bytes.NewReader(data))
+			select {
+			case name := <-started:
+				t.Fatalf("%s started beyond the limit", name)
+			case <-time.After(300 * time.Millisecond):
+			}
+
+			_, err := pw.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, pw.Close())
+			require.NoError(t, <-first)
+			select {
+			case name := <-started:
+				require.Equal(t, "second", name)
+			case <-time.After(5 * time.Second):
+				t.Fatal("queued transfer did not start")
+			}
+			require.NoError(t, <-second)
+		})
+	}
+}
+
+// gateReader serves data, holding reads from gate on until open is closed.
+type gateReader struct {
+	data []byte
+	gate int64
+	open chan struct{}
+
+	mux     sync.Mutex
+	offsets []int64
+}
+
+func (r *gateReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mux.Lock()
+	r.offsets = append(r.offsets, off)
+	r.mux.Unlock()
+	if off >= r.gate {
+		<-r.open
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func TestQueueFile(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	connect(t, mr1, mr2)
+	dir := t.TempDir()
+	mr2.HandleFiles(func(from peer.ID, meta entity.FileMeta) (string, error) {
+		return dir + "/" + meta.Name, nil
+	})
+	sub, err := mr1.EventBus().Subscribe(new(event.EvtFileSent))
+	require.NoError(t, err)
+	defer sub.Close()
+	data := make([]byte, 4*core.FileChunkSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	meta := entity.FileMeta{Name: "photo.jpg", Size: int64(len(data))}
+
+	// half the file goes through before the connection drops
+	r := &gateReader{data: data, gate: 2 * core.FileChunkSize, open: make(chan struct{})}
+	id := mr1.QueueFile(mr2.Host.ID(), r, meta)
+	part := dir + "/photo.jpg." + id + ".part"
+	require.Eventually(t, func() bool {
+		st, err := os.Stat(part)
+		return err == nil && st.Size() == r.gate
+	}, 5*time.Second, 50*time.Millisecond)
+	require.NoError(t, mr1.Host.Network().ClosePeer(mr2.Host.ID()))
+	close(r.open)
+	st, err := os.Stat(part)
+	require.NoError(t, err)
+	require.Equal(t, r.gate, st.Size())
+
+	connect(t, mr1, mr2)
+	select {
+	case e := <-sub.Out():
+		require.Equal(t, event.EvtFileSent{To: mr2.Host.ID(), ID: id, File: meta}, e)
+	case <-time.After(5 * time.Second):
+		t.Fatal("file not sent")
+	}
+	got, err := os.ReadFile(dir + "/photo.jpg")
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+	_, err = os.Stat(part)
+	require.True(t, os.IsNotExist(err))
+	// the second attempt went on from the gate
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	require.Equal(t, []int64{0, core.FileChunkSize, r.gate, r.gate}, r.offsets[:4])
+}
+
+func TestPartExpiry(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessengerWithOption(t, "h2", core.Option{Files: core.FilePolicy{PartExpiry: time.Hour}})
+	connect(t, mr1, mr2)
+	dir := t.TempDir()
+	mr2.HandleFiles(func(from peer.ID, meta entity.FileMeta) (string, error) {
+		return dir + "/" + meta.Name, nil
+	})
+	sub, err := mr1.EventBus().Subscribe(new(event.EvtFileSent))
+	require.NoError(t, err)
+	defer sub.Close()
+	// left by transfers whose sender went away, and a file of the user
+	stale := dir + "/old.jpg." + uuid.New().String() + ".part"
+	fresh := dir + "/new.jpg." + uuid.New().String() + ".part"
+	mine := dir + "/notes.part"
+	for _, path := range []string{stale, fresh, mine} {
+		require.NoError(t, os.WriteFile(path, []byte("half"), 0o600))
+	}
+	long := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(stale, long, long))
+	require.NoError(t, os.Chtimes(mine, long, long))
+
+	data := []byte("a photo")
+	meta := entity.FileMeta{Name: "photo.jpg", Size: int64(len(data))}
+	mr1.QueueFile(mr2.Host.ID(), bytes.NewReader(data), meta)
+	select {
+	case e := <-sub.Out():
+		require.NoError(t, e.(event.EvtFileSent).Err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("file not sent")
+	}
+	_, err = os.Stat(stale)
+	require.True(t, os.IsNotExist(err))
+	for _, path := range []string{fresh, mine} {
+		_, err = os.Stat(path)
+		require.NoError(t, err, path)
+	}
+}
+
+func TestAttachmentFetchFails(t *testing.T) {
+	opt := core.Option{AttachmentThreshold: 1024}
+	path1 := t.TempDir() + "/h1"
+	mr1, err := core.MessengerBuilder(path1, opt, localHost{})
+	require.NoError(t, err)
+	_, err = mr1.SignUp("h1")
+	require.NoError(t, err)
+	mr2 := newTestMessengerWithOption(t, "h2", opt)
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+
+	// the attachment can't be fetched, the message is not acknowledged
+	mr1.Host.RemoveStreamHandler(core.AttachmentID)
+	connect(t, &mr1, mr2)
+	long := strings.Repeat("a very long paste ", 2*core.MaxMsgSize/18)
+	msg, err := mr1.SendPM(chat.ID, long)
+	require.NoError(t, err)
+	require.Never(t, func() bool {
+		_, err := mr2.GetMessage(msg.ID)
+		return err == nil
+	}, time.Second, 100*time.Millisecond)
+	require.Equal(t, 1, mr1.OutboxDepth())
+	mr1.Stop()
+
+	// and delivered once it can
+	mr1, err = core.MessengerBuilder(path1, opt, localHost{})
+	require.NoError(t, err)
+	defer mr1.Stop()
+	connect(t, &mr1, mr2)
+	require.Eventually(t, func() bool {
+		got, err := mr2.GetMessage(msg.ID)
+		return err == nil && got.Text == long
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool { return mr1.OutboxDepth() == 0 }, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestAttachmentThreshold(t *testing.T) {
+	opt := core.Option{AttachmentThreshold: 1024}
+	mr1 := newTestMessengerWithOption(t, "h1", opt)
+	mr2 := newTestMessengerWithOption(t, "h2", opt)
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	connect(t, mr1, mr2)
+	sub, err := mr2.EventBus().Subscribe(new(event.EvtMessageReceived))
+	require.NoError(t, err)
+	defer sub.Close()
+	onWire := func() *pb.Message {
+		select {
+		case e := <-sub.Out():
+			return e.(event.EvtMessageReceived).Msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message received")
+		}
+		return nil
+	}
+	received := func(id entity.ID) entity.Message {
+		var msg entity.Message
+		require.Eventually(t, func() bool {
+			msg, err = mr2.GetMessage(id)
+			return err == nil
+		}, 5*time.Second, 50*time.Millisecond)
+		return msg
+	}
+
+	msg, err := mr1.SendPM(chat.ID, "short")
+	require.NoError(t, err)
+	frame := onWire()
+	require.Equal(t, "short", frame.GetText())
+	require.Empty(t, frame.GetAttachment())
+	require.Equal(t, "short", received(msg.ID).Text)
+
+	long := strings.Repeat("a very long paste ", 2*core.MaxMsgSize/18)
+	msg, err = mr1.SendPM(chat.ID, long)
+	require.NoError(t, err)
+	require.NotEmpty(t, msg.Attachment)
+	frame = onWire()
+	require.Empty(t, frame.GetText())
+	require.Equal(t, msg.Attachment, frame.GetAttachment())
+	require.Less(t, proto.Size(frame), 1024)
+	got := received(msg.ID)
+	require.Equal(t, long, got.Text)
+	require.Equal(t, msg.Attachment, got.Attachment)
+
+	_, err = mr1.SendPM(chat.ID, strings.Repeat("x", core.MaxAttachmentSize+1))
+	require.ErrorIs(t, err, core.ErrAttachmentSize)
+}
+
+// spyAttachments is an AttachmentStore recording what goes through it.
+type spyAttachments struct {
+	mux     sync.Mutex
+	data    map[string][]byte
+	deleted []string
+}
+
+func (s *spyAttachments) Put(id string, data []byte) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.data[id] = data
+	return nil
+}
+
+func (s *spyAttachments) Get(id string) ([]byte, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	data, ok := s.data[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return data, nil
+}
+
+func (s *spyAttachments) Delete(id string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.data, id)
+	s.deleted = append(s.deleted, id)
+	return nil
+}
+
+func TestAttachmentStore(t *testing.T) {
+	spy := &spyAttachments{data: make(map[string][]byte)}
+	mr1 := newTestMessengerWithOption(t, "h1", core.Option{AttachmentThreshold: 1024})
+	mr2 := newTestMessengerWithOption(t, "h2", core.Option{AttachmentThreshold: 1024, Attachments: spy})
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	connect(t, mr1, mr2)
+
+	long := strings.Repeat("a very long paste ", 2*core.MaxMsgSize/18)
+	msg, err := mr1.SendPM(chat.ID, long)
+	require.NoError(t, err)
+	var got entity.Message
+	require.Eventually(t, func() bool {
+		got, err = mr2.GetMessage(msg.ID)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, long, got.Text)
+	data, err := spy.Get(msg.Attachment)
+	require.NoError(t, err)
+	require.Equal(t, long, string(data))
+
+	// purging the sender drops its attachments from the store too
+	require.NoError(t, mr2.PurgePeer(mr1.Host.ID()))
+	spy.mux.Lock()
+	defer spy.mux.Unlock()
+	require.Equal(t, []string{msg.Attachment}, spy.deleted)
+	require.Empty(t, spy.data)
+}
+
+func TestTrustedPeers(t *testing.T) {
+	// relays tag the peers holding a reservation in their conn manager
+	newTaggingRelay := func() host.Host {
+		cm, err := connmgr.NewConnManager(10, 100)
+		require.NoError(t, err)
+		return newRelay(t, libp2p.ConnectionManager(cm))
+	}
+	trusted := newTaggingRelay()
+	other := newTaggingRelay()
+	mr := newTestMessengerWithOption(t, "h1", core.Option{
+		LpOpt: []libp2p.Option{libp2p.ForceReachabilityPrivate()},
+		Relays: []peer.AddrInfo{
+			{ID: other.ID(), Addrs: other.Addrs()},
+			{ID: trusted.ID(), Addrs: trusted.Addrs()},
+		},
+		TrustedPeers: []peer.ID{trusted.ID()},
+	})
+	reserved := func(relay host.Host) bool {
+		info := relay.ConnManager().GetTagInfo(mr.Host.ID())
+		return info != nil && info.Tags["relay-reservation"] > 0
+	}
+	require.Eventually(t, func() bool { return reserved(trusted) }, 10*time.Second, 100*time.Millisecond)
+	require.False(t, reserved(other))
+	require.NotEqual(t, network.Connected, other.Network().Connectedness(mr.Host.ID()))
+}
+
+func TestExportImportIdentity(t *testing.T) {
+	mr1 := newTestMessengerWithOption(t, "h1", core.Option{Passphrase: "old device"})
+	_, err := mr1.ExportIdentity("")
+	require.ErrorIs(t, err, core.ErrExportPassphrase)
+	blob, err := mr1.ExportIdentity("new device")
+	require.NoError(t, err)
+
+	path := t.TempDir() + "/imported"
+	require.ErrorIs(t, core.ImportIdentity(blob, "old device", path, false), entity.ErrWrongPassphrase)
+	require.NoError(t, core.ImportIdentity(blob, "new device", path, false))
+	require.ErrorIs(t, core.ImportIdentity(blob, "new device", path, false), core.ErrRepoExists)
+	require.NoError(t, core.ImportIdentity(blob, "new device", path, true))
+
+	mr, err := core.MessengerBuilder(path, core.Option{Passphrase: "new device"}, localHost{})
+	require.NoError(t, err)
+	defer mr.Stop()
+	require.Equal(t, mr1.Host.ID(), mr.Host.ID())
+	user1, err := mr1.GetIdentity()
+	require.NoError(t, err)
+	imported, err := mr.GetIdentity()
+	require.NoError(t, err)
+	require.Equal(t, user1.Name, imported.Name)
+}
+
+func TestStats(t *testing.T) {
+	mr1 := newTestMessenger(t, "h1")
+	mr2 := newTestMessenger(t, "h2")
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+	require.Equal(t, 0, mr1.Stats().Peers)
+
+	connect(t, mr1, mr2)
+	_, err = mr1.SendPM(chat.ID, "hello")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		st := mr1.Stats()
+		return st.Outbox == 0 && st.BytesSent > 0 && st.BytesReceived > 0
+	}, 5*time.Second, 100*time.Millisecond)
+	st := mr1.Stats()
+	require.Equal(t, 1, st.Peers)
+	require.Zero(t, st.RoutingTable)
+	require.Equal(t, core.BootstrapOff, st.Bootstrap)
+	require.Positive(t, st.Uptime)
+}
+
+func TestSharedKey(t *testing.T) {
+	opt := core.Option{Passphrase: "correct horse", AttachmentThreshold: 64}
+	mr1 := newTestMessengerWithOption(t, "h1", opt)
+	mr2 := newTestMessenger(t, "h2")
+	user1, err := mr1.GetIdentity()
+	require.NoError(t, err)
+	user2, err := mr2.GetIdentity()
+	require.NoError(t, err)
+	require.NoError(t, mr1.AddContact(*user2.Me()))
+	require.NoError(t, mr2.AddContact(*user1.Me()))
+	require.ErrorIs(t, mr1.SetSharedKey(user2.ID, []byte("short")), entity.ErrSharedKeySize)
+	key := bytes.Repeat([]byte{7}, entity.SharedKeySize)
+	require.NoError(t, mr1.SetSharedKey(user2.ID, key))
+	require.NoError(t, mr2.SetSharedKey(user1.ID, key))
+	chat, err := mr1.CreatePMChat(user2.ID)
+	require.NoError(t, err)
+
+	// not connected yet, the message waits in the outbox
+	msg, err := mr1.SendPM(chat.ID, "meet at noon")
+	require.NoError(t, err)
+	// long enough to go as an attachment
+	long := strings.Repeat("meet at the north gate ", 10)
+	lmsg, err := mr1.SendPM(chat.ID, long)
+	require.NoError(t, err)
+	var bundle store.BHBundle
+	require.Eventually(t, func() bool {
+		var buf bytes.Buffer
+		require.NoError(t, mr1.Snapshot(&buf))
+		data, err := entity.OpenWithPassphrase(buf.Bytes(), opt.Passphrase)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(data, &bundle))
+		return len(bundle.Outbox) == 2
+	}, 5*time.Second, 100*time.Millisecond)
+	queued := map[string]store.BHTextMessage{}
+	for _, e := range bundle.Outbox {
+		require.True(t, e.Message.Sealed)
+		require.NotContains(t, e.Message.Text, "meet")
+		require.Empty(t, e.To.SharedKey)
+		queued[e.Message.ID] = e.Message
+	}
+	text, err := entity.OpenText(key, queued[msg.ID.String()].Text)
+	require.NoError(t, err)
+	require.Equal(t, "meet at noon", text)
+	// the attachment peers are served is sealed too
+	sealed := queued[lmsg.ID.String()]
+	require.NotEqual(t, lmsg.Attachment, sealed.Attachment)
+	var served []byte
+	for _, a := range bundle.Attachments {
+		if a.ID == sealed.Attachment {
+			served = a.Data
+		}
+	}
+	text, err = entity.OpenText(key, string(served))
+	require.NoError(t, err)
+	require.Equal(t, long, text)
+
+	connect(t, mr1, mr2)
+	require.Eventually(t, func() bool {
+		got, err := mr2.GetMessage(msg.ID)
+		return err == nil && got.Text == "meet at noon" && !got.Sealed
+	}, 5*time.Second, 100*time.Millisecond)
+	require.Eventually(t, func() bool {
+		got, err := mr2.GetMessage(lmsg.ID)
+		return err == nil && got.Text == long && !got.Sealed
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestSubscribeInfraPeers(t *testing.T) {
+	boot := newRelay(t)
+	bootInfo := peer.AddrInfo{ID: boot.ID(), Addrs: boot.Addrs()}
+	mr1 := newTestMessengerWithOption(t, "h1", core.Option{BootstrapPeers: []peer.AddrInfo{bootInfo}})
+	mr2 := newTestMessenger(t, "h2")
+	events, cancel, err := mr1.SubscribeInfraPeers()
+	require.NoError(t, err)
+	defer cancel()
+	next := func() interface{} {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no infrastructure event")
+			return nil
+		}
+	}
+
+	// other peers are left out
+	connect(t, mr1, mr2)
+	require.NoError(t, mr1.Host.Connect(context.Background(), bootInfo))
+	on, ok := next().(event.EvtInfraPeerConnected)
+	require.True(t, ok)
+	require.Equal(t, boot.ID(), on.ID)
+	require.True(t, on.Bootstrap)
+	require.False(t, on.Relay)
+
+	require.NoError(t, mr1.Host.Network().ClosePeer(mr2.Host.ID()))
+	require.NoError(t, mr1.Host.Network().ClosePeer(boot.ID()))
+	off, ok := next().(event.EvtInfraPeerDisconnected)
+	require.True(t, ok)
+	require.Equal(t, boot.ID(), off.ID)
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %v", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
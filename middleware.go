@@ -0,0 +1,50 @@
+package core
+
+import (
+	"sync"
+
+	"github.com/hood-chat/core/entity"
+)
+
+// Middleware inspects or transforms a message, returning an error drops it.
+type Middleware func(*entity.Message) error
+
+type middlewares struct {
+	mux  sync.RWMutex
+	send []Middleware
+	recv []Middleware
+}
+
+func (mw *middlewares) addSend(fn Middleware) {
+	mw.mux.Lock()
+	defer mw.mux.Unlock()
+	mw.send = append(mw.send, fn)
+}
+
+func (mw *middlewares) addReceive(fn Middleware) {
+	mw.mux.Lock()
+	defer mw.mux.Unlock()
+	mw.recv = append(mw.recv, fn)
+}
+
+func (mw *middlewares) applySend(msg *entity.Message) error {
+	mw.mux.RLock()
+	defer mw.mux.RUnlock()
+	return apply(mw.send, msg)
+}
+
+func (mw *middlewares) applyReceive(msg *entity.Message) error {
+	mw.mux.RLock()
+	defer mw.mux.RUnlock()
+	return apply(mw.recv, msg)
+}
+
+// apply runs chain in order, stopping at the first error.
+func apply(chain []Middleware, msg *entity.Message) error {
+	for _, fn := range chain {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"context"
+	"sync"
+
+	lpevt "github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// NATType classifies the NAT the node sits behind.
+type NATType int
+
+const (
+	// NATUnknown is reported until AutoNAT and the observed addresses
+	// settle.
+	NATUnknown NATType = iota
+	// NATPublic nodes are reachable directly, no NAT in the way.
+	NATPublic
+	// NATCone nodes can be hole punched by peers also behind a cone NAT.
+	NATCone
+	// NATSymmetric nodes can't be hole punched, peers reach them only
+	// through a relay.
+	NATSymmetric
+)
+
+func (t NATType) String() string {
+	switch t {
+	case NATPublic:
+		return "public"
+	case NATCone:
+		return "cone"
+	case NATSymmetric:
+		return "symmetric"
+	default:
+		return "unknown"
+	}
+}
+
+// natWatcher follows the reachability found by AutoNAT and the NAT device
+// types the host infers from its observed addresses.
+type natWatcher struct {
+	mux     sync.Mutex
+	reach   network.Reachability
+	devices map[network.NATTransportProtocol]network.NATDeviceType
+	// changed is closed and replaced on every update
+	changed chan struct{}
+	sub     lpevt.Subscription
+	done    chan struct{}
+}
+
+func newNATWatcher(bus lpevt.Bus) (*natWatcher, error) {
+	sub, err := bus.Subscribe([]interface{}{new(lpevt.EvtLocalReachabilityChanged), new(lpevt.EvtNATDeviceTypeChanged)})
+	if err != nil {
+		return nil, err
+	}
+	w := &natWatcher{
+		devices: make(map[network.NATTransportProtocol]network.NATDeviceType),
+		changed: make(chan struct{}),
+		sub:     sub,
+		done:    make(chan struct{}),
+	}
+	go w.background()
+	return w, nil
+}
+
+func (w *natWatcher) background() {
+	defer close(w.done)
+	for e := range w.sub.Out() {
+		w.mux.Lock()
+		switch evt := e.(type) {
+		case lpevt.EvtLocalReachabilityChanged:
+			w.reach = evt.Reachability
+		case lpevt.EvtNATDeviceTypeChanged:
+			w.devices[evt.TransportProtocol] = evt.NatDeviceType
+		}
+		close(w.changed)
+		w.changed = make(chan struct{})
+		w.mux.Unlock()
+	}
+}
+
+// classify tells the NAT type, false while it is not known yet. Device
+// types only mean something once AutoNAT found the node private. A cone
+// on any transport leaves hole punching possible over it.
+func (w *natWatcher) classify() (NATType, bool) {
+	switch w.reach {
+	case network.ReachabilityPublic:
+		return NATPublic, true
+	case network.ReachabilityPrivate:
+		t := NATUnknown
+		for _, d := range w.devices {
+			switch d {
+			case network.NATDeviceTypeCone:
+				return NATCone, true
+			case network.NATDeviceTypeSymmetric:
+				t = NATSymmetric
+			}
+		}
+		return t, t != NATUnknown
+	}
+	return NATUnknown, false
+}
+
+// wait returns the NAT type once known, or what is known when ctx ends
+// along with its error.
+func (w *natWatcher) wait(ctx context.Context) (NATType, error) {
+	for {
+		w.mux.Lock()
+		t, ok := w.classify()
+		changed := w.changed
+		w.mux.Unlock()
+		if ok {
+			return t, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return t, ctx.Err()
+		}
+	}
+}
+
+func (w *natWatcher) stop() {
+	w.sub.Close()
+	<-w.done
+}
+
+// NATType classifies the NAT in front of the node from AutoNAT probes and
+// the addresses peers observe, so the UI can warn that a symmetric NAT
+// forces relayed connections. It waits until the type is known or ctx
+// ends, then returns NATUnknown with the context error.
+func (m *Messenger) NATType(ctx context.Context) (NATType, error) {
+	return m.nat.wait(ctx)
+}
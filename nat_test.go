@@ -0,0 +1,64 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	lpevt "github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNATType(t *testing.T) {
+	type device struct {
+		proto network.NATTransportProtocol
+		typ   network.NATDeviceType
+	}
+	cases := []struct {
+		name    string
+		reach   network.Reachability
+		devices []device
+		want    NATType
+	}{
+		{"public", network.ReachabilityPublic, nil, NATPublic},
+		{"cone", network.ReachabilityPrivate, []device{{network.NATTransportUDP, network.NATDeviceTypeCone}}, NATCone},
+		{"symmetric", network.ReachabilityPrivate, []device{{network.NATTransportTCP, network.NATDeviceTypeSymmetric}}, NATSymmetric},
+		{"cone over udp", network.ReachabilityPrivate, []device{
+			{network.NATTransportTCP, network.NATDeviceTypeSymmetric},
+			{network.NATTransportUDP, network.NATDeviceTypeCone},
+		}, NATCone},
+		// device types are ignored until AutoNAT finds the node private
+		{"unknown", network.ReachabilityUnknown, []device{{network.NATTransportUDP, network.NATDeviceTypeSymmetric}}, NATUnknown},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			bus := eventbus.NewBus()
+			w, err := newNATWatcher(bus)
+			require.NoError(t, err)
+			defer w.stop()
+			reach, err := bus.Emitter(new(lpevt.EvtLocalReachabilityChanged))
+			require.NoError(t, err)
+			defer reach.Close()
+			devices, err := bus.Emitter(new(lpevt.EvtNATDeviceTypeChanged))
+			require.NoError(t, err)
+			defer devices.Close()
+
+			for _, d := range c.devices {
+				require.NoError(t, devices.Emit(lpevt.EvtNATDeviceTypeChanged{TransportProtocol: d.proto, NatDeviceType: d.typ}))
+			}
+			require.NoError(t, reach.Emit(lpevt.EvtLocalReachabilityChanged{Reachability: c.reach}))
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			got, err := w.wait(ctx)
+			if c.want == NATUnknown {
+				require.ErrorIs(t, err, context.DeadlineExceeded)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, c.want, got)
+		})
+	}
+}
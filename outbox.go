@@ -2,54 +2,246 @@ package core
 
 import (
 	"context"
+	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/hood-chat/core/entity"
+	"github.com/hood-chat/core/repo"
 	"github.com/libp2p/go-libp2p/core/peer"
+	bf "github.com/libp2p/go-libp2p/p2p/discovery/backoff"
+	"google.golang.org/protobuf/proto"
 )
 
 const Timeout = 60 * 5
 
+// OutboxRetryInterval is how often recipients due for redelivery are
+// checked.
+const OutboxRetryInterval = time.Second
+
+// OutboxPolicy bounds how undelivered messages are retried.
+type OutboxPolicy struct {
+	// Deadline is how long a message may wait for delivery before it
+	// fails, Timeout seconds when zero.
+	Deadline time.Duration
+	// Backoff paces redelivery to a recipient after a failed send, nil
+	// uses an exponential backoff.
+	Backoff bf.BackoffFactory
+	// PurgeFailed deletes messages that failed from the history once they
+	// are older than it, their failure was announced long before, and
+	// emits EvtMessagesPurged. Zero keeps them.
+	PurgeFailed time.Duration
+	// KeepFailed exempts the message id from PurgeFailed, e.g. when the
+	// user starred it. Nil exempts none.
+	KeepFailed func(id entity.ID) bool
+	// SendQueue bounds the messages waiting for the sender, the ones past
+	// it wait in the outbox. SendQueueSize when zero.
+	SendQueue int
+	// MaxPending bounds the messages waiting for delivery, the ones sent
+	// past it are dropped with EvtMessageDropped. Zero never drops.
+	MaxPending int
+}
+
 type Data map[peer.ID][]*entity.Envelop
 
 type outbox struct {
-	mux     sync.Mutex
-	data    Data
-	failed  chan *entity.Envelop
-	bctx    context.Context
-	bcancel context.CancelFunc
+	mux      sync.Mutex
+	data     Data
+	failed   chan *entity.Envelop
+	bctx     context.Context
+	bcancel  context.CancelFunc
+	done     chan struct{}
+	stopOnce sync.Once
+	// persist keeps queued envelopes across restarts, nil keeps them in
+	// memory only.
+	persist  repo.IRepo[entity.Envelop]
+	deadline time.Duration
+	bfk      bf.BackoffFactory
+	retries  map[peer.ID]*connCacheData
 }
 
-func newOutBox() *outbox {
-	return &outbox{
-		mux:     sync.Mutex{},
-		data:    make(Data),
-		failed:  make(chan *entity.Envelop),
-		bctx:    nil,
-		bcancel: nil,
+func newOutBox(persist repo.IRepo[entity.Envelop], policy OutboxPolicy) *outbox {
+	o := &outbox{
+		mux:      sync.Mutex{},
+		data:     make(Data),
+		failed:   make(chan *entity.Envelop),
+		bctx:     nil,
+		bcancel:  nil,
+		done:     make(chan struct{}),
+		persist:  persist,
+		deadline: policy.Deadline,
+		bfk:      policy.Backoff,
+		retries:  make(map[peer.ID]*connCacheData),
+	}
+	if o.deadline == 0 {
+		o.deadline = Timeout * time.Second
+	}
+	if o.bfk == nil {
+		o.bfk = bf.NewExponentialBackoff(time.Second, 5*time.Minute, bf.NoJitter, time.Second, 2, 0, rand.NewSource(0))
+	}
+	return o
+}
+
+// load queues the envelopes kept by an earlier run and returns how many.
+func (o *outbox) load() int {
+	if o.persist == nil {
+		return 0
+	}
+	// entries kept by an older release are upgraded before being read
+	if u, ok := o.persist.(repo.Upgrader); ok {
+		n, err := u.Upgrade()
+		if err != nil {
+			log.Errorf("can not upgrade outbox %s", err.Error())
+			return 0
+		}
+		if n > 0 {
+			log.Infof("upgraded %d outbox entries", n)
+		}
+	}
+	nvlops, err := o.persist.GetAll(repo.NewOption(0, 0))
+	if err != nil {
+		log.Errorf("can not load outbox %s", err.Error())
+		return 0
+	}
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	for i := range nvlops {
+		pid, err := nvlops[i].To.PeerID()
+		if err != nil {
+			log.Errorf("drop outbox entry for invalid peer %s", err.Error())
+			o.forget(&nvlops[i])
+			continue
+		}
+		o.data[pid] = append(o.data[pid], &nvlops[i])
+		o.schedule(pid)
+	}
+	if len(o.data) > 0 {
+		o.mayStart()
 	}
+	return len(nvlops)
 }
 
+// put queues val for key, keeping it until it is delivered or expires.
 func (o *outbox) put(key peer.ID, val *entity.Envelop) {
 	o.mux.Lock()
 	defer o.mux.Unlock()
 	o.data[key] = append(o.data[key], val)
+	if o.persist != nil {
+		if err := o.persist.Set(*val); err != nil {
+			log.Errorf("can not persist outbox entry %s", err.Error())
+		}
+	}
+	o.schedule(key)
 	o.mayStart()
 }
 
+// requeue puts back envelopes popped for a send that failed and backs off
+// the recipient.
+func (o *outbox) requeue(key peer.ID, vals []*entity.Envelop) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.data[key] = append(o.data[key], vals...)
+	o.schedule(key)
+	r := o.retries[key]
+	r.nextTry = time.Now().Add(r.strat.Delay())
+	o.mayStart()
+}
+
+// schedule makes sure key has a retry state, due after the first delay.
+func (o *outbox) schedule(key peer.ID) {
+	if _, ok := o.retries[key]; ok {
+		return
+	}
+	strat := o.bfk()
+	o.retries[key] = &connCacheData{strat: strat, nextTry: time.Now().Add(strat.Delay())}
+}
+
+// delivered forgets val and resets the backoff of its recipient.
+func (o *outbox) delivered(key peer.ID, val *entity.Envelop) {
+	o.mux.Lock()
+	o.forget(val)
+	if len(o.data[key]) == 0 {
+		delete(o.retries, key)
+	} else if r, ok := o.retries[key]; ok {
+		r.strat.Reset()
+	}
+	o.mux.Unlock()
+	o.mayStop()
+}
+
+func (o *outbox) forget(val *entity.Envelop) {
+	if o.persist == nil {
+		return
+	}
+	if err := o.persist.Delete(val.Key()); err != nil {
+		log.Errorf("can not delete outbox entry %s", err.Error())
+	}
+}
+
+// due lists the recipients whose backoff has passed.
+func (o *outbox) due(t time.Time) []peer.ID {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	pids := make([]peer.ID, 0)
+	for pid, r := range o.retries {
+		if len(o.data[pid]) > 0 && !r.nextTry.After(t) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// pop takes the messages queued for key to send them. The expiry loop
+// keeps running until they are delivered.
 func (o *outbox) pop(key peer.ID) []*entity.Envelop {
 	o.mux.Lock()
+	defer o.mux.Unlock()
 	msgs, ok := o.data[key]
 	if ok {
 		delete(o.data, key)
 	}
-	o.mux.Unlock()
+	return msgs
+}
 
+// discard drops the messages queued for key, the persisted ones too, and
+// its retry state.
+func (o *outbox) discard(key peer.ID) []*entity.Envelop {
+	o.mux.Lock()
+	msgs := o.data[key]
+	delete(o.data, key)
+	delete(o.retries, key)
+	for _, val := range msgs {
+		o.forget(val)
+	}
+	o.mux.Unlock()
 	o.mayStop()
 	return msgs
 }
 
+// peers lists the peers that have queued messages.
+func (o *outbox) peers() []peer.ID {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	pids := make([]peer.ID, 0, len(o.data))
+	for pid := range o.data {
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+// size estimates the bytes held by queued messages.
+func (o *outbox) size() int64 {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	var size int64
+	for _, msgs := range o.data {
+		for _, m := range msgs {
+			size += int64(proto.Size(m.Proto()))
+		}
+	}
+	return size
+}
+
 func (o *outbox) mayStart() {
 	if o.bctx == nil {
 		o.bctx, o.bcancel = context.WithCancel(context.Background())
@@ -68,28 +260,52 @@ func (o *outbox) mayStop() {
 	}
 }
 
+// stop ends the expiry loop for good, queued messages stay.
+func (o *outbox) stop() {
+	o.stopOnce.Do(func() { close(o.done) })
+}
+
 func (o *outbox) background(ctx context.Context) {
-	ticker := time.NewTicker(1 * time.Minute)
+	interval := time.Minute
+	if o.deadline < interval {
+		interval = o.deadline
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
 		select {
 		case t := <-ticker.C:
 			o.mux.Lock()
+			var expired []*entity.Envelop
 			tmp := make(map[peer.ID][]*entity.Envelop)
 			for k, v := range o.data {
 				for _, m := range v {
-					if m.Message.CreatedAt+(Timeout) <= t.UTC().Unix() {
-						o.failed <- m
-					} else {
-						tmp[k] = append(tmp[k], m)
+					if !time.Unix(m.Message.CreatedAt, 0).Add(o.deadline).After(t) {
+						expired = append(expired, m)
+						continue
 					}
+					tmp[k] = append(tmp[k], m)
 				}
 			}
 			o.data = tmp
 			o.mux.Unlock()
+			// the reader of failed may be waiting on the lock
+			for _, m := range expired {
+				select {
+				case o.failed <- m:
+					o.forget(m)
+				case <-o.done:
+					// nobody reads failed once stopped, the entries
+					// stay persisted and expire on the next load
+					return
+				}
+			}
 			o.mayStop()
 		case <-ctx.Done():
 			log.Debug("context error broke sender")
 			return
+		case <-o.done:
+			return
 		}
 
 	}
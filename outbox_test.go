@@ -0,0 +1,182 @@
+package core
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hood-chat/core/entity"
+	"github.com/hood-chat/core/event"
+	"github.com/hood-chat/core/pb"
+	"github.com/hood-chat/core/utils"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	bf "github.com/libp2p/go-libp2p/p2p/discovery/backoff"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	o := newOutBox(nil, OutboxPolicy{})
+	defer o.stop()
+	h := newTestHost(t)
+	nvlp := testEnvelop(t, h, "backoff")
+	o.put(h.ID(), &nvlp)
+
+	var last time.Duration
+	for i := 0; i < 3; i++ {
+		msgs := o.pop(h.ID())
+		require.Len(t, msgs, 1)
+		o.requeue(h.ID(), msgs)
+		wait := time.Until(o.retries[h.ID()].nextTry)
+		require.Greater(t, wait, last)
+		last = wait
+	}
+	require.Empty(t, o.due(time.Now()))
+	require.Equal(t, []peer.ID{h.ID()}, o.due(time.Now().Add(last)))
+
+	o.pop(h.ID())
+	o.delivered(h.ID(), &nvlp)
+	require.Empty(t, o.retries)
+}
+
+func TestOutboxExpiryUnlocked(t *testing.T) {
+	o := newOutBox(nil, OutboxPolicy{Deadline: 100 * time.Millisecond})
+	defer o.stop()
+	h := newTestHost(t)
+	expired := testEnvelop(t, h, "expired")
+	expired.Message.CreatedAt = time.Now().Add(-time.Hour).Unix()
+	o.put(h.ID(), &expired)
+	// the expiry waits for failed to be read, as the sender may be busy
+	time.Sleep(300 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		nvlp := testEnvelop(t, h, "queued")
+		o.put(h.ID(), &nvlp)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("put blocked by the expiry")
+	}
+	require.Equal(t, expired.Message.ID, (<-o.failed).Message.ID)
+}
+
+func TestOutboxNeedsAck(t *testing.T) {
+	h1 := newTestHost(t)
+	h2 := newTestHost(t)
+	bus := eventbus.NewBus()
+	svc, err := newPMServiceWithOutbox(h1, bus, nil, nil, OutboxPolicy{
+		Deadline: 4 * time.Second,
+		Backoff:  bf.NewFixedBackoff(100 * time.Millisecond),
+	}, newInboundLimiter(InboundPolicy{}, nil), nil)
+	require.NoError(t, err)
+	pms := svc.(*pmService)
+	defer pms.Stop()
+	// h2 reads frames but never acknowledges them
+	var reads int32
+	h2.SetStreamHandler(ID, func(s network.Stream) {
+		var msg pb.Message
+		if readMagic(s, []byte(DefaultFrameMagic)) == nil && utils.NewDelimitedReader(s, MaxMsgSize).ReadMsg(&msg) == nil {
+			atomic.AddInt32(&reads, 1)
+		}
+		s.Close()
+	})
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	sub, err := bus.Subscribe(new(event.EvtObject))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	nvlp := testEnvelop(t, h2, "unacked")
+	pms.Send(nvlp)
+	// the message stays queued and is sent again
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&reads) >= 3 }, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, 1, pms.Pending())
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-sub.Out():
+			obj := e.(event.EvtObject)
+			evt, err := event.NewMessagingEventGroup().Parse(&obj)
+			require.NoError(t, err)
+			if *evt.Action() != entity.Failed {
+				continue
+			}
+			require.Equal(t, nvlp.Message.ID, *evt.Payload())
+			require.Zero(t, pms.Pending())
+			return
+		case <-timeout:
+			t.Fatal("unacknowledged message did not fail after the deadline")
+		}
+	}
+}
+
+func TestOversizedAck(t *testing.T) {
+	for _, codec := range []utils.Codec{utils.ProtoCodec{}, utils.JSONCodec{}} {
+		data, err := codec.Marshal(&pb.Message{Id: uuid.New().String(), Type: entity.AckType})
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(data), maxAckSize)
+	}
+
+	h1 := newTestHost(t)
+	h2 := newTestHost(t)
+	bus := eventbus.NewBus()
+	svc, err := newPMServiceWithOutbox(h1, bus, nil, nil, OutboxPolicy{
+		Backoff: bf.NewFixedBackoff(100 * time.Millisecond),
+	}, newInboundLimiter(InboundPolicy{}, nil), nil)
+	require.NoError(t, err)
+	pms := svc.(*pmService)
+	defer pms.Stop()
+	// h2 acknowledges frames with acks padded far past their size
+	var reads int32
+	h2.SetStreamHandler(ID, func(s network.Stream) {
+		defer s.Close()
+		var msg pb.Message
+		if readMagic(s, []byte(DefaultFrameMagic)) != nil || utils.NewDelimitedReader(s, MaxMsgSize).ReadMsg(&msg) != nil {
+			return
+		}
+		atomic.AddInt32(&reads, 1)
+		ack := &pb.Message{Id: msg.GetId(), Type: entity.AckType, Text: strings.Repeat("x", MaxMsgSize/2)}
+		utils.NewCodecWriter(s, utils.ProtoCodec{}).WriteMsg(ack)
+	})
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	pms.Send(testEnvelop(t, h2, "padded"))
+	// the ack is refused and the message sent again
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&reads) >= 3 }, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, 1, pms.Pending())
+}
+
+func TestLegacyNoAck(t *testing.T) {
+	h1 := newTestHost(t)
+	h2 := newTestHost(t)
+	bus := eventbus.NewBus()
+	svc, err := newPMServiceWithOutbox(h1, bus, nil, nil, OutboxPolicy{
+		Backoff: bf.NewFixedBackoff(100 * time.Millisecond),
+	}, newInboundLimiter(InboundPolicy{}, nil), nil)
+	require.NoError(t, err)
+	pms := svc.(*pmService)
+	defer pms.Stop()
+	// h2 is an older client, it never acknowledges
+	var reads int32
+	h2.SetStreamHandler(LegacyID, func(s network.Stream) {
+		var msg pb.Message
+		if utils.NewDelimitedReader(s, MaxMsgSize).ReadMsg(&msg) == nil {
+			atomic.AddInt32(&reads, 1)
+		}
+		s.Close()
+	})
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	pms.Send(testEnvelop(t, h2, "legacy"))
+	// delivered once, without waiting for an ack that never comes
+	require.Eventually(t, func() bool { return pms.Pending() == 0 }, time.Second, 20*time.Millisecond)
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&reads))
+}
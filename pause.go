@@ -0,0 +1,89 @@
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// pauseGater refuses every connection while paused, which silences dials
+// made by the DHT, relays and our own services alike. It also refuses the
+// connections of blocked peers until their block ends.
+type pauseGater struct {
+	paused int32
+
+	mux sync.Mutex
+	// blocked holds when the block of each peer ends, zero for never
+	blocked map[peer.ID]time.Time
+}
+
+var _ connmgr.ConnectionGater = (*pauseGater)(nil)
+
+func (g *pauseGater) pause() {
+	atomic.StoreInt32(&g.paused, 1)
+}
+
+func (g *pauseGater) resume() {
+	atomic.StoreInt32(&g.paused, 0)
+}
+
+func (g *pauseGater) Paused() bool {
+	return atomic.LoadInt32(&g.paused) == 1
+}
+
+// block refuses the connections of p until the given time, or until
+// unblocked when it is zero.
+func (g *pauseGater) block(p peer.ID, until time.Time) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if g.blocked == nil {
+		g.blocked = make(map[peer.ID]time.Time)
+	}
+	if old, ok := g.blocked[p]; ok && old.IsZero() {
+		return
+	}
+	g.blocked[p] = until
+}
+
+func (g *pauseGater) unblock(p peer.ID) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	delete(g.blocked, p)
+}
+
+func (g *pauseGater) isBlocked(p peer.ID) bool {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	until, ok := g.blocked[p]
+	if ok && !until.IsZero() && time.Now().After(until) {
+		delete(g.blocked, p)
+		return false
+	}
+	return ok
+}
+
+func (g *pauseGater) InterceptPeerDial(p peer.ID) bool {
+	return !g.Paused() && !g.isBlocked(p)
+}
+
+func (g *pauseGater) InterceptAddrDial(p peer.ID, _ ma.Multiaddr) bool {
+	return !g.Paused() && !g.isBlocked(p)
+}
+
+func (g *pauseGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return !g.Paused()
+}
+
+func (g *pauseGater) InterceptSecured(_ network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	return !g.Paused() && !g.isBlocked(p)
+}
+
+func (g *pauseGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return !g.Paused(), 0
+}
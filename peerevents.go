@@ -0,0 +1,154 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hood-chat/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// PeerEventsBuffer is the channel capacity of SubscribePeers. Events that
+// don't fit are dropped rather than holding up the network.
+const PeerEventsBuffer = 64
+
+// peerNotifiee forwards connection changes to one subscriber.
+type peerNotifiee struct {
+	mux    sync.Mutex
+	out    chan interface{}
+	closed bool
+}
+
+func newPeerNotifiee() *peerNotifiee {
+	return &peerNotifiee{out: make(chan interface{}, PeerEventsBuffer)}
+}
+
+func (pn *peerNotifiee) send(evt interface{}) {
+	pn.mux.Lock()
+	defer pn.mux.Unlock()
+	if pn.closed {
+		return
+	}
+	select {
+	case pn.out <- evt:
+	default:
+		log.Warnf("peer event dropped, subscriber is too slow")
+	}
+}
+
+func (pn *peerNotifiee) close() {
+	pn.mux.Lock()
+	defer pn.mux.Unlock()
+	if !pn.closed {
+		pn.closed = true
+		close(pn.out)
+	}
+}
+
+func (pn *peerNotifiee) Listen(network.Network, ma.Multiaddr)      {}
+func (pn *peerNotifiee) ListenClose(network.Network, ma.Multiaddr) {}
+func (pn *peerNotifiee) Connected(n network.Network, c network.Conn) {
+	pid := c.RemotePeer()
+	if len(n.ConnsToPeer(pid)) > 1 {
+		return
+	}
+	pn.send(event.EvtPeerConnected{ID: pid, At: time.Now()})
+}
+func (pn *peerNotifiee) Disconnected(n network.Network, c network.Conn) {
+	pid := c.RemotePeer()
+	if n.Connectedness(pid) == network.Connected {
+		return
+	}
+	pn.send(event.EvtPeerDisconnected{ID: pid, At: time.Now()})
+}
+
+// SubscribePeers sends an event.EvtPeerConnected when a peer comes online
+// and an event.EvtPeerDisconnected when it drops. The returned function
+// unsubscribes and closes the channel.
+func (m *Messenger) SubscribePeers() (<-chan interface{}, func()) {
+	pn := newPeerNotifiee()
+	m.Host.Network().Notify(pn)
+	var once sync.Once
+	return pn.out, func() {
+		once.Do(func() {
+			m.Host.Network().StopNotify(pn)
+			pn.close()
+		})
+	}
+}
+
+// infraRole tells what an infrastructure peer is used for.
+type infraRole struct {
+	bootstrap bool
+	relay     bool
+}
+
+// infraNotifiee forwards connection changes of bootstrap and relay peers
+// to one subscriber.
+type infraNotifiee struct {
+	*peerNotifiee
+	roles map[peer.ID]infraRole
+}
+
+func (in *infraNotifiee) Connected(n network.Network, c network.Conn) {
+	pid := c.RemotePeer()
+	role, ok := in.roles[pid]
+	if !ok || len(n.ConnsToPeer(pid)) > 1 {
+		return
+	}
+	in.send(event.EvtInfraPeerConnected{ID: pid, Bootstrap: role.bootstrap, Relay: role.relay, At: time.Now()})
+}
+func (in *infraNotifiee) Disconnected(n network.Network, c network.Conn) {
+	pid := c.RemotePeer()
+	role, ok := in.roles[pid]
+	if !ok || n.Connectedness(pid) == network.Connected {
+		return
+	}
+	in.send(event.EvtInfraPeerDisconnected{ID: pid, Bootstrap: role.bootstrap, Relay: role.relay, At: time.Now()})
+}
+
+// infraRoles maps the bootstrap and relay peers the node uses.
+func (opt *Option) infraRoles() (map[peer.ID]infraRole, error) {
+	roles := make(map[peer.ID]infraRole)
+	var bts []peer.AddrInfo
+	if !opt.DisableDHT {
+		var err error
+		bts, err = opt.bootstrapPeers()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, pi := range bts {
+		role := roles[pi.ID]
+		role.bootstrap = true
+		roles[pi.ID] = role
+	}
+	for _, pi := range opt.trustedOnly(opt.Relays) {
+		role := roles[pi.ID]
+		role.relay = true
+		roles[pi.ID] = role
+	}
+	return roles, nil
+}
+
+// SubscribeInfraPeers sends an event.EvtInfraPeerConnected when a bootstrap
+// or relay peer connects and an event.EvtInfraPeerDisconnected when it
+// drops, leaving out every other peer. The returned function unsubscribes
+// and closes the channel.
+func (m *Messenger) SubscribeInfraPeers() (<-chan interface{}, func(), error) {
+	roles, err := m.opt.infraRoles()
+	if err != nil {
+		return nil, nil, err
+	}
+	in := &infraNotifiee{peerNotifiee: newPeerNotifiee(), roles: roles}
+	m.Host.Network().Notify(in)
+	var once sync.Once
+	return in.out, func() {
+		once.Do(func() {
+			m.Host.Network().StopNotify(in)
+			in.close()
+		})
+	}, nil
+}
@@ -18,19 +18,33 @@ type Info struct {
 	process  map[string]int
 	done     bool
 	working  bool
+	gaveUp   bool
+	attempts int
 	cache    connCacheData
 	peerInfo peer.AddrInfo
 }
 
 type PeerSet struct {
-	set map[peer.ID]*Info
-	mux sync.Mutex
-	bfk bf.BackoffFactory
+	set         map[peer.ID]*Info
+	mux         sync.Mutex
+	bfk         bf.BackoffFactory
+	maxAttempts int
 }
 
 func NewPeerSet() *PeerSet {
+	return NewPeerSetWithPolicy(nil, 0)
+}
+
+// NewPeerSetWithPolicy creates a set retrying peers with the backoff made
+// by bfk, giving up on a peer after maxAttempts failed attempts in a row.
+// A nil bfk uses the default backoff and zero attempts retries forever.
+func NewPeerSetWithPolicy(bfk bf.BackoffFactory, maxAttempts int) *PeerSet {
 	ps := &PeerSet{}
-	ps.bfk = bf.NewPolynomialBackoff(time.Second, time.Minute*2, bf.NoJitter, time.Second, []float64{0.5, 2, 2.5}, rand.NewSource(0))
+	ps.bfk = bfk
+	if ps.bfk == nil {
+		ps.bfk = bf.NewPolynomialBackoff(time.Second, time.Minute*2, bf.NoJitter, time.Second, []float64{0.5, 2, 2.5}, rand.NewSource(0))
+	}
+	ps.maxAttempts = maxAttempts
 	ps.set = make(map[peer.ID]*Info)
 	ps.mux = sync.Mutex{}
 	return ps
@@ -91,7 +105,7 @@ func (p *PeerSet) Turn(t time.Time) []peer.AddrInfo {
 	defer p.mux.Unlock()
 	res := make([]peer.AddrInfo, 0)
 	for key, val := range p.set {
-		if val.cache.nextTry.Before(t) && !val.done && !val.working {
+		if val.cache.nextTry.Before(t) && !val.done && !val.working && !val.gaveUp {
 			res = append(res, val.peerInfo)
 			val.working = true
 			p.set[key] = val
@@ -107,11 +121,34 @@ func (p *PeerSet) Done(id peer.ID) {
 	if ok {
 		info.done = true
 		info.working = false
+		info.gaveUp = false
+		info.attempts = 0
 		info.cache.strat.Reset()
 	}
 }
 
-func (p *PeerSet) Failed(id peer.ID) {
+// Failed records a failed connection attempt and reports whether it was
+// the last one allowed, after which the peer is no longer retried.
+func (p *PeerSet) Failed(id peer.ID) bool {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	info, ok := p.set[id]
+	if ok {
+		info.done = false
+		info.working = false
+		info.attempts++
+		info.cache.nextTry = time.Now().Add(info.cache.strat.Delay())
+		if p.maxAttempts > 0 && info.attempts >= p.maxAttempts && !info.gaveUp {
+			info.gaveUp = true
+			return true
+		}
+	}
+	return false
+}
+
+// Lost schedules a retry for a peer that disconnected, it does not count
+// as a failed attempt.
+func (p *PeerSet) Lost(id peer.ID) {
 	p.mux.Lock()
 	defer p.mux.Unlock()
 	info, ok := p.set[id]
@@ -129,6 +166,8 @@ func (p *PeerSet) Force(id peer.ID) {
 	if ok {
 		info.done = false
 		info.working = true
+		info.gaveUp = false
+		info.attempts = 0
 	}
 }
 
@@ -0,0 +1,237 @@
+package core
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hood-chat/core/entity"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-msgio"
+)
+
+const (
+	PresenceID = "/chat/presence/1.0.0"
+
+	PresenceServiceName = "chat.presence"
+
+	DefaultPresenceInterval = 30 * time.Second
+
+	// presenceSize bounds a presence frame, the longest name fits.
+	presenceSize = 16
+)
+
+// PresencePolicy paces the presence heartbeats.
+type PresencePolicy struct {
+	// Interval between announcements to connected contacts,
+	// DefaultPresenceInterval when zero.
+	Interval time.Duration
+	// Timeout marks a contact offline when nothing was heard from it for
+	// that long, three intervals when zero.
+	Timeout time.Duration
+}
+
+// heard is the last presence a peer announced.
+type heard struct {
+	presence entity.Presence
+	at       time.Time
+}
+
+// presenceService announces the local presence to contacts on a heartbeat
+// and tracks theirs.
+type presenceService struct {
+	host     host.Host
+	interval time.Duration
+	timeout  time.Duration
+	// targets lists the peers to announce to
+	targets func() []peer.ID
+	// accept filters the peers whose announcements are tracked
+	accept   func(peer.ID) bool
+	onChange func(peer.ID, entity.Presence)
+
+	mux   sync.Mutex
+	self  entity.Presence
+	peers map[peer.ID]heard
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newPresenceService(h host.Host, policy PresencePolicy, targets func() []peer.ID, accept func(peer.ID) bool, onChange func(peer.ID, entity.Presence)) *presenceService {
+	if policy.Interval == 0 {
+		policy.Interval = DefaultPresenceInterval
+	}
+	if policy.Timeout == 0 {
+		policy.Timeout = 3 * policy.Interval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ps := &presenceService{
+		host:     h,
+		interval: policy.Interval,
+		timeout:  policy.Timeout,
+		targets:  targets,
+		accept:   accept,
+		onChange: onChange,
+		self:     entity.Online,
+		peers:    make(map[peer.ID]heard),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	h.SetStreamHandler(PresenceID, ps.Handler)
+	go ps.background(ctx)
+	log.Debug("service presence created")
+	return ps
+}
+
+func (c *presenceService) background(ctx context.Context) {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case t := <-ticker.C:
+			c.announceAll(ctx, c.current())
+			c.expire(t)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *presenceService) current() entity.Presence {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.self
+}
+
+// set changes the local presence and tells the contacts right away.
+func (c *presenceService) set(p entity.Presence) {
+	c.mux.Lock()
+	c.self = p
+	c.mux.Unlock()
+	c.announceAll(context.Background(), p)
+}
+
+// get is the presence last heard from pid, offline when none.
+func (c *presenceService) get(pid peer.ID) entity.Presence {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.peers[pid].presence
+}
+
+// announceTo sends the local presence to pid, e.g. when it connects.
+func (c *presenceService) announceTo(pid peer.ID) {
+	ctx, cancel := context.WithTimeout(context.Background(), StreamTimeout)
+	defer cancel()
+	if err := c.announce(ctx, pid, c.current()); err != nil {
+		log.Debugf("can not announce presence to %s: %s", pid, err)
+	}
+}
+
+func (c *presenceService) announceAll(ctx context.Context, p entity.Presence) {
+	ctx, cancel := context.WithTimeout(ctx, StreamTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, pid := range c.targets() {
+		wg.Add(1)
+		go func(pid peer.ID) {
+			defer wg.Done()
+			if err := c.announce(ctx, pid, p); err != nil {
+				log.Debugf("can not announce presence to %s: %s", pid, err)
+			}
+		}(pid)
+	}
+	wg.Wait()
+}
+
+func (c *presenceService) announce(ctx context.Context, pid peer.ID, p entity.Presence) error {
+	s, err := c.host.NewStream(ctx, pid, PresenceID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(StreamTimeout))
+	if err := msgio.NewVarintWriter(s).WriteMsg([]byte(p.String())); err != nil {
+		s.Reset()
+		return err
+	}
+	// wait for the peer to hang up, the goodbye must land before our
+	// connections close
+	s.CloseWrite()
+	_, err = s.Read(make([]byte, 1))
+	if err != io.EOF {
+		s.Reset()
+		return err
+	}
+	return nil
+}
+
+func (c *presenceService) Handler(str network.Stream) {
+	if err := str.Scope().SetService(PresenceServiceName); err != nil {
+		log.Debugf("error attaching stream to presence service: %s", err)
+		str.Reset()
+		return
+	}
+	defer str.Close()
+	str.SetDeadline(time.Now().Add(StreamTimeout))
+
+	pid := str.Conn().RemotePeer()
+	if !c.accept(pid) {
+		log.Debugf("presence ignored from unknown peer %s", pid)
+		return
+	}
+	msg, err := msgio.NewVarintReaderSize(str, presenceSize).ReadMsg()
+	if err != nil {
+		log.Debugf("error reading presence: %s", err)
+		str.Reset()
+		return
+	}
+	p, ok := entity.ParsePresence(string(msg))
+	if !ok {
+		log.Debugf("unknown presence %q from %s", msg, pid)
+		return
+	}
+	c.update(pid, p, time.Now())
+}
+
+func (c *presenceService) update(pid peer.ID, p entity.Presence, at time.Time) {
+	c.mux.Lock()
+	old := c.peers[pid].presence
+	if p == entity.Offline {
+		delete(c.peers, pid)
+	} else {
+		c.peers[pid] = heard{presence: p, at: at}
+	}
+	c.mux.Unlock()
+	if old != p {
+		c.onChange(pid, p)
+	}
+}
+
+// expire marks offline the peers silent for longer than the timeout.
+func (c *presenceService) expire(now time.Time) {
+	c.mux.Lock()
+	var gone []peer.ID
+	for pid, h := range c.peers {
+		if now.Sub(h.at) > c.timeout {
+			gone = append(gone, pid)
+			delete(c.peers, pid)
+		}
+	}
+	c.mux.Unlock()
+	for _, pid := range gone {
+		c.onChange(pid, entity.Offline)
+	}
+}
+
+// Stop tells the contacts the node goes offline, within ctx, so they don't
+// wait for the timeout.
+func (c *presenceService) Stop(ctx context.Context) {
+	c.cancel()
+	<-c.done
+	c.host.RemoveStreamHandler(PresenceID)
+	c.announceAll(ctx, entity.Offline)
+}
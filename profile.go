@@ -0,0 +1,140 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/hood-chat/core/entity"
+	"github.com/hood-chat/core/pb"
+	"github.com/hood-chat/core/utils"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-msgio/protoio"
+)
+
+const (
+	ProfileID = "/chat/profile/1.0.0"
+
+	// ProfilePushID carries profiles sent unasked when they change. Only
+	// peers accepting pushes speak it.
+	ProfilePushID = "/chat/profile/push/1.0.0"
+
+	ProfileServiceName = "chat.profile"
+)
+
+var ErrProfileMismatch = errors.New("profile does not belong to the peer")
+
+type ProfileService interface {
+	Fetch(ctx context.Context, p peer.ID) (entity.Contact, error)
+	// Push sends the local profile to p unasked.
+	Push(ctx context.Context, p peer.ID) error
+	// OnPush accepts profiles pushed by peers, handing them to fn.
+	OnPush(fn func(entity.Contact))
+	Handler(str network.Stream)
+	Stop()
+}
+
+// NewProfileService creates a service answering profile requests with me().
+func NewProfileService(h host.Host, me func() entity.Contact) ProfileService {
+	return newProfileService(h, me)
+}
+
+type profileService struct {
+	host host.Host
+	me   func() entity.Contact
+}
+
+func newProfileService(h host.Host, me func() entity.Contact) *profileService {
+	ps := &profileService{host: h, me: me}
+	h.SetStreamHandler(ProfileID, ps.Handler)
+	log.Debug("service profile created")
+	return ps
+}
+
+func (c *profileService) Fetch(ctx context.Context, p peer.ID) (entity.Contact, error) {
+	s, err := c.host.NewStream(ctx, p, ProfileID)
+	if err != nil {
+		return entity.Contact{}, err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(StreamTimeout))
+
+	rd := utils.NewDelimitedReader(s, MaxMsgSize)
+	var pbc pb.Contact
+	if err := rd.ReadMsg(&pbc); err != nil {
+		s.Reset()
+		return entity.Contact{}, err
+	}
+	if pbc.GetId() != p.String() {
+		return entity.Contact{}, ErrProfileMismatch
+	}
+	return entity.Contact{ID: entity.ID(pbc.GetId()), Name: pbc.GetName()}, nil
+}
+
+func (c *profileService) Push(ctx context.Context, p peer.ID) error {
+	s, err := c.host.NewStream(ctx, p, ProfilePushID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(StreamTimeout))
+
+	me := c.me()
+	wr := protoio.NewDelimitedWriter(s)
+	if err := wr.WriteMsg(&pb.Contact{Id: me.ID.String(), Name: me.Name}); err != nil {
+		s.Reset()
+		return err
+	}
+	return nil
+}
+
+func (c *profileService) OnPush(fn func(entity.Contact)) {
+	c.host.SetStreamHandler(ProfilePushID, func(str network.Stream) {
+		if err := str.Scope().SetService(ProfileServiceName); err != nil {
+			log.Debugf("error attaching stream to profile service: %s", err)
+			str.Reset()
+			return
+		}
+		defer str.Close()
+		str.SetDeadline(time.Now().Add(StreamTimeout))
+
+		rd := utils.NewDelimitedReader(str, MaxMsgSize)
+		var pbc pb.Contact
+		if err := rd.ReadMsg(&pbc); err != nil {
+			log.Debugf("error reading pushed profile: %s", err)
+			str.Reset()
+			return
+		}
+		// a peer may only push its own profile
+		if pbc.GetId() != str.Conn().RemotePeer().String() {
+			log.Debugf("pushed profile rejected: %s", ErrProfileMismatch)
+			return
+		}
+		fn(entity.Contact{ID: entity.ID(pbc.GetId()), Name: pbc.GetName()})
+	})
+}
+
+func (c *profileService) Handler(str network.Stream) {
+	if err := str.Scope().SetService(ProfileServiceName); err != nil {
+		log.Debugf("error attaching stream to profile service: %s", err)
+		str.Reset()
+		return
+	}
+	defer str.Close()
+	str.SetDeadline(time.Now().Add(StreamTimeout))
+
+	me := c.me()
+	wr := protoio.NewDelimitedWriter(str)
+	err := wr.WriteMsg(&pb.Contact{Id: me.ID.String(), Name: me.Name})
+	if err != nil {
+		log.Errorf("error writing profile: %s", err)
+		str.Reset()
+	}
+}
+
+func (c *profileService) Stop() {
+	c.host.RemoveStreamHandler(ProfileID)
+	c.host.RemoveStreamHandler(ProfilePushID)
+}
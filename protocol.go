@@ -1,13 +1,19 @@
 package core
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hood-chat/core/entity"
 	"github.com/hood-chat/core/event"
 	"github.com/hood-chat/core/pb"
+	"github.com/hood-chat/core/repo"
 	"github.com/hood-chat/core/utils"
 	lpevent "github.com/libp2p/go-libp2p/core/event"
 	"github.com/libp2p/go-libp2p/core/host"
@@ -15,16 +21,24 @@ import (
 	// "github.com/libp2p/go-libp2p/p2p/discovery/backoff"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	bf "github.com/libp2p/go-libp2p/p2p/discovery/backoff"
 	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
-	"github.com/libp2p/go-msgio/protoio"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
 const (
 	MessageTimeout = time.Second * 60
 
-	ID = "/chat/pm/1.0.0"
+	ID = "/chat/pm/1.1.0"
+
+	JSONID = "/chat/pm/json/1.1.0"
+
+	// LegacyID and LegacyJSONID are spoken by older clients, their streams
+	// don't open with the frame magic and their frames are not acknowledged.
+	LegacyID = "/chat/pm/1.0.0"
+
+	LegacyJSONID = "/chat/pm/json/1.0.0"
 
 	ServiceName = "chat.pm"
 
@@ -32,59 +46,237 @@ const (
 
 	StreamTimeout  = time.Minute
 	ConnectTimeout = 30 * time.Second
+	// AckTimeout bounds waiting for the receiver to acknowledge a frame.
+	AckTimeout = 10 * time.Second
+	// maxAckSize bounds an ack, the ack of a frame with a uuid id is
+	// under it in either codec.
+	maxAckSize = 64
+
+	// SendQueueSize bounds the envelopes waiting for the sender by default,
+	// past it they wait in the outbox.
+	SendQueueSize = 64
 )
 
+var ErrUnknownProtocol = errors.New("no codec registered for protocol")
+
+// ErrNoAck is returned when the receiver did not acknowledge a frame.
+var ErrNoAck = errors.New("frame not acknowledged")
+
+// ErrFrameMagic is returned when a message stream doesn't open with the
+// frame magic.
+var ErrFrameMagic = errors.New("message stream without frame magic")
+
+// DefaultFrameMagic opens every stream of the ID and JSONID protocols,
+// before the first frame length, so garbage and port scans are reset
+// without being parsed. The legacy protocols and bridged ones added with
+// RegisterCodec go without it.
+const DefaultFrameMagic = "hood"
+
+// writeMagic opens a message stream.
+func writeMagic(w io.Writer, magic []byte) error {
+	_, err := w.Write(magic)
+	return err
+}
+
+// magicFor is the magic opening streams of proto, none for bridged ones.
+func (c *pmService) magicFor(proto protocol.ID) []byte {
+	if proto != ID && proto != JSONID {
+		return nil
+	}
+	return c.magic
+}
+
+// readMagic checks a message stream opens with magic.
+func readMagic(r io.Reader, magic []byte) error {
+	if len(magic) == 0 {
+		return nil
+	}
+	buf := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	if !bytes.Equal(buf, magic) {
+		return ErrFrameMagic
+	}
+	return nil
+}
+
+// Codecs maps every message protocol to the codec its frames are encoded
+// with. Use RegisterCodec to add protocols.
+var Codecs = map[protocol.ID]utils.Codec{
+	ID:           utils.ProtoCodec{},
+	JSONID:       utils.JSONCodec{},
+	LegacyID:     utils.ProtoCodec{},
+	LegacyJSONID: utils.JSONCodec{},
+}
+
+var codecsMux sync.RWMutex
+
+// RegisterCodec makes proto available for sending messages, e.g. to bridge
+// to other chat networks.
+func RegisterCodec(proto protocol.ID, c utils.Codec) {
+	codecsMux.Lock()
+	defer codecsMux.Unlock()
+	Codecs[proto] = c
+}
+
+func codecFor(proto protocol.ID) (utils.Codec, bool) {
+	codecsMux.RLock()
+	defer codecsMux.RUnlock()
+	c, ok := Codecs[proto]
+	return c, ok
+}
+
+// DefaultProtocols are the message protocols offered, most preferred first.
+// The legacy ones come last, for older clients only.
+var DefaultProtocols = []protocol.ID{ID, JSONID, LegacyID, LegacyJSONID}
+
 type PMService interface {
 	Send(entity.Envelop)
 	Handler(str network.Stream)
+	// Dropped is the number of messages dropped due to backpressure.
+	Dropped() uint64
+	// OutboxSize estimates the bytes held by undelivered messages.
+	OutboxSize() int64
+	// Pending is the number of messages waiting for delivery.
+	Pending() int
+	// Flush dials every peer with queued messages right away.
+	Flush()
+	// Discard drops the messages queued for a peer, they are never sent.
+	Discard(pid peer.ID)
+	// SendLatency summarizes how long recent messages took to deliver.
+	SendLatency() LatencyStats
 	Stop()
 }
 
-// NewNATManager creates a NAT manager.
-func NewPMService(h host.Host, ebus lpevent.Bus) PMService {
-	return newPMService(h, ebus)
+// NewPMService creates the private message service. protos are the message
+// protocols to offer in order of preference, DefaultProtocols when empty.
+func NewPMService(h host.Host, ebus lpevent.Bus, protos []protocol.ID) (PMService, error) {
+	return newPMService(h, ebus, protos)
+}
+
+// NewPMServiceWithOutbox keeps undelivered messages in persist, so they
+// are delivered after a restart, and retries them by policy.
+func NewPMServiceWithOutbox(h host.Host, ebus lpevent.Bus, protos []protocol.ID, persist repo.IRepo[entity.Envelop], policy OutboxPolicy) (PMService, error) {
+	return newPMServiceWithOutbox(h, ebus, protos, persist, policy, newInboundLimiter(InboundPolicy{}, nil), nil)
+}
+
+// NewPMServiceWithInbound is NewPMServiceWithOutbox limiting incoming
+// messages by inbound. Peers out of strikes are handed to block, nil never
+// blocks them. magic opens the message streams, nil uses
+// DefaultFrameMagic and an empty one skips the check.
+func NewPMServiceWithInbound(h host.Host, ebus lpevent.Bus, protos []protocol.ID, persist repo.IRepo[entity.Envelop], policy OutboxPolicy, inbound InboundPolicy, block func(peer.ID, time.Duration), magic []byte) (PMService, error) {
+	return newPMServiceWithOutbox(h, ebus, protos, persist, policy, newInboundLimiter(inbound, block), magic)
 }
 
 type pmService struct {
 	host      host.Host
+	protos    []protocol.ID
+	magic     []byte
 	connector Connector
 	backoff   bf.BackoffFactory
 	nvlpCh    chan entity.Envelop
 	outbox    *outbox
+	dropped   uint64
+	pmux      sync.Mutex
+	pending   int
+	latency   *latencyRecorder
+	inbound   *inboundLimiter
+	cancel    context.CancelFunc
 	emitters  struct {
 		evtMessageReceived      lpevent.Emitter
 		evtMessageStatusChanged lpevent.Emitter
+		evtMessageDropped       lpevent.Emitter
+		evtOutboxDepthChanged   lpevent.Emitter
+		evtOutboxDrained        lpevent.Emitter
 	}
+
+	// maxPending bounds the messages waiting for delivery, zero never drops
+	maxPending int
+	// attachments fetches the attachment of a message from the peer that
+	// sent it and keeps it, nil leaves attachments to the receiver. Guarded
+	// by pmux.
+	attachments func(ctx context.Context, from peer.ID, id string) error
+}
+
+func newPMService(h host.Host, ebus lpevent.Bus, protos []protocol.ID) (PMService, error) {
+	return newPMServiceWithOutbox(h, ebus, protos, nil, OutboxPolicy{}, newInboundLimiter(InboundPolicy{}, nil), nil)
 }
 
-func newPMService(h host.Host, ebus lpevent.Bus) PMService {
-	pms := &pmService{}
+func newPMServiceWithOutbox(h host.Host, ebus lpevent.Bus, protos []protocol.ID, persist repo.IRepo[entity.Envelop], policy OutboxPolicy, inbound *inboundLimiter, magic []byte) (PMService, error) {
+	pms := &pmService{inbound: inbound}
 	var err error
 	pms.emitters.evtMessageStatusChanged, err = ebus.Emitter(new(event.EvtObject), eventbus.Stateful)
 	if err != nil {
-		log.Errorf("error reading message: %s", err.Error())
-		panic("failed to create message service")
+		return nil, err
 	}
 	pms.emitters.evtMessageReceived, err = ebus.Emitter(new(event.EvtMessageReceived), eventbus.Stateful)
 	if err != nil {
-		log.Errorf("error reading message: %s", err.Error())
-		panic("failed to create message service")
+		return nil, err
+	}
+	pms.emitters.evtMessageDropped, err = ebus.Emitter(new(event.EvtMessageDropped))
+	if err != nil {
+		return nil, err
+	}
+	pms.emitters.evtOutboxDepthChanged, err = ebus.Emitter(new(event.EvtOutboxDepthChanged), eventbus.Stateful)
+	if err != nil {
+		return nil, err
+	}
+	pms.emitters.evtOutboxDrained, err = ebus.Emitter(new(event.EvtOutboxDrained))
+	if err != nil {
+		return nil, err
 	}
 	pms.host = h
-	h.SetStreamHandler(ID, pms.Handler)
+	if len(protos) == 0 {
+		protos = DefaultProtocols
+	}
+	pms.protos = protos
+	if magic == nil {
+		magic = []byte(DefaultFrameMagic)
+	}
+	pms.magic = magic
+	for _, proto := range protos {
+		h.SetStreamHandler(proto, pms.Handler)
+	}
 	log.Debug("service PMS created")
-	pms.nvlpCh = make(chan entity.Envelop)
-	pms.outbox = newOutBox()
+	queue := policy.SendQueue
+	if queue == 0 {
+		queue = SendQueueSize
+	}
+	pms.nvlpCh = make(chan entity.Envelop, queue)
+	pms.maxPending = policy.MaxPending
+	pms.outbox = newOutBox(persist, policy)
+	pms.latency = newLatencyRecorder()
 	pms.backoff = bf.NewPolynomialBackoff(time.Second*5, time.Second*10, bf.NoJitter, time.Second, []float64{5, 7, 10}, rand.NewSource(0))
 	pms.connector = NewConnector(h)
 	pms.host.Network().Notify((*pmsNotifiee)(pms))
-	go pms.background(context.Background(), pms.nvlpCh)
-	return pms
+	if n := pms.outbox.load(); n > 0 {
+		pms.addPending(n)
+	}
+	var ctx context.Context
+	ctx, pms.cancel = context.WithCancel(context.Background())
+	go pms.background(ctx, pms.nvlpCh)
+	return pms, nil
 }
 
-func (c *pmService) send(p peer.ID, pbmsg *pb.Message) error {
+// send writes nvlop to p over its protocol, or the protocols offered when
+// unset, and waits for the receiver to acknowledge it unless a legacy
+// protocol was negotiated.
+func (c *pmService) send(p peer.ID, nvlop *entity.Envelop) error {
+	pbmsg := nvlop.Proto()
+	protos := c.protos
+	if nvlop.Protocol != "" {
+		protos = []protocol.ID{nvlop.Protocol}
+	}
 	nctx := network.WithUseTransient(context.Background(), "just a chat")
-	s, err := c.host.NewStream(nctx, p, ID)
+	s, err := c.host.NewStream(nctx, p, protos...)
+	if err != nil && c.host.Network().Connectedness(p) != network.Connected {
+		ctx, cancel := context.WithTimeout(context.Background(), ConnectTimeout)
+		if connectWithFallback(ctx, c.host, peer.AddrInfo{ID: p}) == nil {
+			s, err = c.host.NewStream(nctx, p, protos...)
+		}
+		cancel()
+	}
 	if err != nil {
 		log.Errorf("new stream failed: %s", err)
 		return err
@@ -96,7 +288,12 @@ func (c *pmService) send(p peer.ID, pbmsg *pb.Message) error {
 		// return 0, err
 	}
 	defer s.Scope().ReleaseMemory(MaxMsgSize)
-	wr := protoio.NewDelimitedWriter(s)
+	codec, ok := codecFor(s.Protocol())
+	if !ok {
+		s.Reset()
+		return ErrUnknownProtocol
+	}
+	wr := utils.NewCodecWriter(s, codec)
 	defer func() {
 		wr.Close()
 	}()
@@ -105,41 +302,185 @@ func (c *pmService) send(p peer.ID, pbmsg *pb.Message) error {
 		return err
 	}
 	log.Debugf("text sent with message text: %s", pbmsg.GetText())
-	wr.WriteMsg(pbmsg)
+	err = writeMagic(s, c.magicFor(s.Protocol()))
 	if err != nil {
 		log.Errorf("write err %s", err)
 		return err
 	}
-	c.done(pbmsg.Id, p)
+	err = wr.WriteMsg(pbmsg)
+	if err != nil {
+		log.Errorf("write err %s", err)
+		return err
+	}
+	if acked(s.Protocol()) {
+		err = readAck(s, codec, pbmsg.GetId())
+		if err != nil {
+			log.Debugf("no ack from %s: %s", logID(p), err)
+			return err
+		}
+	}
+	c.outbox.delivered(p, nvlop)
+	c.done(pbmsg, p)
+	return nil
+}
+
+// acked reports whether frames of proto are acknowledged, older clients on
+// the legacy protocols never write an ack.
+func acked(proto protocol.ID) bool {
+	return proto != LegacyID && proto != LegacyJSONID
+}
+
+// readAck waits for the receiver to acknowledge the frame id.
+func readAck(s network.Stream, codec utils.Codec, id string) error {
+	if err := s.CloseWrite(); err != nil {
+		return err
+	}
+	s.SetReadDeadline(time.Now().Add(AckTimeout))
+	var ack pb.Message
+	err := utils.NewCodecReader(s, maxAckSize, codec).ReadMsg(&ack)
+	if err != nil {
+		// whatever the receiver wrote instead is not read any further
+		s.Reset()
+		return err
+	}
+	if ack.GetType() != entity.AckType || ack.GetId() != id {
+		return ErrNoAck
+	}
 	return nil
 }
 
+// Send queues nvlop for the sender. While the sender is busy it waits in
+// the outbox, it is only dropped past the MaxPending of the policy.
 func (c *pmService) Send(nvlop entity.Envelop) {
+	if c.maxPending > 0 && c.Pending() >= c.maxPending {
+		c.drop(nvlop, event.DropBackpressure)
+		return
+	}
+	if nvlop.Type == "" || nvlop.Type == entity.TextType {
+		c.latency.start(nvlop.Message.ID.String(), time.Now())
+	}
+	c.addPending(1)
+	select {
+	case c.nvlpCh <- nvlop:
+	default:
+		// a slow peer holds the sender up, retry like an undelivered one
+		if pi, ok := c.recipient(nvlop); ok {
+			c.outbox.put(pi.ID, &nvlop)
+		}
+	}
+}
+
+// recipient is the peer nvlp goes to. Envelopes that can't be sent are let
+// go, false is returned for them.
+func (c *pmService) recipient(nvlp entity.Envelop) (*peer.AddrInfo, bool) {
+	pi, err := nvlp.To.AdderInfo()
+	if err != nil || pi.ID == c.host.ID() || pi.ID == "" {
+		c.latency.forget(nvlp.Message.ID.String())
+		c.addPending(-1)
+		return nil, false
+	}
+	c.connector.Need(nvlp.Proto().Id, *pi)
+	return pi, true
+}
 
-	c.nvlpCh <- nvlop
+func (c *pmService) drop(nvlop entity.Envelop, reason string) {
+	atomic.AddUint64(&c.dropped, 1)
+	log.Warnf("message %s dropped: %s", nvlop.Message.ID, reason)
+	pbmsg := nvlop.Proto()
+	if pbmsg.GetType() == entity.TextType {
+		c.latency.forget(pbmsg.Id)
+		c.emitMessageChange(entity.Failed, pbmsg.Id)
+	}
+	c.emitters.evtMessageDropped.Emit(event.EvtMessageDropped{
+		MsgID:  nvlop.Message.ID,
+		ChatID: nvlop.Message.ChatID,
+		Reason: reason,
+	})
+}
+
+// addPending moves the pending count by delta and announces the new depth,
+// and that the outbox drained when the last message left it.
+func (c *pmService) addPending(delta int) {
+	c.pmux.Lock()
+	defer c.pmux.Unlock()
+	c.pending += delta
+	c.emitters.evtOutboxDepthChanged.Emit(event.EvtOutboxDepthChanged{Depth: c.pending})
+	if delta < 0 && c.pending == 0 {
+		c.emitters.evtOutboxDrained.Emit(event.EvtOutboxDrained{})
+	}
+}
+
+// keepAttachments holds the acknowledgement of messages sent with an
+// attachment until fn fetched and kept it.
+func (c *pmService) keepAttachments(fn func(ctx context.Context, from peer.ID, id string) error) {
+	c.pmux.Lock()
+	defer c.pmux.Unlock()
+	c.attachments = fn
+}
+
+func (c *pmService) Pending() int {
+	c.pmux.Lock()
+	defer c.pmux.Unlock()
+	return c.pending
+}
 
+func (c *pmService) SendLatency() LatencyStats {
+	return c.latency.stats()
+}
+
+func (c *pmService) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+func (c *pmService) OutboxSize() int64 {
+	return c.outbox.size()
+}
+
+func (c *pmService) Flush() {
+	for _, pid := range c.outbox.peers() {
+		go func(pid peer.ID) {
+			ctx, cancel := context.WithTimeout(context.Background(), ConnectTimeout)
+			defer cancel()
+			err := c.host.Connect(ctx, c.host.Peerstore().PeerInfo(pid))
+			if err != nil {
+				log.Debugf("flush connect to %s failed: %s", logID(pid), err)
+			}
+		}(pid)
+	}
+}
+
+func (c *pmService) Discard(pid peer.ID) {
+	msgs := c.outbox.discard(pid)
+	for _, m := range msgs {
+		c.latency.forget(m.Message.ID.String())
+		c.connector.Done(m.Proto().Id, pid)
+	}
+	if len(msgs) > 0 {
+		c.addPending(-len(msgs))
+	}
 }
 
 func (c *pmService) background(ctx context.Context, nvlpCh <-chan entity.Envelop) {
+	retry := time.NewTicker(OutboxRetryInterval)
+	defer retry.Stop()
 	for {
 		select {
+		case t := <-retry.C:
+			for _, pid := range c.outbox.due(t) {
+				c.redeliver(pid)
+			}
 		case m := <-c.outbox.failed:
-			c.failed(m.Proto().Id, peer.ID(m.To.ID))
+			c.failed(m.Proto(), peer.ID(m.To.ID))
 		case nvlp := <-nvlpCh:
 			h := c.host
-			pi, err := nvlp.To.AdderInfo()
-			if err != nil {
+			pi, ok := c.recipient(nvlp)
+			if !ok {
 				continue
 			}
-
-			if pi.ID == c.host.ID() || pi.ID == "" {
-				continue
-			}
-			c.connector.Need(nvlp.Proto().Id, *pi)
 			cns := h.Network().Connectedness(pi.ID)
 			switch cns {
 			case network.Connected:
-				err := c.send(pi.ID, nvlp.Proto())
+				err := c.send(pi.ID, &nvlp)
 				if err != nil {
 					c.outbox.put(pi.ID, &nvlp)
 				}
@@ -148,7 +489,8 @@ func (c *pmService) background(ctx context.Context, nvlpCh <-chan entity.Envelop
 				c.outbox.put(pi.ID, &nvlp)
 			}
 		case <-ctx.Done():
-			log.Errorf("context error broke sender")
+			log.Debug("message sender stopped")
+			return
 		}
 
 	}
@@ -161,27 +503,72 @@ func (c *pmService) Handler(str network.Stream) {
 		str.Reset()
 		return
 	}
+	from := str.Conn().RemotePeer()
+	if !c.inbound.allow(from, time.Now()) {
+		log.Debugf("message stream from %s throttled", logID(from))
+		str.Reset()
+		c.inbound.strike(from, time.Now())
+		return
+	}
 
-	if err := str.Scope().ReserveMemory(MaxMsgSize, network.ReservationPriorityAlways); err != nil {
+	maxSize := c.inbound.policy.MaxMessageSize
+	if err := str.Scope().ReserveMemory(maxSize, network.ReservationPriorityAlways); err != nil {
 		log.Debugf("error reserving memory for Private Message stream: %s", err)
 		str.Reset()
 		return
 	}
-	defer str.Scope().ReleaseMemory(MaxMsgSize)
-
-	rd := utils.NewDelimitedReader(str, MaxMsgSize)
-	defer rd.Close()
+	defer str.Scope().ReleaseMemory(maxSize)
 
+	codec, ok := codecFor(str.Protocol())
+	if !ok {
+		log.Errorf("no codec for %s", str.Protocol())
+		str.Reset()
+		return
+	}
 	str.SetDeadline(time.Now().Add(StreamTimeout))
+	if err := readMagic(str, c.magicFor(str.Protocol())); err != nil {
+		log.Debugf("message stream from %s dropped: %s", logID(from), err)
+		str.Reset()
+		return
+	}
+	rd := utils.NewCodecReader(str, maxSize, codec)
+	defer rd.Close()
 
 	var msg pb.Message
 
 	err := rd.ReadMsg(&msg)
+	if errors.Is(err, io.ErrShortBuffer) {
+		log.Debugf("message from %s over %d bytes rejected", logID(from), maxSize)
+		str.Reset()
+		c.inbound.strike(from, time.Now())
+		return
+	}
 	if err != nil {
 		log.Errorf("error reading message: %s", err.Error())
 		str.Reset()
 		return
 	}
+	// a receipt speaks for its author, nobody else may send it
+	if t := msg.GetType(); (t == entity.SeenType || t == entity.DeliveredType) && msg.GetAuthor().GetId() != from.String() {
+		log.Debugf("receipt from %s on behalf of another peer dropped", logID(from))
+		str.Reset()
+		return
+	}
+	// the text sent apart is held before the ack lets the sender forget it,
+	// in time for the sender still waiting for the ack
+	c.pmux.Lock()
+	keep := c.attachments
+	c.pmux.Unlock()
+	if id := msg.GetAttachment(); id != "" && keep != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), AckTimeout/2)
+		err := keep(ctx, from, id)
+		cancel()
+		if err != nil {
+			log.Debugf("attachment %s of %s not fetched: %s", id, logID(from), err)
+			str.Reset()
+			return
+		}
+	}
 	log.Debugf("message received ... %s", msg.GetText())
 	err = c.emitters.evtMessageReceived.Emit(event.EvtMessageReceived{Msg: &msg})
 	if err != nil {
@@ -189,22 +576,46 @@ func (c *pmService) Handler(str network.Stream) {
 		str.Reset()
 		return
 	}
+	if !acked(str.Protocol()) {
+		return
+	}
+	ack := &pb.Message{Id: msg.GetId(), Type: entity.AckType}
+	err = utils.NewCodecWriter(str, codec).WriteMsg(ack)
+	if err != nil {
+		log.Debugf("can not ack message %s: %s", msg.GetId(), err)
+	}
 }
 
 func (c *pmService) Stop() {
-	c.host.RemoveStreamHandler(ID)
+	c.cancel()
+	c.outbox.stop()
+	c.connector.Stop()
+	for _, proto := range c.protos {
+		c.host.RemoveStreamHandler(proto)
+	}
 	c.emitters.evtMessageReceived.Close()
 	c.emitters.evtMessageStatusChanged.Close()
+	c.emitters.evtMessageDropped.Close()
+	c.emitters.evtOutboxDepthChanged.Close()
+	c.emitters.evtOutboxDrained.Close()
 }
 
-func (c *pmService) done(msgID string, pid peer.ID) {
-	c.emitMessageChange(entity.Sent, msgID)
-	c.connector.Done(msgID, pid)
+func (c *pmService) done(pbmsg *pb.Message, pid peer.ID) {
+	// receipts share the id of the message they refer to
+	if pbmsg.GetType() == entity.TextType {
+		c.latency.stop(pbmsg.Id, time.Now())
+		c.emitMessageChange(entity.Sent, pbmsg.Id)
+	}
+	c.connector.Done(pbmsg.Id, pid)
+	c.addPending(-1)
 }
 
-func (c *pmService) failed(msgID string, pid peer.ID) {
-	c.emitMessageChange(entity.Failed, msgID)
-	c.connector.Done(msgID, pid)
+func (c *pmService) failed(pbmsg *pb.Message, pid peer.ID) {
+	if pbmsg.GetType() == entity.TextType {
+		c.emitMessageChange(entity.Failed, pbmsg.Id)
+	}
+	c.connector.Done(pbmsg.Id, pid)
+	c.addPending(-1)
 }
 
 func (c *pmService) emitMessageChange(status entity.Status, msgID string) {
@@ -218,16 +629,28 @@ func (c *pmService) emitMessageChange(status entity.Status, msgID string) {
 }
 
 func (c *pmService) onConnected(pid peer.ID) {
+	c.redeliver(pid)
+}
+
+// redeliver sends the messages queued for pid, those that fail are queued
+// again and pid backs off.
+func (c *pmService) redeliver(pid peer.ID) {
 	msgs := c.outbox.pop(pid)
+	if len(msgs) == 0 {
+		return
+	}
 	go func(msgs []*entity.Envelop) {
+		var failed []*entity.Envelop
 		for _, val := range msgs {
-			err := c.send(pid, val.Proto())
+			err := c.send(pid, val)
 			if err != nil {
-				c.outbox.put(pid, val)
+				failed = append(failed, val)
 			}
 		}
+		if len(failed) > 0 {
+			c.outbox.requeue(pid, failed)
+		}
 	}(msgs)
-
 }
 
 type pmsNotifiee pmService
@@ -0,0 +1,324 @@
+package core
+
+import (
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hood-chat/core/entity"
+	"github.com/hood-chat/core/event"
+	"github.com/hood-chat/core/pb"
+	"github.com/hood-chat/core/utils"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestHost(t *testing.T) host.Host {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	require.NoError(t, err)
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func testEnvelop(t *testing.T, to host.Host, text string) entity.Envelop {
+	return entity.Envelop{
+		To: entity.Contact{ID: entity.ID(to.ID().String())},
+		Message: entity.Message{
+			ID:        entity.ID(text),
+			ChatID:    "chat",
+			CreatedAt: time.Now().UTC().Unix(),
+			Text:      text,
+			Author:    entity.Contact{ID: "author", Name: "author"},
+		},
+	}
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	h1 := newTestHost(t)
+	h2 := newTestHost(t)
+	bus1 := eventbus.NewBus()
+	bus2 := eventbus.NewBus()
+	// h1 is an older client speaking JSON only
+	pms1, err := newPMService(h1, bus1, []protocol.ID{JSONID})
+	require.NoError(t, err)
+	pms2, err := newPMService(h2, bus2, nil)
+	require.NoError(t, err)
+	defer pms1.Stop()
+	defer pms2.Stop()
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	sub1, err := bus1.Subscribe(new(event.EvtMessageReceived))
+	require.NoError(t, err)
+	defer sub1.Close()
+	sub2, err := bus2.Subscribe(new(event.EvtMessageReceived))
+	require.NoError(t, err)
+	defer sub2.Close()
+
+	pms1.Send(testEnvelop(t, h2, "from json"))
+	select {
+	case e := <-sub2.Out():
+		require.Equal(t, "from json", e.(event.EvtMessageReceived).Msg.GetText())
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	pms2.Send(testEnvelop(t, h1, "from proto"))
+	select {
+	case e := <-sub1.Out():
+		require.Equal(t, "from proto", e.(event.EvtMessageReceived).Msg.GetText())
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	protos, err := h2.Peerstore().SupportsProtocols(h1.ID(), ID, JSONID)
+	require.NoError(t, err)
+	require.Equal(t, []string{JSONID}, protos)
+}
+
+func TestDropOnBackpressure(t *testing.T) {
+	h1 := newTestHost(t)
+	h2 := newTestHost(t)
+	bus := eventbus.NewBus()
+	// h2 is never connected, so the first message stays pending
+	svc, err := newPMServiceWithOutbox(h1, bus, nil, nil, OutboxPolicy{MaxPending: 1}, newInboundLimiter(InboundPolicy{}, nil), nil)
+	require.NoError(t, err)
+	pms := svc.(*pmService)
+	defer pms.Stop()
+
+	sub, err := bus.Subscribe(new(event.EvtMessageDropped))
+	require.NoError(t, err)
+	defer sub.Close()
+
+	pms.Send(testEnvelop(t, h2, "queued"))
+	require.Equal(t, uint64(0), pms.Dropped())
+	nvlp := testEnvelop(t, h2, "dropped")
+	pms.Send(nvlp)
+	require.Equal(t, uint64(1), pms.Dropped())
+	require.Equal(t, 1, pms.Pending())
+	select {
+	case e := <-sub.Out():
+		evt := e.(event.EvtMessageDropped)
+		require.Equal(t, nvlp.Message.ID, evt.MsgID)
+		require.Equal(t, nvlp.Message.ChatID, evt.ChatID)
+		require.Equal(t, event.DropBackpressure, evt.Reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("drop event not emitted")
+	}
+}
+
+func TestSpillToOutbox(t *testing.T) {
+	h1 := newTestHost(t)
+	h2 := newTestHost(t)
+	bus := eventbus.NewBus()
+	svc, err := newPMServiceWithOutbox(h1, bus, nil, nil, OutboxPolicy{SendQueue: 1}, newInboundLimiter(InboundPolicy{}, nil), nil)
+	require.NoError(t, err)
+	pms := svc.(*pmService)
+	defer pms.Stop()
+	// h2 takes frames but never acknowledges them, holding the sender up
+	var reads int32
+	h2.SetStreamHandler(ID, func(s network.Stream) {
+		atomic.AddInt32(&reads, 1)
+	})
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	pms.Send(testEnvelop(t, h2, "sending"))
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&reads) == 1 }, 5*time.Second, 20*time.Millisecond)
+	pms.Send(testEnvelop(t, h2, "queued"))
+	pms.Send(testEnvelop(t, h2, "spilled"))
+	require.Zero(t, pms.Dropped())
+	require.Equal(t, 3, pms.Pending())
+	msgs := pms.outbox.pop(h2.ID())
+	require.Len(t, msgs, 1)
+	require.Equal(t, "spilled", msgs[0].Message.Text)
+}
+
+// countingCodec counts the frames it was asked to parse.
+type countingCodec struct {
+	utils.ProtoCodec
+	parsed *int32
+}
+
+func (c countingCodec) Unmarshal(data []byte, msg proto.Message) error {
+	atomic.AddInt32(c.parsed, 1)
+	return c.ProtoCodec.Unmarshal(data, msg)
+}
+
+func TestFrameMagic(t *testing.T) {
+	var parsed int32
+	RegisterCodec(ID, countingCodec{parsed: &parsed})
+	t.Cleanup(func() { RegisterCodec(ID, utils.ProtoCodec{}) })
+	h1 := newTestHost(t)
+	h2 := newTestHost(t)
+	bus1 := eventbus.NewBus()
+	bus2 := eventbus.NewBus()
+	pms1, err := newPMService(h1, bus1, nil)
+	require.NoError(t, err)
+	pms2, err := newPMService(h2, bus2, nil)
+	require.NoError(t, err)
+	defer pms1.Stop()
+	defer pms2.Stop()
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+
+	// a parsable length followed by garbage
+	garbage := make([]byte, 64)
+	_, err = crand.Read(garbage)
+	require.NoError(t, err)
+	garbage[0] = 32
+	s, err := h1.NewStream(context.Background(), h2.ID(), ID)
+	require.NoError(t, err)
+	_, err = s.Write(garbage)
+	require.NoError(t, err)
+	require.NoError(t, s.CloseWrite())
+	_, err = io.ReadAll(s)
+	require.ErrorIs(t, err, network.ErrReset)
+	require.Equal(t, int32(0), atomic.LoadInt32(&parsed))
+
+	sub, err := bus2.Subscribe(new(event.EvtMessageReceived))
+	require.NoError(t, err)
+	defer sub.Close()
+	pms1.Send(testEnvelop(t, h2, "with magic"))
+	select {
+	case e := <-sub.Out():
+		require.Equal(t, "with magic", e.(event.EvtMessageReceived).Msg.GetText())
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+	require.Eventually(t, func() bool { return pms1.Pending() == 0 }, 5*time.Second, 50*time.Millisecond)
+
+	// a service with its own magic resets streams opening with the default
+	h3 := newTestHost(t)
+	pms3, err := newPMServiceWithOutbox(h3, eventbus.NewBus(), nil, nil, OutboxPolicy{}, newInboundLimiter(InboundPolicy{}, nil), []byte("chat"))
+	require.NoError(t, err)
+	defer pms3.Stop()
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h3.ID(), Addrs: h3.Addrs()}))
+	before := atomic.LoadInt32(&parsed)
+	require.Error(t, sendRaw(h1, h3.ID(), &pb.Message{Id: "default magic", Text: "x"}))
+	require.Equal(t, before, atomic.LoadInt32(&parsed))
+}
+
+func TestLegacyProtocol(t *testing.T) {
+	h1 := newTestHost(t)
+	h2 := newTestHost(t)
+	bus1 := eventbus.NewBus()
+	bus2 := eventbus.NewBus()
+	// h1 is an older client, framing without magic
+	pms1, err := newPMService(h1, bus1, []protocol.ID{LegacyID})
+	require.NoError(t, err)
+	pms2, err := newPMService(h2, bus2, nil)
+	require.NoError(t, err)
+	defer pms1.Stop()
+	defer pms2.Stop()
+	require.NoError(t, h1.Connect(context.Background(), peer.AddrInfo{ID: h2.ID(), Addrs: h2.Addrs()}))
+	sub1, err := bus1.Subscribe(new(event.EvtMessageReceived))
+	require.NoError(t, err)
+	defer sub1.Close()
+	sub2, err := bus2.Subscribe(new(event.EvtMessageReceived))
+	require.NoError(t, err)
+	defer sub2.Close()
+
+	// a frame with no magic at all is taken on the legacy protocol
+	s, err := h1.NewStream(context.Background(), h2.ID(), LegacyID)
+	require.NoError(t, err)
+	require.NoError(t, utils.NewCodecWriter(s, utils.ProtoCodec{}).WriteMsg(testEnvelop(t, h2, "raw").Proto()))
+	s.Close()
+	select {
+	case e := <-sub2.Out():
+		require.Equal(t, "raw", e.(event.EvtMessageReceived).Msg.GetText())
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	pms2.Send(testEnvelop(t, h1, "to legacy"))
+	select {
+	case e := <-sub1.Out():
+		require.Equal(t, "to legacy", e.(event.EvtMessageReceived).Msg.GetText())
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+	pms1.Send(testEnvelop(t, h2, "from legacy"))
+	select {
+	case e := <-sub2.Out():
+		require.Equal(t, "from legacy", e.(event.EvtMessageReceived).Msg.GetText())
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+// sendRaw writes msg to p over ID and waits for its ack.
+func sendRaw(h host.Host, p peer.ID, msg *pb.Message) error {
+	s, err := h.NewStream(context.Background(), p, ID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := writeMagic(s, []byte(DefaultFrameMagic)); err != nil {
+		return err
+	}
+	if err := utils.NewCodecWriter(s, utils.ProtoCodec{}).WriteMsg(msg); err != nil {
+		return err
+	}
+	return readAck(s, utils.ProtoCodec{}, msg.GetId())
+}
+
+func TestInboundLimits(t *testing.T) {
+	h := newTestHost(t)
+	bus := eventbus.NewBus()
+	blocked := make(chan peer.ID, 4)
+	policy := InboundPolicy{MaxMessageSize: 256, Messages: 2, Interval: time.Hour, Strikes: 2, BlockFor: time.Hour}
+	pms, err := newPMServiceWithOutbox(h, bus, nil, nil, OutboxPolicy{}, newInboundLimiter(policy, func(p peer.ID, d time.Duration) {
+		require.Equal(t, time.Hour, d)
+		blocked <- p
+	}), nil)
+	require.NoError(t, err)
+	defer pms.Stop()
+	sub, err := bus.Subscribe(new(event.EvtMessageReceived))
+	require.NoError(t, err)
+	defer sub.Close()
+	connectTo := func(from host.Host) {
+		require.NoError(t, from.Connect(context.Background(), peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}))
+	}
+
+	big := newTestHost(t)
+	connectTo(big)
+	err = sendRaw(big, h.ID(), &pb.Message{Id: "big", Text: strings.Repeat("x", 1024)})
+	require.ErrorIs(t, err, network.ErrReset)
+	require.NoError(t, sendRaw(big, h.ID(), &pb.Message{Id: "small", Text: "x"}))
+	require.Equal(t, "small", (<-sub.Out()).(event.EvtMessageReceived).Msg.GetId())
+
+	flood := newTestHost(t)
+	connectTo(flood)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, sendRaw(flood, h.ID(), &pb.Message{Id: fmt.Sprint(i)}))
+		<-sub.Out()
+	}
+	// past the rate streams are reset unread, and the peer is blocked once
+	// out of strikes
+	for i := 2; i < 5; i++ {
+		err := sendRaw(flood, h.ID(), &pb.Message{Id: fmt.Sprint(i)})
+		require.ErrorIs(t, err, network.ErrReset)
+	}
+	select {
+	case p := <-blocked:
+		require.Equal(t, flood.ID(), p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("flooding peer not blocked")
+	}
+	select {
+	case p := <-blocked:
+		t.Fatalf("%s blocked again", p)
+	case e := <-sub.Out():
+		t.Fatalf("unexpected message %v", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -2,14 +2,20 @@ package repo
 
 import (
 	"errors"
+	"strconv"
+	"strings"
 
 	"github.com/hood-chat/core/entity"
 	"github.com/hood-chat/core/store"
+	"github.com/libp2p/go-libp2p/core/protocol"
 )
 
 var ErrNotImplemented = errors.New("not implemented")
 var ErrNotSupported = errors.New("not supported")
 
+// ErrBadCursor is returned for a cursor not made by ChatCursor.
+var ErrBadCursor = errors.New("malformed cursor")
+
 
 //TODO: after adding IOption look like we can remove GetAll and GetByID
 type IRepo[C any] interface {
@@ -18,6 +24,14 @@ type IRepo[C any] interface {
 	GetAll(opt IOption) ([]C, error)
 	Set(C) error
 	Add(C) error
+	Delete(id entity.ID) error
+}
+
+// Upgrader is a repo that can bring what it persisted in an older format
+// to the current one.
+type Upgrader interface {
+	// Upgrade returns how many records were rewritten.
+	Upgrade() (int, error)
 }
 
 type IOption interface {
@@ -65,8 +79,17 @@ type ChatRepo struct {
 	store *store.Store
 }
 
+// GetAll lists the chats as stored. With a "before" filter they are listed
+// most recently active first, after the chat the cursor was made from, or
+// from the start when it is empty.
 func (c ChatRepo) GetAll(opt IOption) ([]entity.ChatInfo, error) {
-	chl, err := c.store.ChatList(opt.Skip(), opt.Limit())
+	var chl []store.BHChat
+	var err error
+	if cursor, ok := opt.Filters()["before"]; ok {
+		chl, err = c.byActivity(cursor, opt.Limit())
+	} else {
+		chl, err = c.store.ChatList(opt.Skip(), opt.Limit())
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -81,14 +104,38 @@ func (c ChatRepo) GetAll(opt IOption) ([]entity.ChatInfo, error) {
 			})
 		}
 		ci = append(ci, entity.ChatInfo{
-			ID:      entity.ID(val.ID),
-			Name:    val.Name,
-			Members: members,
+			ID:            entity.ID(val.ID),
+			Name:          val.Name,
+			Members:       members,
+			Unread:        val.Unread,
+			LastActivity:  val.LastActivity,
+			LastMessageID: entity.ID(val.LastMessageID),
 		})
 	}
 	return ci, nil
 }
 
+func (c ChatRepo) byActivity(cursor string, limit int) ([]store.BHChat, error) {
+	if cursor == "" {
+		return c.store.ChatsByActivity(nil, limit)
+	}
+	activity, id, ok := strings.Cut(cursor, ":")
+	if !ok {
+		return nil, ErrBadCursor
+	}
+	at, err := strconv.ParseInt(activity, 10, 64)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	return c.store.ChatsByActivity(&store.BHChat{ID: id, LastActivity: at}, limit)
+}
+
+// ChatCursor marks the place of chat in the list by activity, for the
+// "before" filter of the chat repo.
+func ChatCursor(chat entity.ChatInfo) string {
+	return strconv.FormatInt(chat.LastActivity, 10) + ":" + chat.ID.String()
+}
+
 func (c ChatRepo) GetByID(id entity.ID) (entity.ChatInfo, error) {
 	ct, err := c.store.ChatByID(string(id))
 	if err != nil {
@@ -103,9 +150,12 @@ func (c ChatRepo) GetByID(id entity.ID) (entity.ChatInfo, error) {
 		})
 	}
 	return entity.ChatInfo{
-		ID:      entity.ID(ct.ID),
-		Name:    ct.Name,
-		Members: members,
+		ID:            entity.ID(ct.ID),
+		Name:          ct.Name,
+		Members:       members,
+		Unread:        ct.Unread,
+		LastActivity:  ct.LastActivity,
+		LastMessageID: entity.ID(ct.LastMessageID),
 	}, nil
 }
 
@@ -127,6 +177,19 @@ func (c ChatRepo) Add(chat entity.ChatInfo) error {
 }
 
 func (c ChatRepo) Set(chat entity.ChatInfo) error {
+	m := []string{}
+	for _, val := range chat.Members {
+		m = append(m, string(val.ID))
+	}
+	return c.store.UpdateChat(store.BHChat{
+		ID:      string(chat.ID),
+		Name:    chat.Name,
+		Members: m,
+		Unread:  chat.Unread,
+	})
+}
+
+func (c ChatRepo) Delete(id entity.ID) error {
 	return ErrNotImplemented
 }
 
@@ -145,48 +208,21 @@ func NewMessageRepo(store *store.Store) IRepo[entity.Message] {
 }
 
 func (m MessageRepo) Add(msg entity.Message) error {
-	tmsg := store.BHTextMessage{
-		ID:        string(msg.ID),
-		ChatID:    string(msg.ChatID),
-		CreatedAt: msg.CreatedAt,
-		Text:      msg.Text,
-		Status:    store.Status(msg.Status),
-		Author:    store.BHContact{Name: msg.Author.Name, ID: string(msg.Author.ID)},
-	}
-	err := m.store.InsertTextMessage(tmsg)
+	err := m.store.InsertTextMessage(bhMessage(msg))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 func (m MessageRepo) Set(msg entity.Message) error {
-	tmsg := store.BHTextMessage{
-		ID:        string(msg.ID),
-		ChatID:    string(msg.ChatID),
-		CreatedAt: msg.CreatedAt,
-		Text:      msg.Text,
-		Status:    store.Status(msg.Status),
-		Author:    store.BHContact{Name: msg.Author.Name, ID: string(msg.Author.ID)},
-	}
-	return m.store.UpdateMessage(tmsg)
+	return m.store.UpdateMessage(bhMessage(msg))
 }
 func (m MessageRepo) GetByID(id entity.ID) (entity.Message, error) {
 	bhmsg, err := m.store.MsgByID(id.String())
 	if err != nil {
 		return entity.Message{}, err
 	}
-	msg := entity.Message{
-		ID:        entity.ID(bhmsg.ID),
-		ChatID:    entity.ID(bhmsg.ChatID),
-		CreatedAt: bhmsg.CreatedAt,
-		Text:      bhmsg.Text,
-		Status:    entity.Status(bhmsg.Status),
-		Author: entity.Contact{
-			ID:   entity.ID(bhmsg.Author.ID),
-			Name: bhmsg.Author.Name,
-		},
-	}
-	return msg, nil
+	return message(bhmsg), nil
 }
 func (m MessageRepo) GetAll(opt IOption) ([]entity.Message, error) {
 	messages := make([]entity.Message, 0)
@@ -194,26 +230,78 @@ func (m MessageRepo) GetAll(opt IOption) ([]entity.Message, error) {
 	if !pres {
 		return nil, ErrNotSupported
 	}
-	bhm, err := m.store.ChatMessages(string(chID), opt.Skip(), opt.Limit())
+	var bhm []store.BHTextMessage
+	var err error
+	if anchor, ok := opt.Filters()["before"]; ok {
+		bhm, err = m.around(chID, anchor, opt.Limit(), m.store.MessagesBefore)
+	} else if anchor, ok := opt.Filters()["after"]; ok {
+		bhm, err = m.around(chID, anchor, opt.Limit(), m.store.MessagesAfter)
+	} else {
+		bhm, err = m.store.ChatMessages(string(chID), opt.Skip(), opt.Limit())
+	}
 	if err != nil {
 		return nil, err
 	}
 	for _, m := range bhm {
-		messages = append(messages, entity.Message{
-			ID:        entity.ID(m.ID),
-			ChatID:    entity.ID(m.ChatID),
-			CreatedAt: m.CreatedAt,
-			Text:      m.Text,
-			Status:    entity.Status(m.Status),
-			Author: entity.Contact{
-				ID:   entity.ID(m.Author.ID),
-				Name: m.Author.Name,
-			},
-		})
+		messages = append(messages, message(m))
 	}
 	return messages, nil
 }
 
+// around lists up to limit messages of a chat on one side of the anchor
+// message, none when limit is zero.
+func (m MessageRepo) around(chID string, anchorID string, limit int, list func(string, store.BHTextMessage, int) ([]store.BHTextMessage, error)) ([]store.BHTextMessage, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	anchor, err := m.store.MsgByID(anchorID)
+	if err != nil {
+		return nil, err
+	}
+	return list(chID, anchor, limit)
+}
+
+func bhMessage(msg entity.Message) store.BHTextMessage {
+	tmsg := store.BHTextMessage{
+		ID:         string(msg.ID),
+		ChatID:     string(msg.ChatID),
+		CreatedAt:  msg.CreatedAt,
+		Text:       msg.Text,
+		Status:     store.Status(msg.Status),
+		Author:     store.BHContact{Name: msg.Author.Name, ID: string(msg.Author.ID)},
+		Attachment: msg.Attachment,
+		Sealed:     msg.Sealed,
+	}
+	if msg.ForwardedFrom != nil {
+		tmsg.ForwardedFrom = &store.BHContact{Name: msg.ForwardedFrom.Name, ID: string(msg.ForwardedFrom.ID)}
+	}
+	return tmsg
+}
+
+func message(bhmsg store.BHTextMessage) entity.Message {
+	msg := entity.Message{
+		ID:        entity.ID(bhmsg.ID),
+		ChatID:    entity.ID(bhmsg.ChatID),
+		CreatedAt: bhmsg.CreatedAt,
+		Text:      bhmsg.Text,
+		Status:    entity.Status(bhmsg.Status),
+		Author: entity.Contact{
+			ID:   entity.ID(bhmsg.Author.ID),
+			Name: bhmsg.Author.Name,
+		},
+		Attachment: bhmsg.Attachment,
+		Sealed:     bhmsg.Sealed,
+	}
+	if bhmsg.ForwardedFrom != nil {
+		msg.ForwardedFrom = &entity.Contact{ID: entity.ID(bhmsg.ForwardedFrom.ID), Name: bhmsg.ForwardedFrom.Name}
+	}
+	return msg
+}
+
+func (m MessageRepo) Delete(id entity.ID) error {
+	return ErrNotImplemented
+}
+
 func (m MessageRepo) Get() (entity.Message, error) {
 	return entity.Message{}, ErrNotSupported
 }
@@ -229,27 +317,21 @@ func NewContactRepo(store *store.Store) IRepo[entity.Contact] {
 }
 
 func (c ContactRepo) Add(con entity.Contact) error {
-	err := c.store.InsertContact(store.BHContact{
-		Name: con.Name,
-		ID:   string(con.ID),
-	})
+	err := c.store.InsertContact(bhContact(con))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 func (c ContactRepo) Set(cont entity.Contact) error {
-	return ErrNotImplemented
+	return c.store.UpdateContact(bhContact(cont))
 }
 func (c ContactRepo) GetByID(id entity.ID) (entity.Contact, error) {
 	con, err := c.store.ContactByID(string(id))
 	if err != nil {
 		return entity.Contact{}, err
 	}
-	return entity.Contact{
-		ID:   entity.ID(con.ID),
-		Name: con.Name,
-	}, nil
+	return contact(con), nil
 }
 func (c ContactRepo) GetAll(opt IOption) ([]entity.Contact, error) {
 	cons := make([]entity.Contact, 0)
@@ -258,14 +340,35 @@ func (c ContactRepo) GetAll(opt IOption) ([]entity.Contact, error) {
 		return nil, err
 	}
 	for _, val := range bhcl {
-		cons = append(cons, entity.Contact{
-			Name: val.Name,
-			ID:   entity.ID(val.ID),
-		})
+		cons = append(cons, contact(val))
 	}
 	return cons, nil
 }
 
+func bhContact(con entity.Contact) store.BHContact {
+	return store.BHContact{
+		ID:        string(con.ID),
+		Name:      con.Name,
+		Verified:  con.Verified,
+		Addrs:     con.Addrs,
+		SharedKey: con.SharedKey,
+	}
+}
+
+func contact(bhcon store.BHContact) entity.Contact {
+	return entity.Contact{
+		ID:        entity.ID(bhcon.ID),
+		Name:      bhcon.Name,
+		Verified:  bhcon.Verified,
+		Addrs:     bhcon.Addrs,
+		SharedKey: bhcon.SharedKey,
+	}
+}
+
+func (c ContactRepo) Delete(id entity.ID) error {
+	return c.store.DeleteContact(string(id))
+}
+
 func (c ContactRepo) Get() (entity.Contact, error) {
 	return entity.Contact{}, ErrNotSupported
 }
@@ -285,9 +388,10 @@ func (i IdentityRepo) Add(con entity.Identity) error {
 }
 func (i IdentityRepo) Set(iden entity.Identity) error {
 	err := i.store.SetIdentity(store.BHIdentity{
-		ID:   string(iden.ID),
-		Name: iden.Name,
-		Key:  iden.PrivKey,
+		ID:       string(iden.ID),
+		Name:     iden.Name,
+		Key:      iden.PrivKey,
+		Nickname: iden.Nickname,
 	})
 	if err != nil {
 		return err
@@ -303,20 +407,242 @@ func (i IdentityRepo) GetAll(_ IOption) ([]entity.Identity, error) {
 		return nil, err
 	}
 	return []entity.Identity{{
-		ID:      entity.ID(id.ID),
-		Name:    id.Name,
-		PrivKey: id.Key,
+		ID:       entity.ID(id.ID),
+		Name:     id.Name,
+		PrivKey:  id.Key,
+		Nickname: id.Nickname,
 	}}, nil
 }
 
+func (i IdentityRepo) Delete(id entity.ID) error {
+	return ErrNotImplemented
+}
+
 func (i IdentityRepo) Get() (entity.Identity, error) {
 	id, err := i.store.GetIdentity()
 	if err != nil {
 		return entity.Identity{}, err
 	}
 	return entity.Identity{
-		ID:      entity.ID(id.ID),
-		Name:    id.Name,
-		PrivKey: id.Key,
+		ID:       entity.ID(id.ID),
+		Name:     id.Name,
+		PrivKey:  id.Key,
+		Nickname: id.Nickname,
 	}, nil
 }
+
+type PendingRequestRepo struct {
+	store store.Store
+}
+
+func NewPendingRequestRepo(store *store.Store) IRepo[entity.PendingRequest] {
+	return PendingRequestRepo{
+		store: *store,
+	}
+}
+
+func (p PendingRequestRepo) Add(pr entity.PendingRequest) error {
+	return ErrNotImplemented
+}
+
+func (p PendingRequestRepo) Set(pr entity.PendingRequest) error {
+	msgs := make([]store.BHTextMessage, 0)
+	for _, msg := range pr.Messages {
+		msgs = append(msgs, bhMessage(msg))
+	}
+	return p.store.UpsertPendingRequest(store.BHPendingRequest{
+		ID:        string(pr.ID),
+		Name:      pr.Name,
+		Intro:     pr.Intro,
+		CreatedAt: pr.CreatedAt,
+		Messages:  msgs,
+	})
+}
+
+func (p PendingRequestRepo) GetByID(id entity.ID) (entity.PendingRequest, error) {
+	bhpr, err := p.store.PendingRequestByID(string(id))
+	if err != nil {
+		return entity.PendingRequest{}, err
+	}
+	return pendingRequest(bhpr), nil
+}
+
+func (p PendingRequestRepo) GetAll(opt IOption) ([]entity.PendingRequest, error) {
+	prs := make([]entity.PendingRequest, 0)
+	bhprs, err := p.store.PendingRequests(opt.Skip(), opt.Limit())
+	if err != nil {
+		return nil, err
+	}
+	for _, val := range bhprs {
+		prs = append(prs, pendingRequest(val))
+	}
+	return prs, nil
+}
+
+func (p PendingRequestRepo) Delete(id entity.ID) error {
+	return p.store.DeletePendingRequest(string(id))
+}
+
+func (p PendingRequestRepo) Get() (entity.PendingRequest, error) {
+	return entity.PendingRequest{}, ErrNotSupported
+}
+
+func pendingRequest(bhpr store.BHPendingRequest) entity.PendingRequest {
+	msgs := make([]entity.Message, 0)
+	for _, m := range bhpr.Messages {
+		msgs = append(msgs, message(m))
+	}
+	return entity.PendingRequest{
+		ID:        entity.ID(bhpr.ID),
+		Name:      bhpr.Name,
+		Intro:     bhpr.Intro,
+		CreatedAt: bhpr.CreatedAt,
+		Messages:  msgs,
+	}
+}
+
+type FavoriteRepo struct {
+	store store.Store
+}
+
+func NewFavoriteRepo(store *store.Store) IRepo[entity.ID] {
+	return FavoriteRepo{
+		store: *store,
+	}
+}
+
+func (f FavoriteRepo) Add(id entity.ID) error {
+	return f.store.InsertFavorite(store.BHFavorite{ID: string(id)})
+}
+
+func (f FavoriteRepo) Set(id entity.ID) error {
+	return ErrNotSupported
+}
+
+func (f FavoriteRepo) GetByID(id entity.ID) (entity.ID, error) {
+	return "", ErrNotSupported
+}
+
+func (f FavoriteRepo) GetAll(_ IOption) ([]entity.ID, error) {
+	favs, err := f.store.Favorites()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]entity.ID, 0)
+	for _, fav := range favs {
+		ids = append(ids, entity.ID(fav.ID))
+	}
+	return ids, nil
+}
+
+func (f FavoriteRepo) Delete(id entity.ID) error {
+	return f.store.DeleteFavorite(string(id))
+}
+
+func (f FavoriteRepo) Get() (entity.ID, error) {
+	return "", ErrNotSupported
+}
+
+type BlockedRepo struct {
+	store store.Store
+}
+
+func NewBlockedRepo(store *store.Store) IRepo[entity.ID] {
+	return BlockedRepo{
+		store: *store,
+	}
+}
+
+func (b BlockedRepo) Add(id entity.ID) error {
+	return b.store.InsertBlocked(store.BHBlocked{ID: string(id)})
+}
+
+func (b BlockedRepo) Set(id entity.ID) error {
+	return ErrNotSupported
+}
+
+func (b BlockedRepo) GetByID(id entity.ID) (entity.ID, error) {
+	return "", ErrNotSupported
+}
+
+func (b BlockedRepo) GetAll(_ IOption) ([]entity.ID, error) {
+	blocked, err := b.store.Blocked()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]entity.ID, 0)
+	for _, bl := range blocked {
+		ids = append(ids, entity.ID(bl.ID))
+	}
+	return ids, nil
+}
+
+func (b BlockedRepo) Delete(id entity.ID) error {
+	return b.store.DeleteBlocked(string(id))
+}
+
+func (b BlockedRepo) Get() (entity.ID, error) {
+	return "", ErrNotSupported
+}
+
+type OutboxRepo struct {
+	store store.Store
+}
+
+// NewOutboxRepo keeps envelopes waiting for delivery, keyed by
+// entity.Envelop.Key.
+func NewOutboxRepo(store *store.Store) IRepo[entity.Envelop] {
+	return OutboxRepo{
+		store: *store,
+	}
+}
+
+func (o OutboxRepo) Add(nvlop entity.Envelop) error {
+	return o.Set(nvlop)
+}
+
+func (o OutboxRepo) Set(nvlop entity.Envelop) error {
+	to := bhContact(nvlop.To)
+	// the shared key stays with the contact, the outbox holds ciphertext only
+	to.SharedKey = nil
+	return o.store.UpsertOutboxEntry(store.BHOutboxEntry{
+		ID:       nvlop.Key().String(),
+		To:       to,
+		Type:     nvlop.Type,
+		Protocol: string(nvlop.Protocol),
+		Message:  bhMessage(nvlop.Message),
+	})
+}
+
+func (o OutboxRepo) GetByID(id entity.ID) (entity.Envelop, error) {
+	return entity.Envelop{}, ErrNotSupported
+}
+
+func (o OutboxRepo) GetAll(opt IOption) ([]entity.Envelop, error) {
+	nvlops := make([]entity.Envelop, 0)
+	entries, err := o.store.OutboxEntries(opt.Skip(), opt.Limit())
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		nvlops = append(nvlops, entity.Envelop{
+			To:       contact(e.To),
+			Message:  message(e.Message),
+			Type:     e.Type,
+			Protocol: protocol.ID(e.Protocol),
+		})
+	}
+	return nvlops, nil
+}
+
+func (o OutboxRepo) Upgrade() (int, error) {
+	return o.store.UpgradeOutbox()
+}
+
+func (o OutboxRepo) Delete(id entity.ID) error {
+	return o.store.DeleteOutboxEntry(string(id))
+}
+
+func (o OutboxRepo) Get() (entity.Envelop, error) {
+	return entity.Envelop{}, ErrNotSupported
+}
@@ -41,9 +41,21 @@ func TestContact(t *testing.T) {
 	opt := repo.NewOption(0, 50)
 	res2, err := rc.GetAll(opt)
 	require.NoError(t, err)
-	if !reflect.DeepEqual(res2, test_contact) {
+	want := []entity.Contact{test_contact[0], test_contact[2], test_contact[3], test_contact[1]}
+	if !reflect.DeepEqual(res2, want) {
 		t.Error("in and out are not equal")
 	}
+
+	con := test_contact[1]
+	con.Addrs = []string{"/ip4/127.0.0.1/tcp/4001"}
+	require.NoError(t, rc.Set(con))
+	res, err := rc.GetByID(con.ID)
+	require.NoError(t, err)
+	require.Equal(t, con, res)
+
+	require.NoError(t, rc.Delete(con.ID))
+	_, err = rc.GetByID(con.ID)
+	require.Error(t, err)
 }
 
 func TestChat(t *testing.T) {
@@ -164,6 +176,9 @@ func TestChat(t *testing.T) {
 	rmsg = repo.NewMessageRepo(s)
 	rmsg.Add(chat1[0])
 	rmsg.Add(chat1[1])
+	// chats are as active as their newest message
+	chatinfo0.LastActivity, chatinfo0.LastMessageID = chat0[1].CreatedAt, chat0[1].ID
+	chatinfo1.LastActivity, chatinfo1.LastMessageID = chat1[1].CreatedAt, chat1[1].ID
 	b := repo.NewOption(0, 50)
 	res, err := chrepo.GetAll(b)
 	require.NoError(t, err)
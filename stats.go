@@ -0,0 +1,44 @@
+package core
+
+import (
+	"time"
+)
+
+// Stats is a snapshot of the node's activity, cheap enough to poll.
+type Stats struct {
+	// Peers is the number of peers connected
+	Peers int
+	// RoutingTable is the number of peers in the DHT routing table, zero
+	// without a DHT
+	RoutingTable int
+	// Bootstrap tells whether the node is still dialing bootstrap peers,
+	// BootstrapOff without a DHT
+	Bootstrap BootstrapState
+	// Outbox is the number of messages waiting for delivery
+	Outbox int
+	// BytesSent and BytesReceived count the traffic of every protocol
+	// since the messenger was built
+	BytesSent     int64
+	BytesReceived int64
+	// Uptime is the time since the host last started
+	Uptime time.Duration
+}
+
+// Stats reports the connections, outbox and traffic of the node.
+func (m *Messenger) Stats() Stats {
+	bw := m.bw.GetBandwidthTotals()
+	st := Stats{
+		Peers:         len(m.Host.Network().Peers()),
+		Outbox:        m.pms.Pending(),
+		BytesSent:     bw.TotalOut,
+		BytesReceived: bw.TotalIn,
+		Uptime:        time.Since(m.started),
+	}
+	if r, ok := m.Host.(Routed); ok {
+		st.RoutingTable = r.DHT().RoutingTable().Size()
+	}
+	if b, ok := m.Host.(bootstrapStater); ok {
+		st.Bootstrap = b.BootstrapState()
+	}
+	return st
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path"
+
+	"github.com/dgraph-io/badger/v3"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+var _ ds.Batching = (*Datastore)(nil)
+
+// Datastore keeps datastore records, such as the DHT ones, in a badger
+// database of their own.
+type Datastore struct {
+	db *badger.DB
+}
+
+func NewDatastore(dir string) (*Datastore, error) {
+	opt := badger.DefaultOptions(dir)
+	db, err := badger.Open(opt)
+	if err != nil {
+		log.Errorf("can not open datastore %s", err.Error())
+		return nil, err
+	}
+	return &Datastore{db: db}, nil
+}
+
+func (d *Datastore) Get(_ context.Context, key ds.Key) ([]byte, error) {
+	var val []byte
+	err := d.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key.Bytes())
+		if err != nil {
+			return err
+		}
+		val, err = item.ValueCopy(nil)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ds.ErrNotFound
+	}
+	return val, err
+}
+
+func (d *Datastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	_, err := d.GetSize(ctx, key)
+	if errors.Is(err, ds.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d *Datastore) GetSize(_ context.Context, key ds.Key) (int, error) {
+	size := -1
+	err := d.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key.Bytes())
+		if err != nil {
+			return err
+		}
+		size = int(item.ValueSize())
+		return nil
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return -1, ds.ErrNotFound
+	}
+	return size, err
+}
+
+// Query reads the matching records at once, the DHT keeps few of them.
+func (d *Datastore) Query(_ context.Context, q dsq.Query) (dsq.Results, error) {
+	prefix := path.Clean("/" + q.Prefix)
+	if prefix == "/" {
+		prefix = ""
+	}
+	var entries []dsq.Entry
+	err := d.db.View(func(txn *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.PrefetchValues = !q.KeysOnly
+		opt.Prefix = []byte(prefix)
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			e := dsq.Entry{Key: string(item.KeyCopy(nil)), Size: int(item.ValueSize())}
+			if !q.KeysOnly {
+				v, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				e.Value = v
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dsq.NaiveQueryApply(q, dsq.ResultsWithEntries(q, entries)), nil
+}
+
+func (d *Datastore) Put(_ context.Context, key ds.Key, value []byte) error {
+	return d.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key.Bytes(), value)
+	})
+}
+
+func (d *Datastore) Delete(_ context.Context, key ds.Key) error {
+	return d.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key.Bytes())
+	})
+}
+
+func (d *Datastore) Sync(context.Context, ds.Key) error {
+	return d.db.Sync()
+}
+
+func (d *Datastore) Batch(context.Context) (ds.Batch, error) {
+	return ds.NewBasicBatch(d), nil
+}
+
+func (d *Datastore) Close() error {
+	return d.db.Close()
+}
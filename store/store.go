@@ -1,6 +1,13 @@
 package store
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
 	"github.com/timshannon/badgerhold/v4"
 
 	logging "github.com/ipfs/go-log/v2"
@@ -19,20 +26,29 @@ const (
 )
 
 type BHIdentity struct {
-	ID   string `badgerhold:"unique"`
-	Name string
-	Key  string
+	ID       string `badgerhold:"unique"`
+	Name     string
+	Key      string
+	Nickname string
 }
 
 type BHContact struct {
-	ID   string `badgerhold:"unique"`
-	Name string
+	ID        string `badgerhold:"unique"`
+	Name      string
+	Verified  bool
+	Addrs     []string
+	SharedKey []byte
 }
 
 type BHChat struct {
 	Name    string
 	ID      string `badgerhold:"unique"`
 	Members []string
+	Unread  int
+	// LastActivity is the creation time of the newest message and
+	// LastMessageID its ID, kept by InsertTextMessage
+	LastActivity  int64
+	LastMessageID string
 }
 
 type BHTextMessage struct {
@@ -43,6 +59,88 @@ type BHTextMessage struct {
 	Text      string
 	Status    Status
 	Author    BHContact
+	// ForwardedFrom is the original author of a forwarded message
+	ForwardedFrom *BHContact
+	// Attachment is the CID the text travels under when sent apart
+	Attachment string
+	// Sealed is set when Text is encrypted with a key shared with a contact
+	Sealed bool
+	// FailedAt is when the message failed in unix seconds, set by
+	// UpdateMessage while Status is Failed.
+	FailedAt int64
+}
+
+type BHPendingRequest struct {
+	ID        string `badgerhold:"unique"`
+	Name      string
+	Intro     string
+	CreatedAt int64
+	Messages  []BHTextMessage
+}
+
+type BHFavorite struct {
+	ID string `badgerhold:"unique"`
+}
+
+// BHBlocked is a peer whose connections are refused.
+type BHBlocked struct {
+	ID string `badgerhold:"unique"`
+}
+
+// OutboxVersion is the format of the outbox entries written, older ones
+// are brought to it by UpgradeOutbox.
+const OutboxVersion = 1
+
+// BHOutboxEntry is a message waiting for delivery to To.
+type BHOutboxEntry struct {
+	ID       string `badgerhold:"unique"`
+	To       BHContact
+	Type     string
+	Protocol string
+	Message  BHTextMessage
+	// Version is the format the entry was written in, zero for entries
+	// written before it was kept.
+	Version int
+}
+
+// BHAttachment is a message body served to peers by its CID.
+type BHAttachment struct {
+	ID   string `badgerhold:"unique"`
+	Data []byte
+}
+
+// BHNetConfig holds the listen settings of the node, kept so a restart
+// listens where the last start did.
+type BHNetConfig struct {
+	ID          string `badgerhold:"unique"`
+	ListenAddrs []string
+	QUICOnly    bool
+}
+
+const netConfigID = "net"
+
+// BHSchema records the migrations run on the store.
+type BHSchema struct {
+	ID      string `badgerhold:"unique"`
+	Version int
+}
+
+const schemaID = "schema"
+
+// ActivitySchema is the schema version from which chats are indexed by
+// their last activity.
+const ActivitySchema = 1
+
+// activityPrefix keys the index of chats by last activity, next to the
+// records of badgerhold: the activity big endian then the chat ID, so
+// iterating it backwards lists the most recent chats first.
+var activityPrefix = []byte("_chatActivity:")
+
+func activityKey(at int64, id string) []byte {
+	key := make([]byte, 0, len(activityPrefix)+8+len(id))
+	key = append(key, activityPrefix...)
+	key = binary.BigEndian.AppendUint64(key, uint64(at))
+	return append(key, id...)
 }
 
 type Store struct {
@@ -55,29 +153,136 @@ func NewStore(path string) (*Store, error) {
 	opt.ValueDir = path
 	store, err := badgerhold.Open(opt)
 	if err != nil {
-		log.Fatal(err)
+		log.Errorf("can not open store %s", err.Error())
 		return nil, err
 	}
 
-	return &Store{
+	s := &Store{
 		bh: *store,
-	}, nil
+	}
+	var schema BHSchema
+	err = s.bh.Get(schemaID, &schema)
+	if err != nil && err != badgerhold.ErrNotFound {
+		s.Close()
+		return nil, err
+	}
+	if schema.Version < ActivitySchema {
+		if err := s.indexActivity(); err != nil {
+			log.Errorf("can not index chat activity %s", err.Error())
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
 
 }
 
+// Schema is the version of the migrations run on the store.
+func (s *Store) Schema() (int, error) {
+	var res BHSchema
+	err := s.bh.Get(schemaID, &res)
+	if err == badgerhold.ErrNotFound {
+		return 0, nil
+	}
+	return res.Version, err
+}
+
+// indexActivity sets the last activity and message of every chat from its
+// newest message and indexes the chats by it again, for ChatsByActivity.
+func (s *Store) indexActivity() error {
+	if err := s.bh.Badger().DropPrefix(activityPrefix); err != nil {
+		return err
+	}
+	var chats []BHChat
+	if err := s.bh.Find(&chats, &badgerhold.Query{}); err != nil {
+		return err
+	}
+	for _, ch := range chats {
+		newest, err := s.ChatMessages(ch.ID, 0, 1)
+		if err != nil {
+			return err
+		}
+		ch.LastActivity, ch.LastMessageID = 0, ""
+		if len(newest) > 0 {
+			ch.LastActivity, ch.LastMessageID = newest[0].CreatedAt, newest[0].ID
+		}
+		err = s.bh.Badger().Update(func(tx *badger.Txn) error {
+			if err := s.bh.TxUpdate(tx, ch.ID, ch); err != nil {
+				return err
+			}
+			return tx.Set(activityKey(ch.LastActivity, ch.ID), nil)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.bh.Upsert(schemaID, BHSchema{ID: schemaID, Version: ActivitySchema})
+}
+
 func (s *Store) InsertContact(contact BHContact) error {
 	err := s.bh.Insert(contact.ID, contact)
 	return err
 }
 
+func (s *Store) UpdateContact(contact BHContact) error {
+	return s.bh.Update(contact.ID, contact)
+}
+
+func (s *Store) DeleteContact(id string) error {
+	return s.bh.Delete(id, BHContact{})
+}
+
+// InsertTextMessage stores tm and moves the last activity of its chat up to
+// it.
 func (s *Store) InsertTextMessage(tm BHTextMessage) error {
-	err := s.bh.Insert(tm.ID, tm)
-	return err
+	return s.bh.Badger().Update(func(tx *badger.Txn) error {
+		if err := s.bh.TxInsert(tx, tm.ID, tm); err != nil {
+			return err
+		}
+		var ch BHChat
+		err := s.bh.TxGet(tx, tm.ChatID, &ch)
+		if err == badgerhold.ErrNotFound || (err == nil && ch.LastActivity > tm.CreatedAt) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return s.txSetActivity(tx, ch, tm.CreatedAt, tm.ID)
+	})
+}
+
+// txSetActivity moves ch to its new last activity and message, in the
+// record and in the index.
+func (s *Store) txSetActivity(tx *badger.Txn, ch BHChat, at int64, msgID string) error {
+	if err := tx.Delete(activityKey(ch.LastActivity, ch.ID)); err != nil {
+		return err
+	}
+	ch.LastActivity, ch.LastMessageID = at, msgID
+	if err := s.bh.TxUpdate(tx, ch.ID, ch); err != nil {
+		return err
+	}
+	return tx.Set(activityKey(at, ch.ID), nil)
 }
 
 func (s *Store) InsertChat(ch BHChat) error {
-	err := s.bh.Insert(ch.ID, ch)
-	return err
+	return s.bh.Badger().Update(func(tx *badger.Txn) error {
+		if err := s.bh.TxInsert(tx, ch.ID, ch); err != nil {
+			return err
+		}
+		return tx.Set(activityKey(ch.LastActivity, ch.ID), nil)
+	})
+}
+
+// UpdateChat writes ch, keeping the last activity set by the messages.
+func (s *Store) UpdateChat(ch BHChat) error {
+	return s.bh.Badger().Update(func(tx *badger.Txn) error {
+		var old BHChat
+		if err := s.bh.TxGet(tx, ch.ID, &old); err != nil {
+			return err
+		}
+		ch.LastActivity, ch.LastMessageID = old.LastActivity, old.LastMessageID
+		return s.bh.TxUpdate(tx, ch.ID, ch)
+	})
 }
 
 func (s *Store) ChatList(skip int, limit int) ([]BHChat, error) {
@@ -89,6 +294,42 @@ func (s *Store) ChatList(skip int, limit int) ([]BHChat, error) {
 	return res, err
 }
 
+// ChatsByActivity lists up to limit chats, most recently active first,
+// those sharing an activity by ID. A non-nil anchor lists the chats after
+// it. Only the chats listed are read, walking the activity index back.
+func (s *Store) ChatsByActivity(anchor *BHChat, limit int) ([]BHChat, error) {
+	var res []BHChat
+	err := s.bh.Badger().View(func(tx *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		opts.PrefetchValues = false
+		opts.Prefix = activityPrefix
+		it := tx.NewIterator(opts)
+		defer it.Close()
+		// past every key of the index
+		seek := append(append([]byte(nil), activityPrefix...), 0xff)
+		if anchor != nil {
+			seek = activityKey(anchor.LastActivity, anchor.ID)
+		}
+		for it.Seek(seek); it.Valid(); it.Next() {
+			if limit > 0 && len(res) == limit {
+				break
+			}
+			key := it.Item().Key()
+			if anchor != nil && bytes.Equal(key, seek) {
+				continue
+			}
+			var ch BHChat
+			if err := s.bh.TxGet(tx, string(key[len(activityPrefix)+8:]), &ch); err != nil {
+				return err
+			}
+			res = append(res, ch)
+		}
+		return nil
+	})
+	return res, err
+}
+
 func (s *Store) ChatMessages(id string, skip int, limit int) ([]BHTextMessage, error) {
 	var res []BHTextMessage
 	q := badgerhold.Where("ChatID").Eq(id).SortBy("CreatedAt").Reverse()
@@ -98,6 +339,30 @@ func (s *Store) ChatMessages(id string, skip int, limit int) ([]BHTextMessage, e
 	return res, err
 }
 
+// MessagesBefore lists up to limit messages of chat id older than anchor,
+// newest first. Messages sharing a timestamp are ordered by ID.
+func (s *Store) MessagesBefore(id string, anchor BHTextMessage, limit int) ([]BHTextMessage, error) {
+	var res []BHTextMessage
+	q := badgerhold.Where("ChatID").Eq(id).And("CreatedAt").Lt(anchor.CreatedAt).
+		Or(badgerhold.Where("ChatID").Eq(id).And("CreatedAt").Eq(anchor.CreatedAt).And("ID").Lt(anchor.ID)).
+		SortBy("CreatedAt", "ID").Reverse()
+	q.Limit(limit)
+	err := s.bh.Find(&res, q)
+	return res, err
+}
+
+// MessagesAfter lists up to limit messages of chat id newer than anchor,
+// oldest first. Messages sharing a timestamp are ordered by ID.
+func (s *Store) MessagesAfter(id string, anchor BHTextMessage, limit int) ([]BHTextMessage, error) {
+	var res []BHTextMessage
+	q := badgerhold.Where("ChatID").Eq(id).And("CreatedAt").Gt(anchor.CreatedAt).
+		Or(badgerhold.Where("ChatID").Eq(id).And("CreatedAt").Eq(anchor.CreatedAt).And("ID").Gt(anchor.ID)).
+		SortBy("CreatedAt", "ID")
+	q.Limit(limit)
+	err := s.bh.Find(&res, q)
+	return res, err
+}
+
 func (s *Store) MsgByID(id string) (BHTextMessage, error) {
 	var res BHTextMessage
 	q := badgerhold.Where("ID").Eq(id)
@@ -105,14 +370,127 @@ func (s *Store) MsgByID(id string) (BHTextMessage, error) {
 	return res, err
 }
 
+func (s *Store) MsgsByIDs(ids []string) ([]BHTextMessage, error) {
+	var res []BHTextMessage
+	err := s.bh.Find(&res, badgerhold.Where("ID").In(badgerhold.Slice(ids)...))
+	return res, err
+}
+
+// UpdateMessage replaces the stored message, stamping when it fails and
+// keeping that time until its status changes again.
 func (s *Store) UpdateMessage(msg BHTextMessage) error {
-	// tx := s.bh.Badger().NewTransaction(true)
-	return s.bh.Update(msg.ID, msg)
+	return s.bh.Badger().Update(func(tx *badger.Txn) error {
+		var old BHTextMessage
+		if err := s.bh.TxGet(tx, msg.ID, &old); err != nil {
+			return err
+		}
+		msg.FailedAt = 0
+		if msg.Status == Failed {
+			msg.FailedAt = old.FailedAt
+			if old.Status != Failed || msg.FailedAt == 0 {
+				msg.FailedAt = time.Now().UTC().Unix()
+			}
+		}
+		return s.bh.TxUpdate(tx, msg.ID, msg)
+	})
+}
+
+func (s *Store) DeleteMessage(id string) error {
+	return s.bh.Delete(id, BHTextMessage{})
+}
+
+// DeleteFailedBefore deletes the messages that failed before t, but those
+// keep holds, and returns them. Those that failed before the time was kept
+// go by when they were created. The chats they were the last message of
+// move back to the newest one left and their unread count stays within the
+// messages left, all or nothing.
+func (s *Store) DeleteFailedBefore(t int64, keep func(BHTextMessage) bool) ([]BHTextMessage, error) {
+	q := badgerhold.Where("Status").Eq(Failed).And("FailedAt").Gt(int64(0)).And("FailedAt").Lt(t).
+		Or(badgerhold.Where("Status").Eq(Failed).And("FailedAt").Eq(int64(0)).And("CreatedAt").Lt(t))
+	var deleted []BHTextMessage
+	err := s.bh.Badger().Update(func(tx *badger.Txn) error {
+		var failed []BHTextMessage
+		if err := s.bh.TxFind(tx, &failed, q); err != nil {
+			return err
+		}
+		chats := make(map[string]struct{})
+		for _, tm := range failed {
+			if keep != nil && keep(tm) {
+				continue
+			}
+			if err := s.bh.TxDelete(tx, tm.ID, BHTextMessage{}); err != nil {
+				return err
+			}
+			deleted = append(deleted, tm)
+			chats[tm.ChatID] = struct{}{}
+		}
+		for id := range chats {
+			var ch BHChat
+			err := s.bh.TxGet(tx, id, &ch)
+			if err == badgerhold.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			left, err := s.bh.TxCount(tx, BHTextMessage{}, badgerhold.Where("ChatID").Eq(id))
+			if err != nil {
+				return err
+			}
+			if uint64(ch.Unread) > left {
+				ch.Unread = int(left)
+			}
+			var newest []BHTextMessage
+			err = s.bh.TxFind(tx, &newest, badgerhold.Where("ChatID").Eq(id).SortBy("CreatedAt").Reverse().Limit(1))
+			if err != nil {
+				return err
+			}
+			var at int64
+			var last string
+			if len(newest) > 0 {
+				at, last = newest[0].CreatedAt, newest[0].ID
+			}
+			if err := s.txSetActivity(tx, ch, at, last); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
 }
 
+// OrphanMessages lists the messages whose chat does not exist.
+func (s *Store) OrphanMessages() ([]BHTextMessage, error) {
+	var chats []BHChat
+	if err := s.bh.Find(&chats, &badgerhold.Query{}); err != nil {
+		return nil, err
+	}
+	ids := make(map[string]struct{}, len(chats))
+	for _, ch := range chats {
+		ids[ch.ID] = struct{}{}
+	}
+	var res []BHTextMessage
+	err := s.bh.ForEach(&badgerhold.Query{}, func(tm *BHTextMessage) error {
+		if _, ok := ids[tm.ChatID]; !ok {
+			res = append(res, *tm)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// CountReceived counts the messages of chat id not written by author.
+func (s *Store) CountReceived(id string, author string) (uint64, error) {
+	return s.bh.Count(BHTextMessage{}, badgerhold.Where("ChatID").Eq(id).And("Author.ID").Ne(author))
+}
+
+// AllContacts lists contacts by name, those sharing a name by ID.
 func (s *Store) AllContacts(skip int, limit int) ([]BHContact, error) {
 	var res []BHContact
-	q := &badgerhold.Query{}
+	q := (&badgerhold.Query{}).SortBy("Name", "ID")
 	q.Limit(limit)
 	q.Skip(skip)
 	err := s.bh.Find(&res, q)
@@ -139,7 +517,7 @@ func (s *Store) ChatByID(id string) (BHChat, error) {
 }
 
 func (s *Store) SetIdentity(id BHIdentity) error {
-	err := s.bh.Insert(id.ID, id)
+	err := s.bh.Upsert(id.ID, id)
 	return err
 }
 
@@ -153,6 +531,335 @@ func (s *Store) GetIdentity() (BHIdentity, error) {
 	return res, err
 }
 
+func (s *Store) SetNetConfig(conf BHNetConfig) error {
+	conf.ID = netConfigID
+	return s.bh.Upsert(conf.ID, conf)
+}
+
+func (s *Store) GetNetConfig() (BHNetConfig, error) {
+	var res BHNetConfig
+	err := s.bh.Get(netConfigID, &res)
+	return res, err
+}
+
+// DeleteNetConfig forgets the saved listen settings, if any.
+func (s *Store) DeleteNetConfig() error {
+	err := s.bh.Delete(netConfigID, BHNetConfig{})
+	if errors.Is(err, badgerhold.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *Store) UpsertOutboxEntry(e BHOutboxEntry) error {
+	e.Version = OutboxVersion
+	return s.bh.Upsert(e.ID, e)
+}
+
+// UpgradeOutbox rewrites the outbox entries written in an older format
+// and returns how many. Unversioned entries may hold the shared key of
+// their recipient, which is dropped.
+func (s *Store) UpgradeOutbox() (int, error) {
+	n := 0
+	err := s.bh.Badger().Update(func(tx *badger.Txn) error {
+		var entries []BHOutboxEntry
+		if err := s.bh.TxFind(tx, &entries, badgerhold.Where("Version").Lt(OutboxVersion)); err != nil {
+			return err
+		}
+		for _, e := range entries {
+			e.To.SharedKey = nil
+			e.Version = OutboxVersion
+			if err := s.bh.TxUpdate(tx, e.ID, e); err != nil {
+				return err
+			}
+		}
+		n = len(entries)
+		return nil
+	})
+	return n, err
+}
+
+func (s *Store) DeleteOutboxEntry(id string) error {
+	err := s.bh.Delete(id, BHOutboxEntry{})
+	if err == badgerhold.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *Store) OutboxEntries(skip int, limit int) ([]BHOutboxEntry, error) {
+	var res []BHOutboxEntry
+	q := &badgerhold.Query{}
+	q.Limit(limit)
+	q.Skip(skip)
+	err := s.bh.Find(&res, q)
+	return res, err
+}
+
+func (s *Store) UpsertAttachment(a BHAttachment) error {
+	return s.bh.Upsert(a.ID, a)
+}
+
+func (s *Store) AttachmentByID(id string) (BHAttachment, error) {
+	var res BHAttachment
+	err := s.bh.Get(id, &res)
+	return res, err
+}
+
+// DeleteAttachment deletes attachment id, if held.
+func (s *Store) DeleteAttachment(id string) error {
+	err := s.bh.Delete(id, BHAttachment{})
+	if errors.Is(err, badgerhold.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *Store) UpsertPendingRequest(pr BHPendingRequest) error {
+	return s.bh.Upsert(pr.ID, pr)
+}
+
+func (s *Store) PendingRequests(skip int, limit int) ([]BHPendingRequest, error) {
+	var res []BHPendingRequest
+	q := badgerhold.Where("CreatedAt").Ge(int64(0)).SortBy("CreatedAt")
+	q.Limit(limit)
+	q.Skip(skip)
+	err := s.bh.Find(&res, q)
+	return res, err
+}
+
+func (s *Store) PendingRequestByID(id string) (BHPendingRequest, error) {
+	var res BHPendingRequest
+	err := s.bh.FindOne(&res, badgerhold.Where("ID").Eq(id))
+	return res, err
+}
+
+func (s *Store) DeletePendingRequest(id string) error {
+	return s.bh.Delete(id, BHPendingRequest{})
+}
+
+func (s *Store) InsertFavorite(fav BHFavorite) error {
+	return s.bh.Upsert(fav.ID, fav)
+}
+
+func (s *Store) DeleteFavorite(id string) error {
+	return s.bh.Delete(id, BHFavorite{})
+}
+
+func (s *Store) Favorites() ([]BHFavorite, error) {
+	var res []BHFavorite
+	err := s.bh.Find(&res, &badgerhold.Query{})
+	return res, err
+}
+
+// PurgePeer deletes contact id with its pending request and favorite mark,
+// chat chatID with its messages, the outbox entries for id and the
+// attachments no other message refers to, all or nothing. It returns the
+// CIDs of those attachments.
+func (s *Store) PurgePeer(id string, chatID string) ([]string, error) {
+	var orphans []string
+	err := s.bh.Badger().Update(func(tx *badger.Txn) error {
+		for _, dt := range []interface{}{BHContact{}, BHPendingRequest{}, BHFavorite{}} {
+			err := s.bh.TxDelete(tx, id, dt)
+			if err != nil && !errors.Is(err, badgerhold.ErrNotFound) {
+				return err
+			}
+		}
+		var ch BHChat
+		err := s.bh.TxGet(tx, chatID, &ch)
+		if err == nil {
+			if err := tx.Delete(activityKey(ch.LastActivity, ch.ID)); err != nil {
+				return err
+			}
+			err = s.bh.TxDelete(tx, chatID, BHChat{})
+		}
+		if err != nil && !errors.Is(err, badgerhold.ErrNotFound) {
+			return err
+		}
+		var msgs []BHTextMessage
+		if err := s.bh.TxFind(tx, &msgs, badgerhold.Where("ChatID").Eq(chatID)); err != nil {
+			return err
+		}
+		var entries []BHOutboxEntry
+		if err := s.bh.TxFind(tx, &entries, badgerhold.Where("To.ID").Eq(id)); err != nil {
+			return err
+		}
+		attachments := make(map[string]struct{})
+		for _, tm := range msgs {
+			if tm.Attachment != "" {
+				attachments[tm.Attachment] = struct{}{}
+			}
+		}
+		for _, e := range entries {
+			if e.Message.Attachment != "" {
+				attachments[e.Message.Attachment] = struct{}{}
+			}
+		}
+		err = s.bh.TxDeleteMatching(tx, BHTextMessage{}, badgerhold.Where("ChatID").Eq(chatID))
+		if err != nil {
+			return err
+		}
+		err = s.bh.TxDeleteMatching(tx, BHOutboxEntry{}, badgerhold.Where("To.ID").Eq(id))
+		if err != nil {
+			return err
+		}
+		for a := range attachments {
+			// the same text may have been sent to other chats
+			n, err := s.bh.TxCount(tx, BHTextMessage{}, badgerhold.Where("Attachment").Eq(a))
+			if err != nil {
+				return err
+			}
+			q, err := s.bh.TxCount(tx, BHOutboxEntry{}, badgerhold.Where("Message.Attachment").Eq(a))
+			if err != nil {
+				return err
+			}
+			if n+q > 0 {
+				continue
+			}
+			err = s.bh.TxDelete(tx, a, BHAttachment{})
+			if err != nil && !errors.Is(err, badgerhold.ErrNotFound) {
+				return err
+			}
+			orphans = append(orphans, a)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+func (s *Store) InsertBlocked(b BHBlocked) error {
+	return s.bh.Upsert(b.ID, b)
+}
+
+func (s *Store) DeleteBlocked(id string) error {
+	return s.bh.Delete(id, BHBlocked{})
+}
+
+func (s *Store) Blocked() ([]BHBlocked, error) {
+	var res []BHBlocked
+	err := s.bh.Find(&res, &badgerhold.Query{})
+	return res, err
+}
+
+// Usage estimates the bytes taken by records of the given types, indexes included.
+func (s *Store) Usage(dataTypes ...interface{}) (int64, error) {
+	var size int64
+	err := s.bh.Badger().View(func(txn *badger.Txn) error {
+		for _, dt := range dataTypes {
+			name := reflect.TypeOf(dt).Name()
+			for _, prefix := range []string{"bh_" + name + ":", "_bhIndex:" + name + ":"} {
+				opts := badger.DefaultIteratorOptions
+				opts.PrefetchValues = false
+				opts.Prefix = []byte(prefix)
+				it := txn.NewIterator(opts)
+				for it.Rewind(); it.Valid(); it.Next() {
+					size += it.Item().EstimatedSize()
+				}
+				it.Close()
+			}
+		}
+		return nil
+	})
+	return size, err
+}
+
+// DiskUsage reports the on-disk size of the LSM tree and value log.
+func (s *Store) DiskUsage() int64 {
+	lsm, vlog := s.bh.Badger().Size()
+	return lsm + vlog
+}
+
+// BHBundle is the whole content of a store, for moving it elsewhere.
+type BHBundle struct {
+	Identity        BHIdentity
+	Contacts        []BHContact
+	Chats           []BHChat
+	Messages        []BHTextMessage
+	PendingRequests []BHPendingRequest
+	Favorites       []BHFavorite
+	Blocked         []BHBlocked
+	Outbox          []BHOutboxEntry
+	Attachments     []BHAttachment
+	NetConfig       *BHNetConfig
+}
+
+func (s *Store) Export() (BHBundle, error) {
+	var b BHBundle
+	var err error
+	b.Identity, err = s.GetIdentity()
+	if err != nil {
+		return b, err
+	}
+	for _, res := range []interface{}{&b.Contacts, &b.Chats, &b.Messages, &b.PendingRequests, &b.Favorites, &b.Blocked, &b.Outbox, &b.Attachments} {
+		if err := s.bh.Find(res, &badgerhold.Query{}); err != nil {
+			return b, err
+		}
+	}
+	conf, err := s.GetNetConfig()
+	if err == nil {
+		b.NetConfig = &conf
+	} else if err != badgerhold.ErrNotFound {
+		return b, err
+	}
+	return b, nil
+}
+
+func (s *Store) Import(b BHBundle) error {
+	err := s.SetIdentity(b.Identity)
+	if err != nil {
+		return err
+	}
+	for _, c := range b.Contacts {
+		if err := s.bh.Upsert(c.ID, c); err != nil {
+			return err
+		}
+	}
+	for _, ch := range b.Chats {
+		if err := s.bh.Upsert(ch.ID, ch); err != nil {
+			return err
+		}
+	}
+	for _, tm := range b.Messages {
+		if err := s.bh.Upsert(tm.ID, tm); err != nil {
+			return err
+		}
+	}
+	for _, pr := range b.PendingRequests {
+		if err := s.UpsertPendingRequest(pr); err != nil {
+			return err
+		}
+	}
+	for _, fav := range b.Favorites {
+		if err := s.InsertFavorite(fav); err != nil {
+			return err
+		}
+	}
+	for _, bl := range b.Blocked {
+		if err := s.InsertBlocked(bl); err != nil {
+			return err
+		}
+	}
+	for _, e := range b.Outbox {
+		if err := s.UpsertOutboxEntry(e); err != nil {
+			return err
+		}
+	}
+	for _, a := range b.Attachments {
+		if err := s.UpsertAttachment(a); err != nil {
+			return err
+		}
+	}
+	if b.NetConfig != nil {
+		if err := s.SetNetConfig(*b.NetConfig); err != nil {
+			return err
+		}
+	}
+	return s.indexActivity()
+}
+
 func (s *Store) Close() {
 	s.bh.Close()
 }
\ No newline at end of file
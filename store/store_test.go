@@ -7,6 +7,7 @@ import (
 
 	"github.com/hood-chat/core/store"
 	"github.com/stretchr/testify/require"
+	"github.com/timshannon/badgerhold/v4"
 )
 
 func TestContact(t *testing.T) {
@@ -35,9 +36,10 @@ func TestContact(t *testing.T) {
 		require.NoError(t, err)
 	}
 
+	// listed by name, then ID
 	res, err := s.AllContacts(0, 10)
 	require.NoError(t, err)
-	if !reflect.DeepEqual(res, data) {
+	if !reflect.DeepEqual(res, []store.BHContact{data[0], data[2], data[3], data[1]}) {
 		t.Error("in and out are not equal")
 	}
 	t.Log("result ", res)
@@ -52,7 +54,7 @@ func TestContact(t *testing.T) {
 
 	res2, err := s.ContactByID("2")
 	require.NoError(t, err)
-	if res2 != data[1] {
+	if !reflect.DeepEqual(res2, data[1]) {
 		t.Error("in and out are not equal")
 	}
 	t.Log("result ", res2)
@@ -150,6 +152,9 @@ func TestChat(t *testing.T) {
 		err := s.InsertTextMessage(val)
 		require.NoError(t, err)
 	}
+	// chats are as active as their newest message
+	test_chat[0].LastActivity, test_chat[0].LastMessageID = test_msg[0].CreatedAt, test_msg[0].ID
+	test_chat[1].LastActivity, test_chat[1].LastMessageID = test_msg[2].CreatedAt, test_msg[2].ID
 
 	res, err := s.ChatList(0, 10)
 	require.NoError(t, err)
@@ -172,6 +177,221 @@ func TestChat(t *testing.T) {
 
 }
 
+func TestChatActivityBackfill(t *testing.T) {
+	// BHChat as stored before the last activity was kept
+	type BHChat struct {
+		Name    string
+		ID      string `badgerhold:"unique"`
+		Members []string
+		Unread  int
+	}
+	dir := t.TempDir()
+	opt := badgerhold.DefaultOptions
+	opt.Dir = dir
+	opt.ValueDir = dir
+	bh, err := badgerhold.Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, bh.Insert("old", BHChat{ID: "old", Members: []string{"1"}}))
+	require.NoError(t, bh.Insert("quiet", BHChat{ID: "quiet", Members: []string{"1"}}))
+	for i, at := range []int64{100, 200, 150} {
+		id := string(rune('a' + i))
+		require.NoError(t, bh.Insert(id, store.BHTextMessage{ID: id, ChatID: "old", CreatedAt: at}))
+	}
+	require.NoError(t, bh.Close())
+
+	s, err := store.NewStore(dir)
+	require.NoError(t, err)
+	defer func() { s.Close() }()
+	chats, err := s.ChatsByActivity(nil, 10)
+	require.NoError(t, err)
+	require.Len(t, chats, 2)
+	require.Equal(t, "old", chats[0].ID)
+	require.Equal(t, int64(200), chats[0].LastActivity)
+	require.Equal(t, "b", chats[0].LastMessageID)
+	require.Equal(t, "quiet", chats[1].ID)
+	rest, err := s.ChatsByActivity(&chats[0], 10)
+	require.NoError(t, err)
+	require.Len(t, rest, 1)
+	require.Equal(t, "quiet", rest[0].ID)
+	schema, err := s.Schema()
+	require.NoError(t, err)
+	require.Equal(t, store.ActivitySchema, schema)
+	s.Close()
+
+	// the chats are indexed once, not on every open
+	bh, err = badgerhold.Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, bh.Insert("late", BHChat{ID: "late", Members: []string{"1"}}))
+	require.NoError(t, bh.Close())
+	s, err = store.NewStore(dir)
+	require.NoError(t, err)
+	chats, err = s.ChatsByActivity(nil, 10)
+	require.NoError(t, err)
+	require.Len(t, chats, 2)
+}
+
+func TestDeleteFailedBefore(t *testing.T) {
+	s, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertChat(store.BHChat{ID: "c", Members: []string{"2"}}))
+	// written long ago, failed just now
+	require.NoError(t, s.InsertTextMessage(store.BHTextMessage{ID: "late", ChatID: "c", CreatedAt: 100}))
+	// failed before the failure time was kept
+	require.NoError(t, s.InsertTextMessage(store.BHTextMessage{ID: "legacy", ChatID: "c", CreatedAt: 100, Status: store.Failed}))
+	require.NoError(t, s.InsertTextMessage(store.BHTextMessage{ID: "sent", ChatID: "c", CreatedAt: 100, Status: store.Sent}))
+	msg, err := s.MsgByID("late")
+	require.NoError(t, err)
+	msg.Status = store.Failed
+	require.NoError(t, s.UpdateMessage(msg))
+	msg, err = s.MsgByID("late")
+	require.NoError(t, err)
+	failedAt := msg.FailedAt
+	require.InDelta(t, time.Now().Unix(), failedAt, 5)
+	// stays stamped with the first failure
+	require.NoError(t, s.UpdateMessage(msg))
+	msg, err = s.MsgByID("late")
+	require.NoError(t, err)
+	require.Equal(t, failedAt, msg.FailedAt)
+
+	deleted, err := s.DeleteFailedBefore(time.Now().Add(-time.Hour).Unix(), nil)
+	require.NoError(t, err)
+	require.Len(t, deleted, 1)
+	require.Equal(t, "legacy", deleted[0].ID)
+	_, err = s.MsgByID("legacy")
+	require.ErrorIs(t, err, badgerhold.ErrNotFound)
+	_, err = s.MsgByID("late")
+	require.NoError(t, err)
+	_, err = s.DeleteFailedBefore(failedAt+1, nil)
+	require.NoError(t, err)
+	_, err = s.MsgByID("late")
+	require.ErrorIs(t, err, badgerhold.ErrNotFound)
+	_, err = s.MsgByID("sent")
+	require.NoError(t, err)
+}
+
+func TestDeleteFailedChat(t *testing.T) {
+	s, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertChat(store.BHChat{ID: "c", Members: []string{"2"}}))
+	require.NoError(t, s.InsertChat(store.BHChat{ID: "d", Members: []string{"3"}}))
+	require.NoError(t, s.InsertTextMessage(store.BHTextMessage{ID: "hi", ChatID: "c", CreatedAt: 100}))
+	require.NoError(t, s.InsertTextMessage(store.BHTextMessage{ID: "starred", ChatID: "c", CreatedAt: 150, Status: store.Failed}))
+	require.NoError(t, s.InsertTextMessage(store.BHTextMessage{ID: "lost", ChatID: "c", CreatedAt: 200, Status: store.Failed}))
+	require.NoError(t, s.InsertTextMessage(store.BHTextMessage{ID: "alone", ChatID: "d", CreatedAt: 300, Status: store.Failed}))
+	// more unread than messages left once purged
+	ch, err := s.ChatByID("d")
+	require.NoError(t, err)
+	ch.Unread = 1
+	require.NoError(t, s.UpdateChat(ch))
+
+	deleted, err := s.DeleteFailedBefore(1000, func(tm store.BHTextMessage) bool { return tm.ID == "starred" })
+	require.NoError(t, err)
+	ids := make([]string, 0, len(deleted))
+	for _, tm := range deleted {
+		ids = append(ids, tm.ID)
+	}
+	require.ElementsMatch(t, []string{"lost", "alone"}, ids)
+	_, err = s.MsgByID("starred")
+	require.NoError(t, err)
+
+	chats, err := s.ChatsByActivity(nil, 10)
+	require.NoError(t, err)
+	require.Len(t, chats, 2)
+	require.Equal(t, "c", chats[0].ID)
+	require.Equal(t, int64(150), chats[0].LastActivity)
+	require.Equal(t, "starred", chats[0].LastMessageID)
+	require.Equal(t, "d", chats[1].ID)
+	require.Zero(t, chats[1].LastActivity)
+	require.Empty(t, chats[1].LastMessageID)
+	require.Zero(t, chats[1].Unread)
+}
+
+func TestUpgradeOutbox(t *testing.T) {
+	// BHOutboxEntry as stored before its format was versioned
+	type BHOutboxEntry struct {
+		ID       string `badgerhold:"unique"`
+		To       store.BHContact
+		Type     string
+		Protocol string
+		Message  store.BHTextMessage
+	}
+	dir := t.TempDir()
+	opt := badgerhold.DefaultOptions
+	opt.Dir = dir
+	opt.ValueDir = dir
+	bh, err := badgerhold.Open(opt)
+	require.NoError(t, err)
+	to := store.BHContact{ID: "2", Name: "red", SharedKey: []byte("key")}
+	require.NoError(t, bh.Insert("old", BHOutboxEntry{ID: "old", To: to, Message: store.BHTextMessage{ID: "m", Text: "hi"}}))
+	require.NoError(t, bh.Close())
+
+	s, err := store.NewStore(dir)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.UpsertOutboxEntry(store.BHOutboxEntry{ID: "new", To: store.BHContact{ID: "3"}}))
+	n, err := s.UpgradeOutbox()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	entries, err := s.OutboxEntries(0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	for _, e := range entries {
+		require.Equal(t, store.OutboxVersion, e.Version)
+		require.Nil(t, e.To.SharedKey)
+	}
+	n, err = s.UpgradeOutbox()
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestPurgePeer(t *testing.T) {
+	s, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer s.Close()
+	peer := store.BHContact{ID: "2", Name: "red"}
+	require.NoError(t, s.InsertContact(peer))
+	require.NoError(t, s.InsertChat(store.BHChat{ID: "c2", Members: []string{"1", "2"}}))
+	require.NoError(t, s.InsertChat(store.BHChat{ID: "c3", Members: []string{"1", "3"}}))
+	for _, a := range []string{"long", "shared", "sealed"} {
+		require.NoError(t, s.UpsertAttachment(store.BHAttachment{ID: a, Data: []byte(a)}))
+	}
+	require.NoError(t, s.InsertTextMessage(store.BHTextMessage{ID: "1", ChatID: "c2", Attachment: "long"}))
+	require.NoError(t, s.InsertTextMessage(store.BHTextMessage{ID: "2", ChatID: "c2", Attachment: "shared"}))
+	require.NoError(t, s.InsertTextMessage(store.BHTextMessage{ID: "3", ChatID: "c3", Attachment: "shared"}))
+	require.NoError(t, s.UpsertOutboxEntry(store.BHOutboxEntry{
+		ID:      "e2",
+		To:      peer,
+		Message: store.BHTextMessage{ID: "1", ChatID: "c2", Attachment: "sealed"},
+	}))
+	require.NoError(t, s.UpsertOutboxEntry(store.BHOutboxEntry{
+		ID:      "e3",
+		To:      store.BHContact{ID: "3"},
+		Message: store.BHTextMessage{ID: "3", ChatID: "c3", Attachment: "shared"},
+	}))
+
+	orphans, err := s.PurgePeer("2", "c2")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"long", "sealed"}, orphans)
+	_, err = s.ContactByID("2")
+	require.Error(t, err)
+	msgs, err := s.ChatMessages("c2", 0, 10)
+	require.NoError(t, err)
+	require.Empty(t, msgs)
+	entries, err := s.OutboxEntries(0, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "e3", entries[0].ID)
+	for _, a := range []string{"long", "sealed"} {
+		_, err = s.AttachmentByID(a)
+		require.Error(t, err, a)
+	}
+	// still sent to the other chat
+	_, err = s.AttachmentByID("shared")
+	require.NoError(t, err)
+}
+
 func TestIdentity(t *testing.T) {
 	s, err := store.NewStore(t.TempDir())
 	expected := store.BHIdentity{ID: "001", Name: "farhoud", Key: "privatekey"}
@@ -188,3 +408,27 @@ func TestIdentity(t *testing.T) {
 		t.Errorf("net equal %s, %s", res, expected)
 	}
 }
+
+func TestUsage(t *testing.T) {
+	s, err := store.NewStore(t.TempDir())
+	require.NoError(t, err)
+	defer s.Close()
+
+	empty, err := s.Usage(store.BHTextMessage{})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), empty)
+
+	prev := empty
+	for _, id := range []string{"1", "2", "3"} {
+		err := s.InsertTextMessage(store.BHTextMessage{ID: id, ChatID: "1", Text: "asdf cbdgf"})
+		require.NoError(t, err)
+		usage, err := s.Usage(store.BHTextMessage{})
+		require.NoError(t, err)
+		require.Greater(t, usage, prev)
+		prev = usage
+	}
+
+	contacts, err := s.Usage(store.BHContact{})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), contacts)
+}
@@ -0,0 +1,186 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-msgio"
+)
+
+const (
+	TypingID = "/chat/typing/1.0.0"
+
+	TypingServiceName = "chat.typing"
+
+	// TypingInterval is how often a peer is told again that we are still
+	// typing, starts within it are dropped. Option.TypingInterval
+	// overrides it.
+	TypingInterval = 3 * time.Second
+
+	// typingSize bounds a typing frame, a single byte.
+	typingSize = 1
+	// typingQueue bounds the indicators waiting to be sent, more are
+	// dropped.
+	typingQueue = 64
+)
+
+// typing frames
+const (
+	typingStop  byte = 0
+	typingStart byte = 1
+)
+
+// typingFrame is an indicator waiting to be sent to a peer.
+type typingFrame struct {
+	pid   peer.ID
+	frame byte
+}
+
+// typingService tells connected peers when we start or stop typing. The
+// indicators are never stored or queued, a peer not connected misses them.
+type typingService struct {
+	host host.Host
+	// accept filters the peers whose indicators are reported
+	accept   func(peer.ID) bool
+	onTyping func(peer.ID, bool)
+	interval time.Duration
+
+	mux sync.Mutex
+	// started holds when a start was last sent to each peer we type to
+	started map[peer.ID]time.Time
+
+	// queue keeps the indicators in order, a stop never overtakes its start
+	queue  chan typingFrame
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newTypingService(h host.Host, interval time.Duration, accept func(peer.ID) bool, onTyping func(peer.ID, bool)) *typingService {
+	if interval <= 0 {
+		interval = TypingInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ts := &typingService{
+		host:     h,
+		accept:   accept,
+		onTyping: onTyping,
+		interval: interval,
+		started:  make(map[peer.ID]time.Time),
+		queue:    make(chan typingFrame, typingQueue),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	h.SetStreamHandler(TypingID, ts.Handler)
+	go ts.background(ctx)
+	log.Debug("service typing created")
+	return ts
+}
+
+func (c *typingService) background(ctx context.Context) {
+	defer close(c.done)
+	for {
+		select {
+		case f := <-c.queue:
+			if err := c.write(ctx, f.pid, f.frame); err != nil {
+				log.Debugf("can not send typing to %s: %s", f.pid, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send tells pid whether we are typing, once per interval while we are
+// and once when we stop.
+func (c *typingService) send(pid peer.ID, typing bool, now time.Time) {
+	if c.host.Network().Connectedness(pid) != network.Connected {
+		return
+	}
+	c.mux.Lock()
+	at, ok := c.started[pid]
+	if typing {
+		if ok && now.Sub(at) < c.interval {
+			c.mux.Unlock()
+			return
+		}
+		c.started[pid] = now
+	} else {
+		if !ok {
+			c.mux.Unlock()
+			return
+		}
+		delete(c.started, pid)
+	}
+	c.mux.Unlock()
+
+	frame := typingStop
+	if typing {
+		frame = typingStart
+	}
+	select {
+	case c.queue <- typingFrame{pid: pid, frame: frame}:
+	default:
+		log.Debugf("typing to %s dropped, queue full", pid)
+	}
+}
+
+func (c *typingService) write(ctx context.Context, pid peer.ID, frame byte) error {
+	ctx, cancel := context.WithTimeout(ctx, StreamTimeout)
+	defer cancel()
+	// the peer may have gone meanwhile, the indicator is not worth a dial
+	s, err := c.host.NewStream(network.WithNoDial(ctx, "typing"), pid, TypingID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(StreamTimeout))
+	if err := msgio.NewVarintWriter(s).WriteMsg([]byte{frame}); err != nil {
+		s.Reset()
+		return err
+	}
+	return nil
+}
+
+func (c *typingService) Handler(str network.Stream) {
+	if err := str.Scope().SetService(TypingServiceName); err != nil {
+		log.Debugf("error attaching stream to typing service: %s", err)
+		str.Reset()
+		return
+	}
+	defer str.Close()
+	str.SetDeadline(time.Now().Add(StreamTimeout))
+
+	pid := str.Conn().RemotePeer()
+	if !c.accept(pid) {
+		log.Debugf("typing ignored from unknown peer %s", pid)
+		return
+	}
+	msg, err := msgio.NewVarintReaderSize(str, typingSize).ReadMsg()
+	if err != nil {
+		log.Debugf("error reading typing: %s", err)
+		str.Reset()
+		return
+	}
+	if len(msg) != typingSize {
+		log.Debugf("empty typing frame from %s", pid)
+		return
+	}
+	switch msg[0] {
+	case typingStart:
+		c.onTyping(pid, true)
+	case typingStop:
+		c.onTyping(pid, false)
+	default:
+		log.Debugf("unknown typing frame %d from %s", msg[0], pid)
+	}
+}
+
+func (c *typingService) Stop() {
+	c.cancel()
+	<-c.done
+	c.host.RemoveStreamHandler(TypingID)
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hood-chat/core/pb"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-msgio/protoio"
+)
+
+const (
+	// ProtocolPrefix is shared by every chat protocol.
+	ProtocolPrefix = "/chat/"
+
+	// UnsupportedID names the handler catching unknown chat protocols.
+	UnsupportedID = ProtocolPrefix + "*"
+)
+
+// unsupportedHandler answers streams for chat protocols this node does not
+// speak, so the remote learns why instead of seeing a failed negotiation.
+type unsupportedHandler struct {
+	host    host.Host
+	handler network.StreamHandler
+	sub     event.Subscription
+
+	mux   sync.RWMutex
+	known map[protocol.ID]struct{}
+}
+
+// newUnsupportedHandler registers handler for unknown chat protocols, nil
+// answers with an Unsupported frame listing the chat protocols spoken.
+func newUnsupportedHandler(h host.Host, handler network.StreamHandler) (*unsupportedHandler, error) {
+	u := &unsupportedHandler{host: h, handler: handler, known: make(map[protocol.ID]struct{})}
+	if u.handler == nil {
+		u.handler = u.reply
+	}
+	// subscribe before the snapshot so no registration is missed
+	sub, err := h.EventBus().Subscribe(new(event.EvtLocalProtocolsUpdated))
+	if err != nil {
+		return nil, err
+	}
+	u.sub = sub
+	for _, p := range h.Mux().Protocols() {
+		u.known[protocol.ID(p)] = struct{}{}
+	}
+	go u.background()
+	h.SetStreamHandlerMatch(UnsupportedID, u.match, u.handler)
+	return u, nil
+}
+
+func (u *unsupportedHandler) background() {
+	for e := range u.sub.Out() {
+		evt := e.(event.EvtLocalProtocolsUpdated)
+		u.mux.Lock()
+		for _, p := range evt.Added {
+			u.known[p] = struct{}{}
+		}
+		for _, p := range evt.Removed {
+			delete(u.known, p)
+		}
+		u.mux.Unlock()
+	}
+}
+
+func (u *unsupportedHandler) match(proto string) bool {
+	if !strings.HasPrefix(proto, ProtocolPrefix) {
+		return false
+	}
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+	_, ok := u.known[protocol.ID(proto)]
+	return !ok
+}
+
+func (u *unsupportedHandler) reply(str network.Stream) {
+	defer str.Close()
+	str.SetDeadline(time.Now().Add(StreamTimeout))
+
+	msg := &pb.Unsupported{Protocol: string(str.Protocol())}
+	u.mux.RLock()
+	for p := range u.known {
+		if strings.HasPrefix(string(p), ProtocolPrefix) && p != UnsupportedID {
+			msg.Supported = append(msg.Supported, string(p))
+		}
+	}
+	u.mux.RUnlock()
+	sort.Strings(msg.Supported)
+	wr := protoio.NewDelimitedWriter(str)
+	if err := wr.WriteMsg(msg); err != nil {
+		log.Errorf("error writing unsupported frame: %s", err)
+		str.Reset()
+	}
+}
+
+func (u *unsupportedHandler) Stop() {
+	u.host.RemoveStreamHandler(UnsupportedID)
+	u.sub.Close()
+}
@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"io"
+
+	"github.com/multiformats/go-varint"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec serializes a single frame of a stream protocol.
+type Codec interface {
+	Marshal(msg proto.Message) ([]byte, error)
+	Unmarshal(data []byte, msg proto.Message) error
+}
+
+// ProtoCodec encodes frames in protobuf binary format.
+type ProtoCodec struct{}
+
+func (ProtoCodec) Marshal(msg proto.Message) ([]byte, error) {
+	return proto.Marshal(msg)
+}
+
+func (ProtoCodec) Unmarshal(data []byte, msg proto.Message) error {
+	return proto.Unmarshal(data, msg)
+}
+
+// JSONCodec encodes frames in protobuf JSON format.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(msg proto.Message) ([]byte, error) {
+	return protojson.Marshal(msg)
+}
+
+func (JSONCodec) Unmarshal(data []byte, msg proto.Message) error {
+	return protojson.Unmarshal(data, msg)
+}
+
+type Writer interface {
+	WriteMsg(msg proto.Message) error
+}
+
+type WriteCloser interface {
+	Writer
+	io.Closer
+}
+
+type uvarintWriter struct {
+	w      io.Writer
+	lenBuf []byte
+	closer io.Closer
+	codec  Codec
+}
+
+// NewCodecWriter writes length-prefixed frames encoded with c.
+func NewCodecWriter(w io.Writer, c Codec) WriteCloser {
+	var closer io.Closer
+	if cl, ok := w.(io.Closer); ok {
+		closer = cl
+	}
+	return &uvarintWriter{w, make([]byte, varint.MaxLenUvarint63), closer, c}
+}
+
+func (uw *uvarintWriter) WriteMsg(msg proto.Message) error {
+	data, err := uw.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	n := varint.PutUvarint(uw.lenBuf, uint64(len(data)))
+	if _, err := uw.w.Write(uw.lenBuf[:n]); err != nil {
+		return err
+	}
+	_, err = uw.w.Write(data)
+	return err
+}
+
+func (uw *uvarintWriter) Close() error {
+	if uw.closer != nil {
+		return uw.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package utils_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/hood-chat/core/pb"
+	"github.com/hood-chat/core/utils"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	msg := &pb.Message{
+		Id:        "1",
+		ChatId:    "2",
+		CreatedAt: 1671000000,
+		Type:      "text",
+		Text:      "hello",
+		Author:    &pb.Contact{Id: "3", Name: "blue"},
+	}
+	for name, codec := range map[string]utils.Codec{"proto": utils.ProtoCodec{}, "json": utils.JSONCodec{}} {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			wr := utils.NewCodecWriter(&buf, codec)
+			require.NoError(t, wr.WriteMsg(msg))
+			require.NoError(t, wr.WriteMsg(msg))
+
+			rd := utils.NewCodecReader(&buf, 1024, codec)
+			for i := 0; i < 2; i++ {
+				var res pb.Message
+				require.NoError(t, rd.ReadMsg(&res))
+				require.True(t, proto.Equal(msg, &res))
+			}
+		})
+	}
+}
@@ -57,14 +57,20 @@ type uvarintReader struct {
 	buf     []byte
 	maxSize int
 	closer  io.Closer
+	codec   Codec
 }
 
 func NewDelimitedReader(r io.Reader, maxSize int) ReadCloser {
+	return NewCodecReader(r, maxSize, ProtoCodec{})
+}
+
+// NewCodecReader reads length-prefixed frames decoded with c.
+func NewCodecReader(r io.Reader, maxSize int, c Codec) ReadCloser {
 	var closer io.Closer
-	if c, ok := r.(io.Closer); ok {
-		closer = c
+	if cl, ok := r.(io.Closer); ok {
+		closer = cl
 	}
-	return &uvarintReader{bufio.NewReader(r), nil, maxSize, closer}
+	return &uvarintReader{bufio.NewReader(r), nil, maxSize, closer, c}
 }
 
 func (ur *uvarintReader) ReadMsg(msg proto.Message) (err error) {
@@ -90,7 +96,7 @@ func (ur *uvarintReader) ReadMsg(msg proto.Message) (err error) {
 	if _, err := io.ReadFull(ur.r, buf); err != nil {
 		return err
 	}
-	return proto.Unmarshal(buf, msg)
+	return ur.codec.Unmarshal(buf, msg)
 }
 
 func (ur *uvarintReader) Close() error {